@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/truemilk/trivelastic/internal/config"
+	"github.com/truemilk/trivelastic/internal/elasticsearch"
+)
+
+// runCheck loads and validates the configuration, pings Elasticsearch and
+// prints a report to out. It returns the process exit code.
+func runCheck(out io.Writer) int {
+	fmt.Fprintln(out, "trivelastic configuration check")
+
+	// Load validates the configuration and reports every problem at once
+	cfg, err := config.Load()
+	if err != nil {
+		var invalid *config.ValidationError
+		if errors.As(err, &invalid) {
+			for _, p := range invalid.Problems {
+				fmt.Fprintf(out, "  [FAIL] %s: %s\n", p.Option, p.Message)
+			}
+		} else {
+			fmt.Fprintf(out, "  [FAIL] load configuration: %v\n", err)
+		}
+		fmt.Fprintln(out, "  [SKIP] ping Elasticsearch: configuration is invalid")
+		return 1
+	}
+	fmt.Fprintln(out, "  [ OK ] load and validate configuration")
+
+	esClient, err := elasticsearch.NewClient(&cfg.ES)
+	if err != nil {
+		fmt.Fprintf(out, "  [FAIL] create Elasticsearch client: %v\n", err)
+		return 1
+	}
+	if err := esClient.Ping(); err != nil {
+		for _, e := range unwrapAll(err) {
+			fmt.Fprintf(out, "  [FAIL] ping Elasticsearch: %v\n", e)
+		}
+		return 1
+	}
+	fmt.Fprintf(out, "  [ OK ] ping Elasticsearch at %s\n", strings.Join(cfg.ES.URLs, ", "))
+
+	return 0
+}
+
+// unwrapAll flattens an error created with errors.Join
+func unwrapAll(err error) []error {
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		return joined.Unwrap()
+	}
+	return []error{err}
+}
@@ -1,55 +1,106 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
-	"runtime"
+	"os/signal"
+	"syscall"
 
-	"github.com/truemilk/trivelastic/internal/config"
-	"github.com/truemilk/trivelastic/internal/handler"
 	"github.com/truemilk/trivelastic/internal/logger"
-	"github.com/truemilk/trivelastic/internal/worker"
+	"github.com/truemilk/trivelastic/pkg/server"
 )
 
 func main() {
-	// Initialize logger
+	// Dispatch subcommands
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "check":
+			os.Exit(runCheck(os.Stdout))
+		case "plugin":
+			os.Exit(runPlugin(os.Stdin, os.Stderr))
+		default:
+			fmt.Printf("Unknown command: %s\n", os.Args[1])
+			os.Exit(2)
+		}
+	}
+
+	// Initialize logger until the configuration is loaded, which sets it up
+	// again from the configuration file as well
 	err := logger.Initialize(logger.Config{
-		Level:      os.Getenv("LOG_LEVEL"),
-		JSONFormat: os.Getenv("LOG_FORMAT") == "json",
+		Level:      getenv("LOG_LEVEL"),
+		JSONFormat: getenv("LOG_FORMAT") == "json",
 	})
 	if err != nil {
 		fmt.Printf("Failed to initialize logger: %v\n", err)
 		os.Exit(1)
 	}
 
-	log := logger.GetLogger("main")
-
 	// Load configuration
-	cfg, err := config.Load()
+	cfg, err := server.LoadConfig()
+	log := logger.GetLogger("main")
 	if err != nil {
 		log.Fatal().
 			Err(err).
 			Msg("Failed to load configuration")
 	}
 
-	// Create a buffered channel for requests
-	numWorkers := runtime.NumCPU() * 2
-	log.Info().
-		Int("num_workers", numWorkers).
-		Msg("Initializing worker pool")
-
-	requestPool := worker.NewPool(numWorkers)
+	minWorkers, maxWorkers := cfg.Workers.Bounds()
 
 	// Create and start the server
 	log.Info().
 		Str("port", cfg.Port).
-		Int("workers", numWorkers).
+		Int("min_workers", minWorkers).
+		Int("max_workers", maxWorkers).
 		Msg("Initializing server")
 
-	server := handler.NewServer(cfg, requestPool)
-	if err := server.Start(); err != nil {
+	srv, err := server.New(cfg)
+	if err != nil {
 		log.Fatal().
 			Err(err).
-			Msg("Server failed to start")
+			Msg("Failed to initialize server")
+	}
+
+	// Stop on SIGINT and SIGTERM, such as sent by Kubernetes before killing the pod
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	errs := make(chan error, 1)
+	go func() {
+		errs <- srv.ListenAndServe()
+	}()
+	select {
+	case err := <-errs:
+		if err != nil {
+			log.Fatal().
+				Err(err).
+				Msg("Server failed to start")
+		}
+		return
+	case <-ctx.Done():
+	}
+
+	log.Info().
+		Dur("timeout", cfg.HTTP.ShutdownTimeout).
+		Msg("Shutting down")
+	shutdownCtx := context.Background()
+	if cfg.HTTP.ShutdownTimeout > 0 {
+		var cancel context.CancelFunc
+		shutdownCtx, cancel = context.WithTimeout(shutdownCtx, cfg.HTTP.ShutdownTimeout)
+		defer cancel()
+	}
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Fatal().
+			Err(err).
+			Msg("Shutdown did not complete")
+	}
+	log.Info().Msg("Server stopped")
+}
+
+// getenv returns the TRIVELASTIC_ prefixed variable name, or the unprefixed
+// alias when the prefixed one is not set
+func getenv(name string) string {
+	if value, ok := os.LookupEnv("TRIVELASTIC_" + name); ok {
+		return value
 	}
+	return os.Getenv(name)
 }
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/truemilk/trivelastic/internal/logger"
+	"github.com/truemilk/trivelastic/pkg/server"
+)
+
+// runPlugin ingests a single report read from in, as a Trivy output plugin:
+// `trivy image --format json --output plugin=trivelastic` pipes the report to
+// the plugin. The report goes through the same pipeline and worker as the
+// HTTP server, in-process, without the authentication and the other
+// middleware of the HTTP routes. Logs are written to errOut, at the warn level unless
+// TRIVELASTIC_LOG_LEVEL says otherwise. It returns the process exit code.
+func runPlugin(in io.Reader, errOut io.Writer) (code int) {
+	// Trivy's own output stays readable unless more logs are asked for
+	if os.Getenv("TRIVELASTIC_LOG_LEVEL") == "" && os.Getenv("LOG_LEVEL") == "" {
+		os.Setenv("TRIVELASTIC_LOG_LEVEL", zerolog.LevelWarnValue)
+	}
+	logger.SetLogger(zerolog.New(zerolog.ConsoleWriter{
+		Out:        errOut,
+		TimeFormat: time.RFC3339,
+		NoColor:    true,
+	}).With().Timestamp().Logger())
+
+	cfg, err := server.LoadConfig()
+	if err != nil {
+		fmt.Fprintf(errOut, "trivelastic: %v\n", err)
+		return 1
+	}
+	// The process exits once the report is indexed: nothing may be left
+	// buffered, queued or spooled behind it, nor hold the queue database
+	cfg.Reload.Watch = false
+	cfg.ES.Bulk.Enabled = false
+	cfg.Queue.Path = ""
+	cfg.Queue.SpillDir = ""
+	cfg.RetryQueue.Enabled = false
+	cfg.Maintenance.Windows = ""
+
+	srv, err := server.New(cfg, server.WithWorkers(1))
+	if err != nil {
+		fmt.Fprintf(errOut, "trivelastic: %v\n", err)
+		return 1
+	}
+
+	// Stop the workers and the background loops before the process exits
+	defer func() {
+		ctx := context.Background()
+		if cfg.HTTP.ShutdownTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, cfg.HTTP.ShutdownTimeout)
+			defer cancel()
+		}
+		if err := srv.Shutdown(ctx); err != nil {
+			fmt.Fprintf(errOut, "trivelastic: error shutting down: %v\n", err)
+			code = 1
+		}
+	}()
+
+	body, err := io.ReadAll(in)
+	if err != nil {
+		fmt.Fprintf(errOut, "trivelastic: error reading report: %v\n", err)
+		return 1
+	}
+	// Processed synchronously, so that the process exits once the report
+	// is written or failed
+	resp := srv.Ingest(context.Background(), body)
+
+	status, message, queued := "", resp.Error, false
+	if answer, ok := resp.Body.(map[string]interface{}); ok {
+		status, _ = answer["status"].(string)
+		message, _ = answer["message"].(string)
+		queued, _ = answer["queued"].(bool)
+	}
+	// Only an indexed report is a success, the process cannot retry later
+	if resp.Status >= http.StatusBadRequest || status != "success" || queued {
+		fmt.Fprintf(errOut, "trivelastic: report not indexed: status=%d: %s\n", max(resp.Status, http.StatusOK), message)
+		return 1
+	}
+	fmt.Fprintf(errOut, "trivelastic: %s\n", message)
+	return 0
+}
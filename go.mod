@@ -1,11 +1,24 @@
 module github.com/truemilk/trivelastic
 
-go 1.23
+go 1.23.0
 
-require github.com/rs/zerolog v1.31.0
+require (
+	github.com/elastic/elastic-transport-go/v8 v8.7.0
+	github.com/elastic/go-elasticsearch/v8 v8.18.1
+	github.com/fsnotify/fsnotify v1.7.0
+	github.com/rs/zerolog v1.31.0
+	go.etcd.io/bbolt v1.4.0
+	golang.org/x/net v0.38.0
+)
 
 require (
+	github.com/go-logr/logr v1.4.2 // indirect
+	github.com/go-logr/stdr v1.2.2 // indirect
 	github.com/mattn/go-colorable v0.1.13 // indirect
 	github.com/mattn/go-isatty v0.0.19 // indirect
-	golang.org/x/sys v0.12.0 // indirect
+	go.opentelemetry.io/otel v1.28.0 // indirect
+	go.opentelemetry.io/otel/metric v1.28.0 // indirect
+	go.opentelemetry.io/otel/trace v1.28.0 // indirect
+	golang.org/x/sys v0.31.0 // indirect
+	golang.org/x/text v0.23.0 // indirect
 )
@@ -0,0 +1,216 @@
+package awsauth
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// refreshWindow renews temporary credentials this long before they expire
+const refreshWindow = 5 * time.Minute
+
+// Credentials are AWS access keys, optionally temporary
+type Credentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	Expires         time.Time
+}
+
+func (c *Credentials) expired() bool {
+	return !c.Expires.IsZero() && time.Now().Add(refreshWindow).After(c.Expires)
+}
+
+// CredentialsProvider resolves credentials the way the AWS SDKs do on EKS:
+// static environment keys first, then IAM roles for service accounts (web
+// identity), then the container credentials endpoint used by EKS Pod Identity.
+// Temporary credentials are cached until shortly before they expire.
+type CredentialsProvider struct {
+	client *http.Client
+
+	mu     sync.Mutex
+	cached *Credentials
+}
+
+func NewCredentialsProvider(client *http.Client) *CredentialsProvider {
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	return &CredentialsProvider{client: client}
+}
+
+// Retrieve returns valid credentials, refreshing them when needed
+func (p *CredentialsProvider) Retrieve(ctx context.Context) (*Credentials, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.cached != nil && !p.cached.expired() {
+		return p.cached, nil
+	}
+
+	creds, err := p.resolve(ctx)
+	if err != nil {
+		return nil, err
+	}
+	p.cached = creds
+	return creds, nil
+}
+
+func (p *CredentialsProvider) resolve(ctx context.Context) (*Credentials, error) {
+	if id, secret := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"); id != "" && secret != "" {
+		return &Credentials{
+			AccessKeyID:     id,
+			SecretAccessKey: secret,
+			SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		}, nil
+	}
+
+	if roleARN, tokenFile := os.Getenv("AWS_ROLE_ARN"), os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE"); roleARN != "" && tokenFile != "" {
+		return p.assumeRoleWithWebIdentity(ctx, roleARN, tokenFile)
+	}
+
+	if endpoint := containerCredentialsEndpoint(); endpoint != "" {
+		return p.containerCredentials(ctx, endpoint)
+	}
+
+	return nil, errors.New("no AWS credentials found in environment, web identity or container credentials")
+}
+
+func (p *CredentialsProvider) assumeRoleWithWebIdentity(ctx context.Context, roleARN, tokenFile string) (*Credentials, error) {
+	token, err := os.ReadFile(tokenFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading web identity token: %w", err)
+	}
+
+	sessionName := os.Getenv("AWS_ROLE_SESSION_NAME")
+	if sessionName == "" {
+		sessionName = "trivelastic"
+	}
+
+	endpoint := "https://sts.amazonaws.com/"
+	if region := Region(); region != "" {
+		endpoint = fmt.Sprintf("https://sts.%s.amazonaws.com/", region)
+	}
+
+	query := url.Values{
+		"Action":           {"AssumeRoleWithWebIdentity"},
+		"Version":          {"2011-06-15"},
+		"RoleArn":          {roleARN},
+		"RoleSessionName":  {sessionName},
+		"WebIdentityToken": {strings.TrimSpace(string(token))},
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating STS request: %w", err)
+	}
+
+	body, err := p.do(req)
+	if err != nil {
+		return nil, fmt.Errorf("AssumeRoleWithWebIdentity: %w", err)
+	}
+
+	var out struct {
+		Credentials struct {
+			AccessKeyID     string    `xml:"AccessKeyId"`
+			SecretAccessKey string    `xml:"SecretAccessKey"`
+			SessionToken    string    `xml:"SessionToken"`
+			Expiration      time.Time `xml:"Expiration"`
+		} `xml:"AssumeRoleWithWebIdentityResult>Credentials"`
+	}
+	if err := xml.Unmarshal(body, &out); err != nil {
+		return nil, fmt.Errorf("error decoding STS response: %w", err)
+	}
+
+	return &Credentials{
+		AccessKeyID:     out.Credentials.AccessKeyID,
+		SecretAccessKey: out.Credentials.SecretAccessKey,
+		SessionToken:    out.Credentials.SessionToken,
+		Expires:         out.Credentials.Expiration,
+	}, nil
+}
+
+func containerCredentialsEndpoint() string {
+	if full := os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI"); full != "" {
+		return full
+	}
+	if relative := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); relative != "" {
+		return "http://169.254.170.2" + relative
+	}
+	return ""
+}
+
+func (p *CredentialsProvider) containerCredentials(ctx context.Context, endpoint string) (*Credentials, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating container credentials request: %w", err)
+	}
+
+	token := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN")
+	if tokenFile := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE"); tokenFile != "" {
+		raw, err := os.ReadFile(tokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading container authorization token: %w", err)
+		}
+		token = strings.TrimSpace(string(raw))
+	}
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+
+	body, err := p.do(req)
+	if err != nil {
+		return nil, fmt.Errorf("container credentials: %w", err)
+	}
+
+	var out struct {
+		AccessKeyID     string    `json:"AccessKeyId"`
+		SecretAccessKey string    `json:"SecretAccessKey"`
+		Token           string    `json:"Token"`
+		Expiration      time.Time `json:"Expiration"`
+	}
+	if err := json.Unmarshal(body, &out); err != nil {
+		return nil, fmt.Errorf("error decoding container credentials: %w", err)
+	}
+
+	return &Credentials{
+		AccessKeyID:     out.AccessKeyID,
+		SecretAccessKey: out.SecretAccessKey,
+		SessionToken:    out.Token,
+		Expires:         out.Expiration,
+	}, nil
+}
+
+func (p *CredentialsProvider) do(req *http.Request) ([]byte, error) {
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 400 {
+		return nil, fmt.Errorf("status=%d, response=%s", resp.StatusCode, string(body))
+	}
+	return body, nil
+}
+
+// Region returns the region configured in the environment
+func Region() string {
+	if region := os.Getenv("AWS_REGION"); region != "" {
+		return region
+	}
+	return os.Getenv("AWS_DEFAULT_REGION")
+}
@@ -0,0 +1,121 @@
+// Package chaos injects failures for resilience testing in staging. It is
+// only active when TRIVELASTIC_CHAOS_ENABLED is set and must never be
+// enabled in production.
+package chaos
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/truemilk/trivelastic/internal/config"
+	"github.com/truemilk/trivelastic/internal/logger"
+)
+
+// ErrInjected marks failures injected by chaos mode
+var ErrInjected = errors.New("chaos: injected failure")
+
+// Transport wraps an Elasticsearch transport and makes requests fail, hang
+// or lose their connection, exercising the client's retries and failover
+type Transport struct {
+	cfg  config.ChaosConfig
+	next http.RoundTripper
+	log  zerolog.Logger
+}
+
+func NewTransport(cfg config.ChaosConfig, next http.RoundTripper) *Transport {
+	return &Transport{
+		cfg:  cfg,
+		next: next,
+		log:  logger.GetLogger("chaos"),
+	}
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if hit(t.cfg.LatencyRate) {
+		t.log.Warn().
+			Str("url", req.URL.String()).
+			Dur("latency", t.cfg.Latency).
+			Msg("Injecting sink latency")
+		select {
+		case <-time.After(t.cfg.Latency):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+
+	if hit(t.cfg.DropRate) {
+		t.log.Warn().
+			Str("url", req.URL.String()).
+			Msg("Injecting dropped connection")
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, fmt.Errorf("%w: connection reset by peer", ErrInjected)
+	}
+
+	if hit(t.cfg.ErrorRate) {
+		t.log.Warn().
+			Str("url", req.URL.String()).
+			Msg("Injecting sink server error")
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		body := `{"error":{"type":"chaos_injected_exception","reason":"injected by trivelastic chaos mode"},"status":503}`
+		return &http.Response{
+			Status:        "503 Service Unavailable",
+			StatusCode:    http.StatusServiceUnavailable,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        http.Header{"Content-Type": []string{"application/json"}},
+			Body:          io.NopCloser(strings.NewReader(body)),
+			ContentLength: int64(len(body)),
+			Request:       req,
+		}, nil
+	}
+
+	return t.next.RoundTrip(req)
+}
+
+// Middleware corrupts incoming payloads before they reach the pipeline
+func Middleware(cfg config.ChaosConfig, next http.Handler) http.Handler {
+	log := logger.GetLogger("chaos")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Body != nil && hit(cfg.CorruptRate) {
+			body, err := io.ReadAll(r.Body)
+			r.Body.Close()
+			if err == nil {
+				log.Warn().
+					Str("path", r.URL.Path).
+					Int("size", len(body)).
+					Msg("Injecting corrupted payload")
+				body = corrupt(body)
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			r.ContentLength = int64(len(body))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// corrupt truncates body at a random point, as a client that lost its
+// connection mid-upload would. A truncated JSON object is never valid.
+func corrupt(body []byte) []byte {
+	body = bytes.TrimSpace(body)
+	if len(body) == 0 {
+		return []byte("{")
+	}
+	return body[:rand.IntN(len(body))]
+}
+
+// hit reports whether an event with the given probability happens
+func hit(rate float64) bool {
+	return rate > 0 && rand.Float64() < rate
+}
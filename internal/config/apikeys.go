@@ -0,0 +1,60 @@
+package config
+
+import (
+	"encoding/json"
+	"os"
+)
+
+// APIKey is a named ingest key. Its name is recorded on the documents
+// indexed with it.
+type APIKey struct {
+	Name string `json:"name"`
+	// Key is never written out, see Redacted
+	Key string `json:"-"`
+	// Revoked keys are rejected, and logged with their name
+	Revoked bool `json:"revoked"`
+}
+
+// loadAPIKeys reads the API keys file, a JSON array such as
+// [{"name": "payments-ci", "key": "..."}, {"name": "legacy", "key": "...", "revoked": true}]
+func loadAPIKeys(path string, problems *ValidationError) []APIKey {
+	if path == "" {
+		return nil
+	}
+	option := envPrefix + "AUTH_KEYS_FILE"
+	data, err := os.ReadFile(path)
+	if err != nil {
+		problems.add(option, "%v", err)
+		return nil
+	}
+	var entries []struct {
+		Name    string `json:"name"`
+		Key     string `json:"key"`
+		Revoked bool   `json:"revoked"`
+	}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		problems.add(option, "invalid JSON in %s: %v", path, err)
+		return nil
+	}
+
+	keys := make([]APIKey, 0, len(entries))
+	names := map[string]bool{}
+	values := map[string]bool{}
+	for i, entry := range entries {
+		switch {
+		case entry.Name == "":
+			problems.add(option, "key %d has no name", i)
+		case entry.Key == "":
+			problems.add(option, "key %q is empty", entry.Name)
+		case names[entry.Name]:
+			problems.add(option, "key name %q is used more than once", entry.Name)
+		case values[entry.Key]:
+			problems.add(option, "key %q has the same value as another key", entry.Name)
+		default:
+			keys = append(keys, APIKey{Name: entry.Name, Key: entry.Key, Revoked: entry.Revoked})
+		}
+		names[entry.Name] = true
+		values[entry.Key] = true
+	}
+	return keys
+}
@@ -1,34 +1,789 @@
 package config
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
 	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/rs/zerolog"
+	"github.com/truemilk/trivelastic/internal/awsauth"
+	"github.com/truemilk/trivelastic/internal/indexname"
 	"github.com/truemilk/trivelastic/internal/logger"
+	"github.com/truemilk/trivelastic/internal/schedule"
 )
 
+// Config is loaded from the environment. See env.go for the tag syntax; every
+// option is read from TRIVELASTIC_<env>, with the listed aliases kept for
+// backward compatibility. Options tagged secret:"true" are masked by Redacted
+// and may hold a reference resolved by a SecretProvider.
 type Config struct {
-	Port string
-	ES   ElasticsearchConfig
-	Log  LogConfig
+	Port        string              `env:"PORT" alias:"PORT" default:"8080" json:"port"`
+	HTTP        HTTPConfig          `json:"http"`
+	TLS         ListenerTLSConfig   `json:"tls"`
+	ES          ElasticsearchConfig `json:"elasticsearch"`
+	Log         LogConfig           `json:"log"`
+	Routing     RoutingConfig       `json:"routing"`
+	Admin       AdminConfig         `json:"admin"`
+	Auth        AuthConfig          `json:"auth"`
+	RateLimit   RateLimitConfig     `json:"rate_limit"`
+	CORS        CORSConfig          `json:"cors"`
+	Network     NetworkConfig       `json:"network"`
+	Tenants     TenantsConfig       `json:"tenants"`
+	Metrics     MetricsConfig       `json:"metrics"`
+	Transform   TransformConfig     `json:"transform"`
+	Timestamp   TimestampConfig     `json:"timestamp"`
+	DocumentID  DocumentIDConfig    `json:"document_id"`
+	Report      ReportConfig        `json:"report"`
+	Maintenance MaintenanceConfig   `json:"maintenance"`
+	Fingerprint FingerprintConfig   `json:"fingerprint"`
+	Dedup       DedupConfig         `json:"dedup"`
+	Async       AsyncConfig         `json:"async"`
+	Queue       QueueConfig         `json:"queue"`
+	Workers     WorkersConfig       `json:"workers"`
+	RetryQueue  RetryQueueConfig    `json:"retry_queue"`
+	Idempotency IdempotencyConfig   `json:"idempotency"`
+	KEV         KEVConfig           `json:"kev"`
+	VEX         VEXConfig           `json:"vex"`
+	Diff        DiffConfig          `json:"diff"`
+	Registry    RegistryConfig      `json:"registry"`
+	Reload      ReloadConfig        `json:"reload"`
+	Chaos       ChaosConfig         `json:"chaos"`
+	// Pipelines are loaded from TRIVELASTIC_PIPELINES, see loadPipelines
+	Pipelines []PipelineConfig `json:"pipelines"`
+}
+
+// HTTPConfig bounds how long clients may hold a connection to the HTTP
+// server. Zero means no timeout.
+type HTTPConfig struct {
+	// ReadHeaderTimeout bounds reading the request headers, so that slow
+	// clients cannot hold connections open
+	ReadHeaderTimeout time.Duration `env:"HTTP_READ_HEADER_TIMEOUT" default:"10s" json:"read_header_timeout"`
+	// ReadTimeout bounds reading the whole request, body included
+	ReadTimeout time.Duration `env:"HTTP_READ_TIMEOUT" default:"1m" json:"read_timeout"`
+	// WriteTimeout bounds the time from the end of the request headers to the
+	// end of the response, processing and indexing included
+	WriteTimeout time.Duration `env:"HTTP_WRITE_TIMEOUT" default:"2m" json:"write_timeout"`
+	// IdleTimeout closes keep-alive connections idle for longer
+	IdleTimeout time.Duration `env:"HTTP_IDLE_TIMEOUT" default:"2m" json:"idle_timeout"`
+	// ShutdownTimeout bounds the wait for requests in progress and queued
+	// reports when the process is stopped. Zero waits for all of them.
+	ShutdownTimeout time.Duration `env:"HTTP_SHUTDOWN_TIMEOUT" default:"30s" json:"shutdown_timeout"`
+	// MaxBodySize is the largest request body accepted, in bytes. Zero
+	// means no limit.
+	MaxBodySize int64 `env:"HTTP_MAX_BODY_SIZE" default:"104857600" json:"max_body_size"`
+	// StrictContentType rejects request bodies whose Content-Type is not
+	// accepted by their route with 415. The deprecated root route is not
+	// checked, as clients written for earlier releases may not send one.
+	StrictContentType bool `env:"HTTP_STRICT_CONTENT_TYPE" default:"true" json:"strict_content_type"`
+	// HTTP2 is negotiated with clients over HTTPS
+	HTTP2 bool `env:"HTTP_HTTP2" default:"true" json:"http2"`
+	// H2C accepts HTTP/2 without TLS, from clients that know the server
+	// supports it or that upgrade their connection
+	H2C bool `env:"HTTP_H2C" default:"false" json:"h2c"`
+}
+
+// ListenerTLSConfig makes the HTTP server terminate HTTPS itself. The
+// certificate is reloaded when its files change.
+type ListenerTLSConfig struct {
+	// CertFile and KeyFile are the PEM server certificate and private key.
+	// The server listens over plain HTTP when they are empty.
+	CertFile string `env:"TLS_CERT_FILE" json:"cert_file"`
+	KeyFile  string `env:"TLS_KEY_FILE" json:"key_file"`
+	// MinVersion is the lowest accepted TLS version: 1.0, 1.1, 1.2 or 1.3
+	MinVersion string `env:"TLS_MIN_VERSION" default:"1.2" json:"min_version"`
+	// ClientAuth is ClientAuthNone, ClientAuthOptional or ClientAuthRequire
+	ClientAuth string `env:"TLS_CLIENT_AUTH" default:"none" json:"client_auth"`
+	// ClientCAFile is a PEM bundle of the certificate authorities that
+	// issue client certificates
+	ClientCAFile string `env:"TLS_CLIENT_CA_FILE" json:"client_ca_file"`
+}
+
+// Client certificate policies of the HTTP listener
+const (
+	// ClientAuthNone ignores client certificates
+	ClientAuthNone = "none"
+	// ClientAuthOptional verifies client certificates when they are presented
+	ClientAuthOptional = "optional"
+	// ClientAuthRequire rejects requests without a valid client certificate,
+	// except for health checks and metrics
+	ClientAuthRequire = "require"
+)
+
+// Enabled reports whether the server listens over HTTPS
+func (c ListenerTLSConfig) Enabled() bool {
+	return c.CertFile != ""
+}
+
+// Version returns the tls constant of MinVersion, 0 when it is invalid
+func (c ListenerTLSConfig) Version() uint16 {
+	return tlsVersions[c.MinVersion]
 }
 
 type ElasticsearchConfig struct {
-	URL    string
-	APIKey string
-	Index  string
+	// Target is the kind of cluster: elasticsearch or opensearch
+	Target string `env:"ES_TARGET" default:"elasticsearch" json:"target"`
+	// URL is a comma-separated list of node URLs
+	URL  string   `env:"ES_URL" alias:"ES_URL" required:"true" json:"url"`
+	URLs []string `json:"urls"`
+	// APIKey may be empty when the cluster authenticates the client certificate,
+	// see TLSConfig, or requests are signed with SigV4
+	APIKey string `env:"ES_API_KEY" alias:"ES_API_KEY" secret:"true" json:"api_key"`
+	// Index may contain date patterns such as "trivy-%{+yyyy.MM.dd}", see package indexname
+	Index string      `env:"ES_INDEX" alias:"ES_INDEX" required:"true" json:"index"`
+	Retry RetryConfig `json:"retry"`
+	// RequestTimeout bounds each attempt of a request. Zero means no timeout.
+	RequestTimeout time.Duration `env:"ES_REQUEST_TIMEOUT" default:"30s" json:"request_timeout"`
+	// Transport tunes the connection pool of the HTTP client
+	Transport TransportConfig `json:"transport"`
+	// Breaker stops sending requests while the cluster is down
+	Breaker BreakerConfig `json:"breaker"`
+	Bulk    BulkConfig    `json:"bulk"`
+	ILM     ILMConfig     `json:"ilm"`
+	// Rollover rolls write aliases over from trivelastic itself, without ILM
+	Rollover RolloverConfig `json:"rollover"`
+	// Template installs mappings suited to Trivy reports for the target indices
+	Template TemplateConfig `json:"template"`
+	TLS      TLSConfig      `json:"tls"`
+	// SigV4 signs requests with AWS credentials, for Amazon OpenSearch Service
+	SigV4 SigV4Config `json:"sigv4"`
+	// Pipeline is an ingest pipeline run by Elasticsearch on every indexed document
+	Pipeline string `env:"ES_PIPELINE" json:"pipeline"`
+	// ShardRouting co-locates related documents on the same shard
+	ShardRouting ShardRoutingConfig `json:"shard_routing"`
+	// DiscoverNodesInterval periodically replaces URL with the cluster's HTTP nodes. Zero disables discovery.
+	DiscoverNodesInterval time.Duration `env:"ES_DISCOVER_NODES_INTERVAL" default:"0s" json:"discover_nodes_interval"`
+	// Compression gzips request bodies, which shrinks Trivy reports considerably
+	Compression bool `env:"ES_COMPRESSION" default:"false" json:"compression"`
+	// CompatibilityMode asks a newer cluster to respond in the format of Elasticsearch 8
+	CompatibilityMode bool `env:"ES_COMPATIBILITY_MODE" default:"false" json:"compatibility_mode"`
+	// FailureStatus answers reports that could not be indexed, so that clients
+	// retry. 503 is used instead while the circuit breaker is open.
+	FailureStatus int `env:"ES_FAILURE_STATUS" default:"502" json:"failure_status"`
+	// LenientFailures answers 200 with a warning when indexing fails, as
+	// earlier releases did
+	LenientFailures bool `env:"ES_LENIENT_FAILURES" default:"false" json:"lenient_failures"`
+}
+
+// ShardRoutingConfig selects the routing value sent with every document.
+// Documents with the same value are stored on the same shard, so queries
+// scoped to one artifact only need to search that shard.
+type ShardRoutingConfig struct {
+	// Value is a static routing value
+	Value string `env:"ES_ROUTING_VALUE" json:"value"`
+	// Field is a dotted report path, such as "ArtifactName", read from each report
+	Field string `env:"ES_ROUTING_FIELD" json:"field"`
+}
+
+// Cluster targets
+const (
+	TargetElasticsearch = "elasticsearch"
+	TargetOpenSearch    = "opensearch"
+)
+
+// SigV4Config controls AWS Signature Version 4 signing of cluster requests.
+// Credentials are resolved from the environment, IRSA or EKS Pod Identity.
+type SigV4Config struct {
+	Enabled bool `env:"ES_AWS_SIGV4_ENABLED" default:"false" json:"enabled"`
+	// Region defaults to AWS_REGION or AWS_DEFAULT_REGION
+	Region string `env:"ES_AWS_REGION" json:"region"`
+	// Service is "es" for managed domains or "aoss" for OpenSearch Serverless
+	Service string `env:"ES_AWS_SERVICE" default:"es" json:"service"`
+}
+
+// TLSConfig controls how the Elasticsearch server certificate is verified and
+// the client certificate presented to clusters that require mutual TLS
+type TLSConfig struct {
+	// CAFile is a PEM bundle of certificate authorities trusted in addition to the system pool
+	CAFile string `env:"ES_TLS_CA_FILE" json:"ca_file"`
+	// SkipVerify disables certificate verification. Only use it for testing.
+	SkipVerify bool `env:"ES_TLS_SKIP_VERIFY" default:"false" json:"skip_verify"`
+	// MinVersion is the lowest accepted TLS version: 1.0, 1.1, 1.2 or 1.3
+	MinVersion string `env:"ES_TLS_MIN_VERSION" default:"1.2" json:"min_version"`
+	// CertFile and KeyFile are the PEM client certificate and private key
+	CertFile string `env:"ES_TLS_CERT_FILE" json:"cert_file"`
+	KeyFile  string `env:"ES_TLS_KEY_FILE" json:"key_file"`
+	// CA, Cert and Key hold the same PEM material as the files instead, so
+	// that it can be resolved from a secret manager
+	CA   string `env:"ES_TLS_CA" secret:"true" json:"ca"`
+	Cert string `env:"ES_TLS_CERT" secret:"true" json:"cert"`
+	Key  string `env:"ES_TLS_KEY" secret:"true" json:"key"`
+}
+
+// HasClientCert tells whether a client certificate is configured, from files
+// or PEM content
+func (c TLSConfig) HasClientCert() bool {
+	return c.CertFile != "" || c.Cert != ""
+}
+
+// Files lists the certificate files that are set
+func (c TLSConfig) Files() []string {
+	var files []string
+	for _, file := range []string{c.CAFile, c.CertFile, c.KeyFile} {
+		if file != "" {
+			files = append(files, file)
+		}
+	}
+	return files
+}
+
+// tlsVersions maps the accepted TLS_MIN_VERSION values to their tls constants
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// Version returns the tls constant of MinVersion, or zero if it is invalid
+func (c TLSConfig) Version() uint16 {
+	return tlsVersions[c.MinVersion]
+}
+
+// TemplateConfig controls the index template installed at startup
+type TemplateConfig struct {
+	Enabled bool   `env:"ES_TEMPLATE_ENABLED" default:"true" json:"enabled"`
+	Name    string `env:"ES_TEMPLATE_NAME" default:"trivelastic" json:"name"`
+	// TotalFieldsLimit caps the number of fields dynamic mapping may create
+	TotalFieldsLimit int `env:"ES_TEMPLATE_TOTAL_FIELDS_LIMIT" default:"2000" json:"total_fields_limit"`
+}
+
+// ILMConfig controls the index lifecycle policy installed at startup
+type ILMConfig struct {
+	Enabled bool   `env:"ES_ILM_ENABLED" default:"false" json:"enabled"`
+	Policy  string `env:"ES_ILM_POLICY" default:"trivelastic" json:"policy"`
+	// RolloverMaxSize and RolloverMaxAge roll the write index over, e.g. "50gb" or "30d".
+	// Rollover requires writing through an alias.
+	RolloverMaxSize string `env:"ES_ILM_ROLLOVER_MAX_SIZE" json:"rollover_max_size"`
+	RolloverMaxAge  string `env:"ES_ILM_ROLLOVER_MAX_AGE" json:"rollover_max_age"`
+	// DeleteAfter deletes indices this long after rollover, or after creation
+	// when they are not rolled over, e.g. "90d". Empty keeps them.
+	DeleteAfter string `env:"ES_ILM_DELETE_AFTER" json:"delete_after"`
+}
+
+// Rollover reports whether the policy rolls indices over
+func (c ILMConfig) Rollover() bool {
+	return c.RolloverMaxSize != "" || c.RolloverMaxAge != ""
+}
+
+// RolloverConfig controls rolling write aliases over with the _rollover API
+type RolloverConfig struct {
+	Enabled bool `env:"ES_ROLLOVER_ENABLED" default:"false" json:"enabled"`
+	// Interval is how often the rollover conditions are checked
+	Interval time.Duration `env:"ES_ROLLOVER_INTERVAL" default:"5m" json:"interval"`
+	// MaxSize is per primary shard, e.g. "50gb"; MaxAge e.g. "7d". Empty or zero values are not checked.
+	MaxSize string `env:"ES_ROLLOVER_MAX_SIZE" json:"max_size"`
+	MaxAge  string `env:"ES_ROLLOVER_MAX_AGE" json:"max_age"`
+	MaxDocs int    `env:"ES_ROLLOVER_MAX_DOCS" default:"0" json:"max_docs"`
+}
+
+// Conditions returns the conditions of a _rollover request
+func (c RolloverConfig) Conditions() map[string]interface{} {
+	conditions := map[string]interface{}{}
+	if c.MaxSize != "" {
+		conditions["max_primary_shard_size"] = c.MaxSize
+	}
+	if c.MaxAge != "" {
+		conditions["max_age"] = c.MaxAge
+	}
+	if c.MaxDocs > 0 {
+		conditions["max_docs"] = c.MaxDocs
+	}
+	return conditions
+}
+
+// BulkConfig controls batching of documents into _bulk requests
+type BulkConfig struct {
+	// Enabled batches documents. When false every document is indexed with its own request.
+	Enabled bool `env:"ES_BULK_ENABLED" default:"false" json:"enabled"`
+	// MaxDocs flushes a batch once it holds this many documents
+	MaxDocs int `env:"ES_BULK_MAX_DOCS" default:"500" json:"max_docs"`
+	// MaxBytes flushes a batch once its body reaches this size
+	MaxBytes int `env:"ES_BULK_MAX_BYTES" default:"5242880" json:"max_bytes"`
+	// FlushInterval is the longest a document waits for its batch to fill up
+	FlushInterval time.Duration `env:"ES_BULK_FLUSH_INTERVAL" default:"200ms" json:"flush_interval"`
+}
+
+// BreakerConfig controls the circuit breaker around Elasticsearch requests
+type BreakerConfig struct {
+	// Threshold opens the circuit after this many consecutive failures. Zero disables the breaker.
+	Threshold int `env:"ES_BREAKER_THRESHOLD" default:"5" json:"threshold"`
+	// Cooldown is how long the circuit stays open before a request probes the cluster
+	Cooldown time.Duration `env:"ES_BREAKER_COOLDOWN" default:"30s" json:"cooldown"`
+}
+
+// TransportConfig controls how connections to the cluster are kept and reused
+type TransportConfig struct {
+	// MaxIdleConns caps the idle connections kept across all nodes. Zero means no limit.
+	MaxIdleConns int `env:"ES_MAX_IDLE_CONNS" default:"100" json:"max_idle_conns"`
+	// MaxIdleConnsPerHost caps the idle connections kept per node. Raise it
+	// with the number of workers to avoid reconnecting under load. Zero means 2.
+	MaxIdleConnsPerHost int `env:"ES_MAX_IDLE_CONNS_PER_HOST" default:"32" json:"max_idle_conns_per_host"`
+	// IdleConnTimeout closes connections idle for longer. Zero keeps them open.
+	IdleConnTimeout time.Duration `env:"ES_IDLE_CONN_TIMEOUT" default:"90s" json:"idle_conn_timeout"`
+	// TLSHandshakeTimeout bounds the TLS handshake of new connections. Zero means no timeout.
+	TLSHandshakeTimeout time.Duration `env:"ES_TLS_HANDSHAKE_TIMEOUT" default:"10s" json:"tls_handshake_timeout"`
+}
+
+// RetryConfig controls how failed Elasticsearch requests are retried
+type RetryConfig struct {
+	// MaxAttempts is the total number of attempts, including the first one
+	MaxAttempts int `env:"ES_RETRY_MAX_ATTEMPTS" default:"3" json:"max_attempts"`
+	// Interval is the delay before the first retry
+	Interval time.Duration `env:"ES_RETRY_INTERVAL" default:"1s" json:"interval"`
+	// BackoffMultiplier scales the delay after every retry. 1 keeps it constant.
+	BackoffMultiplier float64 `env:"ES_RETRY_BACKOFF_MULTIPLIER" default:"2" json:"backoff_multiplier"`
+	// MaxInterval caps the delay between two attempts. Zero means no cap.
+	MaxInterval time.Duration `env:"ES_RETRY_MAX_INTERVAL" default:"30s" json:"max_interval"`
+	// Jitter is the largest fraction of each delay dropped at random, from 0 to 1
+	Jitter float64 `env:"ES_RETRY_JITTER" default:"0.5" json:"jitter"`
+	// MaxElapsed stops retrying once this much time has passed. Zero means no limit.
+	MaxElapsed time.Duration `env:"ES_RETRY_MAX_ELAPSED" default:"0s" json:"max_elapsed"`
+	// OnStatus lists the response statuses worth retrying, as codes such as
+	// "429" or classes such as "5xx". Other error responses fail at once.
+	// Requests that got no response are always retried.
+	OnStatus []string `env:"ES_RETRY_ON_STATUS" default:"408,429,5xx" json:"on_status"`
+}
+
+// Retryable reports whether a response with the given status should be retried
+func (c RetryConfig) Retryable(status int) bool {
+	code := strconv.Itoa(status)
+	for _, s := range c.OnStatus {
+		if s == code || (strings.HasSuffix(s, "xx") && s[0] == code[0]) {
+			return true
+		}
+	}
+	return false
+}
+
+// validRetryStatus reports whether s is an error status code or class
+func validRetryStatus(s string) bool {
+	if s == "4xx" || s == "5xx" {
+		return true
+	}
+	code, err := strconv.Atoi(s)
+	return err == nil && len(s) == 3 && code >= 400 && code < 600
 }
 
 type LogConfig struct {
-	Level      string
-	JSONFormat bool
+	Level      string `env:"LOG_LEVEL" alias:"LOG_LEVEL" default:"info" json:"level"`
+	Format     string `env:"LOG_FORMAT" alias:"LOG_FORMAT" default:"console" json:"format"`
+	JSONFormat bool   `json:"json_format"`
+	// Access logs every request at info level
+	Access bool `env:"LOG_ACCESS" default:"false" json:"access"`
+	// AccessExclude lists paths left out of the access log, such as probes
+	AccessExclude []string `env:"LOG_ACCESS_EXCLUDE" default:"/readyz,/metrics" json:"access_exclude"`
+}
+
+// RoutingConfig controls how findings are fanned out to indices
+type RoutingConfig struct {
+	// SeverityIndices maps an upper-case severity to the index its findings are written to,
+	// e.g. "CRITICAL=trivy-hot,HIGH=trivy-hot,LOW=trivy-cold".
+	// Severities without an entry stay in the default index.
+	SeverityIndices map[string]string `env:"ROUTING_SEVERITY_INDICES" alias:"ROUTING_SEVERITY_INDICES" json:"severity_indices"`
+	// KubernetesIndex receives the resources of Trivy Kubernetes cluster
+	// reports instead of the default index. Empty keeps the default index.
+	KubernetesIndex string `env:"ROUTING_KUBERNETES_INDEX" json:"kubernetes_index"`
+	// MisconfigurationIndex receives the misconfigurations of every report,
+	// with their own mappings. Empty keeps them with the report.
+	MisconfigurationIndex string `env:"ROUTING_MISCONFIGURATION_INDEX" json:"misconfiguration_index"`
+	// LicenseIndex receives the license findings of every report, like
+	// MisconfigurationIndex. Empty keeps them with the report.
+	LicenseIndex string `env:"ROUTING_LICENSE_INDEX" json:"license_index"`
+	// Split selects how a report is divided into documents, see SplitReport
+	Split string `env:"ROUTING_SPLIT" default:"report" json:"split"`
+	// Summary also writes a compact summary of every report to the
+	// "-summary" index next to the default index
+	Summary bool `env:"ROUTING_SUMMARY" default:"false" json:"summary"`
+}
+
+// Document splitting modes
+const (
+	// SplitReport indexes each report as one document
+	SplitReport = "report"
+	// SplitResult indexes one document per entry of Results, with the report
+	// metadata copied onto it
+	SplitResult = "result"
+	// SplitVulnerability indexes one document per vulnerability, with the
+	// report and result metadata copied onto it
+	SplitVulnerability = "vulnerability"
+)
+
+// TransformConfig controls the processing transforms
+type TransformConfig struct {
+	// MaxFieldLength truncates longer string values. Zero disables truncation.
+	MaxFieldLength int `env:"TRANSFORM_MAX_FIELD_LENGTH" default:"0" json:"max_field_length"`
+}
+
+// TimestampConfig controls the validation of report timestamps
+type TimestampConfig struct {
+	// MaxSkew is how far CreatedAt may be from ingest time. Zero disables the check.
+	MaxSkew time.Duration `env:"TIMESTAMP_MAX_SKEW" default:"24h" json:"max_skew"`
+	// Clamp replaces skewed timestamps with the ingest time instead of only reporting them
+	Clamp bool `env:"TIMESTAMP_CLAMP" default:"false" json:"clamp"`
+}
+
+// DocumentIDConfig controls the deterministic IDs of indexed reports
+type DocumentIDConfig struct {
+	// Enabled derives each document ID from Fields so that resubmitting a report
+	// replaces the earlier copy instead of creating a duplicate
+	Enabled bool `env:"DOCUMENT_ID_ENABLED" default:"true" json:"enabled"`
+	// Fields are the dotted report paths hashed into the ID
+	Fields []string `env:"DOCUMENT_ID_FIELDS" default:"ArtifactName,Metadata.ImageID,Metadata.RepoDigests,CreatedAt" json:"fields"`
+}
+
+// ReportConfig controls how incoming payloads are checked
+type ReportConfig struct {
+	// Validate rejects payloads that are not Trivy JSON reports, see pkg/trivy
+	Validate bool `env:"REPORT_VALIDATE" default:"true" json:"validate"`
+}
+
+// MaintenanceConfig schedules windows during which reports are spooled to
+// disk instead of being written to Elasticsearch
+type MaintenanceConfig struct {
+	// Windows is a semicolon-separated list of cron expressions (evaluated in UTC),
+	// each followed by a duration, e.g. "0 2 * * SUN 2h"
+	Windows  string `env:"MAINTENANCE_WINDOWS" json:"windows"`
+	SpoolDir string `env:"MAINTENANCE_SPOOL_DIR" default:"/var/lib/trivelastic/spool" json:"spool_dir"`
+}
+
+// FingerprintConfig controls the fleet-wide duplicate tracking index
+type FingerprintConfig struct {
+	Enabled bool `env:"FINGERPRINT_ENABLED" default:"false" json:"enabled"`
+	// Index defaults to "<ES_INDEX>-fingerprints", without any date pattern
+	Index string `env:"FINGERPRINT_INDEX" json:"index"`
+	// Window is how long a report is acknowledged as a duplicate when the
+	// exact same content is submitted again. Zero disables it.
+	Window time.Duration `env:"FINGERPRINT_WINDOW" default:"0s" json:"window"`
+}
+
+// DedupConfig controls dropping repeat scans of the same artifact
+type DedupConfig struct {
+	// Window is how long an indexed report suppresses identical ones. Zero disables deduplication.
+	Window time.Duration `env:"DEDUP_WINDOW" default:"0s" json:"window"`
+}
+
+// AsyncConfig controls acknowledging reports before they are indexed
+type AsyncConfig struct {
+	// Enabled answers 202 Accepted with a job ID as soon as a report is
+	// validated. Requests choose with ?async=true or ?async=false.
+	Enabled bool `env:"ASYNC_ENABLED" default:"false" json:"enabled"`
+	// JobTTL is how long the status of a finished job can be read
+	JobTTL time.Duration `env:"ASYNC_JOB_TTL" default:"1h" json:"job_ttl"`
+}
+
+// QueueConfig bounds the requests waiting for a worker, so that clients back
+// off instead of piling up when Elasticsearch cannot keep up
+type QueueConfig struct {
+	// Size is how many requests may wait for a worker, zero for one per
+	// worker. It is only read at startup.
+	Size int `env:"QUEUE_SIZE" default:"0" json:"size"`
+	// Timeout is how long a request waits for room in a full queue before
+	// it is rejected with 429. Zero rejects it at once.
+	Timeout time.Duration `env:"QUEUE_TIMEOUT" default:"1s" json:"timeout"`
+	// MaxBytes bounds the payload bytes of the requests queued or being
+	// processed, zero for no bound. Requests over it are spilled when
+	// SpillDir is set, otherwise rejected with 429.
+	MaxBytes int64 `env:"QUEUE_MAX_BYTES" default:"0" json:"max_bytes"`
+	// Path is a database keeping every report on disk until it is indexed,
+	// so that accepted reports survive restarts and Elasticsearch outages.
+	// Empty disables the persistent queue. It is only read at startup.
+	Path string `env:"QUEUE_PATH" json:"path"`
+	// RetryInterval is how often reports left in the persistent queue are
+	// sent again
+	RetryInterval time.Duration `env:"QUEUE_RETRY_INTERVAL" default:"30s" json:"retry_interval"`
+	// SpillDir is a directory holding the reports of queued requests while
+	// the queue is above SpillHighWater, so that spikes are absorbed on disk
+	// instead of rejected. Empty disables spilling. It is only read at
+	// startup, like the other spill settings.
+	SpillDir string `env:"QUEUE_SPILL_DIR" json:"spill_dir"`
+	// SpillHighWater is the queue length above which requests are spilled,
+	// zero for the queue size
+	SpillHighWater int `env:"QUEUE_SPILL_HIGH_WATER" default:"0" json:"spill_high_water"`
+	// SpillMaxReports is the most requests spilled at once. Further requests
+	// wait for room in the queue.
+	SpillMaxReports int `env:"QUEUE_SPILL_MAX_REPORTS" default:"10000" json:"spill_max_reports"`
+}
+
+// WorkersConfig bounds the number of workers processing reports. The pool
+// starts with Min workers and adds more up to Max while requests are queued.
+// It is only read at startup.
+type WorkersConfig struct {
+	// Min is the number of workers kept running, zero for the number of CPUs
+	Min int `env:"WORKERS_MIN" default:"0" json:"min"`
+	// Max is the number of workers the pool may grow to, zero for twice the
+	// number of CPUs
+	Max int `env:"WORKERS_MAX" default:"0" json:"max"`
+	// MaxLatency stops adding workers while indexing a report takes longer
+	// on average, as Elasticsearch is then the bottleneck
+	MaxLatency time.Duration `env:"WORKERS_MAX_LATENCY" default:"2s" json:"max_latency"`
+	// ScaleInterval is how often the number of workers is adjusted
+	ScaleInterval time.Duration `env:"WORKERS_SCALE_INTERVAL" default:"1s" json:"scale_interval"`
+}
+
+// Bounds returns the minimum and maximum number of workers, resolving the
+// defaults from the number of CPUs
+func (w WorkersConfig) Bounds() (int, int) {
+	minWorkers, maxWorkers := w.Min, w.Max
+	if minWorkers == 0 {
+		minWorkers = runtime.NumCPU()
+	}
+	if maxWorkers == 0 {
+		maxWorkers = max(minWorkers, runtime.NumCPU()*2)
+	}
+	return minWorkers, maxWorkers
+}
+
+// RetryQueueConfig controls the delayed retry of reports that failed with an
+// error that may go away. It is only read at startup.
+type RetryQueueConfig struct {
+	// Enabled answers such failures with "queued" and retries the reports
+	// in the background, instead of retrying in the request path
+	Enabled bool `env:"RETRY_QUEUE_ENABLED" default:"false" json:"enabled"`
+	// Size is the most reports waiting to be retried. Further failures are
+	// answered with the error.
+	Size int `env:"RETRY_QUEUE_SIZE" default:"10000" json:"size"`
+	// Interval is the delay before the first retry, doubled after every
+	// failed one up to MaxInterval
+	Interval    time.Duration `env:"RETRY_QUEUE_INTERVAL" default:"5s" json:"interval"`
+	MaxInterval time.Duration `env:"RETRY_QUEUE_MAX_INTERVAL" default:"5m" json:"max_interval"`
+	// MaxAge drops reports still failing this long after their first failure
+	MaxAge time.Duration `env:"RETRY_QUEUE_MAX_AGE" default:"1h" json:"max_age"`
+	// Path is the file holding the reports still waiting when the process
+	// stops, retried by the next one. Empty abandons them.
+	Path string `env:"RETRY_QUEUE_PATH" default:"/var/lib/trivelastic/retry-queue.json" json:"path"`
+}
+
+// IdempotencyConfig controls replaying the answer to payloads submitted again.
+// It is only read at startup.
+type IdempotencyConfig struct {
+	// TTL is how long the answer to a stored payload is replayed. Zero
+	// disables the cache.
+	TTL time.Duration `env:"IDEMPOTENCY_TTL" default:"0s" json:"ttl"`
+	// MaxEntries bounds the answers kept in memory. Payloads are processed
+	// without being cached while the cache is full.
+	MaxEntries int `env:"IDEMPOTENCY_MAX_ENTRIES" default:"1000" json:"max_entries"`
+}
+
+// KEVConfig controls flagging vulnerabilities listed in the CISA Known
+// Exploited Vulnerabilities catalog
+type KEVConfig struct {
+	Enabled bool   `env:"KEV_ENABLED" default:"false" json:"enabled"`
+	URL     string `env:"KEV_URL" default:"https://www.cisa.gov/sites/default/files/feeds/known_exploited_vulnerabilities.json" json:"url"`
+	// RefreshInterval is how often the catalog is downloaded again
+	RefreshInterval time.Duration `env:"KEV_REFRESH_INTERVAL" default:"24h" json:"refresh_interval"`
+}
+
+// VEX modes
+const (
+	// VEXMark annotates vulnerabilities covered by a VEX statement
+	VEXMark = "mark"
+	// VEXFilter also drops vulnerabilities declared not_affected or fixed
+	VEXFilter = "filter"
+)
+
+// VEXConfig controls applying OpenVEX documents to reports
+type VEXConfig struct {
+	// Dir holds the OpenVEX documents as *.json files. Empty disables VEX.
+	Dir  string `env:"VEX_DIR" json:"dir"`
+	Mode string `env:"VEX_MODE" default:"mark" json:"mode"`
+}
+
+// DiffConfig controls indexing only the vulnerabilities that changed since
+// the previous report of the same artifact
+type DiffConfig struct {
+	Enabled bool `env:"DIFF_ENABLED" default:"false" json:"enabled"`
+	// Index holds the last indexed vulnerabilities of every artifact.
+	// It defaults to "<ES_INDEX>-diff", without any date pattern.
+	Index string `env:"DIFF_INDEX" json:"index"`
 }
 
+// RegistryConfig controls enriching reports with the metadata of the scanned
+// image read from its registry
+type RegistryConfig struct {
+	Enabled bool `env:"REGISTRY_ENABLED" default:"false" json:"enabled"`
+	// Hosts lists the registries that are queried, e.g. "ghcr.io,docker.io".
+	// Reports name their registry, so images hosted anywhere else are not
+	// looked up.
+	Hosts []string `env:"REGISTRY_HOSTS" json:"hosts"`
+	// Username and Password are sent to every listed registry. Empty
+	// credentials query the registries anonymously.
+	Username string `env:"REGISTRY_USERNAME" json:"username"`
+	Password string `env:"REGISTRY_PASSWORD" secret:"true" json:"password"`
+	// Timeout bounds each lookup, every request to the registry included
+	Timeout time.Duration `env:"REGISTRY_TIMEOUT" default:"10s" json:"timeout"`
+	// CacheTTL is how long the metadata of an image is reused
+	CacheTTL time.Duration `env:"REGISTRY_CACHE_TTL" default:"1h" json:"cache_ttl"`
+}
+
+// ReloadConfig controls reloading the configuration from mounted files
+type ReloadConfig struct {
+	// File is an optional file of NAME=value lines, e.g. a mounted ConfigMap.
+	// Variables set in the environment take precedence over the file.
+	File string `env:"CONFIG_FILE" json:"file"`
+	// Watch reloads the configuration when File, a file: secret or a TLS certificate changes
+	Watch bool `env:"CONFIG_WATCH" default:"true" json:"watch"`
+	// Files lists the mounted files the configuration was read from
+	Files []string `json:"files"`
+}
+
+// ChaosConfig injects failures for resilience testing. Never enable it in production.
+type ChaosConfig struct {
+	Enabled bool `env:"CHAOS_ENABLED" default:"false" json:"enabled"`
+	// ErrorRate is the probability that an Elasticsearch request gets a 503
+	ErrorRate float64 `env:"CHAOS_ERROR_RATE" default:"0" json:"error_rate"`
+	// LatencyRate is the probability that an Elasticsearch request is delayed by Latency
+	LatencyRate float64       `env:"CHAOS_LATENCY_RATE" default:"0" json:"latency_rate"`
+	Latency     time.Duration `env:"CHAOS_LATENCY" default:"5s" json:"latency"`
+	// DropRate is the probability that an Elasticsearch request loses its connection
+	DropRate float64 `env:"CHAOS_DROP_RATE" default:"0" json:"drop_rate"`
+	// CorruptRate is the probability that an incoming payload is truncated
+	CorruptRate float64 `env:"CHAOS_CORRUPT_RATE" default:"0" json:"corrupt_rate"`
+}
+
+// AdminConfig controls the administrative endpoints
+type AdminConfig struct {
+	// Token is the bearer token required by /admin endpoints. They are disabled when empty.
+	Token string `env:"ADMIN_TOKEN" alias:"ADMIN_TOKEN" secret:"true" json:"token"`
+	// Pprof serves the net/http/pprof profiles on PprofAddr
+	Pprof bool `env:"ADMIN_PPROF_ENABLED" default:"false" json:"pprof"`
+	// PprofAddr must be a loopback address, profiles are not authenticated
+	PprofAddr string `env:"ADMIN_PPROF_ADDR" default:"127.0.0.1:6060" json:"pprof_addr"`
+}
+
+// AuthConfig controls the authentication of incoming requests
+type AuthConfig struct {
+	// Tokens is a comma-separated list of bearer tokens accepted on every
+	// endpoint but health checks, metrics and admin endpoints. Requests are
+	// not authenticated when it is empty.
+	Tokens string `env:"AUTH_TOKENS" secret:"true" json:"tokens"`
+	// SignatureSecret is the shared secret of the X-Trivelastic-Signature
+	// header, an HMAC-SHA256 of the request body. Signatures are not
+	// checked when it is empty.
+	SignatureSecret string `env:"AUTH_SIGNATURE_SECRET" secret:"true" json:"signature_secret"`
+	// KeysFile is a JSON file of named API keys, see loadAPIKeys. Edits
+	// apply when the configuration is reloaded.
+	KeysFile string `env:"AUTH_KEYS_FILE" json:"keys_file"`
+	// Keys are loaded from KeysFile
+	Keys []APIKey `json:"keys"`
+}
+
+// TokenList returns the accepted bearer tokens
+func (c AuthConfig) TokenList() []string {
+	return splitList(c.Tokens)
+}
+
+// Rate limit keys
+const (
+	// RateLimitByIP gives every client address its own budget
+	RateLimitByIP = "ip"
+	// RateLimitByAPIKey gives every API key its own budget, and every client
+	// address without a key
+	RateLimitByAPIKey = "api_key"
+)
+
+// RateLimitConfig limits how often each client may send requests, with a
+// token bucket per client
+type RateLimitConfig struct {
+	// Rate is the number of requests per second allowed per client. Zero
+	// disables rate limiting.
+	Rate float64 `env:"RATE_LIMIT_RATE" default:"0" json:"rate"`
+	// Burst is the number of requests a client may send at once
+	Burst int `env:"RATE_LIMIT_BURST" default:"10" json:"burst"`
+	// Key is RateLimitByIP or RateLimitByAPIKey
+	Key string `env:"RATE_LIMIT_KEY" default:"ip" json:"key"`
+}
+
+// TenantsConfig lets teams share a deployment, each posting to its own
+// path and index
+type TenantsConfig struct {
+	// Indices maps a tenant name to its index, e.g. "payments=trivy-payments,web=trivy-web".
+	// Reports for other tenants are rejected.
+	Indices map[string]string `env:"TENANT_INDICES" json:"indices"`
+}
+
+// Names returns the tenant names in order
+func (c TenantsConfig) Names() []string {
+	names := make([]string, 0, len(c.Indices))
+	for name := range c.Indices {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NetworkConfig restricts the addresses clients may connect from
+type NetworkConfig struct {
+	// AllowedCIDRs lists the networks, or single addresses, allowed to send
+	// requests. Empty allows any address.
+	AllowedCIDRs []string `env:"ALLOWED_CIDRS" json:"allowed_cidrs"`
+	// TrustedProxies lists the networks of the proxies whose X-Forwarded-For
+	// header gives the client address
+	TrustedProxies []string `env:"TRUSTED_PROXIES" json:"trusted_proxies"`
+}
+
+// ParsePrefixes parses networks in CIDR notation or single addresses
+func ParsePrefixes(values []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(values))
+	for _, value := range values {
+		if addr, err := netip.ParseAddr(value); err == nil {
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q", value)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// CORSConfig lets browser-based tools call trivelastic from other origins
+type CORSConfig struct {
+	// AllowedOrigins lists the origins allowed, or "*" for any. Empty disables CORS.
+	AllowedOrigins []string `env:"CORS_ALLOWED_ORIGINS" json:"allowed_origins"`
+	AllowedMethods []string `env:"CORS_ALLOWED_METHODS" default:"GET,POST" json:"allowed_methods"`
+	AllowedHeaders []string `env:"CORS_ALLOWED_HEADERS" default:"Authorization,Content-Type,X-API-Key,X-Trivelastic-Signature" json:"allowed_headers"`
+	// MaxAge is how long browsers may cache the answer to a preflight request
+	MaxAge time.Duration `env:"CORS_MAX_AGE" default:"10m" json:"max_age"`
+}
+
+// MetricsConfig controls the Prometheus metrics endpoint
+type MetricsConfig struct {
+	Enabled bool `env:"METRICS_ENABLED" default:"true" json:"enabled"`
+	// Port serves /metrics on a port of its own, e.g. to keep it off the
+	// ingest listener. Empty serves it on the main port.
+	Port string `env:"METRICS_PORT" json:"port"`
+}
+
+// Load reads the configuration from the environment. Every missing or invalid
+// option is reported at once in a *ValidationError.
 func Load() (*Config, error) {
-	// Initialize logger with basic configuration for config loading
-	err := logger.Initialize(logger.Config{
-		Level:      os.Getenv("LOG_LEVEL"),
-		JSONFormat: os.Getenv("LOG_FORMAT") == "json",
+	config := &Config{}
+	problems := &ValidationError{}
+	env, err := newEnvironment()
+	if err != nil {
+		problems.add(envPrefix+"CONFIG_FILE", "%v", err)
+	}
+	sources := loadEnv(config, env, problems)
+	config.finalize()
+	config.Pipelines = loadPipelines(env, config.ES.Index, problems)
+	config.Auth.Keys = loadAPIKeys(config.Auth.KeysFile, problems)
+	config.validate(problems)
+
+	// Initialize logger with the loaded configuration
+	err = logger.Initialize(logger.Config{
+		Level:      config.Log.Level,
+		JSONFormat: config.Log.JSONFormat,
 	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialize logger: %w", err)
@@ -36,100 +791,614 @@ func Load() (*Config, error) {
 
 	log := logger.GetLogger("config")
 
-	// Load Elasticsearch config
-	esConfig, err := loadESConfig()
-	if err != nil {
-		log.Error().Err(err).Msg("Failed to load Elasticsearch configuration")
+	for _, source := range sources {
+		log.Debug().
+			Str("option", source.Option).
+			Str("source", source.Variable).
+			Msg("Option loaded")
+	}
+
+	if err := problems.orNil(); err != nil {
+		for _, p := range problems.Problems {
+			log.Error().
+				Str("option", p.Option).
+				Str("problem", p.Message).
+				Msg("Invalid configuration option")
+		}
 		return nil, err
 	}
 
-	// Load server port
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
-		log.Info().Str("port", port).Msg("Using default port")
-	} else {
-		log.Info().Str("port", port).Msg("Port configured from environment")
+	// Resolve secrets referenced by ARN or resource name
+	ctx, cancel := context.WithTimeout(context.Background(), secretResolveTimeout)
+	defer cancel()
+	resolved, err := resolveSecrets(ctx, config)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to resolve secret")
+		return nil, err
+	}
+	if config.Reload.File != "" {
+		config.Reload.Files = append(config.Reload.Files, config.Reload.File)
+	}
+	// Reload when certificates are rotated
+	config.Reload.Files = append(config.Reload.Files, config.ES.TLS.Files()...)
+	if config.Auth.KeysFile != "" {
+		config.Reload.Files = append(config.Reload.Files, config.Auth.KeysFile)
+	}
+	for _, secret := range resolved {
+		if secret.Provider == (fileSecretProvider{}).Name() {
+			path, _ := splitSecretKey(secretFilePath(secret.Ref))
+			config.Reload.Files = append(config.Reload.Files, path)
+		}
+		log.Info().
+			Str("option", secret.Option).
+			Str("provider", secret.Provider).
+			Msg("Secret resolved")
 	}
 
-	// Load logging config
-	logConfig := loadLogConfig()
 	log.Info().
-		Str("level", logConfig.Level).
-		Bool("json_format", logConfig.JSONFormat).
-		Msg("Logging configuration loaded")
+		Str("port", config.Port).
+		Strs("es_urls", config.ES.URLs).
+		Str("es_index", config.ES.Index).
+		Str("log_level", config.Log.Level).
+		Str("log_format", config.Log.Format).
+		Msg("Configuration loaded successfully")
+
+	if len(config.Routing.SeverityIndices) > 0 {
+		log.Info().
+			Interface("severity_indices", config.Routing.SeverityIndices).
+			Msg("Per-severity index routing enabled")
+	}
+	if config.Routing.Split != SplitReport {
+		log.Info().
+			Str("split", config.Routing.Split).
+			Msg("Reports are split into several documents")
+	}
+
+	if config.ES.TLS.SkipVerify {
+		log.Warn().Msg("TLS certificate verification of Elasticsearch is disabled, do not use this in production")
+	}
+
+	if config.ES.Pipeline != "" {
+		log.Info().
+			Str("ingest_pipeline", config.ES.Pipeline).
+			Msg("Documents are indexed through an ingest pipeline")
+	}
+
+	if config.ES.ShardRouting.Field != "" {
+		log.Info().
+			Str("routing_field", config.ES.ShardRouting.Field).
+			Msg("Documents are routed to shards by report field")
+	} else if config.ES.ShardRouting.Value != "" {
+		log.Info().
+			Str("routing_value", config.ES.ShardRouting.Value).
+			Msg("Documents are routed to shards by a static value")
+	}
+
+	for _, p := range config.Pipelines {
+		log.Info().
+			Str("pipeline", p.Name).
+			Str("path", p.Path).
+			Str("index", p.Index).
+			Str("sanitize_profile", p.SanitizeProfile).
+			Msg("Pipeline configured")
+	}
+
+	if config.Chaos.Enabled {
+		log.Warn().
+			Float64("error_rate", config.Chaos.ErrorRate).
+			Float64("latency_rate", config.Chaos.LatencyRate).
+			Dur("latency", config.Chaos.Latency).
+			Float64("drop_rate", config.Chaos.DropRate).
+			Float64("corrupt_rate", config.Chaos.CorruptRate).
+			Msg("Chaos mode enabled, failures will be injected. Do not use in production")
+	}
 
-	config := &Config{
-		Port: port,
-		ES:   *esConfig,
-		Log:  *logConfig,
+	if config.Admin.Token == "" {
+		log.Info().Msg("TRIVELASTIC_ADMIN_TOKEN not set, admin endpoints disabled")
+	} else {
+		log.Info().Msg("Admin endpoints enabled")
 	}
 
-	log.Info().Msg("Configuration loaded successfully")
 	return config, nil
 }
 
-func loadESConfig() (*ElasticsearchConfig, error) {
-	log := logger.GetLogger("config.elasticsearch")
+// finalize fills the fields derived from loaded options
+func (c *Config) finalize() {
+	// ES_URL may list several nodes for failover
+	c.ES.URLs = splitList(c.ES.URL)
+	for i := range c.ES.URLs {
+		c.ES.URLs[i] = strings.TrimRight(c.ES.URLs[i], "/")
+	}
+
+	c.ES.Target = strings.ToLower(c.ES.Target)
+	if c.ES.SigV4.Enabled && c.ES.SigV4.Region == "" {
+		c.ES.SigV4.Region = awsauth.Region()
+	}
 
-	url := os.Getenv("ES_URL")
-	apiKey := os.Getenv("ES_API_KEY")
-	index := os.Getenv("ES_INDEX")
+	c.Log.JSONFormat = c.Log.Format == "json"
 
-	missingVars := make([]string, 0)
-	if url == "" {
-		missingVars = append(missingVars, "ES_URL")
+	// Fingerprints are counted across days, so the default index has no date pattern
+	if c.Fingerprint.Index == "" {
+		c.Fingerprint.Index = indexname.Static(c.ES.Index) + "-fingerprints"
 	}
-	if apiKey == "" {
-		missingVars = append(missingVars, "ES_API_KEY")
+	if c.Diff.Index == "" {
+		c.Diff.Index = indexname.Static(c.ES.Index) + "-diff"
 	}
-	if index == "" {
-		missingVars = append(missingVars, "ES_INDEX")
+
+	severityIndices := make(map[string]string, len(c.Routing.SeverityIndices))
+	for severity, index := range c.Routing.SeverityIndices {
+		severityIndices[strings.ToUpper(severity)] = index
 	}
+	c.Routing.SeverityIndices = severityIndices
+}
+
+// Validate checks the loaded values for problems that would only surface at
+// ingest time. It returns a *ValidationError listing all of them.
+func (c *Config) Validate() error {
+	problems := &ValidationError{}
+	c.validate(problems)
+	return problems.orNil()
+}
 
-	if len(missingVars) > 0 {
-		log.Error().
-			Strs("missing_variables", missingVars).
-			Msg("Missing required environment variables")
-		return nil, fmt.Errorf("missing required environment variables: %v", missingVars)
+// validate records every problem with the loaded values. Options already
+// reported while loading, e.g. as missing, are not reported twice.
+func (c *Config) validate(problems *ValidationError) {
+	loaded := problems.Problems
+	add := func(option, format string, args ...interface{}) {
+		for _, p := range loaded {
+			if p.Option == option {
+				return
+			}
+		}
+		problems.add(option, format, args...)
 	}
 
-	config := &ElasticsearchConfig{
-		URL:    url,
-		APIKey: apiKey,
-		Index:  index,
+	if port, err := strconv.Atoi(c.Port); err != nil || port < 1 || port > 65535 {
+		add(envPrefix+"PORT", "invalid port %q", c.Port)
 	}
 
-	log.Info().
-		Str("url", url).
-		Str("index", index).
-		Msg("Elasticsearch configuration loaded")
+	if len(c.ES.URLs) == 0 {
+		add(envPrefix+"ES_URL", "must contain at least one URL")
+	}
+	for _, esURL := range c.ES.URLs {
+		if u, err := url.Parse(esURL); err != nil {
+			add(envPrefix+"ES_URL", "%v", err)
+		} else if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			add(envPrefix+"ES_URL", "expected an http(s) URL, got %q", esURL)
+		}
+	}
 
-	return config, nil
-}
+	if c.ES.APIKey == "" && !c.ES.TLS.HasClientCert() && !c.ES.SigV4.Enabled {
+		add(envPrefix+"ES_API_KEY", "must be set unless a client certificate or SigV4 signing is configured")
+	}
+
+	switch c.ES.Target {
+	case TargetElasticsearch:
+	case TargetOpenSearch:
+		if c.ES.CompatibilityMode {
+			add(envPrefix+"ES_COMPATIBILITY_MODE", "is not supported by OpenSearch")
+		}
+		if c.ES.ILM.Enabled {
+			add(envPrefix+"ES_ILM_ENABLED", "is not supported by OpenSearch, manage retention with an ISM policy")
+		}
+	default:
+		add(envPrefix+"ES_TARGET", "must be elasticsearch or opensearch, got %q", c.ES.Target)
+	}
+
+	if c.ES.SigV4.Enabled {
+		if c.ES.SigV4.Region == "" {
+			add(envPrefix+"ES_AWS_REGION", "must be set when SigV4 signing is enabled, or set AWS_REGION")
+		}
+		if c.ES.SigV4.Service == "" {
+			add(envPrefix+"ES_AWS_SERVICE", "must not be empty when SigV4 signing is enabled")
+		}
+		if c.ES.DiscoverNodesInterval > 0 {
+			add(envPrefix+"ES_DISCOVER_NODES_INTERVAL", "must be 0 when SigV4 signing is enabled, AWS endpoints do not expose their nodes")
+		}
+	}
+
+	if c.ES.Index == "" {
+		add(envPrefix+"ES_INDEX", "must not be empty")
+	} else if err := indexname.Validate(c.ES.Index); err != nil {
+		add(envPrefix+"ES_INDEX", "%v", err)
+	}
+	severities := make([]string, 0, len(c.Routing.SeverityIndices))
+	for severity := range c.Routing.SeverityIndices {
+		severities = append(severities, severity)
+	}
+	sort.Strings(severities)
+	for _, severity := range severities {
+		if err := indexname.Validate(c.Routing.SeverityIndices[severity]); err != nil {
+			add(envPrefix+"ROUTING_SEVERITY_INDICES", "%s: %v", severity, err)
+		}
+	}
+	for _, index := range []struct {
+		option string
+		name   string
+	}{
+		{"ROUTING_KUBERNETES_INDEX", c.Routing.KubernetesIndex},
+		{"ROUTING_MISCONFIGURATION_INDEX", c.Routing.MisconfigurationIndex},
+		{"ROUTING_LICENSE_INDEX", c.Routing.LicenseIndex},
+	} {
+		if index.name == "" {
+			continue
+		}
+		if err := indexname.Validate(index.name); err != nil {
+			add(envPrefix+index.option, "%v", err)
+		}
+	}
+	if c.Routing.LicenseIndex != "" && c.Routing.LicenseIndex == c.Routing.MisconfigurationIndex {
+		add(envPrefix+"ROUTING_LICENSE_INDEX", "must differ from %sROUTING_MISCONFIGURATION_INDEX", envPrefix)
+	}
+	switch c.Routing.Split {
+	case SplitReport, SplitResult, SplitVulnerability:
+	default:
+		add(envPrefix+"ROUTING_SPLIT", "unknown split mode %q, expected report, result or vulnerability", c.Routing.Split)
+	}
+
+	if _, err := zerolog.ParseLevel(strings.ToLower(c.Log.Level)); err != nil {
+		add(envPrefix+"LOG_LEVEL", "unknown log level %q, expected trace, debug, info, warn, error, fatal, panic or disabled", c.Log.Level)
+	}
+	if c.Log.Format != "console" && c.Log.Format != "json" {
+		add(envPrefix+"LOG_FORMAT", "unknown log format %q, expected console or json", c.Log.Format)
+	}
+
+	if c.ES.DiscoverNodesInterval < 0 {
+		add(envPrefix+"ES_DISCOVER_NODES_INTERVAL", "must not be negative, got %s", c.ES.DiscoverNodesInterval)
+	}
+
+	for _, count := range []struct {
+		option string
+		value  int
+	}{
+		{"ES_MAX_IDLE_CONNS", c.ES.Transport.MaxIdleConns},
+		{"ES_MAX_IDLE_CONNS_PER_HOST", c.ES.Transport.MaxIdleConnsPerHost},
+	} {
+		if count.value < 0 {
+			add(envPrefix+count.option, "must not be negative, got %d", count.value)
+		}
+	}
+	for _, timeout := range []struct {
+		option string
+		value  time.Duration
+	}{
+		{"ES_IDLE_CONN_TIMEOUT", c.ES.Transport.IdleConnTimeout},
+		{"ES_TLS_HANDSHAKE_TIMEOUT", c.ES.Transport.TLSHandshakeTimeout},
+		{"HTTP_READ_HEADER_TIMEOUT", c.HTTP.ReadHeaderTimeout},
+		{"HTTP_READ_TIMEOUT", c.HTTP.ReadTimeout},
+		{"HTTP_WRITE_TIMEOUT", c.HTTP.WriteTimeout},
+		{"HTTP_IDLE_TIMEOUT", c.HTTP.IdleTimeout},
+		{"HTTP_SHUTDOWN_TIMEOUT", c.HTTP.ShutdownTimeout},
+	} {
+		if timeout.value < 0 {
+			add(envPrefix+timeout.option, "must not be negative, got %s", timeout.value)
+		}
+	}
+
+	if c.ES.Template.Enabled {
+		if c.ES.Template.Name == "" {
+			add(envPrefix+"ES_TEMPLATE_NAME", "must not be empty when the index template is enabled")
+		}
+		if c.ES.Template.TotalFieldsLimit < 1 {
+			add(envPrefix+"ES_TEMPLATE_TOTAL_FIELDS_LIMIT", "must be at least 1, got %d", c.ES.Template.TotalFieldsLimit)
+		}
+	}
+
+	if c.ES.ILM.Enabled {
+		if c.ES.ILM.Policy == "" {
+			add(envPrefix+"ES_ILM_POLICY", "must not be empty when ILM is enabled")
+		}
+		if !c.ES.ILM.Rollover() && c.ES.ILM.DeleteAfter == "" {
+			add(envPrefix+"ES_ILM_ENABLED", "set a rollover condition or TRIVELASTIC_ES_ILM_DELETE_AFTER")
+		}
+	}
+
+	if c.ES.TLS.Version() == 0 {
+		add(envPrefix+"ES_TLS_MIN_VERSION", "must be one of 1.0, 1.1, 1.2 or 1.3, got %q", c.ES.TLS.MinVersion)
+	}
+	for _, file := range []struct {
+		option string
+		path   string
+	}{
+		{"ES_TLS_CA_FILE", c.ES.TLS.CAFile},
+		{"ES_TLS_CERT_FILE", c.ES.TLS.CertFile},
+		{"ES_TLS_KEY_FILE", c.ES.TLS.KeyFile},
+	} {
+		if file.path == "" {
+			continue
+		}
+		if _, err := os.Stat(file.path); err != nil {
+			add(envPrefix+file.option, "%v", err)
+		}
+	}
+	if (c.ES.TLS.CertFile == "") != (c.ES.TLS.KeyFile == "") {
+		add(envPrefix+"ES_TLS_KEY_FILE", "TRIVELASTIC_ES_TLS_CERT_FILE and TRIVELASTIC_ES_TLS_KEY_FILE must be set together")
+	}
+	if (c.ES.TLS.Cert == "") != (c.ES.TLS.Key == "") {
+		add(envPrefix+"ES_TLS_KEY", "TRIVELASTIC_ES_TLS_CERT and TRIVELASTIC_ES_TLS_KEY must be set together")
+	}
+	if c.ES.TLS.CA != "" && c.ES.TLS.CAFile != "" {
+		add(envPrefix+"ES_TLS_CA", "cannot be used with %sES_TLS_CA_FILE", envPrefix)
+	}
+	if c.ES.TLS.Cert != "" && c.ES.TLS.CertFile != "" {
+		add(envPrefix+"ES_TLS_CERT", "cannot be used with %sES_TLS_CERT_FILE", envPrefix)
+	}
+
+	if c.TLS.Version() == 0 {
+		add(envPrefix+"TLS_MIN_VERSION", "must be one of 1.0, 1.1, 1.2 or 1.3, got %q", c.TLS.MinVersion)
+	}
+	for _, file := range []struct {
+		option string
+		path   string
+	}{
+		{"TLS_CERT_FILE", c.TLS.CertFile},
+		{"TLS_KEY_FILE", c.TLS.KeyFile},
+		{"TLS_CLIENT_CA_FILE", c.TLS.ClientCAFile},
+	} {
+		if file.path == "" {
+			continue
+		}
+		if _, err := os.Stat(file.path); err != nil {
+			add(envPrefix+file.option, "%v", err)
+		}
+	}
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		add(envPrefix+"TLS_KEY_FILE", "TRIVELASTIC_TLS_CERT_FILE and TRIVELASTIC_TLS_KEY_FILE must be set together")
+	}
+	switch c.TLS.ClientAuth {
+	case ClientAuthNone:
+	case ClientAuthOptional, ClientAuthRequire:
+		if !c.TLS.Enabled() {
+			add(envPrefix+"TLS_CLIENT_AUTH", "requires TRIVELASTIC_TLS_CERT_FILE, client certificates are only sent over HTTPS")
+		}
+		if c.TLS.ClientCAFile == "" {
+			add(envPrefix+"TLS_CLIENT_CA_FILE", "must be set when TRIVELASTIC_TLS_CLIENT_AUTH is %s", c.TLS.ClientAuth)
+		}
+	default:
+		add(envPrefix+"TLS_CLIENT_AUTH", "must be one of %s, %s or %s, got %q", ClientAuthNone, ClientAuthOptional, ClientAuthRequire, c.TLS.ClientAuth)
+	}
 
-func loadLogConfig() *LogConfig {
-	log := logger.GetLogger("config.log")
+	if c.ES.Rollover.Enabled {
+		if len(c.ES.Rollover.Conditions()) == 0 {
+			add(envPrefix+"ES_ROLLOVER_ENABLED", "set TRIVELASTIC_ES_ROLLOVER_MAX_SIZE, TRIVELASTIC_ES_ROLLOVER_MAX_AGE or TRIVELASTIC_ES_ROLLOVER_MAX_DOCS")
+		}
+		if c.ES.Rollover.Interval <= 0 {
+			add(envPrefix+"ES_ROLLOVER_INTERVAL", "must be positive, got %s", c.ES.Rollover.Interval)
+		}
+		if c.ES.ILM.Enabled && c.ES.ILM.Rollover() {
+			add(envPrefix+"ES_ROLLOVER_ENABLED", "cannot be combined with ILM rollover, use one or the other")
+		}
+	}
+	if c.ES.Rollover.MaxDocs < 0 {
+		add(envPrefix+"ES_ROLLOVER_MAX_DOCS", "must not be negative, got %d", c.ES.Rollover.MaxDocs)
+	}
 
-	level := os.Getenv("LOG_LEVEL")
-	if level == "" {
-		level = "info"
-		log.Info().Str("level", level).Msg("Using default log level")
+	if c.ES.Bulk.MaxDocs < 1 {
+		add(envPrefix+"ES_BULK_MAX_DOCS", "must be at least 1, got %d", c.ES.Bulk.MaxDocs)
+	}
+	if c.ES.Bulk.MaxBytes < 1 {
+		add(envPrefix+"ES_BULK_MAX_BYTES", "must be at least 1, got %d", c.ES.Bulk.MaxBytes)
+	}
+	if c.ES.Bulk.FlushInterval <= 0 {
+		add(envPrefix+"ES_BULK_FLUSH_INTERVAL", "must be positive, got %s", c.ES.Bulk.FlushInterval)
 	}
 
-	jsonFormat := os.Getenv("LOG_FORMAT") == "json"
-	format := "console"
-	if jsonFormat {
-		format = "json"
+	if c.ES.ShardRouting.Value != "" && c.ES.ShardRouting.Field != "" {
+		add(envPrefix+"ES_ROUTING_FIELD", "cannot be combined with %sES_ROUTING_VALUE", envPrefix)
 	}
 
-	log.Debug().
-		Str("level", level).
-		Str("format", format).
-		Msg("Log configuration loaded")
+	if c.DocumentID.Enabled && len(c.DocumentID.Fields) == 0 {
+		add(envPrefix+"DOCUMENT_ID_FIELDS", "must list at least one field when document IDs are enabled")
+	}
 
-	return &LogConfig{
-		Level:      level,
-		JSONFormat: jsonFormat,
+	if c.KEV.Enabled {
+		if u, err := url.Parse(c.KEV.URL); err != nil {
+			add(envPrefix+"KEV_URL", "%v", err)
+		} else if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			add(envPrefix+"KEV_URL", "expected an http(s) URL, got %q", c.KEV.URL)
+		}
+		if c.KEV.RefreshInterval <= 0 {
+			add(envPrefix+"KEV_REFRESH_INTERVAL", "must be positive, got %s", c.KEV.RefreshInterval)
+		}
+	}
+	if c.VEX.Dir != "" {
+		if info, err := os.Stat(c.VEX.Dir); err != nil {
+			add(envPrefix+"VEX_DIR", "%v", err)
+		} else if !info.IsDir() {
+			add(envPrefix+"VEX_DIR", "%s is not a directory", c.VEX.Dir)
+		}
+	}
+	switch c.VEX.Mode {
+	case VEXMark, VEXFilter:
+	default:
+		add(envPrefix+"VEX_MODE", "unknown mode %q, expected mark or filter", c.VEX.Mode)
+	}
+	if c.Diff.Enabled {
+		if err := indexname.Validate(c.Diff.Index); err != nil {
+			add(envPrefix+"DIFF_INDEX", "%v", err)
+		} else if indexname.HasPattern(c.Diff.Index) {
+			add(envPrefix+"DIFF_INDEX", "must not contain a date pattern, got %q", c.Diff.Index)
+		}
+	}
+	if c.RateLimit.Rate < 0 {
+		add(envPrefix+"RATE_LIMIT_RATE", "must not be negative, got %g", c.RateLimit.Rate)
+	}
+	if c.RateLimit.Rate > 0 && c.RateLimit.Burst < 1 {
+		add(envPrefix+"RATE_LIMIT_BURST", "must be at least 1, got %d", c.RateLimit.Burst)
+	}
+	if c.RateLimit.Key != RateLimitByIP && c.RateLimit.Key != RateLimitByAPIKey {
+		add(envPrefix+"RATE_LIMIT_KEY", "must be %s or %s, got %q", RateLimitByIP, RateLimitByAPIKey, c.RateLimit.Key)
+	}
+	if c.ES.FailureStatus < 500 || c.ES.FailureStatus > 599 {
+		add(envPrefix+"ES_FAILURE_STATUS", "must be a 5xx status code, got %d", c.ES.FailureStatus)
+	}
+	for _, origin := range c.CORS.AllowedOrigins {
+		if origin != "*" && !strings.HasPrefix(origin, "http://") && !strings.HasPrefix(origin, "https://") {
+			add(envPrefix+"CORS_ALLOWED_ORIGINS", "origin %q must be * or start with http:// or https://", origin)
+		}
+	}
+	if c.CORS.MaxAge < 0 {
+		add(envPrefix+"CORS_MAX_AGE", "must not be negative, got %s", c.CORS.MaxAge)
+	}
+	if c.Admin.Pprof {
+		host, _, err := net.SplitHostPort(c.Admin.PprofAddr)
+		if ip := net.ParseIP(host); err != nil || host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			add(envPrefix+"ADMIN_PPROF_ADDR", "must be a loopback host and port such as 127.0.0.1:6060, got %q", c.Admin.PprofAddr)
+		}
+	}
+	for _, name := range c.Tenants.Names() {
+		if !pipelineNamePattern.MatchString(name) {
+			add(envPrefix+"TENANT_INDICES", "tenant %q must be lower-case letters, digits, - and _", name)
+		}
+		if err := indexname.Validate(c.Tenants.Indices[name]); err != nil {
+			add(envPrefix+"TENANT_INDICES", "%s: %v", name, err)
+		}
+	}
+	if _, err := ParsePrefixes(c.Network.AllowedCIDRs); err != nil {
+		add(envPrefix+"ALLOWED_CIDRS", "%v", err)
+	}
+	if _, err := ParsePrefixes(c.Network.TrustedProxies); err != nil {
+		add(envPrefix+"TRUSTED_PROXIES", "%v", err)
+	}
+	if c.HTTP.H2C && (!c.HTTP.HTTP2 || c.TLS.Enabled()) {
+		add(envPrefix+"HTTP_H2C", "requires %sHTTP_HTTP2 and a listener without TLS, HTTPS listeners negotiate HTTP/2 themselves", envPrefix)
+	}
+	if c.HTTP.MaxBodySize < 0 {
+		add(envPrefix+"HTTP_MAX_BODY_SIZE", "must not be negative, got %d", c.HTTP.MaxBodySize)
+	}
+	if c.Metrics.Port != "" && c.Metrics.Port == c.Port {
+		add(envPrefix+"METRICS_PORT", "must differ from %sPORT, leave it empty to serve metrics on the main port", envPrefix)
+	}
+	if c.Registry.Enabled {
+		if len(c.Registry.Hosts) == 0 {
+			add(envPrefix+"REGISTRY_HOSTS", "must list the registries to query when registry enrichment is enabled")
+		}
+		if c.Registry.Timeout <= 0 {
+			add(envPrefix+"REGISTRY_TIMEOUT", "must be positive, got %s", c.Registry.Timeout)
+		}
+		if c.Registry.CacheTTL < 0 {
+			add(envPrefix+"REGISTRY_CACHE_TTL", "must not be negative, got %s", c.Registry.CacheTTL)
+		}
+	}
+	if c.Fingerprint.Window < 0 {
+		add(envPrefix+"FINGERPRINT_WINDOW", "must not be negative, got %s", c.Fingerprint.Window)
+	}
+	if c.Async.JobTTL <= 0 {
+		add(envPrefix+"ASYNC_JOB_TTL", "must be positive, got %s", c.Async.JobTTL)
+	}
+	if c.Queue.Size < 0 {
+		add(envPrefix+"QUEUE_SIZE", "must not be negative, got %d", c.Queue.Size)
+	}
+	if c.Queue.Timeout < 0 {
+		add(envPrefix+"QUEUE_TIMEOUT", "must not be negative, got %s", c.Queue.Timeout)
+	}
+	if c.Queue.MaxBytes < 0 {
+		add(envPrefix+"QUEUE_MAX_BYTES", "must not be negative, got %d", c.Queue.MaxBytes)
+	}
+	if c.Queue.SpillDir != "" {
+		if c.Queue.SpillHighWater < 0 {
+			add(envPrefix+"QUEUE_SPILL_HIGH_WATER", "must not be negative, got %d", c.Queue.SpillHighWater)
+		}
+		if c.Queue.SpillMaxReports <= 0 {
+			add(envPrefix+"QUEUE_SPILL_MAX_REPORTS", "must be positive, got %d", c.Queue.SpillMaxReports)
+		}
+	}
+	if c.Workers.Min < 0 {
+		add(envPrefix+"WORKERS_MIN", "must not be negative, got %d", c.Workers.Min)
+	}
+	if c.Workers.Max < 0 {
+		add(envPrefix+"WORKERS_MAX", "must not be negative, got %d", c.Workers.Max)
+	}
+	if c.Workers.Max > 0 && c.Workers.Max < c.Workers.Min {
+		add(envPrefix+"WORKERS_MAX", "must not be lower than WORKERS_MIN (%d), got %d", c.Workers.Min, c.Workers.Max)
+	}
+	if c.Workers.MaxLatency < 0 {
+		add(envPrefix+"WORKERS_MAX_LATENCY", "must not be negative, got %s", c.Workers.MaxLatency)
+	}
+	if c.Workers.ScaleInterval <= 0 {
+		add(envPrefix+"WORKERS_SCALE_INTERVAL", "must be positive, got %s", c.Workers.ScaleInterval)
+	}
+	if c.Idempotency.TTL < 0 {
+		add(envPrefix+"IDEMPOTENCY_TTL", "must not be negative, got %s", c.Idempotency.TTL)
+	}
+	if c.Idempotency.TTL > 0 && c.Idempotency.MaxEntries <= 0 {
+		add(envPrefix+"IDEMPOTENCY_MAX_ENTRIES", "must be positive, got %d", c.Idempotency.MaxEntries)
+	}
+	if c.RetryQueue.Enabled {
+		if c.Queue.Path != "" {
+			add(envPrefix+"RETRY_QUEUE_ENABLED", "cannot be used with %sQUEUE_PATH, the persistent queue retries failed reports", envPrefix)
+		}
+		if c.RetryQueue.Size <= 0 {
+			add(envPrefix+"RETRY_QUEUE_SIZE", "must be positive, got %d", c.RetryQueue.Size)
+		}
+		if c.RetryQueue.Interval <= 0 {
+			add(envPrefix+"RETRY_QUEUE_INTERVAL", "must be positive, got %s", c.RetryQueue.Interval)
+		}
+		if c.RetryQueue.MaxInterval < c.RetryQueue.Interval {
+			add(envPrefix+"RETRY_QUEUE_MAX_INTERVAL", "must not be lower than RETRY_QUEUE_INTERVAL (%s), got %s", c.RetryQueue.Interval, c.RetryQueue.MaxInterval)
+		}
+		if c.RetryQueue.MaxAge <= 0 {
+			add(envPrefix+"RETRY_QUEUE_MAX_AGE", "must be positive, got %s", c.RetryQueue.MaxAge)
+		}
+	}
+	if c.Queue.Path != "" && c.Queue.RetryInterval <= 0 {
+		add(envPrefix+"QUEUE_RETRY_INTERVAL", "must be positive, got %s", c.Queue.RetryInterval)
+	}
+	if c.Dedup.Window < 0 {
+		add(envPrefix+"DEDUP_WINDOW", "must not be negative, got %s", c.Dedup.Window)
+	}
+	if c.Timestamp.MaxSkew < 0 {
+		add(envPrefix+"TIMESTAMP_MAX_SKEW", "must not be negative, got %s", c.Timestamp.MaxSkew)
+	}
+
+	for _, rate := range []struct {
+		option string
+		value  float64
+	}{
+		{"CHAOS_ERROR_RATE", c.Chaos.ErrorRate},
+		{"CHAOS_LATENCY_RATE", c.Chaos.LatencyRate},
+		{"CHAOS_DROP_RATE", c.Chaos.DropRate},
+		{"CHAOS_CORRUPT_RATE", c.Chaos.CorruptRate},
+	} {
+		if rate.value < 0 || rate.value > 1 {
+			add(envPrefix+rate.option, "must be between 0 and 1, got %g", rate.value)
+		}
+	}
+
+	if _, err := schedule.ParseWindows(c.Maintenance.Windows); err != nil {
+		add(envPrefix+"MAINTENANCE_WINDOWS", "%v", err)
+	}
+
+	if c.ES.Retry.MaxAttempts < 1 {
+		add(envPrefix+"ES_RETRY_MAX_ATTEMPTS", "must be at least 1, got %d", c.ES.Retry.MaxAttempts)
+	}
+	if c.ES.Retry.Interval < 0 {
+		add(envPrefix+"ES_RETRY_INTERVAL", "must not be negative, got %s", c.ES.Retry.Interval)
+	}
+	if c.ES.Retry.BackoffMultiplier < 1 {
+		add(envPrefix+"ES_RETRY_BACKOFF_MULTIPLIER", "must be at least 1, got %g", c.ES.Retry.BackoffMultiplier)
+	}
+	if c.ES.RequestTimeout < 0 {
+		add(envPrefix+"ES_REQUEST_TIMEOUT", "must not be negative, got %s", c.ES.RequestTimeout)
+	}
+	if c.ES.Breaker.Threshold < 0 {
+		add(envPrefix+"ES_BREAKER_THRESHOLD", "must not be negative, got %d", c.ES.Breaker.Threshold)
+	}
+	if c.ES.Breaker.Threshold > 0 && c.ES.Breaker.Cooldown <= 0 {
+		add(envPrefix+"ES_BREAKER_COOLDOWN", "must be positive, got %s", c.ES.Breaker.Cooldown)
+	}
+	if c.ES.Retry.MaxInterval < 0 {
+		add(envPrefix+"ES_RETRY_MAX_INTERVAL", "must not be negative, got %s", c.ES.Retry.MaxInterval)
+	}
+	if c.ES.Retry.Jitter < 0 || c.ES.Retry.Jitter > 1 {
+		add(envPrefix+"ES_RETRY_JITTER", "must be between 0 and 1, got %g", c.ES.Retry.Jitter)
+	}
+	if c.ES.Retry.MaxElapsed < 0 {
+		add(envPrefix+"ES_RETRY_MAX_ELAPSED", "must not be negative, got %s", c.ES.Retry.MaxElapsed)
+	}
+	for _, status := range c.ES.Retry.OnStatus {
+		if !validRetryStatus(status) {
+			add(envPrefix+"ES_RETRY_ON_STATUS", "%q is not a status from 400 to 599 or a class such as 5xx", status)
+		}
 	}
 }
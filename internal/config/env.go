@@ -0,0 +1,149 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// envPrefix namespaces every option read from the environment
+const envPrefix = "TRIVELASTIC_"
+
+// Options are declared on the config structs with field tags:
+//
+//	env:"ES_URL"         option name, read from TRIVELASTIC_ES_URL
+//	alias:"ES_URL"       comma-separated legacy names checked when the namespaced variable is unset
+//	default:"8080"       value used when no variable is set
+//	required:"true"      the option must be set
+//
+// Nested structs are walked recursively. Fields without an env tag are
+// derived after loading and are left untouched.
+
+// envSource records which variable an option was read from
+type envSource struct {
+	Option   string
+	Variable string
+}
+
+// loadEnv populates target, a pointer to a struct, from env. It
+// returns the variables that were used and records missing or malformed
+// options in problems.
+func loadEnv(target interface{}, env environment, problems *ValidationError) []envSource {
+	var sources []envSource
+
+	var walk func(v reflect.Value)
+	walk = func(v reflect.Value) {
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			field, value := t.Field(i), v.Field(i)
+
+			name, ok := field.Tag.Lookup("env")
+			if !ok {
+				if field.Type.Kind() == reflect.Struct && field.Type != reflect.TypeOf(time.Duration(0)) {
+					walk(value)
+				}
+				continue
+			}
+
+			raw, variable, found := env.lookup(name, field.Tag.Get("alias"))
+			if !found {
+				if def, ok := field.Tag.Lookup("default"); ok {
+					raw, variable = def, "default"
+				} else {
+					if field.Tag.Get("required") == "true" {
+						problems.add(envPrefix+name, "required but not set")
+					}
+					continue
+				}
+			}
+
+			if err := setField(value, raw); err != nil {
+				problems.add(envPrefix+name, "%v", err)
+				continue
+			}
+			sources = append(sources, envSource{Option: envPrefix + name, Variable: variable})
+		}
+	}
+	walk(reflect.ValueOf(target).Elem())
+
+	return sources
+}
+
+// setField converts raw into the field's type
+func setField(v reflect.Value, raw string) error {
+	if v.Type() == reflect.TypeOf(time.Duration(0)) {
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(raw)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("unsupported slice type %s", v.Type())
+		}
+		v.Set(reflect.ValueOf(splitList(raw)))
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String || v.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("unsupported map type %s", v.Type())
+		}
+		m, err := parseMap(raw)
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(m))
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+// parseMap parses a list such as "CRITICAL=trivy-hot,HIGH=trivy-hot"
+func parseMap(value string) (map[string]string, error) {
+	result := make(map[string]string)
+	for _, entry := range splitList(value) {
+		key, val, ok := strings.Cut(entry, "=")
+		key, val = strings.TrimSpace(key), strings.TrimSpace(val)
+		if !ok || key == "" || val == "" {
+			return nil, fmt.Errorf("invalid entry %q, expected key=value", entry)
+		}
+		result[key] = val
+	}
+	return result, nil
+}
+
+// splitList splits a comma-separated value, dropping empty entries
+func splitList(value string) []string {
+	result := make([]string, 0)
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			result = append(result, item)
+		}
+	}
+	return result
+}
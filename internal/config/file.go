@@ -0,0 +1,82 @@
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// environment looks up option variables in the process environment and,
+// when TRIVELASTIC_CONFIG_FILE is set, in that file. Variables set in the
+// environment take precedence over the file.
+type environment struct {
+	path string
+	file map[string]string
+}
+
+// newEnvironment reads the configuration file named by TRIVELASTIC_CONFIG_FILE, if any
+func newEnvironment() (environment, error) {
+	env := environment{path: os.Getenv(envPrefix + "CONFIG_FILE")}
+	if env.path == "" {
+		return env, nil
+	}
+
+	file, err := readConfigFile(env.path)
+	if err != nil {
+		return env, err
+	}
+	env.file = file
+	return env, nil
+}
+
+// lookup reads the namespaced variable, falling back to its aliases. It
+// returns the value and where it was read from.
+func (e environment) lookup(name, aliases string) (string, string, bool) {
+	names := append([]string{envPrefix + name}, splitList(aliases)...)
+	for _, n := range names {
+		if value := os.Getenv(n); value != "" {
+			return value, n, true
+		}
+	}
+	for _, n := range names {
+		if value := e.file[n]; value != "" {
+			return value, e.path + ":" + n, true
+		}
+	}
+	return "", "", false
+}
+
+// readConfigFile parses a file of NAME=value lines, such as a mounted
+// ConfigMap. Blank lines and lines starting with # are ignored, and values
+// may be wrapped in single or double quotes.
+func readConfigFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		name, value, ok := strings.Cut(strings.TrimPrefix(text, "export "), "=")
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("%s:%d: expected NAME=value", path, line)
+		}
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		values[name] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return values, nil
+}
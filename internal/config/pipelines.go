@@ -0,0 +1,102 @@
+package config
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Sanitization profiles
+const (
+	// SanitizeDefault drops empty values and keys Elasticsearch cannot index
+	SanitizeDefault = "default"
+	// SanitizeMinimal only drops keys Elasticsearch cannot index
+	SanitizeMinimal = "minimal"
+	// SanitizeNone forwards payloads unchanged
+	SanitizeNone = "none"
+)
+
+var pipelineNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// PipelineConfig describes a named ingest pipeline served on its own path
+type PipelineConfig struct {
+	Name            string `json:"name"`
+	Path            string `json:"path"`
+	Index           string `json:"index"`
+	SanitizeProfile string `json:"sanitize_profile"`
+}
+
+// loadPipelines reads the named pipelines listed in TRIVELASTIC_PIPELINES,
+// e.g. "image,fs,iac". Each pipeline reads its options from
+// TRIVELASTIC_PIPELINE_<NAME>_PATH (default /pipelines/<name>),
+// TRIVELASTIC_PIPELINE_<NAME>_INDEX (default: the Elasticsearch index) and
+// TRIVELASTIC_PIPELINE_<NAME>_SANITIZE_PROFILE (default, minimal or none).
+func loadPipelines(env environment, defaultIndex string, problems *ValidationError) []PipelineConfig {
+	names, _, _ := env.lookup("PIPELINES", "")
+
+	pipelines := make([]PipelineConfig, 0)
+	seenPaths := make(map[string]string)
+	for _, name := range splitList(names) {
+		if !pipelineNamePattern.MatchString(name) {
+			problems.add(envPrefix+"PIPELINES", "invalid pipeline name %q", name)
+			continue
+		}
+
+		prefix := "PIPELINE_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_"
+		p := PipelineConfig{
+			Name:            name,
+			Path:            "/pipelines/" + name,
+			Index:           defaultIndex,
+			SanitizeProfile: SanitizeDefault,
+		}
+		if value, _, ok := env.lookup(prefix+"PATH", ""); ok {
+			p.Path = value
+		}
+		if value, _, ok := env.lookup(prefix+"INDEX", ""); ok {
+			p.Index = value
+		}
+		if value, _, ok := env.lookup(prefix+"SANITIZE_PROFILE", ""); ok {
+			p.SanitizeProfile = value
+		}
+
+		valid := true
+		if !strings.HasPrefix(p.Path, "/") || p.Path == "/" {
+			problems.add(envPrefix+prefix+"PATH", "must be an absolute path other than /, got %q", p.Path)
+			valid = false
+		} else if strings.HasPrefix(p.Path, "/api/") || strings.HasPrefix(p.Path, "/admin/") || versionedPath(p.Path) {
+			problems.add(envPrefix+prefix+"PATH", "%q is reserved for built-in endpoints", p.Path)
+			valid = false
+		} else if strings.HasSuffix(p.Path, "/_batch") || strings.HasSuffix(p.Path, "/_upload") {
+			problems.add(envPrefix+prefix+"PATH", "%q is reserved for the batches and uploads of pipelines", p.Path)
+			valid = false
+		} else if other, ok := seenPaths[p.Path]; ok {
+			problems.add(envPrefix+prefix+"PATH", "%q is already used by pipeline %q", p.Path, other)
+			valid = false
+		}
+		seenPaths[p.Path] = name
+
+		switch p.SanitizeProfile {
+		case SanitizeDefault, SanitizeMinimal, SanitizeNone:
+		default:
+			problems.add(envPrefix+prefix+"SANITIZE_PROFILE", "unknown profile %q, expected default, minimal or none", p.SanitizeProfile)
+			valid = false
+		}
+
+		if valid {
+			pipelines = append(pipelines, p)
+		}
+	}
+
+	return pipelines
+}
+
+// versionedPath tells whether path is under a version of the ingest API,
+// such as /v1/ or a later /v2/
+func versionedPath(path string) bool {
+	version, _, _ := strings.Cut(strings.TrimPrefix(path, "/"), "/")
+	if len(version) < 2 || version[0] != 'v' {
+		return false
+	}
+	_, err := strconv.Atoi(version[1:])
+	return err == nil
+}
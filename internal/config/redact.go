@@ -0,0 +1,19 @@
+package config
+
+import "reflect"
+
+const redactedValue = "[REDACTED]"
+
+// Redacted returns a copy of the configuration that is safe to expose, with
+// every option tagged secret:"true" replaced by a placeholder. Empty secrets
+// are left visible so that missing values can still be spotted.
+func (c *Config) Redacted() *Config {
+	redacted := *c
+
+	walkSecrets(reflect.ValueOf(&redacted).Elem(), func(_ string, v reflect.Value) error {
+		v.SetString(redactedValue)
+		return nil
+	})
+
+	return &redacted
+}
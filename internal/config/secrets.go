@@ -0,0 +1,126 @@
+package config
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// secretResolveTimeout bounds how long startup waits for all secret providers
+const secretResolveTimeout = 30 * time.Second
+
+// SecretProvider resolves references to secrets held in an external store.
+// Options tagged secret:"true" whose value matches a provider are replaced by
+// the resolved secret when the configuration is loaded.
+type SecretProvider interface {
+	// Name identifies the provider in logs and errors
+	Name() string
+	// Matches reports whether ref is a reference handled by this provider
+	Matches(ref string) bool
+	// Resolve fetches the secret value for ref
+	Resolve(ctx context.Context, ref string) (string, error)
+}
+
+var (
+	secretProvidersMu sync.RWMutex
+	secretProviders   []SecretProvider
+)
+
+// RegisterSecretProvider makes a provider available to Load. Providers are
+// consulted in registration order and the first match wins.
+func RegisterSecretProvider(p SecretProvider) {
+	secretProvidersMu.Lock()
+	defer secretProvidersMu.Unlock()
+
+	secretProviders = append(secretProviders, p)
+}
+
+func init() {
+	RegisterSecretProvider(fileSecretProvider{})
+	RegisterSecretProvider(newAWSSecretsManagerProvider())
+	RegisterSecretProvider(newGCPSecretManagerProvider())
+}
+
+// resolvedSecret records which provider resolved an option
+type resolvedSecret struct {
+	Option   string
+	Provider string
+	Ref      string
+}
+
+// resolveSecrets replaces secret references in target with their values
+func resolveSecrets(ctx context.Context, target interface{}) ([]resolvedSecret, error) {
+	secretProvidersMu.RLock()
+	providers := append([]SecretProvider(nil), secretProviders...)
+	secretProvidersMu.RUnlock()
+
+	var resolved []resolvedSecret
+	err := walkSecrets(reflect.ValueOf(target).Elem(), func(name string, v reflect.Value) error {
+		ref := v.String()
+		for _, p := range providers {
+			if !p.Matches(ref) {
+				continue
+			}
+			value, err := p.Resolve(ctx, ref)
+			if err != nil {
+				return fmt.Errorf("%s%s: %s: %w", envPrefix, name, p.Name(), err)
+			}
+			v.SetString(value)
+			resolved = append(resolved, resolvedSecret{Option: envPrefix + name, Provider: p.Name(), Ref: ref})
+			return nil
+		}
+		return nil
+	})
+	return resolved, err
+}
+
+// walkSecrets calls fn for every string field tagged secret:"true"
+func walkSecrets(v reflect.Value, fn func(name string, v reflect.Value) error) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field, value := t.Field(i), v.Field(i)
+		if field.Type.Kind() == reflect.Struct {
+			if err := walkSecrets(value, fn); err != nil {
+				return err
+			}
+			continue
+		}
+		if field.Tag.Get("secret") != "true" || field.Type.Kind() != reflect.String || value.String() == "" {
+			continue
+		}
+		if err := fn(field.Tag.Get("env"), value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// splitSecretKey separates an optional "#key" suffix from a reference. The
+// key selects a field when the stored secret is a JSON object.
+func splitSecretKey(ref string) (string, string) {
+	if i := strings.LastIndex(ref, "#"); i >= 0 {
+		return ref[:i], ref[i+1:]
+	}
+	return ref, ""
+}
+
+// selectSecretKey returns the named field of a JSON secret, or the secret itself when key is empty
+func selectSecretKey(secret, key string) (string, error) {
+	if key == "" {
+		return secret, nil
+	}
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(secret), &fields); err != nil {
+		return "", fmt.Errorf("secret is not a JSON object, cannot select key %q", key)
+	}
+	value, ok := fields[key].(string)
+	if !ok {
+		return "", fmt.Errorf("secret has no string key %q", key)
+	}
+	return value, nil
+}
@@ -0,0 +1,96 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/truemilk/trivelastic/internal/awsauth"
+)
+
+// awsSecretsManagerProvider resolves AWS Secrets Manager ARNs such as
+// arn:aws:secretsmanager:eu-west-1:123456789012:secret:trivelastic-AbCdEf#api_key
+// using credentials from the environment, IRSA or EKS Pod Identity.
+type awsSecretsManagerProvider struct {
+	client *http.Client
+	creds  *awsauth.CredentialsProvider
+}
+
+func newAWSSecretsManagerProvider() *awsSecretsManagerProvider {
+	client := &http.Client{Timeout: 10 * time.Second}
+	return &awsSecretsManagerProvider{
+		client: client,
+		creds:  awsauth.NewCredentialsProvider(client),
+	}
+}
+
+func (p *awsSecretsManagerProvider) Name() string {
+	return "aws-secrets-manager"
+}
+
+func (p *awsSecretsManagerProvider) Matches(ref string) bool {
+	return strings.HasPrefix(ref, "arn:aws:secretsmanager:") ||
+		strings.HasPrefix(ref, "arn:aws-cn:secretsmanager:") ||
+		strings.HasPrefix(ref, "arn:aws-us-gov:secretsmanager:")
+}
+
+func (p *awsSecretsManagerProvider) Resolve(ctx context.Context, ref string) (string, error) {
+	arn, key := splitSecretKey(ref)
+
+	// arn:partition:secretsmanager:region:account:secret:name
+	parts := strings.SplitN(arn, ":", 7)
+	if len(parts) != 7 || parts[3] == "" {
+		return "", fmt.Errorf("malformed secret ARN %q", arn)
+	}
+	region := parts[3]
+
+	creds, err := p.creds.Retrieve(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	body, err := json.Marshal(map[string]string{"SecretId": arn})
+	if err != nil {
+		return "", err
+	}
+
+	endpoint := fmt.Sprintf("https://secretsmanager.%s.amazonaws.com/", region)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return "", fmt.Errorf("error creating request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "secretsmanager.GetSecretValue")
+	awsauth.Sign(req, body, creds, region, "secretsmanager", time.Now())
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("error sending request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("error reading response: %w", err)
+	}
+	if resp.StatusCode >= 400 {
+		return "", fmt.Errorf("GetSecretValue failed: status=%d, response=%s", resp.StatusCode, string(respBody))
+	}
+
+	var out struct {
+		SecretString string `json:"SecretString"`
+	}
+	if err := json.Unmarshal(respBody, &out); err != nil {
+		return "", fmt.Errorf("error decoding response: %w", err)
+	}
+	if out.SecretString == "" {
+		return "", fmt.Errorf("secret %q has no string value", arn)
+	}
+
+	return selectSecretKey(out.SecretString, key)
+}
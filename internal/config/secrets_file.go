@@ -0,0 +1,37 @@
+package config
+
+import (
+	"context"
+	"os"
+	"strings"
+)
+
+// fileSecretPrefix marks secret references read from a file, typically a
+// mounted Kubernetes Secret, e.g. file:/etc/trivelastic/secrets/api-key
+const fileSecretPrefix = "file:"
+
+// fileSecretProvider reads secrets from local files. Trailing newlines are
+// trimmed; a "#key" suffix selects a field of a JSON file.
+type fileSecretProvider struct{}
+
+func (fileSecretProvider) Name() string {
+	return "file"
+}
+
+func (fileSecretProvider) Matches(ref string) bool {
+	return strings.HasPrefix(ref, fileSecretPrefix)
+}
+
+func (fileSecretProvider) Resolve(_ context.Context, ref string) (string, error) {
+	path, key := splitSecretKey(secretFilePath(ref))
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return selectSecretKey(strings.TrimRight(string(data), "\r\n"), key)
+}
+
+// secretFilePath returns the path referenced by a file: secret, including any "#key" suffix
+func secretFilePath(ref string) string {
+	return strings.TrimPrefix(ref, fileSecretPrefix)
+}
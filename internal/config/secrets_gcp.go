@@ -0,0 +1,116 @@
+package config
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	gcpMetadataTokenURL = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+	gcpSecretManagerURL = "https://secretmanager.googleapis.com/v1/"
+)
+
+// gcpSecretManagerProvider resolves GCP Secret Manager resource names such as
+// projects/my-project/secrets/trivelastic/versions/latest#api_key using the
+// service account of the GKE workload (Workload Identity) via the metadata server.
+type gcpSecretManagerProvider struct {
+	client *http.Client
+}
+
+func newGCPSecretManagerProvider() *gcpSecretManagerProvider {
+	return &gcpSecretManagerProvider{
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (p *gcpSecretManagerProvider) Name() string {
+	return "gcp-secret-manager"
+}
+
+func (p *gcpSecretManagerProvider) Matches(ref string) bool {
+	parts := strings.Split(ref, "/")
+	return len(parts) >= 4 && parts[0] == "projects" && parts[2] == "secrets"
+}
+
+func (p *gcpSecretManagerProvider) Resolve(ctx context.Context, ref string) (string, error) {
+	name, key := splitSecretKey(ref)
+	if !strings.Contains(name, "/versions/") {
+		name += "/versions/latest"
+	}
+
+	token, err := p.accessToken(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, gcpSecretManagerURL+name+":access", nil)
+	if err != nil {
+		return "", fmt.Errorf("error creating request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	body, err := p.do(req)
+	if err != nil {
+		return "", fmt.Errorf("access %s: %w", name, err)
+	}
+
+	var out struct {
+		Payload struct {
+			Data string `json:"data"`
+		} `json:"payload"`
+	}
+	if err := json.Unmarshal(body, &out); err != nil {
+		return "", fmt.Errorf("error decoding response: %w", err)
+	}
+
+	data, err := base64.StdEncoding.DecodeString(out.Payload.Data)
+	if err != nil {
+		return "", fmt.Errorf("error decoding secret payload: %w", err)
+	}
+
+	return selectSecretKey(string(data), key)
+}
+
+func (p *gcpSecretManagerProvider) accessToken(ctx context.Context) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, gcpMetadataTokenURL, nil)
+	if err != nil {
+		return "", fmt.Errorf("error creating metadata request: %w", err)
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+
+	body, err := p.do(req)
+	if err != nil {
+		return "", fmt.Errorf("metadata token: %w", err)
+	}
+
+	var out struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.Unmarshal(body, &out); err != nil {
+		return "", fmt.Errorf("error decoding metadata token: %w", err)
+	}
+	return out.AccessToken, nil
+}
+
+func (p *gcpSecretManagerProvider) do(req *http.Request) ([]byte, error) {
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error sending request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading response: %w", err)
+	}
+	if resp.StatusCode >= 400 {
+		return nil, fmt.Errorf("status=%d, response=%s", resp.StatusCode, string(body))
+	}
+	return body, nil
+}
@@ -0,0 +1,41 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Problem is a single invalid or missing option
+type Problem struct {
+	Option  string `json:"option"`
+	Message string `json:"message"`
+}
+
+// ValidationError lists every problem found while loading the configuration,
+// so that operators can fix all of them in one go
+type ValidationError struct {
+	Problems []Problem `json:"problems"`
+}
+
+func (e *ValidationError) Error() string {
+	lines := make([]string, 0, len(e.Problems))
+	for _, p := range e.Problems {
+		lines = append(lines, p.Option+": "+p.Message)
+	}
+	return fmt.Sprintf("invalid configuration (%d problems): %s", len(e.Problems), strings.Join(lines, "; "))
+}
+
+func (e *ValidationError) add(option, format string, args ...interface{}) {
+	e.Problems = append(e.Problems, Problem{
+		Option:  option,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// orNil returns e as an error, or nil when no problem was recorded
+func (e *ValidationError) orNil() error {
+	if len(e.Problems) == 0 {
+		return nil
+	}
+	return e
+}
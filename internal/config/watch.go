@@ -0,0 +1,81 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/truemilk/trivelastic/internal/logger"
+)
+
+// reloadDebounce groups the burst of events produced by a single update
+const reloadDebounce = time.Second
+
+// Watch calls reload after any of files changes, until ctx is done.
+// Kubernetes updates mounted ConfigMaps and Secrets by swapping the ..data
+// symlink in the mount directory, so the parent directories are watched
+// rather than the files themselves.
+func Watch(ctx context.Context, files []string, reload func()) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("error creating file watcher: %w", err)
+	}
+
+	// Only events on the files or on the Kubernetes ..data symlink trigger a reload
+	relevant := make(map[string]bool)
+	dirs := make(map[string]bool)
+	for _, file := range files {
+		file = filepath.Clean(file)
+		dir := filepath.Dir(file)
+		relevant[file] = true
+		relevant[filepath.Join(dir, "..data")] = true
+		if dirs[dir] {
+			continue
+		}
+		if err := watcher.Add(dir); err != nil {
+			watcher.Close()
+			return fmt.Errorf("error watching %s: %w", dir, err)
+		}
+		dirs[dir] = true
+	}
+
+	log := logger.GetLogger("config")
+	go func() {
+		defer watcher.Close()
+
+		timer := time.NewTimer(reloadDebounce)
+		timer.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if !relevant[filepath.Clean(event.Name)] {
+					continue
+				}
+				log.Debug().
+					Str("file", event.Name).
+					Str("op", event.Op.String()).
+					Msg("Configuration file event")
+				timer.Reset(reloadDebounce)
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Warn().
+					Err(err).
+					Msg("Configuration file watcher error")
+			case <-timer.C:
+				reload()
+			}
+		}
+	}()
+
+	return nil
+}
@@ -0,0 +1,287 @@
+// Package diff compares each report with the last indexed report of the same
+// artifact, so that only the vulnerabilities that changed are indexed
+package diff
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/truemilk/trivelastic/internal/elasticsearch"
+	"github.com/truemilk/trivelastic/internal/logger"
+)
+
+// Changes recorded under "diff.change" on the vulnerabilities of a delta
+const (
+	ChangeNew      = "new"
+	ChangeFixed    = "fixed"
+	ChangeSeverity = "severity_changed"
+)
+
+// metadataField holds trivelastic's own annotations on indexed documents
+const metadataField = "_trivelastic"
+
+// Vulnerability is a vulnerability as remembered between reports
+type Vulnerability struct {
+	Target           string `json:"target"`
+	Class            string `json:"class,omitempty"`
+	Type             string `json:"type,omitempty"`
+	VulnerabilityID  string `json:"vulnerability_id"`
+	PkgName          string `json:"pkg_name,omitempty"`
+	InstalledVersion string `json:"installed_version,omitempty"`
+	Severity         string `json:"severity,omitempty"`
+}
+
+// key identifies a vulnerability across reports. The installed version is
+// left out so that upgrading a package that stays vulnerable is not
+// reported as a fix and a new vulnerability.
+func (v Vulnerability) key() string {
+	return v.Target + "\x00" + v.PkgName + "\x00" + v.VulnerabilityID
+}
+
+// State is the set of vulnerabilities last indexed for an artifact
+type State struct {
+	ArtifactName    string          `json:"artifact_name"`
+	ScannedAt       string          `json:"scanned_at,omitempty"`
+	UpdatedAt       string          `json:"updated_at"`
+	Vulnerabilities []Vulnerability `json:"vulnerabilities"`
+}
+
+// Delta is a report reduced to the changes since the previous report of its
+// artifact. Commit it once the report is indexed.
+type Delta struct {
+	Report  map[string]interface{}
+	id      string
+	state   State
+	tracker *Tracker
+}
+
+// Tracker keeps the last indexed vulnerabilities of every artifact in a
+// dedicated index, one document per artifact name
+type Tracker struct {
+	es    *elasticsearch.Client
+	index string
+	log   zerolog.Logger
+}
+
+func NewTracker(es *elasticsearch.Client, index string) *Tracker {
+	return &Tracker{
+		es:    es,
+		index: index,
+		log:   logger.GetLogger("diff"),
+	}
+}
+
+// Diff compares report with the last committed state of its artifact. The
+// delta report keeps the vulnerabilities that are new or whose severity
+// changed, adds those that were fixed, and summarizes the comparison under
+// _trivelastic.diff. Packages and unchanged vulnerabilities are dropped;
+// other findings are kept as they are. Reports without an artifact name are
+// not diffed and Diff returns nil.
+func (t *Tracker) Diff(ctx context.Context, report map[string]interface{}) (*Delta, error) {
+	artifact, _ := report["ArtifactName"].(string)
+	if artifact == "" {
+		return nil, nil
+	}
+	sum := sha256.Sum256([]byte(artifact))
+	id := hex.EncodeToString(sum[:])
+
+	source, err := t.es.Get(ctx, t.index, id)
+	if err != nil {
+		return nil, fmt.Errorf("error reading previous report of %s: %w", artifact, err)
+	}
+	var previous *State
+	if source != nil {
+		previous = &State{}
+		if err := remarshal(source, previous); err != nil {
+			return nil, fmt.Errorf("error decoding previous report of %s: %w", artifact, err)
+		}
+	}
+	before := map[string]Vulnerability{}
+	if previous != nil {
+		for _, v := range previous.Vulnerabilities {
+			before[v.key()] = v
+		}
+	}
+
+	state := State{
+		ArtifactName: artifact,
+		UpdatedAt:    time.Now().UTC().Format(time.RFC3339),
+	}
+	state.ScannedAt, _ = report["CreatedAt"].(string)
+
+	counts := map[string]int{ChangeNew: 0, ChangeFixed: 0, ChangeSeverity: 0}
+	unchanged := 0
+	seen := map[string]bool{}
+	var results []interface{}
+	byTarget := map[string]map[string]interface{}{}
+	items, _ := report["Results"].([]interface{})
+	for _, item := range items {
+		result, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		target, _ := result["Target"].(string)
+		class, _ := result["Class"].(string)
+		typ, _ := result["Type"].(string)
+
+		reduced := make(map[string]interface{}, len(result))
+		for k, v := range result {
+			if k != "Packages" && k != "Vulnerabilities" {
+				reduced[k] = v
+			}
+		}
+		vulns, _ := result["Vulnerabilities"].([]interface{})
+		var changed []interface{}
+		for _, item := range vulns {
+			vuln, ok := item.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			v := Vulnerability{Target: target, Class: class, Type: typ}
+			v.VulnerabilityID, _ = vuln["VulnerabilityID"].(string)
+			v.PkgName, _ = vuln["PkgName"].(string)
+			v.InstalledVersion, _ = vuln["InstalledVersion"].(string)
+			v.Severity, _ = vuln["Severity"].(string)
+			state.Vulnerabilities = append(state.Vulnerabilities, v)
+			seen[v.key()] = true
+
+			change := map[string]interface{}{}
+			old, ok := before[v.key()]
+			switch {
+			case !ok:
+				change["change"] = ChangeNew
+				counts[ChangeNew]++
+			case old.Severity != v.Severity:
+				change["change"] = ChangeSeverity
+				change["previous_severity"] = old.Severity
+				counts[ChangeSeverity]++
+			default:
+				unchanged++
+				continue
+			}
+			changed = append(changed, withField(vuln, "diff", change))
+		}
+		if changed != nil {
+			reduced["Vulnerabilities"] = changed
+		}
+
+		// Results only holding unchanged vulnerabilities are dropped
+		if hasFindings(reduced) {
+			results = append(results, reduced)
+			byTarget[target] = reduced
+		}
+	}
+
+	// Vulnerabilities of the previous report missing from this one were fixed
+	if previous != nil {
+		for _, v := range previous.Vulnerabilities {
+			if seen[v.key()] {
+				continue
+			}
+			seen[v.key()] = true
+			result, ok := byTarget[v.Target]
+			if !ok {
+				result = nonEmpty(map[string]interface{}{"Target": v.Target, "Class": v.Class, "Type": v.Type})
+				results = append(results, result)
+				byTarget[v.Target] = result
+			}
+			list, _ := result["Vulnerabilities"].([]interface{})
+			result["Vulnerabilities"] = append(list, nonEmpty(map[string]interface{}{
+				"VulnerabilityID":  v.VulnerabilityID,
+				"PkgName":          v.PkgName,
+				"InstalledVersion": v.InstalledVersion,
+				"Severity":         v.Severity,
+				"diff":             map[string]interface{}{"change": ChangeFixed},
+			}))
+			counts[ChangeFixed]++
+		}
+	}
+
+	delta := make(map[string]interface{}, len(report))
+	for k, v := range report {
+		if k != "Results" {
+			delta[k] = v
+		}
+	}
+	if results != nil {
+		delta["Results"] = results
+	}
+	summary := map[string]interface{}{
+		ChangeNew:      counts[ChangeNew],
+		ChangeFixed:    counts[ChangeFixed],
+		ChangeSeverity: counts[ChangeSeverity],
+		"unchanged":    unchanged,
+	}
+	if previous != nil && previous.ScannedAt != "" {
+		summary["previous_scan"] = previous.ScannedAt
+	}
+	meta, _ := report[metadataField].(map[string]interface{})
+	delta[metadataField] = withField(meta, "diff", summary)
+
+	t.log.Debug().
+		Str("artifact_name", artifact).
+		Int("new", counts[ChangeNew]).
+		Int("fixed", counts[ChangeFixed]).
+		Int("severity_changed", counts[ChangeSeverity]).
+		Int("unchanged", unchanged).
+		Msg("Report diffed")
+
+	return &Delta{Report: delta, id: id, state: state, tracker: t}, nil
+}
+
+// Commit makes the vulnerabilities of the report the baseline of the next
+// report of the same artifact
+func (d *Delta) Commit(ctx context.Context) error {
+	doc := map[string]interface{}{}
+	if err := remarshal(d.state, &doc); err != nil {
+		return err
+	}
+	_, err := d.tracker.es.IndexWithOptions(ctx, d.tracker.index, elasticsearch.IndexOptions{ID: d.id}, doc)
+	return err
+}
+
+// remarshal converts between a decoded JSON document and a struct
+func remarshal(from, to interface{}) error {
+	data, err := json.Marshal(from)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, to)
+}
+
+// hasFindings reports whether a result holds anything besides the fields identifying it
+func hasFindings(result map[string]interface{}) bool {
+	for k := range result {
+		if k != "Target" && k != "Class" && k != "Type" {
+			return true
+		}
+	}
+	return false
+}
+
+// nonEmpty returns the fields of m that are not empty strings
+func nonEmpty(m map[string]interface{}) map[string]interface{} {
+	result := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		if s, ok := v.(string); ok && s == "" {
+			continue
+		}
+		result[k] = v
+	}
+	return result
+}
+
+// withField returns a shallow copy of m with key set to value
+func withField(m map[string]interface{}, key string, value interface{}) map[string]interface{} {
+	result := make(map[string]interface{}, len(m)+1)
+	for k, v := range m {
+		result[k] = v
+	}
+	result[key] = value
+	return result
+}
@@ -0,0 +1,126 @@
+package diff
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/truemilk/trivelastic/internal/config"
+	"github.com/truemilk/trivelastic/internal/elasticsearch"
+)
+
+// fakeCluster stores documents by path. Written documents are returned by
+// realtime GETs straight away, but never by searches, as if the index had
+// not refreshed yet.
+type fakeCluster struct {
+	mu   sync.Mutex
+	docs map[string]json.RawMessage
+}
+
+func (f *fakeCluster) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("X-Elastic-Product", "Elasticsearch")
+	w.Header().Set("Content-Type", "application/json")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/_search"):
+		w.Write([]byte(`{"hits":{"hits":[]}}`))
+	case r.Method == http.MethodPut:
+		body, _ := io.ReadAll(r.Body)
+		f.docs[r.URL.Path] = body
+		w.Write([]byte(`{"result":"created"}`))
+	case r.Method == http.MethodGet:
+		doc, ok := f.docs[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"found":false}`))
+			return
+		}
+		w.Write([]byte(`{"found":true,"_source":` + string(doc) + `}`))
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// report returns a report of alpine with the given vulnerabilities
+func report(createdAt string, ids ...string) map[string]interface{} {
+	vulns := []interface{}{}
+	for _, id := range ids {
+		vulns = append(vulns, map[string]interface{}{"VulnerabilityID": id, "PkgName": "openssl", "Severity": "HIGH"})
+	}
+	return map[string]interface{}{
+		"ArtifactName": "alpine:3.19",
+		"CreatedAt":    createdAt,
+		"Results":      []interface{}{map[string]interface{}{"Target": "alpine", "Vulnerabilities": vulns}},
+	}
+}
+
+func TestDiffBackToBack(t *testing.T) {
+	srv := httptest.NewServer(&fakeCluster{docs: map[string]json.RawMessage{}})
+	defer srv.Close()
+	es, err := elasticsearch.NewClient(&config.ElasticsearchConfig{
+		URLs:  []string{srv.URL},
+		Retry: config.RetryConfig{MaxAttempts: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracker := NewTracker(es, "trivy-diff")
+	ctx := context.Background()
+
+	first, err := tracker.Diff(ctx, report("2026-10-16T10:00:00Z", "CVE-1", "CVE-2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := first.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// Sent straight after the first one, before any refresh
+	second, err := tracker.Diff(ctx, report("2026-10-16T10:00:01Z", "CVE-2", "CVE-3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, _ := second.Report[metadataField].(map[string]interface{})
+	summary, _ := meta["diff"].(map[string]interface{})
+	want := map[string]interface{}{
+		ChangeNew:       1,
+		ChangeFixed:     1,
+		ChangeSeverity:  0,
+		"unchanged":     1,
+		"previous_scan": "2026-10-16T10:00:00Z",
+	}
+	for k, v := range want {
+		if summary[k] != v {
+			t.Errorf("expected %s %v, got %v", k, v, summary[k])
+		}
+	}
+}
+
+func TestDiffFirstReport(t *testing.T) {
+	srv := httptest.NewServer(&fakeCluster{docs: map[string]json.RawMessage{}})
+	defer srv.Close()
+	es, err := elasticsearch.NewClient(&config.ElasticsearchConfig{
+		URLs:  []string{srv.URL},
+		Retry: config.RetryConfig{MaxAttempts: 3},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A missing previous report is not an error, nor retried
+	delta, err := NewTracker(es, "trivy-diff").Diff(context.Background(), report("2026-10-16T10:00:00Z", "CVE-1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, _ := delta.Report[metadataField].(map[string]interface{})
+	summary, _ := meta["diff"].(map[string]interface{})
+	if summary[ChangeNew] != 1 || summary["previous_scan"] != nil {
+		t.Fatalf("expected every vulnerability new, got %v", summary)
+	}
+}
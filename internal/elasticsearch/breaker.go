@@ -0,0 +1,116 @@
+package elasticsearch
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/truemilk/trivelastic/internal/config"
+	"github.com/truemilk/trivelastic/internal/logger"
+)
+
+// ErrCircuitOpen is returned without contacting the cluster while the
+// circuit breaker is open
+var ErrCircuitOpen = errors.New("circuit breaker open, Elasticsearch is unavailable")
+
+// breaker stops requests after threshold consecutive outage failures. Once
+// cooldown has passed, a single request is let through as a probe: its
+// success closes the circuit, its failure opens it for another cooldown.
+type breaker struct {
+	threshold int
+	cooldown  time.Duration
+	log       zerolog.Logger
+
+	mu       sync.Mutex
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+func newBreaker(cfg config.BreakerConfig) *breaker {
+	return &breaker{
+		threshold: cfg.Threshold,
+		cooldown:  cfg.Cooldown,
+		log:       logger.GetLogger("circuit_breaker"),
+	}
+}
+
+// allow returns ErrCircuitOpen when a request must not be sent
+func (b *breaker) allow() error {
+	if b.threshold <= 0 {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.failures < b.threshold {
+		return nil
+	}
+	if b.probing || time.Since(b.openedAt) < b.cooldown {
+		return ErrCircuitOpen
+	}
+
+	b.probing = true
+	b.log.Info().Msg("Circuit breaker half-open, probing Elasticsearch")
+	return nil
+}
+
+// record updates the breaker with the outcome of a request
+func (b *breaker) record(err error) {
+	if b.threshold <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// A cancelled request tells nothing about the cluster, let another one probe it
+	if !isOutage(err) && (errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)) {
+		b.probing = false
+		return
+	}
+
+	// Any response that is not an outage shows the cluster is back
+	if !isOutage(err) {
+		if b.failures >= b.threshold {
+			b.log.Info().Msg("Circuit breaker closed, Elasticsearch is available again")
+		}
+		b.failures = 0
+		b.probing = false
+		return
+	}
+
+	b.failures++
+	switch {
+	case b.probing:
+		b.probing = false
+		b.openedAt = time.Now()
+		b.log.Warn().
+			Err(err).
+			Dur("cooldown", b.cooldown).
+			Msg("Circuit breaker probe failed, staying open")
+	case b.failures == b.threshold:
+		b.openedAt = time.Now()
+		b.log.Error().
+			Err(err).
+			Int("failures", b.failures).
+			Dur("cooldown", b.cooldown).
+			Msg("Circuit breaker opened, failing fast")
+	}
+}
+
+// isOutage reports whether err means the cluster is unreachable or failing,
+// as opposed to rejecting a particular request
+func isOutage(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, errNodeUnreachable) {
+		return true
+	}
+	var respErr *responseError
+	return errors.As(err, &respErr) && respErr.StatusCode >= 500
+}
@@ -0,0 +1,71 @@
+package elasticsearch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/truemilk/trivelastic/internal/config"
+)
+
+func TestBreaker(t *testing.T) {
+	outage := fmt.Errorf("connect: %w", errNodeUnreachable)
+	rejected := &responseError{StatusCode: 400}
+
+	tests := []struct {
+		name string
+		// results are recorded in order, nil for a success
+		results []error
+		open    bool
+	}{
+		{name: "below threshold", results: []error{outage, outage}},
+		{name: "opened by consecutive outages", results: []error{outage, outage, outage}, open: true},
+		{name: "server errors are outages", results: []error{&responseError{StatusCode: 503}, outage, outage}, open: true},
+		{name: "reset by a success", results: []error{outage, outage, nil, outage}},
+		{name: "reset by a rejected request", results: []error{outage, outage, rejected, outage}},
+		{name: "cancellations are ignored", results: []error{outage, context.Canceled, outage}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newBreaker(config.BreakerConfig{Threshold: 3, Cooldown: time.Hour})
+			for _, err := range tt.results {
+				b.record(err)
+			}
+			err := b.allow()
+			if open := errors.Is(err, ErrCircuitOpen); open != tt.open {
+				t.Fatalf("expected the circuit open: %t, got %v", tt.open, err)
+			}
+		})
+	}
+}
+
+func TestBreakerProbe(t *testing.T) {
+	b := newBreaker(config.BreakerConfig{Threshold: 1, Cooldown: 10 * time.Millisecond})
+	b.record(errNodeUnreachable)
+	time.Sleep(20 * time.Millisecond)
+
+	// A single request probes the cluster once the cooldown has passed
+	if err := b.allow(); err != nil {
+		t.Fatalf("expected a probe to be allowed, got %v", err)
+	}
+	if err := b.allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expected a single probe, got %v", err)
+	}
+
+	// A failed probe opens the circuit for another cooldown
+	b.record(errNodeUnreachable)
+	if err := b.allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expected the circuit open after a failed probe, got %v", err)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	if err := b.allow(); err != nil {
+		t.Fatalf("expected a second probe, got %v", err)
+	}
+	b.record(nil)
+	if err := b.allow(); err != nil {
+		t.Fatalf("expected the circuit closed after a successful probe, got %v", err)
+	}
+}
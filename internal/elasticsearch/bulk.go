@@ -0,0 +1,404 @@
+package elasticsearch
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/truemilk/trivelastic/internal/config"
+	"github.com/truemilk/trivelastic/internal/indexname"
+	"github.com/truemilk/trivelastic/internal/logger"
+	"github.com/truemilk/trivelastic/internal/metrics"
+)
+
+// BulkIndexer batches documents and writes them with the _bulk API. A batch
+// is flushed when it reaches MaxDocs documents or MaxBytes bytes, or
+// FlushInterval after its first document, whichever comes first. Documents
+// of every worker, single reports and batches alike, share the same batch.
+// IndexInto blocks until the document's batch has been written or its
+// context is done. Documents whose context is done before their batch is
+// flushed are left out of it.
+type BulkIndexer struct {
+	client *Client
+	cfg    config.BulkConfig
+	log    zerolog.Logger
+
+	mu    sync.Mutex
+	batch []*bulkItem
+	size  int
+	timer *time.Timer
+}
+
+// bulkItem is a document waiting in a batch
+type bulkItem struct {
+	ctx    context.Context
+	lines  []byte
+	result chan bulkResult
+}
+
+// bulkResult is the outcome of a document of a batch
+type bulkResult struct {
+	indexed Indexed
+	err     error
+}
+
+func NewBulkIndexer(client *Client, cfg config.BulkConfig) *BulkIndexer {
+	return &BulkIndexer{
+		client: client,
+		cfg:    cfg,
+		log:    logger.GetLogger("bulk_indexer"),
+	}
+}
+
+// IndexInto adds data to the current batch and waits for it to be indexed
+func (b *BulkIndexer) IndexInto(ctx context.Context, index string, data map[string]interface{}) error {
+	_, err := b.IndexWithOptions(ctx, index, IndexOptions{}, data)
+	return err
+}
+
+// IndexWithOptions adds data to the current batch, waits for it to be
+// indexed and returns where it was written
+func (b *BulkIndexer) IndexWithOptions(ctx context.Context, index string, opts IndexOptions, data map[string]interface{}) (Indexed, error) {
+	lines, err := bulkLines(indexname.Resolve(index, time.Now()), opts, data)
+	if err != nil {
+		return Indexed{}, err
+	}
+	item := &bulkItem{ctx: ctx, lines: lines, result: make(chan bulkResult, 1)}
+	if full, reason := b.add(item); full != nil {
+		b.flush(full, reason)
+	}
+	return item.wait()
+}
+
+// add appends item to the current batch and returns the batch when item
+// filled it up, with what triggered the flush
+func (b *BulkIndexer) add(item *bulkItem) ([]*bulkItem, string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.batch = append(b.batch, item)
+	b.size += len(item.lines)
+	switch {
+	case len(b.batch) >= b.cfg.MaxDocs:
+		return b.take(), "docs"
+	case b.size >= b.cfg.MaxBytes:
+		return b.take(), "bytes"
+	case len(b.batch) == 1:
+		b.timer = time.AfterFunc(b.cfg.FlushInterval, b.flushPending)
+	}
+	return nil, ""
+}
+
+// wait returns the result of item once its batch is written
+func (item *bulkItem) wait() (Indexed, error) {
+	select {
+	case result := <-item.result:
+		return result.indexed, result.err
+	case <-item.ctx.Done():
+		return Indexed{}, fmt.Errorf("request cancelled: %w", item.ctx.Err())
+	}
+}
+
+// take empties the current batch. The caller must hold mu.
+func (b *BulkIndexer) take() []*bulkItem {
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	batch := b.batch
+	b.batch, b.size = nil, 0
+	return batch
+}
+
+// flushPending writes the current batch once its flush interval has elapsed
+func (b *BulkIndexer) flushPending() {
+	b.mu.Lock()
+	batch := b.take()
+	b.mu.Unlock()
+
+	if len(batch) > 0 {
+		b.flush(batch, "interval")
+	}
+}
+
+// Close writes the current batch without waiting for its flush interval.
+// Documents added afterwards are still written, in batches of their own.
+func (b *BulkIndexer) Close() {
+	b.mu.Lock()
+	batch := b.take()
+	b.mu.Unlock()
+
+	if len(batch) > 0 {
+		b.flush(batch, "close")
+	}
+}
+
+// flush writes batch with a single _bulk request and reports each document's
+// result. reason is what triggered the flush.
+func (b *BulkIndexer) flush(batch []*bulkItem, reason string) {
+	// Nobody is waiting for documents whose request was cancelled
+	live := batch[:0]
+	for _, item := range batch {
+		if err := item.ctx.Err(); err != nil {
+			item.result <- bulkResult{err: err}
+			continue
+		}
+		live = append(live, item)
+	}
+	batch = live
+	if len(batch) == 0 {
+		return
+	}
+
+	docs := make([][]byte, len(batch))
+	size := 0
+	for i, item := range batch {
+		docs[i] = item.lines
+		size += len(item.lines)
+	}
+
+	b.log.Debug().
+		Int("documents", len(batch)).
+		Int("bytes", size).
+		Str("reason", reason).
+		Msg("Flushing bulk request")
+	metrics.BulkFlushes.Inc(reason)
+	metrics.BulkDocuments.Observe(float64(len(batch)))
+
+	indexed, errs := b.send(batch, docs)
+	failed := 0
+	kinds := map[string]int{}
+	for i, item := range batch {
+		if errs[i] != nil {
+			failed++
+			var itemErr *ItemError
+			if errors.As(errs[i], &itemErr) {
+				kinds[itemErr.Kind()]++
+				b.log.Warn().
+					Str("kind", itemErr.Kind()).
+					Str("index", itemErr.Index).
+					Int("status", itemErr.Status).
+					Str("type", itemErr.Type).
+					Str("reason", itemErr.Reason).
+					Msg("Bulk item failed")
+			}
+		}
+		item.result <- bulkResult{indexed: indexed[i], err: errs[i]}
+	}
+
+	if failed > 0 {
+		b.log.Error().
+			Int("documents", len(batch)).
+			Int("failed", failed).
+			Interface("failures", kinds).
+			Msg("Bulk request had failures")
+		return
+	}
+	b.log.Info().
+		Int("documents", len(batch)).
+		Msg("Bulk request indexed successfully")
+}
+
+// send writes the documents of batch and returns the location and error of
+// every document, in order. It is attempted once when every document is
+// retried by its sender, see WithoutRetries.
+func (b *BulkIndexer) send(batch []*bulkItem, docs [][]byte) ([]Indexed, []error) {
+	// The batch is shared by several requests, so no single one can cancel it
+	ctx := context.Background()
+	retried := true
+	for _, item := range batch {
+		retried = retried && withoutRetries(item.ctx)
+	}
+	if retried {
+		ctx = WithoutRetries(ctx)
+	}
+	return b.client.bulk(ctx, docs)
+}
+
+// IndexBatch adds items to the current batch, flushing it as often as they
+// fill it up, and returns the location and error of every item, in order
+func (b *BulkIndexer) IndexBatch(ctx context.Context, items []BatchItem) ([]Indexed, []error) {
+	indexed := make([]Indexed, len(items))
+	errs := make([]error, len(items))
+	pending := make([]*bulkItem, len(items))
+	for i, item := range items {
+		lines, err := bulkLines(indexname.Resolve(item.Index, time.Now()), item.Options, item.Document)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		pending[i] = &bulkItem{ctx: ctx, lines: lines, result: make(chan bulkResult, 1)}
+		// The rest of the items go on filling the next batch meanwhile
+		if full, reason := b.add(pending[i]); full != nil {
+			go b.flush(full, reason)
+		}
+	}
+	for i, item := range pending {
+		if item != nil {
+			indexed[i], errs[i] = item.wait()
+		}
+	}
+	return indexed, errs
+}
+
+// BatchItem is a document written by IndexBatch
+type BatchItem struct {
+	Index    string
+	Options  IndexOptions
+	Document map[string]interface{}
+}
+
+// IndexBatch writes items with a _bulk request and returns the
+// location and error of every item, in order
+func (c *Client) IndexBatch(ctx context.Context, items []BatchItem) ([]Indexed, []error) {
+	indexed := make([]Indexed, len(items))
+	errs := make([]error, len(items))
+	var docs [][]byte
+	encoded := make([]int, 0, len(items))
+	for i, item := range items {
+		lines, err := bulkLines(indexname.Resolve(item.Index, time.Now()), item.Options, item.Document)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		docs = append(docs, lines)
+		encoded = append(encoded, i)
+	}
+	if len(encoded) == 0 {
+		return indexed, errs
+	}
+	bulkIndexed, bulkErrs := c.bulk(ctx, docs)
+	for j, i := range encoded {
+		indexed[i], errs[i] = bulkIndexed[j], bulkErrs[j]
+	}
+	return indexed, errs
+}
+
+// bulk writes docs, the bulk lines of each document, and returns the
+// location and error of every document, in order. Documents rejected with a
+// retryable status, such as 429 when the cluster is overloaded, are sent
+// again on their own according to the retry policy, as a single document
+// would be.
+func (c *Client) bulk(ctx context.Context, docs [][]byte) ([]Indexed, []error) {
+	indexed := make([]Indexed, len(docs))
+	errs := make([]error, len(docs))
+	pending := make([]int, len(docs))
+	for i := range docs {
+		pending[i] = i
+	}
+	start := time.Now()
+	for attempt := 1; ; attempt++ {
+		var body bytes.Buffer
+		for _, i := range pending {
+			body.Write(docs[i])
+		}
+		sentIndexed, sentErrs := c.bulkRequest(ctx, body.Bytes(), len(pending))
+
+		var retry []int
+		var lastErr error
+		for j, i := range pending {
+			indexed[i], errs[i] = sentIndexed[j], sentErrs[j]
+			var itemErr *ItemError
+			if errors.As(sentErrs[j], &itemErr) && c.retry.cfg.Retryable(itemErr.Status) {
+				retry = append(retry, i)
+				lastErr = sentErrs[j]
+			}
+		}
+		if len(retry) == 0 || withoutRetries(ctx) {
+			return indexed, errs
+		}
+		wait, ok := c.retry.next(attempt, start, lastErr)
+		if !ok {
+			return indexed, errs
+		}
+
+		c.log.Warn().
+			Err(lastErr).
+			Int("documents", len(retry)).
+			Int("attempt", attempt).
+			Int("max_attempts", c.retry.maxAttempts).
+			Msg("Retrying rejected bulk items")
+		metrics.ESRetries.Inc()
+		select {
+		case <-ctx.Done():
+			return indexed, errs
+		case <-time.After(wait):
+		}
+		pending = retry
+	}
+}
+
+// bulkRequest performs a _bulk request of count documents and returns the
+// location and error of every document, in order
+func (c *Client) bulkRequest(ctx context.Context, body []byte, count int) ([]Indexed, []error) {
+	indexed := make([]Indexed, count)
+	errs := make([]error, count)
+	fail := func(err error) ([]Indexed, []error) {
+		for i := range errs {
+			errs[i] = err
+		}
+		return indexed, errs
+	}
+
+	respBody, err := c.perform(ctx, http.MethodPost, c.withParams("/_bulk", ""), body)
+	if err != nil {
+		return fail(err)
+	}
+
+	var resp struct {
+		Errors bool `json:"errors"`
+		Items  []map[string]struct {
+			Index  string          `json:"_index"`
+			ID     string          `json:"_id"`
+			Status int             `json:"status"`
+			Error  json.RawMessage `json:"error"`
+		} `json:"items"`
+	}
+	if err := json.Unmarshal(respBody, &resp); err != nil {
+		return fail(fmt.Errorf("error decoding bulk response: %w", err))
+	}
+	if len(resp.Items) != count {
+		return fail(fmt.Errorf("bulk response has %d items, expected %d", len(resp.Items), count))
+	}
+	for i, item := range resp.Items {
+		for _, result := range item {
+			if result.Status >= 300 || len(result.Error) > 0 {
+				errs[i] = newItemError(result.Index, result.Status, result.Error)
+				continue
+			}
+			indexed[i] = Indexed{Index: result.Index, ID: result.ID}
+		}
+	}
+	return indexed, errs
+}
+
+// bulkLines encodes the action and source lines for one document
+func bulkLines(index string, opts IndexOptions, data map[string]interface{}) ([]byte, error) {
+	meta := map[string]string{"_index": index}
+	if opts.ID != "" {
+		meta["_id"] = opts.ID
+	}
+	if opts.Routing != "" {
+		meta["routing"] = opts.Routing
+	}
+	action, err := json.Marshal(map[string]interface{}{"index": meta})
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling bulk action: %w", err)
+	}
+	source, err := json.Marshal(data)
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling data: %w", err)
+	}
+
+	lines := make([]byte, 0, len(action)+len(source)+2)
+	lines = append(lines, action...)
+	lines = append(lines, '\n')
+	lines = append(lines, source...)
+	lines = append(lines, '\n')
+	return lines, nil
+}
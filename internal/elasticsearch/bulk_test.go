@@ -0,0 +1,86 @@
+package elasticsearch
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/truemilk/trivelastic/internal/config"
+)
+
+func TestBulkRetriesRejectedItems(t *testing.T) {
+	// The cluster rejects the document named "busy" once with a 429
+	var mu sync.Mutex
+	var requests [][]string
+	rejected := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var names []string
+		var items []string
+		scanner := bufio.NewScanner(bytes.NewReader(body))
+		for i := 0; scanner.Scan(); i++ {
+			if i%2 == 0 {
+				continue
+			}
+			var doc struct {
+				Name string `json:"name"`
+			}
+			json.Unmarshal(scanner.Bytes(), &doc)
+			names = append(names, doc.Name)
+
+			mu.Lock()
+			if doc.Name == "busy" && !rejected {
+				rejected = true
+				items = append(items, `{"index":{"_index":"trivy","status":429,"error":{"type":"es_rejected_execution_exception","reason":"rejected"}}}`)
+			} else {
+				items = append(items, fmt.Sprintf(`{"index":{"_index":"trivy","_id":%q,"status":201}}`, doc.Name))
+			}
+			mu.Unlock()
+		}
+		mu.Lock()
+		requests = append(requests, names)
+		mu.Unlock()
+
+		w.Header().Set("X-Elastic-Product", "Elasticsearch")
+		fmt.Fprintf(w, `{"errors":true,"items":[%s]}`, strings.Join(items, ","))
+	}))
+	defer srv.Close()
+
+	c, err := NewClient(&config.ElasticsearchConfig{
+		URLs: []string{srv.URL},
+		Retry: config.RetryConfig{
+			MaxAttempts:       3,
+			Interval:          time.Millisecond,
+			BackoffMultiplier: 1,
+			OnStatus:          []string{"429"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	indexed, errs := c.IndexBatch(context.Background(), []BatchItem{
+		{Index: "trivy", Document: map[string]interface{}{"name": "ok"}},
+		{Index: "trivy", Document: map[string]interface{}{"name": "busy"}},
+	})
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("expected document %d to be indexed, got %v", i, err)
+		}
+	}
+	if indexed[0].ID != "ok" || indexed[1].ID != "busy" {
+		t.Fatalf("expected the documents in order, got %+v", indexed)
+	}
+	if len(requests) != 2 || len(requests[1]) != 1 || requests[1][0] != "busy" {
+		t.Fatalf("expected only the rejected document to be sent again, got %v", requests)
+	}
+}
@@ -2,123 +2,611 @@ package elasticsearch
 
 import (
 	"bytes"
-	"crypto/tls"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"sync"
 	"time"
 
+	"github.com/elastic/elastic-transport-go/v8/elastictransport"
+	"github.com/elastic/go-elasticsearch/v8"
 	"github.com/rs/zerolog"
 	"github.com/truemilk/trivelastic/internal/config"
+	"github.com/truemilk/trivelastic/internal/indexname"
 	"github.com/truemilk/trivelastic/internal/logger"
+	"github.com/truemilk/trivelastic/internal/metrics"
 )
 
-const (
-	maxRetries    = 3
-	retryInterval = 1 * time.Second
-)
+// errNodeUnreachable marks failures where no response was received from a node
+var errNodeUnreachable = errors.New("node unreachable")
+
+// errUnknownProduct is returned when the cluster does not identify as
+// Elasticsearch, e.g. OpenSearch without TRIVELASTIC_ES_TARGET=opensearch
+var errUnknownProduct = errors.New("cluster does not identify as Elasticsearch")
+
+// responseError is returned when Elasticsearch answers with an error status
+type responseError struct {
+	StatusCode int
+	Body       []byte
+	// RetryAfter is the wait requested by a 429 or 503 response, if any
+	RetryAfter time.Duration
+}
+
+func (e *responseError) Error() string {
+	return fmt.Sprintf("elasticsearch error: status=%d, response=%s", e.StatusCode, string(e.Body))
+}
+
+// userAgent identifies trivelastic to the cluster
+const userAgent = "trivelastic"
 
+// Client talks to Elasticsearch through the official go-elasticsearch
+// client, which checks that the cluster is Elasticsearch and sends the
+// compatibility header. Its elastic-transport-go transport manages the
+// connection pool, dead node resurrection and node discovery, which is
+// scheduled by the client itself so that Close can stop it. Retries are
+// applied by perform according to the retry policy, and stopped by the
+// circuit breaker while the cluster is down.
+//
+// OpenSearch does not identify as Elasticsearch, so for that target requests
+// are sent with the transport alone.
 type Client struct {
 	config *config.ElasticsearchConfig
-	client *http.Client
-	log    zerolog.Logger
+	// api sends requests: the go-elasticsearch client, or the transport for OpenSearch
+	api       elastictransport.Interface
+	transport *elastictransport.Client
+	http      *roundTripper
+	retry     retryPolicy
+	breaker   *breaker
+	log       zerolog.Logger
+
+	// base is the HTTP transport under any wrapper, closed by Close
+	base      *http.Transport
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+// roundTripper lets WrapTransport replace the HTTP transport after the
+// elastic transport has been created
+type roundTripper struct {
+	next http.RoundTripper
+}
+
+func (rt *roundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := rt.next.RoundTrip(req)
+	if a, ok := req.Context().Value(answerKey{}).(*answer); ok && resp != nil {
+		a.status = resp.StatusCode
+		a.product = resp.Header.Get("X-Elastic-Product")
+	}
+	return resp, err
+}
+
+// answer records the response of a node to an attempt, so that a response
+// refused by go-elasticsearch is not taken for an unreachable node
+type answer struct {
+	status  int
+	product string
+}
+
+type answerKey struct{}
+
+func NewClient(cfg *config.ElasticsearchConfig) (*Client, error) {
+	tlsConfig, err := newTLSConfig(cfg.TLS)
+	if err != nil {
+		return nil, err
+	}
+	base := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		TLSClientConfig:     tlsConfig,
+		MaxIdleConns:        cfg.Transport.MaxIdleConns,
+		MaxIdleConnsPerHost: cfg.Transport.MaxIdleConnsPerHost,
+		IdleConnTimeout:     cfg.Transport.IdleConnTimeout,
+		TLSHandshakeTimeout: cfg.Transport.TLSHandshakeTimeout,
+	}
+	var next http.RoundTripper = base
+	if cfg.SigV4.Enabled {
+		next = newSigV4Transport(cfg.SigV4, next)
+	}
+	rt := &roundTripper{next: next}
+
+	var (
+		api       elastictransport.Interface
+		transport *elastictransport.Client
+	)
+	if cfg.Target == config.TargetOpenSearch {
+		transport, err = newOpenSearchTransport(cfg, rt)
+		api = transport
+	} else {
+		var es *elasticsearch.Client
+		es, err = elasticsearch.NewClient(elasticsearch.Config{
+			Addresses: cfg.URLs,
+			APIKey:    cfg.APIKey,
+			Header:    http.Header{"User-Agent": []string{userAgent}},
+			// Retries are handled by perform, see retryPolicy
+			DisableRetry:        true,
+			CompressRequestBody: cfg.Compression,
+			PoolCompressor:      cfg.Compression,
+			// Ask newer clusters to answer like the major version trivelastic was written for
+			EnableCompatibilityMode: cfg.CompatibilityMode,
+			Transport:               rt,
+		})
+		if err == nil {
+			api = es
+			transport = es.Transport.(*elastictransport.Client)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error creating Elasticsearch client: %w", err)
+	}
+
+	c := &Client{
+		config:    cfg,
+		api:       api,
+		transport: transport,
+		http:      rt,
+		retry:     newRetryPolicy(cfg.Retry),
+		breaker:   newBreaker(cfg.Breaker),
+		log:       logger.GetLogger("elasticsearch"),
+		base:      base,
+		stop:      make(chan struct{}),
+	}
+
+	if cfg.DiscoverNodesInterval > 0 {
+		go c.discover(cfg.DiscoverNodesInterval)
+	}
+
+	return c, nil
 }
 
-func NewClient(cfg *config.ElasticsearchConfig) *Client {
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{
-			InsecureSkipVerify: true,
-		},
+// newOpenSearchTransport creates the transport used without the
+// go-elasticsearch client, which refuses OpenSearch
+func newOpenSearchTransport(cfg *config.ElasticsearchConfig, rt http.RoundTripper) (*elastictransport.Client, error) {
+	urls := make([]*url.URL, 0, len(cfg.URLs))
+	for _, raw := range cfg.URLs {
+		u, err := url.Parse(raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Elasticsearch URL %q: %w", raw, err)
+		}
+		urls = append(urls, u)
+	}
+	return elastictransport.New(elastictransport.Config{
+		UserAgent:           userAgent,
+		URLs:                urls,
+		APIKey:              cfg.APIKey,
+		DisableRetry:        true,
+		CompressRequestBody: cfg.Compression,
+		PoolCompressor:      cfg.Compression,
+		Transport:           rt,
+	})
+}
+
+// discover refreshes the nodes straight away, then every interval until
+// the client is closed. The transport's own discovery timer is not used
+// because it cannot be stopped.
+func (c *Client) discover(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		c.discoverNodes()
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+		}
 	}
+}
+
+// Close stops node discovery and closes idle connections. Requests already
+// started are not interrupted, and the client stays usable for them.
+func (c *Client) Close() {
+	c.closeOnce.Do(func() {
+		close(c.stop)
+		c.base.CloseIdleConnections()
+	})
+}
 
-	return &Client{
-		config: cfg,
-		client: &http.Client{Transport: tr},
-		log:    logger.GetLogger("elasticsearch"),
+// discoverNodes replaces the configured nodes with the cluster's HTTP nodes
+func (c *Client) discoverNodes() {
+	if err := c.transport.DiscoverNodes(); err != nil {
+		c.log.Warn().
+			Err(err).
+			Msg("Elasticsearch node discovery failed")
+		return
 	}
+	c.log.Info().
+		Int("nodes", len(c.transport.URLs())).
+		Msg("Elasticsearch nodes discovered")
+}
+
+// WrapTransport wraps the HTTP transport used to reach the cluster, e.g. to
+// inject failures. It must be called before the client is used.
+func (c *Client) WrapTransport(wrap func(http.RoundTripper) http.RoundTripper) {
+	c.http.next = wrap(c.http.next)
 }
 
-func (c *Client) IndexDocument(data map[string]interface{}) error {
+// IndexDocument indexes data into the configured default index
+func (c *Client) IndexDocument(ctx context.Context, data map[string]interface{}) error {
+	return c.IndexInto(ctx, c.config.Index, data)
+}
+
+// IndexInto indexes data into the given index with an ID assigned by Elasticsearch
+func (c *Client) IndexInto(ctx context.Context, index string, data map[string]interface{}) error {
+	_, err := c.IndexWithOptions(ctx, index, IndexOptions{}, data)
+	return err
+}
+
+// IndexOptions are the per-document parameters of an index request
+type IndexOptions struct {
+	// ID replaces any document with the same ID. Empty lets Elasticsearch assign one.
+	ID string
+	// Routing selects the shard, so that documents with the same value are stored together
+	Routing string
+}
+
+// Indexed locates a document written to Elasticsearch
+type Indexed struct {
+	Index string `json:"index"`
+	ID    string `json:"id"`
+}
+
+// IndexWithOptions indexes data into the given index and returns where it
+// was written. Date patterns in the index name are resolved with the
+// current time, see package indexname.
+func (c *Client) IndexWithOptions(ctx context.Context, index string, opts IndexOptions, data map[string]interface{}) (Indexed, error) {
+	index = indexname.Resolve(index, time.Now())
 	body, err := json.Marshal(data)
 	if err != nil {
-		return fmt.Errorf("error marshaling data: %w", err)
+		return Indexed{}, fmt.Errorf("error marshaling data: %w", err)
 	}
 
-	esURL := fmt.Sprintf("%s/%s/_doc", c.config.URL, c.config.Index)
+	method, path := http.MethodPost, fmt.Sprintf("/%s/_doc", url.PathEscape(index))
+	if opts.ID != "" {
+		method, path = http.MethodPut, fmt.Sprintf("/%s/_doc/%s", url.PathEscape(index), url.PathEscape(opts.ID))
+	}
+	path = c.withParams(path, opts.Routing)
 	c.log.Debug().
-		Str("url", esURL).
+		Str("path", path).
 		RawJSON("body", body).
 		Msg("Preparing to index document")
 
+	respBody, err := c.perform(ctx, method, path, body)
+	if err != nil {
+		err = documentError(index, err)
+		c.log.Error().
+			Err(err).
+			Str("path", path).
+			Str("index", index).
+			Msg("All indexing attempts failed")
+		return Indexed{}, err
+	}
+
+	// result is "created", or "updated" when id replaced an existing document
+	var resp struct {
+		Index  string `json:"_index"`
+		ID     string `json:"_id"`
+		Result string `json:"result"`
+	}
+	if err := json.Unmarshal(respBody, &resp); err != nil {
+		c.log.Warn().
+			Err(err).
+			Str("index", index).
+			Msg("Failed to decode index response")
+	}
+
+	c.log.Info().
+		Str("index", index).
+		Str("id", resp.ID).
+		Str("result", resp.Result).
+		Msg("Document indexed successfully")
+	// Writes through an alias report the backing index
+	if resp.Index == "" {
+		resp.Index = index
+	}
+	return Indexed{Index: resp.Index, ID: resp.ID}, nil
+}
+
+// withParams adds the configured ingest pipeline and the routing value, if
+// any, to an indexing request path
+func (c *Client) withParams(path, routing string) string {
+	params := url.Values{}
+	if c.config.Pipeline != "" {
+		params.Set("pipeline", c.config.Pipeline)
+	}
+	if routing != "" {
+		params.Set("routing", routing)
+	}
+	if len(params) == 0 {
+		return path
+	}
+	return path + "?" + params.Encode()
+}
+
+// perform sends a request to the cluster, failing over between nodes and
+// retrying according to the retry policy, until ctx is done. It returns the
+// response body.
+func (c *Client) perform(ctx context.Context, method, path string, body []byte) (_ []byte, err error) {
 	var lastErr error
-	for attempt := 1; attempt <= maxRetries; attempt++ {
-		if err := c.sendRequest(esURL, body); err != nil {
+	start := time.Now()
+	defer func() {
+		metrics.ESRequestDuration.Observe(time.Since(start).Seconds())
+		if err != nil && !notFound(err) {
+			metrics.ESErrors.Inc()
+		}
+	}()
+	for attempt := 1; ; attempt++ {
+		// Fail fast instead of burning retries while the cluster is down
+		if err := c.breaker.allow(); err != nil {
+			if lastErr != nil {
+				return nil, fmt.Errorf("%w after: %w", err, lastErr)
+			}
+			return nil, err
+		}
+
+		respBody, node, err := c.sendRequest(ctx, method, path, body)
+		c.breaker.record(err)
+		if err != nil {
+			// The caller gave up, further attempts would be wasted
+			if ctx.Err() != nil {
+				return nil, err
+			}
+
 			lastErr = err
+			// A missing document is an answer, see Get
+			if notFound(err) {
+				return nil, err
+			}
 			c.log.Warn().
 				Err(err).
+				Str("node", node).
+				Str("path", path).
 				Int("attempt", attempt).
-				Int("max_retries", maxRetries).
-				Msg("Indexing attempt failed")
+				Int("max_attempts", c.retry.maxAttempts).
+				Msg("Elasticsearch request attempt failed")
+
+			// Errors such as a rejected mapping fail the same way every time
+			if !c.retry.retryable(err) {
+				return nil, err
+			}
+
+			wait, retry := c.retry.next(attempt, start, err)
+			if !retry {
+				break
+			}
 
-			if attempt < maxRetries {
-				time.Sleep(retryInterval)
+			// Fail over straight away when another node is still available.
+			// The transport has already marked the unreachable node as dead,
+			// a single node cluster backs off like any other failure.
+			failover := errors.Is(err, errNodeUnreachable) && c.otherNodeLive(node)
+			if !failover && withoutRetries(ctx) {
+				break
+			}
+			metrics.ESRetries.Inc()
+			if failover {
 				continue
 			}
-			break
+
+			select {
+			case <-ctx.Done():
+				return nil, fmt.Errorf("request cancelled: %w", ctx.Err())
+			case <-time.After(wait):
+			}
+			continue
 		}
-		c.log.Info().
+
+		c.log.Debug().
 			Int("attempt", attempt).
-			Str("index", c.config.Index).
-			Msg("Document indexed successfully")
-		return nil
+			Str("node", node).
+			Str("path", path).
+			Msg("Elasticsearch request succeeded")
+		return respBody, nil
 	}
 
-	c.log.Error().
-		Err(lastErr).
-		Str("url", esURL).
-		Str("index", c.config.Index).
-		Msg("All indexing attempts failed")
+	return nil, fmt.Errorf("all retries failed: %w", lastErr)
+}
 
-	return fmt.Errorf("all retries failed: %w", lastErr)
+// otherNodeLive reports whether the transport has a live node besides node
+func (c *Client) otherNodeLive(node string) bool {
+	for _, u := range c.transport.URLs() {
+		if u.Scheme+"://"+u.Host != node {
+			return true
+		}
+	}
+	return false
 }
 
-func (c *Client) sendRequest(url string, body []byte) error {
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(body))
+// sendRequest performs a single attempt on the node picked by the transport,
+// giving up after the request timeout. It returns the response body and the
+// node that was used.
+func (c *Client) sendRequest(ctx context.Context, method, path string, body []byte) ([]byte, string, error) {
+	attemptCtx := ctx
+	if c.config.RequestTimeout > 0 {
+		var cancel context.CancelFunc
+		attemptCtx, cancel = context.WithTimeout(ctx, c.config.RequestTimeout)
+		defer cancel()
+	}
+
+	// Requests without a body must not get one, or it would be compressed
+	var reader io.Reader
+	if len(body) > 0 {
+		reader = bytes.NewReader(body)
+	}
+	var a answer
+	req, err := http.NewRequestWithContext(context.WithValue(attemptCtx, answerKey{}, &a), method, path, reader)
 	if err != nil {
-		return fmt.Errorf("error creating request: %w", err)
+		return nil, "", fmt.Errorf("error creating request: %w", err)
 	}
 
+	// Replaced by the compatibility header in compatibility mode
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", fmt.Sprintf("ApiKey %s", c.config.APIKey))
 
 	c.log.Debug().
-		Str("url", url).
+		Str("method", method).
+		Str("path", path).
 		Msg("Sending request to Elasticsearch")
 
-	resp, err := c.client.Do(req)
+	resp, err := c.api.Perform(req)
+	node := req.URL.Scheme + "://" + req.URL.Host
 	if err != nil {
-		return fmt.Errorf("error sending request: %w", err)
+		// A cancelled caller says nothing about the health of the node
+		if ctx.Err() != nil {
+			return nil, node, fmt.Errorf("request cancelled: %w", ctx.Err())
+		}
+		// go-elasticsearch refuses successful responses from other products
+		if a.status >= 200 && a.status < 300 && a.product != "Elasticsearch" {
+			return nil, node, fmt.Errorf("%w, set TRIVELASTIC_ES_TARGET=opensearch for OpenSearch: %w", errUnknownProduct, err)
+		}
+		return nil, node, fmt.Errorf("%w: error sending request: %w", errNodeUnreachable, err)
 	}
 	defer resp.Body.Close()
 
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		c.log.Error().
+			Err(err).
+			Int("status_code", resp.StatusCode).
+			Msg("Failed to read response body")
+		return nil, node, fmt.Errorf("elasticsearch error: status=%d, failed to read response", resp.StatusCode)
+	}
+
 	if resp.StatusCode >= 400 {
-		respBody, err := io.ReadAll(resp.Body)
-		if err != nil {
-			c.log.Error().
-				Err(err).
-				Int("status_code", resp.StatusCode).
-				Msg("Failed to read error response body")
-			return fmt.Errorf("elasticsearch error: status=%d, failed to read response", resp.StatusCode)
+		event := c.log.Error()
+		if resp.StatusCode == http.StatusNotFound {
+			event = c.log.Debug()
 		}
-
-		c.log.Error().
+		event.
 			Int("status_code", resp.StatusCode).
 			RawJSON("response", respBody).
 			Msg("Elasticsearch request failed")
 
-		return fmt.Errorf("elasticsearch error: status=%d, response=%s", resp.StatusCode, string(respBody))
+		return nil, node, &responseError{
+			StatusCode: resp.StatusCode,
+			Body:       respBody,
+			RetryAfter: retryAfter(resp),
+		}
+	}
+
+	return respBody, node, nil
+}
+
+// Ping verifies that every configured node is reachable and accepts the configured credentials
+func (c *Client) Ping() error {
+	var errs []error
+	for _, node := range c.config.URLs {
+		if err := c.pingNode(node); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", node, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// pingNode sends GET / to one node directly, bypassing the connection pool
+func (c *Client) pingNode(node string) error {
+	req, err := http.NewRequest(http.MethodGet, node, nil)
+	if err != nil {
+		return fmt.Errorf("error creating request: %w", err)
+	}
+
+	req.Header.Set("User-Agent", userAgent)
+	if c.config.APIKey != "" {
+		req.Header.Set("Authorization", fmt.Sprintf("ApiKey %s", c.config.APIKey))
+	}
+
+	c.log.Debug().
+		Str("url", node).
+		Msg("Pinging Elasticsearch")
+
+	resp, err := c.http.RoundTrip(req)
+	if err != nil {
+		return fmt.Errorf("%w: error sending request: %w", errNodeUnreachable, err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return fmt.Errorf("elasticsearch rejected credentials: status=%d", resp.StatusCode)
+	case resp.StatusCode >= 400:
+		return fmt.Errorf("elasticsearch error: status=%d", resp.StatusCode)
 	}
 
 	return nil
 }
+
+// Update applies a partial update or script to the document with the given ID,
+// as accepted by the _update API
+func (c *Client) Update(ctx context.Context, index, id string, update map[string]interface{}) error {
+	body, err := json.Marshal(update)
+	if err != nil {
+		return fmt.Errorf("error marshaling update: %w", err)
+	}
+
+	path := fmt.Sprintf("/%s/_update/%s?retry_on_conflict=3", url.PathEscape(index), url.PathEscape(id))
+	if _, err := c.perform(ctx, http.MethodPost, path, body); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Search runs query against index and returns the _source of every hit
+func (c *Client) Search(ctx context.Context, index string, query map[string]interface{}) ([]map[string]interface{}, error) {
+	body, err := json.Marshal(query)
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling query: %w", err)
+	}
+
+	respBody, err := c.perform(ctx, http.MethodPost, fmt.Sprintf("/%s/_search", url.PathEscape(index)), body)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp struct {
+		Hits struct {
+			Hits []struct {
+				Source map[string]interface{} `json:"_source"`
+			} `json:"hits"`
+		} `json:"hits"`
+	}
+	if err := json.Unmarshal(respBody, &resp); err != nil {
+		return nil, fmt.Errorf("error decoding search response: %w", err)
+	}
+
+	sources := make([]map[string]interface{}, 0, len(resp.Hits.Hits))
+	for _, hit := range resp.Hits.Hits {
+		sources = append(sources, hit.Source)
+	}
+	return sources, nil
+}
+
+// Get returns the _source of the document with the given ID, or nil when
+// neither the document nor the index exists. The GET is realtime: a
+// document written moments ago is returned even before the index refreshes.
+func (c *Client) Get(ctx context.Context, index, id string) (map[string]interface{}, error) {
+	path := fmt.Sprintf("/%s/_doc/%s", url.PathEscape(index), url.PathEscape(id))
+	respBody, err := c.perform(ctx, http.MethodGet, path, nil)
+	if notFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var resp struct {
+		Found  bool                   `json:"found"`
+		Source map[string]interface{} `json:"_source"`
+	}
+	if err := json.Unmarshal(respBody, &resp); err != nil {
+		return nil, fmt.Errorf("error decoding get response: %w", err)
+	}
+	if !resp.Found {
+		return nil, nil
+	}
+	return resp.Source, nil
+}
+
+// notFound reports whether err is a 404 answer, for a missing document or index
+func notFound(err error) bool {
+	var respErr *responseError
+	return errors.As(err, &respErr) && respErr.StatusCode == http.StatusNotFound
+}
@@ -0,0 +1,128 @@
+package elasticsearch
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/truemilk/trivelastic/internal/config"
+)
+
+// unreachableURL returns the URL of a local port nothing listens on
+func unreachableURL(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	return "http://" + addr
+}
+
+func TestPerformBacksOffOnSingleNode(t *testing.T) {
+	cfg := &config.ElasticsearchConfig{
+		URLs: []string{unreachableURL(t)},
+		Retry: config.RetryConfig{
+			MaxAttempts:       3,
+			Interval:          100 * time.Millisecond,
+			BackoffMultiplier: 1,
+		},
+	}
+	c, err := NewClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	_, err = c.perform(context.Background(), http.MethodGet, "/", nil)
+	elapsed := time.Since(start)
+
+	if !errors.Is(err, errNodeUnreachable) {
+		t.Fatalf("expected an unreachable node error, got %v", err)
+	}
+	// Two retries, each after the configured interval
+	if elapsed < 200*time.Millisecond {
+		t.Fatalf("retries were not backed off, all attempts took %s", elapsed)
+	}
+}
+
+func TestPerformFailsOverToLiveNode(t *testing.T) {
+	srv := http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Elastic-Product", "Elasticsearch")
+		w.Write([]byte(`{}`))
+	})}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+	defer srv.Close()
+
+	cfg := &config.ElasticsearchConfig{
+		URLs: []string{unreachableURL(t), "http://" + l.Addr().String()},
+		Retry: config.RetryConfig{
+			MaxAttempts:       3,
+			Interval:          time.Minute,
+			BackoffMultiplier: 1,
+		},
+	}
+	c, err := NewClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Either node may be picked first, a failover must not wait the interval
+	for i := 0; i < 2; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		_, err := c.perform(ctx, http.MethodGet, "/", nil)
+		cancel()
+		if err != nil {
+			t.Fatalf("expected the live node to answer, got %v", err)
+		}
+	}
+}
+
+func TestPerformRejectsOtherProducts(t *testing.T) {
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Write([]byte(`{"version":{"distribution":"opensearch"}}`))
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		target string
+		reject bool
+	}{
+		{target: config.TargetElasticsearch, reject: true},
+		{target: config.TargetOpenSearch},
+	}
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			requests.Store(0)
+			c, err := NewClient(&config.ElasticsearchConfig{
+				URLs:   []string{srv.URL},
+				Target: tt.target,
+				Retry:  config.RetryConfig{MaxAttempts: 3, Interval: time.Millisecond, BackoffMultiplier: 1},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = c.perform(context.Background(), http.MethodGet, "/", nil)
+			if rejected := errors.Is(err, errUnknownProduct); rejected != tt.reject {
+				t.Fatalf("expected the cluster rejected: %t, got %v", tt.reject, err)
+			}
+			// A cluster of another product does not change between attempts
+			if n := requests.Load(); n != 1 {
+				t.Fatalf("expected a single request, got %d", n)
+			}
+		})
+	}
+}
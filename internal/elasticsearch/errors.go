@@ -0,0 +1,102 @@
+package elasticsearch
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// ItemError is a document rejected by Elasticsearch, reported by a _bulk
+// item or a _doc response
+type ItemError struct {
+	Index  string
+	Status int
+	// Type and Reason come from the error object of the response, e.g.
+	// "mapper_parsing_exception" and "failed to parse field [CVSS]"
+	Type   string
+	Reason string
+}
+
+func (e *ItemError) Error() string {
+	return fmt.Sprintf("%s: status=%d, index=%s, type=%s, reason=%s", e.Kind(), e.Status, e.Index, e.Type, e.Reason)
+}
+
+// Kind classifies the error for logs and responses
+func (e *ItemError) Kind() string {
+	switch {
+	case e.VersionConflict():
+		return "version conflict"
+	case e.MappingConflict():
+		return "mapping conflict"
+	case e.Status == 429:
+		return "rejected by overloaded cluster"
+	default:
+		return "document rejected"
+	}
+}
+
+// MappingConflict reports whether a field of the document does not match the index mapping
+func (e *ItemError) MappingConflict() bool {
+	switch e.Type {
+	case "mapper_parsing_exception", "document_parsing_exception", "strict_dynamic_mapping_exception", "illegal_argument_exception":
+		return e.Status == 400
+	}
+	return false
+}
+
+// VersionConflict reports whether the document was changed concurrently
+func (e *ItemError) VersionConflict() bool {
+	return e.Status == 409 || e.Type == "version_conflict_engine_exception"
+}
+
+// errorCause is the error object of an Elasticsearch response
+type errorCause struct {
+	Type   string `json:"type"`
+	Reason string `json:"reason"`
+}
+
+// newItemError decodes the error object of a rejected document. raw may be
+// an object or, for some older responses, a plain string.
+func newItemError(index string, status int, raw json.RawMessage) *ItemError {
+	itemErr := &ItemError{Index: index, Status: status}
+	var cause errorCause
+	if err := json.Unmarshal(raw, &cause); err == nil {
+		itemErr.Type, itemErr.Reason = cause.Type, cause.Reason
+	} else {
+		var reason string
+		if json.Unmarshal(raw, &reason) == nil {
+			itemErr.Reason = reason
+		} else {
+			itemErr.Reason = string(raw)
+		}
+	}
+	return itemErr
+}
+
+// documentError turns the error response of a _doc request into an
+// ItemError, keeping any other error as it is
+func documentError(index string, err error) error {
+	var respErr *responseError
+	if !errors.As(err, &respErr) || respErr.StatusCode >= 500 {
+		return err
+	}
+
+	var resp struct {
+		Error json.RawMessage `json:"error"`
+	}
+	if json.Unmarshal(respErr.Body, &resp) != nil || len(resp.Error) == 0 {
+		return err
+	}
+	return newItemError(index, respErr.StatusCode, resp.Error)
+}
+
+// Retryable reports whether sending the documents that failed with err again
+// later may succeed. Documents rejected for their content never will, unless
+// the cluster was only overloaded.
+func Retryable(err error) bool {
+	var itemErr *ItemError
+	if errors.As(err, &itemErr) {
+		return itemErr.Status == 429 || itemErr.Status >= 500
+	}
+	return true
+}
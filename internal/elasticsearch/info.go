@@ -0,0 +1,90 @@
+package elasticsearch
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Elasticsearch versions whose APIs the client is written for. Composable
+// index templates need 7.8, and newer majors answer like 8 in compatibility
+// mode.
+const (
+	MinMajorVersion = 7
+	MaxMajorVersion = 8
+)
+
+// ErrUnauthorized is returned when the cluster rejects the configured credentials
+var ErrUnauthorized = errors.New("elasticsearch rejected credentials")
+
+// ClusterInfo is the response of GET /
+type ClusterInfo struct {
+	Name        string `json:"name"`
+	ClusterName string `json:"cluster_name"`
+	Version     struct {
+		Number string `json:"number"`
+		// Distribution is "opensearch" for OpenSearch and empty for Elasticsearch
+		Distribution string `json:"distribution"`
+		BuildFlavor  string `json:"build_flavor"`
+	} `json:"version"`
+}
+
+// Major returns the major version of the cluster, zero when it cannot be parsed
+func (info *ClusterInfo) Major() int {
+	major, _, _ := strings.Cut(info.Version.Number, ".")
+	n, err := strconv.Atoi(major)
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+// License is the cluster license reported by GET /_license
+type License struct {
+	Type   string `json:"type"`
+	Status string `json:"status"`
+}
+
+// Info returns the name and version of the cluster
+func (c *Client) Info(ctx context.Context) (*ClusterInfo, error) {
+	respBody, err := c.perform(ctx, http.MethodGet, "/", nil)
+	if err != nil {
+		return nil, authError(err)
+	}
+
+	var info ClusterInfo
+	if err := json.Unmarshal(respBody, &info); err != nil {
+		return nil, fmt.Errorf("error decoding cluster info: %w", err)
+	}
+	return &info, nil
+}
+
+// License returns the license of an Elasticsearch cluster. OpenSearch has no license API.
+func (c *Client) License(ctx context.Context) (*License, error) {
+	respBody, err := c.perform(ctx, http.MethodGet, "/_license", nil)
+	if err != nil {
+		return nil, authError(err)
+	}
+
+	var resp struct {
+		License License `json:"license"`
+	}
+	if err := json.Unmarshal(respBody, &resp); err != nil {
+		return nil, fmt.Errorf("error decoding license: %w", err)
+	}
+	return &resp.License, nil
+}
+
+// authError marks err with ErrUnauthorized when the cluster answered 401 or 403
+func authError(err error) error {
+	var respErr *responseError
+	if errors.As(err, &respErr) &&
+		(respErr.StatusCode == http.StatusUnauthorized || respErr.StatusCode == http.StatusForbidden) {
+		return fmt.Errorf("%w: %w", ErrUnauthorized, err)
+	}
+	return err
+}
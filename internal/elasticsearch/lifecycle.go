@@ -0,0 +1,152 @@
+package elasticsearch
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+
+	"github.com/truemilk/trivelastic/internal/config"
+	"github.com/truemilk/trivelastic/internal/indexname"
+)
+
+// BootstrapILM creates or updates the lifecycle policy and attaches it to
+// every index in indices. A missing index is created, as the first
+// generation behind a write alias when the policy rolls over.
+func (c *Client) BootstrapILM(cfg config.ILMConfig, indices []string) error {
+	if err := c.putILMPolicy(cfg); err != nil {
+		return err
+	}
+	c.log.Info().
+		Str("policy", cfg.Policy).
+		Msg("ILM policy installed")
+
+	for _, index := range indices {
+		if indexname.HasPattern(index) {
+			c.log.Warn().
+				Str("index", index).
+				Msg("ILM policy not attached to time-based index, enable the index template to manage it")
+			continue
+		}
+		if err := c.attachILMPolicy(cfg, index); err != nil {
+			return fmt.Errorf("attach ILM policy to %s: %w", index, err)
+		}
+	}
+	return nil
+}
+
+// putILMPolicy creates or replaces the lifecycle policy
+func (c *Client) putILMPolicy(cfg config.ILMConfig) error {
+	phases := map[string]interface{}{}
+	if cfg.Rollover() {
+		rollover := map[string]string{}
+		if cfg.RolloverMaxSize != "" {
+			rollover["max_primary_shard_size"] = cfg.RolloverMaxSize
+		}
+		if cfg.RolloverMaxAge != "" {
+			rollover["max_age"] = cfg.RolloverMaxAge
+		}
+		phases["hot"] = map[string]interface{}{
+			"actions": map[string]interface{}{"rollover": rollover},
+		}
+	}
+	if cfg.DeleteAfter != "" {
+		phases["delete"] = map[string]interface{}{
+			"min_age": cfg.DeleteAfter,
+			"actions": map[string]interface{}{"delete": map[string]interface{}{}},
+		}
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"policy": map[string]interface{}{"phases": phases},
+	})
+	if err != nil {
+		return fmt.Errorf("error marshaling ILM policy: %w", err)
+	}
+
+	if _, err := c.perform(context.Background(), http.MethodPut, "/_ilm/policy/"+url.PathEscape(cfg.Policy), body); err != nil {
+		return fmt.Errorf("put ILM policy %s: %w", cfg.Policy, err)
+	}
+	return nil
+}
+
+// attachILMPolicy sets the lifecycle policy on index, creating it when it does not exist yet
+func (c *Client) attachILMPolicy(cfg config.ILMConfig, index string) error {
+	lifecycle := map[string]string{"name": cfg.Policy}
+	if cfg.Rollover() {
+		lifecycle["rollover_alias"] = index
+	}
+	settings := map[string]interface{}{
+		"index": map[string]interface{}{"lifecycle": lifecycle},
+	}
+
+	exists, err := c.indexExists(index)
+	if err != nil {
+		return err
+	}
+
+	if exists {
+		body, err := json.Marshal(settings)
+		if err != nil {
+			return fmt.Errorf("error marshaling index settings: %w", err)
+		}
+		if _, err := c.perform(context.Background(), http.MethodPut, "/"+url.PathEscape(index)+"/_settings", body); err != nil {
+			return err
+		}
+		c.log.Info().
+			Str("index", index).
+			Str("policy", cfg.Policy).
+			Msg("ILM policy attached")
+		return nil
+	}
+
+	// Rollover needs a write alias in front of numbered indices
+	create := map[string]interface{}{"settings": settings}
+	name := index
+	if cfg.Rollover() {
+		name = index + "-000001"
+		create["aliases"] = map[string]interface{}{
+			index: map[string]bool{"is_write_index": true},
+		}
+	}
+	body, err := json.Marshal(create)
+	if err != nil {
+		return fmt.Errorf("error marshaling index: %w", err)
+	}
+	if _, err := c.perform(context.Background(), http.MethodPut, "/"+url.PathEscape(name), body); err != nil {
+		return err
+	}
+	c.log.Info().
+		Str("index", name).
+		Str("policy", cfg.Policy).
+		Msg("Index created with ILM policy")
+	return nil
+}
+
+// indexExists reports whether an index or alias with the given name exists
+func (c *Client) indexExists(name string) (bool, error) {
+	indices, err := c.concreteIndices(name)
+	return len(indices) > 0, err
+}
+
+// concreteIndices returns the indices behind name: the index itself, the
+// indices of an alias, or none when name does not exist
+func (c *Client) concreteIndices(name string) ([]string, error) {
+	respBody, err := c.perform(context.Background(), http.MethodGet, "/"+url.PathEscape(name)+"?ignore_unavailable=true&filter_path=*.settings.index.uuid", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var indices map[string]interface{}
+	if err := json.Unmarshal(respBody, &indices); err != nil {
+		return nil, fmt.Errorf("error decoding index response: %w", err)
+	}
+	names := make([]string, 0, len(indices))
+	for index := range indices {
+		names = append(names, index)
+	}
+	sort.Strings(names)
+	return names, nil
+}
@@ -0,0 +1,119 @@
+package elasticsearch
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/truemilk/trivelastic/internal/config"
+)
+
+// withoutRetriesKey marks contexts whose requests are attempted once
+type withoutRetriesKey struct{}
+
+// WithoutRetries makes the requests sent with ctx give up after a single
+// attempt, for callers that retry later on their own. Unreachable nodes are
+// still failed over.
+func WithoutRetries(ctx context.Context) context.Context {
+	return context.WithValue(ctx, withoutRetriesKey{}, true)
+}
+
+func withoutRetries(ctx context.Context) bool {
+	without, _ := ctx.Value(withoutRetriesKey{}).(bool)
+	return without
+}
+
+// retryPolicy computes the delay between indexing attempts
+type retryPolicy struct {
+	maxAttempts int
+	interval    time.Duration
+	multiplier  float64
+	maxInterval time.Duration
+	jitter      float64
+	maxElapsed  time.Duration
+	cfg         config.RetryConfig
+}
+
+func newRetryPolicy(cfg config.RetryConfig) retryPolicy {
+	return retryPolicy{
+		maxAttempts: cfg.MaxAttempts,
+		interval:    cfg.Interval,
+		multiplier:  cfg.BackoffMultiplier,
+		maxInterval: cfg.MaxInterval,
+		jitter:      cfg.Jitter,
+		maxElapsed:  cfg.MaxElapsed,
+		cfg:         cfg,
+	}
+}
+
+// retryable reports whether another attempt could succeed where err failed.
+// Error responses are classified by status; failures without a response,
+// such as an unreachable node or a timeout, are always worth retrying,
+// unlike a cluster that is not Elasticsearch.
+func (p retryPolicy) retryable(err error) bool {
+	if errors.Is(err, errUnknownProduct) {
+		return false
+	}
+	var respErr *responseError
+	if errors.As(err, &respErr) {
+		return p.cfg.Retryable(respErr.StatusCode)
+	}
+	return true
+}
+
+// delay returns the wait before the attempt following attempt, before jitter
+func (p retryPolicy) delay(attempt int) time.Duration {
+	d := float64(p.interval) * math.Pow(p.multiplier, float64(attempt-1))
+	if p.maxInterval > 0 && d > float64(p.maxInterval) {
+		d = float64(p.maxInterval)
+	}
+	return time.Duration(d)
+}
+
+// next reports whether another attempt should follow attempt, and how long to
+// wait before it, given when the first attempt started and the error of
+// attempt. A random part of the delay is dropped so that workers failing
+// together do not retry in lockstep. A Retry-After sent by the cluster is
+// honoured when it asks for a longer wait.
+func (p retryPolicy) next(attempt int, start time.Time, err error) (time.Duration, bool) {
+	if attempt >= p.maxAttempts {
+		return 0, false
+	}
+
+	wait := p.delay(attempt)
+	wait -= time.Duration(p.jitter * rand.Float64() * float64(wait))
+
+	var respErr *responseError
+	if errors.As(err, &respErr) && respErr.RetryAfter > wait {
+		wait = respErr.RetryAfter
+	}
+
+	if p.maxElapsed > 0 && time.Since(start)+wait > p.maxElapsed {
+		return 0, false
+	}
+	return wait, true
+}
+
+// retryAfter parses the Retry-After header of 429 and 503 responses, given
+// either in seconds or as an HTTP date. It returns zero when there is none.
+func retryAfter(resp *http.Response) time.Duration {
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+		return 0
+	}
+
+	value := resp.Header.Get("Retry-After")
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		return max(time.Until(at), 0)
+	}
+	return 0
+}
@@ -0,0 +1,72 @@
+package elasticsearch
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/truemilk/trivelastic/internal/config"
+)
+
+// RolloverResult is the outcome of a _rollover request
+type RolloverResult struct {
+	RolledOver bool            `json:"rolled_over"`
+	OldIndex   string          `json:"old_index"`
+	NewIndex   string          `json:"new_index"`
+	Conditions map[string]bool `json:"conditions"`
+}
+
+// EnsureWriteAlias makes alias a write alias in front of numbered indices,
+// creating "<alias>-000001" when alias does not exist yet. A concrete index
+// with the same name cannot be rolled over and is reported as an error.
+func (c *Client) EnsureWriteAlias(alias string) error {
+	indices, err := c.concreteIndices(alias)
+	if err != nil {
+		return err
+	}
+	if len(indices) == 1 && indices[0] == alias {
+		return fmt.Errorf("%s is an index, not an alias, and cannot be rolled over; reindex it or write to another name", alias)
+	}
+	if len(indices) > 0 {
+		return nil
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"aliases": map[string]interface{}{
+			alias: map[string]bool{"is_write_index": true},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("error marshaling index: %w", err)
+	}
+	name := alias + "-000001"
+	if _, err := c.perform(context.Background(), http.MethodPut, "/"+url.PathEscape(name), body); err != nil {
+		return err
+	}
+	c.log.Info().
+		Str("index", name).
+		Str("alias", alias).
+		Msg("Index created behind write alias")
+	return nil
+}
+
+// Rollover rolls alias over to a new index when one of the configured conditions is met
+func (c *Client) Rollover(ctx context.Context, alias string, cfg config.RolloverConfig) (*RolloverResult, error) {
+	body, err := json.Marshal(map[string]interface{}{"conditions": cfg.Conditions()})
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling rollover conditions: %w", err)
+	}
+
+	respBody, err := c.perform(ctx, http.MethodPost, "/"+url.PathEscape(alias)+"/_rollover", body)
+	if err != nil {
+		return nil, err
+	}
+
+	var result RolloverResult
+	if err := json.Unmarshal(respBody, &result); err != nil {
+		return nil, fmt.Errorf("error decoding rollover response: %w", err)
+	}
+	return &result, nil
+}
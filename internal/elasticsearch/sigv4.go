@@ -0,0 +1,59 @@
+package elasticsearch
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/truemilk/trivelastic/internal/awsauth"
+	"github.com/truemilk/trivelastic/internal/config"
+)
+
+// sigv4Transport signs every request with AWS Signature Version 4, as
+// required by Amazon OpenSearch Service with IAM authentication
+type sigv4Transport struct {
+	next    http.RoundTripper
+	creds   *awsauth.CredentialsProvider
+	region  string
+	service string
+}
+
+func newSigV4Transport(cfg config.SigV4Config, next http.RoundTripper) *sigv4Transport {
+	return &sigv4Transport{
+		next:    next,
+		creds:   awsauth.NewCredentialsProvider(nil),
+		region:  cfg.Region,
+		service: cfg.Service,
+	}
+}
+
+func (t *sigv4Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	creds, err := t.creds.Retrieve(req.Context())
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving AWS credentials: %w", err)
+	}
+
+	var body []byte
+	if req.Body != nil {
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error reading request body: %w", err)
+		}
+	}
+
+	// Sign a copy, RoundTrippers must not modify the caller's request
+	signed := req.Clone(req.Context())
+	signed.Body = http.NoBody
+	if len(body) > 0 {
+		signed.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	signed.ContentLength = int64(len(body))
+	// The signature replaces any other authentication
+	signed.Header.Del("Authorization")
+	awsauth.Sign(signed, body, creds, t.region, t.service, time.Now())
+
+	return t.next.RoundTrip(signed)
+}
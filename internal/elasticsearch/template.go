@@ -0,0 +1,149 @@
+package elasticsearch
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/truemilk/trivelastic/internal/config"
+)
+
+// templatePriority ranks the trivelastic template above the built-in ones,
+// which use priorities up to 100
+const templatePriority = 200
+
+// trivyMappings maps Trivy report fields explicitly: identifiers are keywords,
+// timestamps are dates and large free-text or nested blobs are not indexed.
+// Other strings become keywords instead of text plus keyword.
+//
+//go:embed mappings.json
+var trivyMappings []byte
+
+// InstallTemplate creates or updates a composable index template matching
+// patterns. When ilmPolicy is set, new indices are managed by that policy.
+func (c *Client) InstallTemplate(cfg config.TemplateConfig, patterns []string, ilmPolicy string) error {
+	mappings, err := decodeMappings()
+	if err != nil {
+		return err
+	}
+	addSplitMappings(mappings)
+	return c.putTemplate(cfg.Name, templatePriority, cfg, patterns, ilmPolicy, mappings)
+}
+
+// InstallFindingTemplate creates or updates the index template of an index
+// holding one kind of finding, see routing.FindingIndex. Its results only map
+// the given result fields besides the target. It is named after the report
+// template and ranks above it, so that it wins when their patterns overlap.
+func (c *Client) InstallFindingTemplate(cfg config.TemplateConfig, part string, fields []string, patterns []string, ilmPolicy string) error {
+	mappings, err := decodeMappings()
+	if err != nil {
+		return err
+	}
+
+	properties, _ := mappings["properties"].(map[string]interface{})
+	results, _ := properties["Results"].(map[string]interface{})
+	if resultProperties, ok := results["properties"].(map[string]interface{}); ok {
+		kept := map[string]interface{}{}
+		for _, field := range append([]string{"Target", "Class", "Type"}, fields...) {
+			if mapping, ok := resultProperties[field]; ok {
+				kept[field] = mapping
+			}
+		}
+		results["properties"] = kept
+	}
+
+	return c.putTemplate(cfg.Name+"-"+part, templatePriority+1, cfg, patterns, ilmPolicy, mappings)
+}
+
+// summaryCounts are the vulnerability counts of a report summary, see routing.SummaryRoute
+var summaryCounts = []string{"total", "fixable", "critical", "high", "medium", "low", "unknown"}
+
+// InstallSummaryTemplate creates or updates the index template of the report
+// summary indices. Summaries keep the artifact fields of the report mappings
+// and add the vulnerability counts. It ranks above the report template, like
+// finding templates.
+func (c *Client) InstallSummaryTemplate(cfg config.TemplateConfig, patterns []string, ilmPolicy string) error {
+	mappings, err := decodeMappings()
+	if err != nil {
+		return err
+	}
+
+	properties, _ := mappings["properties"].(map[string]interface{})
+	kept := map[string]interface{}{}
+	for _, field := range []string{"ArtifactName", "ArtifactType", "CreatedAt", "ci", "_trivelastic"} {
+		if mapping, ok := properties[field]; ok {
+			kept[field] = mapping
+		}
+	}
+	counts := make(map[string]interface{}, len(summaryCounts))
+	for _, field := range summaryCounts {
+		counts[field] = map[string]interface{}{"type": "integer"}
+	}
+	kept["vulnerabilities"] = map[string]interface{}{"properties": counts}
+	mappings["properties"] = kept
+
+	return c.putTemplate(cfg.Name+"-summary", templatePriority+1, cfg, patterns, ilmPolicy, mappings)
+}
+
+// decodeMappings returns a fresh copy of trivyMappings
+func decodeMappings() (map[string]interface{}, error) {
+	var mappings map[string]interface{}
+	if err := json.Unmarshal(trivyMappings, &mappings); err != nil {
+		return nil, fmt.Errorf("error decoding mappings: %w", err)
+	}
+	return mappings, nil
+}
+
+// putTemplate creates or updates the index template name
+func (c *Client) putTemplate(name string, priority int, cfg config.TemplateConfig, patterns []string, ilmPolicy string, mappings map[string]interface{}) error {
+	settings := map[string]interface{}{
+		"index.mapping.total_fields.limit": cfg.TotalFieldsLimit,
+	}
+	if ilmPolicy != "" {
+		settings["index.lifecycle.name"] = ilmPolicy
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"index_patterns": patterns,
+		"priority":       priority,
+		"template": map[string]interface{}{
+			"settings": settings,
+			"mappings": mappings,
+		},
+		"_meta": map[string]string{"managed_by": "trivelastic"},
+	})
+	if err != nil {
+		return fmt.Errorf("error marshaling index template: %w", err)
+	}
+
+	if _, err := c.perform(context.Background(), http.MethodPut, "/_index_template/"+url.PathEscape(name), body); err != nil {
+		return fmt.Errorf("put index template %s: %w", name, err)
+	}
+
+	c.log.Info().
+		Str("template", name).
+		Strs("index_patterns", patterns).
+		Msg("Index template installed")
+	return nil
+}
+
+// addSplitMappings maps the fields of documents split from a report, see
+// config.SplitVulnerability, like the report fields they are copied from
+func addSplitMappings(mappings map[string]interface{}) {
+	properties, _ := mappings["properties"].(map[string]interface{})
+	results, _ := properties["Results"].(map[string]interface{})
+	resultProperties, _ := results["properties"].(map[string]interface{})
+	if resultProperties == nil {
+		return
+	}
+
+	result := map[string]interface{}{}
+	for _, field := range []string{"Target", "Class", "Type"} {
+		result[field] = resultProperties[field]
+	}
+	properties["Result"] = map[string]interface{}{"properties": result}
+	properties["Vulnerability"] = resultProperties["Vulnerabilities"]
+}
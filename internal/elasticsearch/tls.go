@@ -0,0 +1,57 @@
+package elasticsearch
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+
+	"github.com/truemilk/trivelastic/internal/config"
+)
+
+// newTLSConfig builds the client TLS configuration. The CA bundle is added
+// to the system pool so that public and private clusters both verify. The
+// client certificate, if any, is presented to clusters that require mTLS.
+// Both are read from files or given as PEM content.
+func newTLSConfig(cfg config.TLSConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion:         cfg.Version(),
+		InsecureSkipVerify: cfg.SkipVerify,
+	}
+
+	if cfg.CAFile != "" || cfg.CA != "" {
+		pem, source := []byte(cfg.CA), "TRIVELASTIC_ES_TLS_CA"
+		if cfg.CAFile != "" {
+			var err error
+			if pem, err = os.ReadFile(cfg.CAFile); err != nil {
+				return nil, fmt.Errorf("error reading CA bundle: %w", err)
+			}
+			source = cfg.CAFile
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %s", source)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	switch {
+	case cfg.CertFile != "":
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	case cfg.Cert != "":
+		cert, err := tls.X509KeyPair([]byte(cfg.Cert), []byte(cfg.Key))
+		if err != nil {
+			return nil, fmt.Errorf("error loading client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
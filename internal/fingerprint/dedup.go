@@ -0,0 +1,108 @@
+package fingerprint
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/truemilk/trivelastic/internal/logger"
+)
+
+// DedupKey identifies the vulnerabilities found in an artifact: its digest,
+// or its name when it has none, and a hash of the set of vulnerabilities.
+// The order of results and vulnerabilities does not matter, nor do fields
+// that change between scans, such as CreatedAt.
+func DedupKey(doc map[string]interface{}) string {
+	artifact := artifactDigest(doc)
+	if artifact == "" {
+		artifact, _ = doc["ArtifactName"].(string)
+	}
+
+	var vulns []string
+	results, _ := doc["Results"].([]interface{})
+	for _, item := range results {
+		result, _ := item.(map[string]interface{})
+		list, _ := result["Vulnerabilities"].([]interface{})
+		for _, item := range list {
+			vuln, _ := item.(map[string]interface{})
+			fields := make([]string, 0, 5)
+			for _, field := range []string{"VulnerabilityID", "PkgName", "InstalledVersion", "FixedVersion", "Severity"} {
+				value, _ := vuln[field].(string)
+				fields = append(fields, value)
+			}
+			target, _ := result["Target"].(string)
+			vulns = append(vulns, target+"\x00"+strings.Join(fields, "\x00"))
+		}
+	}
+	sort.Strings(vulns)
+
+	sum := sha256.Sum256([]byte(artifact + "\x01" + strings.Join(vulns, "\x01")))
+	return hex.EncodeToString(sum[:])
+}
+
+// DedupWindow remembers the reports indexed recently, so that identical
+// back-to-back scans of the same artifact are only indexed once per window
+type DedupWindow struct {
+	window time.Duration
+	mu     sync.Mutex
+	seen   map[string]time.Time
+	// swept is when expired keys were last dropped
+	swept time.Time
+	now   func() time.Time
+	log   zerolog.Logger
+}
+
+func NewDedupWindow(window time.Duration) *DedupWindow {
+	return &DedupWindow{
+		window: window,
+		seen:   map[string]time.Time{},
+		now:    time.Now,
+		log:    logger.GetLogger("dedup"),
+	}
+}
+
+// Seen reports whether every one of keys was recorded within the window
+func (d *DedupWindow) Seen(keys []string) bool {
+	if len(keys) == 0 {
+		return false
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := d.now()
+	for _, key := range keys {
+		at, ok := d.seen[key]
+		if !ok || now.Sub(at) >= d.window {
+			return false
+		}
+	}
+	return true
+}
+
+// Record starts a new window for each of keys
+func (d *DedupWindow) Record(keys []string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := d.now()
+	for _, key := range keys {
+		d.seen[key] = now
+	}
+
+	// Drop expired keys once per window so memory stays bounded
+	if now.Sub(d.swept) < d.window {
+		return
+	}
+	for key, at := range d.seen {
+		if now.Sub(at) >= d.window {
+			delete(d.seen, key)
+		}
+	}
+	d.swept = now
+	d.log.Debug().
+		Int("keys", len(d.seen)).
+		Msg("Expired dedup keys dropped")
+}
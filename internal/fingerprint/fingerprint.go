@@ -0,0 +1,121 @@
+package fingerprint
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/truemilk/trivelastic/internal/elasticsearch"
+	"github.com/truemilk/trivelastic/internal/logger"
+)
+
+// Fingerprint identifies a scan result independently of when and where it ran
+type Fingerprint struct {
+	ID             string `json:"id"`
+	ArtifactName   string `json:"artifact_name,omitempty"`
+	ArtifactDigest string `json:"artifact_digest,omitempty"`
+	ResultsHash    string `json:"results_hash"`
+}
+
+// Compute derives the fingerprint of a Trivy report from its artifact digest
+// and a hash of its results. encoding/json sorts map keys, so the hash does
+// not depend on field order in the payload.
+func Compute(doc map[string]interface{}) (Fingerprint, error) {
+	results, err := json.Marshal(doc["Results"])
+	if err != nil {
+		return Fingerprint{}, err
+	}
+	resultsSum := sha256.Sum256(results)
+
+	fp := Fingerprint{
+		ArtifactDigest: artifactDigest(doc),
+		ResultsHash:    hex.EncodeToString(resultsSum[:]),
+	}
+	fp.ArtifactName, _ = doc["ArtifactName"].(string)
+
+	idSum := sha256.Sum256([]byte(fp.ArtifactDigest + "\x00" + fp.ArtifactName + "\x00" + fp.ResultsHash))
+	fp.ID = hex.EncodeToString(idSum[:])
+
+	return fp, nil
+}
+
+// artifactDigest prefers the repository digest and falls back to the image ID
+func artifactDigest(doc map[string]interface{}) string {
+	metadata, _ := doc["Metadata"].(map[string]interface{})
+	if digests, ok := metadata["RepoDigests"].([]interface{}); ok && len(digests) > 0 {
+		if digest, ok := digests[0].(string); ok {
+			return digest
+		}
+	}
+	imageID, _ := metadata["ImageID"].(string)
+	return imageID
+}
+
+// Tracker maintains one document per fingerprint in a dedicated index,
+// counting how often the same result was ingested
+type Tracker struct {
+	es    *elasticsearch.Client
+	index string
+	log   zerolog.Logger
+}
+
+func NewTracker(es *elasticsearch.Client, index string) *Tracker {
+	return &Tracker{
+		es:    es,
+		index: index,
+		log:   logger.GetLogger("fingerprint"),
+	}
+}
+
+// Record increments the counter for the report's fingerprint, creating it on first sight
+func (t *Tracker) Record(ctx context.Context, doc map[string]interface{}) error {
+	fp, err := Compute(doc)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	err = t.es.Update(ctx, t.index, fp.ID, map[string]interface{}{
+		"script": map[string]interface{}{
+			"source": "ctx._source.count += 1; ctx._source.last_seen = params.now",
+			"lang":   "painless",
+			"params": map[string]interface{}{"now": now},
+		},
+		"upsert": map[string]interface{}{
+			"artifact_name":   fp.ArtifactName,
+			"artifact_digest": fp.ArtifactDigest,
+			"results_hash":    fp.ResultsHash,
+			"count":           1,
+			"first_seen":      now,
+			"last_seen":       now,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	t.log.Debug().
+		Str("fingerprint", fp.ID).
+		Str("artifact_name", fp.ArtifactName).
+		Msg("Fingerprint recorded")
+	return nil
+}
+
+// Query returns up to size fingerprints seen at least minCount times, most frequent first
+func (t *Tracker) Query(ctx context.Context, minCount, size int) ([]map[string]interface{}, error) {
+	return t.es.Search(ctx, t.index, map[string]interface{}{
+		"size": size,
+		"query": map[string]interface{}{
+			"range": map[string]interface{}{
+				"count": map[string]interface{}{"gte": minCount},
+			},
+		},
+		"sort": []interface{}{
+			map[string]interface{}{"count": "desc"},
+			map[string]interface{}{"last_seen": "desc"},
+		},
+	})
+}
@@ -0,0 +1,55 @@
+package handler
+
+import (
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/truemilk/trivelastic/internal/logger"
+)
+
+// countingBody counts the bytes read from a request body
+type countingBody struct {
+	io.ReadCloser
+	bytes int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.bytes += int64(n)
+	return n, err
+}
+
+// logAccess writes a line per request at info level, with the component
+// "access" so that it can be told apart from the other logs
+func logAccess(exclude []string, next http.Handler) http.Handler {
+	log := logger.GetLogger("access")
+	skip := make(map[string]bool, len(exclude))
+	for _, path := range exclude {
+		skip[path] = true
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if skip[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		body := &countingBody{ReadCloser: r.Body}
+		r.Body = body
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		log.Info().
+			Str("method", r.Method).
+			Str("path", r.URL.Path).
+			Int("status", rec.status).
+			Dur("duration", time.Since(start)).
+			Int64("request_bytes", body.bytes).
+			Int64("response_bytes", rec.bytes).
+			Str("remote_addr", r.RemoteAddr).
+			Str("user_agent", r.UserAgent()).
+			Msg("Request")
+	})
+}
@@ -0,0 +1,82 @@
+package handler
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// maxVEXSize bounds uploaded OpenVEX documents
+const maxVEXSize = 10 << 20
+
+// requireAdmin wraps an admin handler with bearer-token authentication
+func (s *Server) requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.current().cfg.Admin.Token)) != 1 {
+			s.log.Warn().
+				Str("path", r.URL.Path).
+				Str("remote_addr", r.RemoteAddr).
+				Msg("Unauthorized admin request")
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handleAdminConfig returns the effective configuration with secrets masked
+func (s *Server) handleAdminConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.current().cfg.Redacted()); err != nil {
+		s.log.Error().
+			Err(err).
+			Msg("Failed to encode configuration")
+	}
+}
+
+// handleAdminVEX lists the loaded OpenVEX documents on GET, and stores an
+// uploaded one on POST. Uploads apply to every following report.
+func (s *Server) handleAdminVEX(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	switch r.Method {
+	case http.MethodGet:
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"documents": s.vex.Documents(),
+		})
+	case http.MethodPost:
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxVEXSize))
+		if err != nil {
+			http.Error(w, "Error reading body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		name, err := s.vex.Save(body)
+		if err != nil {
+			s.log.Warn().
+				Err(err).
+				Msg("Rejected OpenVEX document")
+			http.Error(w, "Invalid OpenVEX document: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		s.log.Info().
+			Str("file", name).
+			Msg("OpenVEX document uploaded")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "success",
+			"file":   name,
+		})
+	default:
+		http.Error(w, "Only GET and POST methods are allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,120 @@
+package handler
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/truemilk/trivelastic/internal/config"
+	"github.com/truemilk/trivelastic/internal/pipeline"
+)
+
+// authenticate rejects requests without one of tokens or a key that is not
+// revoked, before their body is read. The name of the key is recorded on the
+// request, see pipeline.WithAPIKey. Credentials are sent as bearer tokens or
+// in the X-API-Key header. Public routes of rt are not checked.
+func (s *Server) authenticate(rt *router, tokens []string, keys []config.APIKey, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rt.public(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		credential, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			credential = r.Header.Get("X-API-Key")
+		}
+
+		if key, found := findKey(credential, keys); found {
+			if key.Revoked {
+				s.log.Warn().
+					Str("api_key", key.Name).
+					Str("path", r.URL.Path).
+					Str("remote_addr", r.RemoteAddr).
+					Msg("Request with a revoked API key rejected")
+				http.Error(w, "API key revoked", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(pipeline.WithAPIKey(r.Context(), key.Name)))
+			return
+		}
+		if !validToken(credential, tokens) {
+			s.log.Warn().
+				Str("path", r.URL.Path).
+				Str("remote_addr", r.RemoteAddr).
+				Msg("Unauthorized request")
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// validToken compares token with every accepted token in constant time
+func validToken(token string, tokens []string) bool {
+	valid := 0
+	for _, t := range tokens {
+		valid |= subtle.ConstantTimeCompare([]byte(token), []byte(t))
+	}
+	return token != "" && valid == 1
+}
+
+// findKey returns the API key whose value is credential, comparing every key
+// in constant time
+func findKey(credential string, keys []config.APIKey) (config.APIKey, bool) {
+	var match config.APIKey
+	found := false
+	for _, key := range keys {
+		if subtle.ConstantTimeCompare([]byte(credential), []byte(key.Key)) == 1 {
+			match, found = key, true
+		}
+	}
+	return match, credential != "" && found
+}
+
+// SignatureHeader carries the HMAC-SHA256 of the request body, as
+// "sha256=<hex>" or the bare hex digest
+const SignatureHeader = "X-Trivelastic-Signature"
+
+// requireSignature rejects requests whose body does not match its
+// SignatureHeader, computed with secret. Public routes of rt are not checked.
+func (s *Server) requireSignature(rt *router, secret string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rt.public(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Error reading body: "+err.Error(), readErrorStatus(err))
+			return
+		}
+		if !validSignature(r.Header.Get(SignatureHeader), body, secret) {
+			s.log.Warn().
+				Str("path", r.URL.Path).
+				Str("remote_addr", r.RemoteAddr).
+				Msg("Request with an invalid signature rejected")
+			http.Error(w, "Invalid or missing "+SignatureHeader+" header", http.StatusUnauthorized)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		next.ServeHTTP(w, r)
+	})
+}
+
+// validSignature reports whether signature is the HMAC-SHA256 of body
+func validSignature(signature string, body []byte, secret string) bool {
+	signature = strings.TrimPrefix(signature, "sha256=")
+	got, err := hex.DecodeString(signature)
+	if err != nil || len(got) != sha256.Size {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(got, mac.Sum(nil))
+}
@@ -0,0 +1,106 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAuthenticate(t *testing.T) {
+	h, _ := newTestServer(t, map[string]string{"TRIVELASTIC_AUTH_TOKENS": "first,second"})
+
+	tests := []struct {
+		name    string
+		method  string
+		path    string
+		headers map[string]string
+		status  int
+	}{
+		{name: "bearer token", path: "/v1/reports", headers: map[string]string{"Authorization": "Bearer second"}, status: http.StatusOK},
+		{name: "token in X-API-Key", path: "/v1/reports", headers: map[string]string{"X-API-Key": "first"}, status: http.StatusOK},
+		{name: "missing", path: "/v1/reports", status: http.StatusUnauthorized},
+		{name: "wrong token", path: "/v1/reports", headers: map[string]string{"Authorization": "Bearer third"}, status: http.StatusUnauthorized},
+		{name: "not a bearer token", path: "/v1/reports", headers: map[string]string{"Authorization": "Basic first"}, status: http.StatusUnauthorized},
+		{name: "empty bearer token", path: "/v1/reports", headers: map[string]string{"Authorization": "Bearer "}, status: http.StatusUnauthorized},
+		{name: "deprecated root route", path: "/", status: http.StatusUnauthorized},
+		{name: "unknown path", path: "/anything", status: http.StatusUnauthorized},
+		{name: "public route", method: http.MethodGet, path: "/openapi.json", status: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method := tt.method
+			if method == "" {
+				method = http.MethodPost
+			}
+			var rec *httptest.ResponseRecorder
+			if method == http.MethodPost {
+				rec = post(h, tt.path, testReport, tt.headers)
+			} else {
+				rec = httptest.NewRecorder()
+				h.ServeHTTP(rec, httptest.NewRequest(method, tt.path, nil))
+			}
+
+			if rec.Code != tt.status {
+				t.Fatalf("expected %d, got %d: %s", tt.status, rec.Code, rec.Body)
+			}
+			if tt.status == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") != "Bearer" {
+				t.Fatal("expected a bearer challenge")
+			}
+		})
+	}
+}
+
+func TestAPIKeys(t *testing.T) {
+	keys := filepath.Join(t.TempDir(), "keys.json")
+	err := os.WriteFile(keys, []byte(`[
+		{"name": "ci", "key": "ci-secret"},
+		{"name": "old", "key": "old-secret", "revoked": true}
+	]`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, sink := newTestServer(t, map[string]string{
+		"TRIVELASTIC_AUTH_KEYS_FILE": keys,
+		"TRIVELASTIC_AUTH_TOKENS":    "token",
+	})
+	// Clients cannot claim a key of their own
+	forged := `{"SchemaVersion":2,"ArtifactName":"alpine:3.19","_trivelastic":{"api_key":"admin"}}`
+
+	tests := []struct {
+		name    string
+		body    string
+		headers map[string]string
+		status  int
+		apiKey  interface{}
+	}{
+		{name: "key in X-API-Key", body: testReport, headers: map[string]string{"X-API-Key": "ci-secret"}, status: http.StatusOK, apiKey: "ci"},
+		{name: "key as bearer token", body: testReport, headers: map[string]string{"Authorization": "Bearer ci-secret"}, status: http.StatusOK, apiKey: "ci"},
+		{name: "revoked key", body: testReport, headers: map[string]string{"X-API-Key": "old-secret"}, status: http.StatusUnauthorized},
+		{name: "unknown key", body: testReport, headers: map[string]string{"X-API-Key": "other"}, status: http.StatusUnauthorized},
+		{name: "forged key name with a token", body: forged, headers: map[string]string{"Authorization": "Bearer token"}, status: http.StatusOK},
+		{name: "forged key name with another key", body: forged, headers: map[string]string{"X-API-Key": "ci-secret"}, status: http.StatusOK, apiKey: "ci"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := len(sink.indexed("trivy"))
+			rec := post(h, "/v1/reports", tt.body, tt.headers)
+
+			if rec.Code != tt.status {
+				t.Fatalf("expected %d, got %d: %s", tt.status, rec.Code, rec.Body)
+			}
+			docs := sink.indexed("trivy")
+			if tt.status != http.StatusOK {
+				if len(docs) != before {
+					t.Fatal("expected nothing written")
+				}
+				return
+			}
+			meta, _ := docs[len(docs)-1]["_trivelastic"].(map[string]interface{})
+			if meta["api_key"] != tt.apiKey {
+				t.Fatalf("expected api_key %v, got %v", tt.apiKey, meta["api_key"])
+			}
+		})
+	}
+}
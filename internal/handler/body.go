@@ -0,0 +1,29 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// limitBody rejects request bodies larger than max bytes with 413, upfront
+// when the request declares its length and otherwise once max bytes are read
+func limitBody(max int64, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > max {
+			http.Error(w, fmt.Sprintf("Request body larger than %d bytes", max), http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, max)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// readErrorStatus is the status code answering a request whose body could not be read
+func readErrorStatus(err error) int {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
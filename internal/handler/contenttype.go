@@ -0,0 +1,45 @@
+package handler
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Media types of request bodies
+const (
+	mediaJSON      = "application/json"
+	mediaNDJSON    = "application/x-ndjson"
+	mediaMultipart = "multipart/form-data"
+)
+
+// requireContentType rejects requests whose Content-Type is not accepted by
+// their route with 415, before their body is read. Requests without a body,
+// such as GET requests, are not checked.
+func requireContentType(rt *router, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		accepted := rt.accepted(r)
+		if accepted == nil || r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions {
+			next.ServeHTTP(w, r)
+			return
+		}
+		contentType := r.Header.Get("Content-Type")
+		mediaType, _, err := mime.ParseMediaType(contentType)
+		if err == nil && slices.Contains(accepted, strings.ToLower(mediaType)) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Accept-Post", strings.Join(accepted, ", "))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":   "error",
+			"message":  "Unsupported Content-Type " + strconv.Quote(contentType),
+			"accepted": accepted,
+		})
+	})
+}
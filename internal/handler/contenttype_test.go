@@ -0,0 +1,47 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestContentType(t *testing.T) {
+	strict, _ := newTestServer(t, nil)
+	lenient, _ := newTestServer(t, map[string]string{"TRIVELASTIC_HTTP_STRICT_CONTENT_TYPE": "false"})
+
+	tests := []struct {
+		name        string
+		handler     http.Handler
+		path        string
+		contentType string
+		status      int
+	}{
+		{name: "JSON", handler: strict, path: "/v1/reports", contentType: "application/json", status: http.StatusOK},
+		{name: "JSON with charset", handler: strict, path: "/v1/reports", contentType: "application/json; charset=utf-8", status: http.StatusOK},
+		{name: "form", handler: strict, path: "/v1/reports", contentType: "application/x-www-form-urlencoded", status: http.StatusUnsupportedMediaType},
+		{name: "missing", handler: strict, path: "/v1/reports", status: http.StatusUnsupportedMediaType},
+		{name: "JSON to the batch route", handler: strict, path: "/v1/reports/_batch", contentType: "application/json", status: http.StatusUnsupportedMediaType},
+		{name: "NDJSON to the batch route", handler: strict, path: "/v1/reports/_batch", contentType: "application/x-ndjson", status: http.StatusOK},
+		{name: "deprecated root route", handler: strict, path: "/", contentType: "application/x-www-form-urlencoded", status: http.StatusOK},
+		{name: "disabled", handler: lenient, path: "/v1/reports", contentType: "application/x-www-form-urlencoded", status: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, tt.path, strings.NewReader(testReport))
+			if tt.contentType != "" {
+				r.Header.Set("Content-Type", tt.contentType)
+			}
+			rec := httptest.NewRecorder()
+			tt.handler.ServeHTTP(rec, r)
+
+			if rec.Code != tt.status {
+				t.Fatalf("expected %d, got %d: %s", tt.status, rec.Code, rec.Body)
+			}
+			if tt.status == http.StatusUnsupportedMediaType && rec.Header().Get("Accept-Post") == "" {
+				t.Fatal("expected the accepted types in Accept-Post")
+			}
+		})
+	}
+}
@@ -0,0 +1,58 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+const (
+	defaultFingerprintMinCount = 2
+	defaultFingerprintSize     = 100
+	maxFingerprintSize         = 1000
+)
+
+// handleFingerprints lists report fingerprints that were ingested repeatedly,
+// most frequent first. Query parameters: min_count (default 2), size (default 100).
+func (s *Server) handleFingerprints(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	minCount, err := intParam(r, "min_count", defaultFingerprintMinCount)
+	if err != nil || minCount < 1 {
+		http.Error(w, "min_count must be a positive integer", http.StatusBadRequest)
+		return
+	}
+	size, err := intParam(r, "size", defaultFingerprintSize)
+	if err != nil || size < 1 || size > maxFingerprintSize {
+		http.Error(w, "size must be between 1 and 1000", http.StatusBadRequest)
+		return
+	}
+
+	fingerprints, err := s.current().fingerprints.Query(r.Context(), minCount, size)
+	if err != nil {
+		s.log.Error().
+			Err(err).
+			Msg("Failed to query fingerprints")
+		http.Error(w, "Failed to query fingerprints", http.StatusBadGateway)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":       "success",
+		"fingerprints": fingerprints,
+	})
+}
+
+// intParam reads an integer query parameter, returning def when it is absent
+func intParam(r *http.Request, name string, def int) (int, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return def, nil
+	}
+	return strconv.Atoi(value)
+}
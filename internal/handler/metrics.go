@@ -0,0 +1,68 @@
+package handler
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/truemilk/trivelastic/internal/metrics"
+)
+
+// statusRecorder remembers the status code and size of a response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	return n, err
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// countRequests counts the requests served by next by route and status code.
+// Routes are the patterns of mux, so that arbitrary paths do not create new series.
+func countRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		metrics.HTTPRequests.Inc(r.Pattern, strconv.Itoa(rec.status))
+	})
+}
+
+// serveMetrics serves /metrics on the dedicated metrics port
+func (s *Server) serveMetrics(port string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	srv := &http.Server{
+		Addr:              ":" + port,
+		Handler:           mux,
+		ReadHeaderTimeout: s.cfg.HTTP.ReadHeaderTimeout,
+	}
+	s.log.Info().
+		Str("port", port).
+		Msg("Serving metrics")
+	if err := srv.ListenAndServe(); err != nil {
+		s.log.Error().
+			Err(err).
+			Str("port", port).
+			Msg("Failed to start metrics server")
+	}
+}
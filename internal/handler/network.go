@@ -0,0 +1,68 @@
+package handler
+
+import (
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// clientAddr returns the address of the client of r. Behind trusted
+// proxies, it is the last address of X-Forwarded-For that was not added by
+// a trusted proxy, since earlier ones can be forged by the client.
+func clientAddr(r *http.Request, trusted []netip.Prefix) (netip.Addr, bool) {
+	remote, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	addr := remote.Addr().Unmap()
+	if !contains(trusted, addr) {
+		return addr, true
+	}
+
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			return netip.Addr{}, false
+		}
+		addr = hop.Unmap()
+		if !contains(trusted, addr) {
+			break
+		}
+	}
+	return addr, true
+}
+
+func contains(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowNetworks rejects requests from clients outside allowed with 403,
+// before their body is read. Health checks, metrics and the OpenAPI
+// document are served to any address.
+func (s *Server) allowNetworks(rt *router, allowed, trusted []netip.Prefix, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rt.unauthenticated(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if addr, ok := clientAddr(r, trusted); !ok || !contains(allowed, addr) {
+			s.log.Warn().
+				Str("client", addr.String()).
+				Str("remote_addr", r.RemoteAddr).
+				Str("path", r.URL.Path).
+				Msg("Request from a network that is not allowed")
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,418 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/truemilk/trivelastic/internal/config"
+)
+
+// object is a JSON object of the OpenAPI document
+type object = map[string]interface{}
+
+// handleOpenAPI serves the OpenAPI 3 document of the routes of the current
+// configuration
+func (s *Server) handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	st := s.current()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(openAPI(st.cfg, st.fingerprints != nil, s.vex != nil))
+}
+
+// openAPI describes the routes served for cfg
+func openAPI(cfg *config.Config, fingerprints, vex bool) object {
+	paths := object{
+		"/v1/reports": object{"post": ingestOperation("ingestReport", "Ingest a report",
+			"Runs a Trivy report, Kubernetes report, Trivy Operator resource or SBOM through the default pipeline and writes it to Elasticsearch.")},
+		"/v1/reports/_batch": object{"post": batchOperation("ingestBatch", "Ingest many reports",
+			"Accepts newline-delimited JSON, one report per line, and writes the documents of every valid line with a single bulk request.")},
+		"/v1/reports/_upload": object{"post": uploadOperation("uploadReports", "Upload report files",
+			"Accepts one or more report files as multipart/form-data, such as curl -F report=@result.json, and writes them as a batch.")},
+		"/v1/jobs/{id}": object{"get": object{
+			"summary":     "Read the status of an asynchronous job",
+			"operationId": "getJob",
+			"parameters": []object{{
+				"name": "id", "in": "path", "required": true,
+				"schema": object{"type": "string"},
+			}},
+			"responses": withErrors(object{
+				"200": jsonResponse("Job status", ref("Job")),
+			}, "401", "404"),
+		}},
+		"/api/v1/simulate": object{"post": object{
+			"summary":     "Simulate the pipeline",
+			"description": "Returns the documents that would be written for a report and their target indices, without writing anything.",
+			"operationId": "simulate",
+			"requestBody": reportBody(),
+			"responses": withErrors(object{
+				"200": jsonResponse("Documents that would be written", ref("SimulateResponse")),
+			}, "400", "401", "413", "415", "422", "429"),
+		}},
+		"/readyz": object{"get": object{
+			"summary":     "Readiness probe",
+			"operationId": "ready",
+			"security":    []object{},
+			"responses": object{
+				"200": jsonResponse("Elasticsearch accepts the credentials", ref("Ready")),
+				"503": jsonResponse("Elasticsearch rejected the credentials", ref("Ready")),
+			},
+		}},
+		"/openapi.json": object{"get": object{
+			"summary":     "This document",
+			"operationId": "openapi",
+			"security":    []object{},
+			"responses":   object{"200": jsonResponse("OpenAPI 3 document", object{"type": "object"})},
+		}},
+	}
+	if fingerprints {
+		paths["/api/v1/fingerprints"] = object{"get": object{
+			"summary":     "List reports ingested repeatedly",
+			"operationId": "listFingerprints",
+			"parameters": []object{
+				{"name": "min_count", "in": "query", "schema": object{"type": "integer", "minimum": 1, "default": defaultFingerprintMinCount}},
+				{"name": "size", "in": "query", "schema": object{"type": "integer", "minimum": 1, "maximum": maxFingerprintSize, "default": defaultFingerprintSize}},
+			},
+			"responses": withErrors(object{
+				"200": jsonResponse("Fingerprints, most frequent first", object{"type": "object"}),
+			}, "400", "401", "502"),
+		}}
+	}
+	if len(cfg.Tenants.Indices) > 0 {
+		tenant := func(op object) object {
+			op["parameters"] = append([]object{{
+				"name": "tenant", "in": "path", "required": true,
+				"schema": object{"type": "string", "enum": cfg.Tenants.Names()},
+			}}, op["parameters"].([]object)...)
+			op["responses"] = withErrors(op["responses"].(object), "404")
+			return object{"post": op}
+		}
+		paths["/v1/t/{tenant}/reports"] = tenant(ingestOperation("ingestTenantReport", "Ingest a report for a tenant",
+			"Writes a report to the index of the tenant and records the tenant in _trivelastic.tenant."))
+		paths["/v1/t/{tenant}/reports/_batch"] = tenant(batchOperation("ingestTenantBatch", "Ingest many reports for a tenant",
+			"Accepts newline-delimited JSON, one report per line, and writes every valid line to the index of the tenant."))
+		paths["/v1/t/{tenant}/reports/_upload"] = tenant(uploadOperation("uploadTenantReports", "Upload report files for a tenant",
+			"Accepts report files as multipart/form-data and writes them as a batch to the index of the tenant."))
+	}
+	for _, pc := range cfg.Pipelines {
+		paths[pc.Path] = object{"post": ingestOperation("ingestReport_"+pc.Name, "Ingest a report with the "+pc.Name+" pipeline",
+			"Runs a report through the "+pc.Name+" pipeline, which writes to "+pc.Index+".")}
+		paths[pc.Path+"/_batch"] = object{"post": batchOperation("ingestBatch_"+pc.Name, "Ingest many reports with the "+pc.Name+" pipeline",
+			"Accepts newline-delimited JSON, one report per line, and runs every line through the "+pc.Name+" pipeline, which writes to "+pc.Index+".")}
+		paths[pc.Path+"/_upload"] = object{"post": uploadOperation("uploadReports_"+pc.Name, "Upload report files for the "+pc.Name+" pipeline",
+			"Accepts report files as multipart/form-data and runs them through the "+pc.Name+" pipeline as a batch.")}
+	}
+	if cfg.Metrics.Enabled && cfg.Metrics.Port == "" {
+		paths["/metrics"] = object{"get": object{
+			"summary":     "Prometheus metrics",
+			"operationId": "metrics",
+			"security":    []object{},
+			"responses": object{"200": object{
+				"description": "Metrics in the Prometheus text format",
+				"content":     object{"text/plain": object{"schema": object{"type": "string"}}},
+			}},
+		}}
+	}
+	if cfg.Admin.Token != "" {
+		admin := []object{{"adminToken": []string{}}}
+		paths["/admin/config"] = object{"get": object{
+			"summary":     "Read the effective configuration, secrets masked",
+			"operationId": "getConfig",
+			"security":    admin,
+			"responses":   withErrors(object{"200": jsonResponse("Configuration", object{"type": "object"})}, "401"),
+		}}
+		if vex {
+			paths["/admin/vex"] = object{
+				"get": object{
+					"summary":     "List the loaded OpenVEX documents",
+					"operationId": "listVEX",
+					"security":    admin,
+					"responses":   withErrors(object{"200": jsonResponse("OpenVEX documents", object{"type": "object"})}, "401"),
+				},
+				"post": object{
+					"summary":     "Upload an OpenVEX document",
+					"operationId": "uploadVEX",
+					"security":    admin,
+					"requestBody": object{
+						"required": true,
+						"content":  object{"application/json": object{"schema": object{"type": "object"}}},
+					},
+					"responses": withErrors(object{"200": jsonResponse("Document applied", object{"type": "object"})}, "400", "401", "413", "415"),
+				},
+			}
+		}
+	}
+
+	schemes := object{}
+	var security []object
+	if len(cfg.Auth.TokenList()) > 0 || len(cfg.Auth.Keys) > 0 {
+		schemes["bearer"] = object{"type": "http", "scheme": "bearer"}
+		security = append(security, object{"bearer": []string{}})
+	}
+	if len(cfg.Auth.Keys) > 0 {
+		schemes["apiKey"] = object{"type": "apiKey", "in": "header", "name": "X-API-Key"}
+		security = append(security, object{"apiKey": []string{}})
+	}
+	if cfg.Admin.Token != "" {
+		schemes["adminToken"] = object{"type": "http", "scheme": "bearer"}
+	}
+
+	doc := object{
+		"openapi": "3.0.3",
+		"info": object{
+			"title":       "trivelastic",
+			"description": "Ingests Trivy reports into Elasticsearch.",
+			"version":     "v1",
+		},
+		"paths": paths,
+		"components": object{
+			"schemas":         openAPISchemas(),
+			"securitySchemes": schemes,
+		},
+	}
+	if security != nil {
+		doc["security"] = security
+	}
+	return doc
+}
+
+// ingestOperation describes a route accepting a single report
+func ingestOperation(id, summary, description string) object {
+	return object{
+		"operationId": id,
+		"summary":     summary,
+		"description": description,
+		"parameters": []object{{
+			"name":        "async",
+			"in":          "query",
+			"description": "Answer 202 with a job ID as soon as the report is validated",
+			"schema":      object{"type": "boolean"},
+		}},
+		"requestBody": reportBody(),
+		"responses": withErrors(object{
+			"200": jsonResponse("Report stored, spooled or skipped as a duplicate", ref("IngestResponse")),
+			"202": jsonResponse("Report accepted for asynchronous indexing", ref("Accepted")),
+			"422": jsonResponse("Payload is not a valid Trivy report", ref("ValidationError")),
+		}, "400", "401", "413", "415", "429", "502", "503"),
+	}
+}
+
+// batchOperation describes a route accepting newline-delimited reports
+func batchOperation(id, summary, description string) object {
+	return object{
+		"operationId": id,
+		"summary":     summary,
+		"description": description,
+		"parameters":  []object{asyncBatchParameter()},
+		"requestBody": object{
+			"required": true,
+			"content":  object{"application/x-ndjson": object{"schema": object{"type": "string"}}},
+		},
+		"responses": withErrors(object{
+			"200": jsonResponse("Status of every line", ref("BatchResponse")),
+			"202": jsonResponse("Lines accepted for asynchronous indexing", ref("BatchResponse")),
+		}, "400", "401", "413", "415", "429", "502", "503"),
+	}
+}
+
+// uploadOperation describes a route accepting report files
+func uploadOperation(id, summary, description string) object {
+	return object{
+		"operationId": id,
+		"summary":     summary,
+		"description": description,
+		"parameters":  []object{asyncBatchParameter()},
+		"requestBody": object{
+			"required": true,
+			"content": object{"multipart/form-data": object{"schema": object{
+				"type": "object",
+				"properties": object{"report": object{
+					"type":  "array",
+					"items": object{"type": "string", "format": "binary"},
+				}},
+			}}},
+		},
+		"responses": withErrors(object{
+			"200": jsonResponse("Status of every file", ref("BatchResponse")),
+			"202": jsonResponse("Files accepted for asynchronous indexing", ref("BatchResponse")),
+		}, "400", "401", "413", "415", "429", "502", "503"),
+	}
+}
+
+func asyncBatchParameter() object {
+	return object{
+		"name":        "async",
+		"in":          "query",
+		"description": "Answer 202 with a job ID as soon as the reports are validated",
+		"schema":      object{"type": "boolean"},
+	}
+}
+
+func reportBody() object {
+	return object{
+		"required": true,
+		"content":  object{"application/json": object{"schema": ref("Report")}},
+	}
+}
+
+func jsonResponse(description string, schema object) object {
+	return object{
+		"description": description,
+		"content":     object{"application/json": object{"schema": schema}},
+	}
+}
+
+func ref(name string) object {
+	return object{"$ref": "#/components/schemas/" + name}
+}
+
+// errorDescriptions describe the error statuses shared by the routes
+var errorDescriptions = map[string]string{
+	"400": "Malformed request",
+	"401": "Missing or invalid credentials",
+	"404": "Not found",
+	"413": "Request body over the size limit",
+	"415": "Content-Type not accepted by the route",
+	"429": "Too many requests, see Retry-After",
+	"502": "Elasticsearch request failed",
+	"503": "Elasticsearch is unavailable",
+}
+
+// withErrors adds the given error statuses to responses
+func withErrors(responses object, codes ...string) object {
+	for _, code := range codes {
+		if _, ok := responses[code]; ok {
+			continue
+		}
+		if code == "415" {
+			responses[code] = jsonResponse(errorDescriptions[code], ref("UnsupportedMediaType"))
+			continue
+		}
+		responses[code] = object{
+			"description": errorDescriptions[code],
+			"content":     object{"text/plain": object{"schema": object{"type": "string"}}},
+		}
+	}
+	return responses
+}
+
+func openAPISchemas() object {
+	str := object{"type": "string"}
+	warnings := object{"type": "array", "items": ref("Warning")}
+	documents := object{"type": "array", "items": ref("Document")}
+	return object{
+		"Report": object{
+			"type":                 "object",
+			"description":          "Trivy JSON report, Kubernetes report, Trivy Operator resource, CycloneDX or SPDX SBOM",
+			"additionalProperties": true,
+		},
+		"Document": object{
+			"type":        "object",
+			"description": "Location of a document written to Elasticsearch",
+			"properties":  object{"index": str, "id": str},
+		},
+		"Warning": object{
+			"type": "object",
+			"properties": object{
+				"transform": str,
+				"level":     object{"type": "string", "enum": []string{"warning", "error"}},
+				"field":     str,
+				"message":   str,
+			},
+		},
+		"IngestResponse": object{
+			"type": "object",
+			"properties": object{
+				"status":       object{"type": "string", "enum": []string{"success", "warning", "error"}},
+				"message":      str,
+				"duplicate":    object{"type": "boolean"},
+				"queued":       object{"type": "boolean"},
+				"fingerprints": object{"type": "array", "items": str},
+				"documents":    documents,
+				"warnings":     warnings,
+				"data":         ref("Report"),
+			},
+		},
+		"Accepted": object{
+			"type": "object",
+			"properties": object{
+				"status":   object{"type": "string", "enum": []string{"accepted"}},
+				"message":  str,
+				"job_id":   str,
+				"warnings": warnings,
+			},
+		},
+		"Job": object{
+			"type": "object",
+			"properties": object{
+				"id":        str,
+				"status":    object{"type": "string", "enum": []string{"pending", "indexed", "spooled", "failed"}},
+				"error":     str,
+				"warnings":  warnings,
+				"documents": documents,
+				"accepted":  object{"type": "string", "format": "date-time"},
+				"finished":  object{"type": "string", "format": "date-time"},
+			},
+		},
+		"BatchResponse": object{
+			"type": "object",
+			"properties": object{
+				"status":     object{"type": "string", "enum": []string{"success", "partial", "error", "accepted"}},
+				"message":    str,
+				"job_id":     str,
+				"accepted":   object{"type": "integer"},
+				"indexed":    object{"type": "integer"},
+				"queued":     object{"type": "integer"},
+				"duplicates": object{"type": "integer"},
+				"errors":     object{"type": "integer"},
+				"items": object{"type": "array", "items": object{
+					"type": "object",
+					"properties": object{
+						"line":      object{"type": "integer"},
+						"file":      str,
+						"status":    object{"type": "string", "enum": []string{"indexed", "queued", "duplicate", "error", "accepted"}},
+						"error":     str,
+						"problems":  object{"type": "array", "items": ref("Problem")},
+						"warnings":  warnings,
+						"documents": documents,
+					},
+				}},
+			},
+		},
+		"SimulateResponse": object{
+			"type": "object",
+			"properties": object{
+				"status":    str,
+				"applied":   object{"type": "array", "items": str},
+				"warnings":  warnings,
+				"documents": object{"type": "array", "items": object{"type": "object"}},
+			},
+		},
+		"Problem": object{
+			"type":       "object",
+			"properties": object{"field": str, "message": str},
+		},
+		"ValidationError": object{
+			"type": "object",
+			"properties": object{
+				"status":   str,
+				"message":  str,
+				"problems": object{"type": "array", "items": ref("Problem")},
+			},
+		},
+		"UnsupportedMediaType": object{
+			"type": "object",
+			"properties": object{
+				"status":   str,
+				"message":  str,
+				"accepted": object{"type": "array", "items": str},
+			},
+		},
+		"Ready": object{
+			"type":       "object",
+			"properties": object{"status": object{"type": "string", "enum": []string{"ready", "unavailable"}}, "error": str},
+		},
+	}
+}
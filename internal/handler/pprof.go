@@ -0,0 +1,31 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/pprof"
+)
+
+// servePprof serves the net/http/pprof profiles on addr, a loopback address
+// since the profiles are not authenticated
+func (s *Server) servePprof(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: s.cfg.HTTP.ReadHeaderTimeout,
+	}
+	s.log.Info().
+		Str("addr", addr).
+		Msg("Serving pprof profiles")
+	if err := srv.ListenAndServe(); err != nil {
+		s.log.Error().
+			Err(err).
+			Str("addr", addr).
+			Msg("Failed to start pprof server")
+	}
+}
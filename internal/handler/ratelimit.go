@@ -0,0 +1,106 @@
+package handler
+
+import (
+	"math"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/truemilk/trivelastic/internal/config"
+	"github.com/truemilk/trivelastic/internal/metrics"
+	"github.com/truemilk/trivelastic/internal/pipeline"
+)
+
+// maxIdleBuckets is the number of client buckets kept before full ones are dropped
+const maxIdleBuckets = 10000
+
+// bucket is the token bucket of a client
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter keeps a token bucket per client
+type rateLimiter struct {
+	cfg config.RateLimitConfig
+	// trusted are the proxies whose X-Forwarded-For gives the client address
+	trusted []netip.Prefix
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+func newRateLimiter(cfg config.RateLimitConfig, trusted []netip.Prefix) *rateLimiter {
+	return &rateLimiter{cfg: cfg, trusted: trusted, buckets: map[string]*bucket{}}
+}
+
+// allow takes a token from the bucket of key. When the bucket is empty it
+// returns false and how long until the next token.
+func (l *rateLimiter) allow(key string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= maxIdleBuckets {
+			l.prune(now)
+		}
+		b = &bucket{tokens: float64(l.cfg.Burst), last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(l.cfg.Burst), b.tokens+now.Sub(b.last).Seconds()*l.cfg.Rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.cfg.Rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// prune drops the buckets that have refilled, which behave like new ones.
+// The caller must hold mu.
+func (l *rateLimiter) prune(now time.Time) {
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.cfg.Rate >= float64(l.cfg.Burst) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// key identifies the client of a request
+func (l *rateLimiter) key(r *http.Request) string {
+	if l.cfg.Key == config.RateLimitByAPIKey {
+		if name, ok := pipeline.APIKeyName(r.Context()); ok {
+			return "key:" + name
+		}
+	}
+	if addr, ok := clientAddr(r, l.trusted); ok {
+		return "ip:" + addr.String()
+	}
+	return "ip:" + r.RemoteAddr
+}
+
+// rateLimit rejects requests of clients over their rate with 429 and a
+// Retry-After header. Health checks and metrics are not limited.
+func (s *Server) rateLimit(rt *router, cfg config.RateLimitConfig, trusted []netip.Prefix, next http.Handler) http.Handler {
+	limiter := newRateLimiter(cfg, trusted)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rt.unauthenticated(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		key := limiter.key(r)
+		if ok, wait := limiter.allow(key, time.Now()); !ok {
+			s.log.Warn().
+				Str("client", key).
+				Str("path", r.URL.Path).
+				Msg("Request rate limited")
+			metrics.RateLimited.Inc()
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(w, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
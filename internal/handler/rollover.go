@@ -0,0 +1,66 @@
+package handler
+
+import (
+	"context"
+	"time"
+
+	"github.com/truemilk/trivelastic/internal/config"
+	"github.com/truemilk/trivelastic/internal/indexname"
+)
+
+// rolloverLoop checks the rollover conditions of every write alias each interval
+func (s *Server) rolloverLoop(interval time.Duration) {
+	s.log.Info().
+		Dur("interval", interval).
+		Msg("Rollover scheduling enabled")
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.rollover(s.current())
+	}
+}
+
+// rollover rolls every write alias over whose conditions are met
+func (s *Server) rollover(st *state) {
+	if !st.cfg.ES.Rollover.Enabled {
+		return
+	}
+
+	for _, alias := range rolloverAliases(st.cfg) {
+		ctx, cancel := context.WithTimeout(context.Background(), clusterCheckTimeout)
+		result, err := st.es.Rollover(ctx, alias, st.cfg.ES.Rollover)
+		cancel()
+		if err != nil {
+			s.log.Error().
+				Err(err).
+				Str("alias", alias).
+				Msg("Failed to roll write alias over")
+			continue
+		}
+		if !result.RolledOver {
+			s.log.Debug().
+				Str("alias", alias).
+				Msg("Rollover conditions not met")
+			continue
+		}
+		s.log.Info().
+			Str("alias", alias).
+			Str("old_index", result.OldIndex).
+			Str("new_index", result.NewIndex).
+			Interface("conditions", result.Conditions).
+			Msg("Write alias rolled over")
+	}
+}
+
+// rolloverAliases lists the target indices written through a write alias.
+// Time-based names are already partitioned and are not rolled over.
+func rolloverAliases(cfg *config.Config) []string {
+	var aliases []string
+	for _, index := range targetIndices(cfg) {
+		if !indexname.HasPattern(index) {
+			aliases = append(aliases, index)
+		}
+	}
+	return aliases
+}
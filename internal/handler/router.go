@@ -0,0 +1,99 @@
+package handler
+
+import (
+	"net/http"
+)
+
+// middleware wraps a handler, e.g. to authenticate its requests
+type middleware func(http.Handler) http.Handler
+
+// chain wraps h with middleware, the first one outermost
+func chain(h http.Handler, middleware ...middleware) http.Handler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		h = middleware[i](h)
+	}
+	return h
+}
+
+// router dispatches the requests of one configuration to its routes. Each
+// route may have middleware of its own, on top of the middleware shared by
+// every route, see Server.middleware.
+type router struct {
+	mux *http.ServeMux
+	// patterns lists the registered patterns in order
+	patterns []string
+	// accepts maps patterns to the media types of the request bodies they
+	// accept, see requireContentType
+	accepts map[string][]string
+	// open lists the patterns served to any client: health checks, metrics
+	// and the OpenAPI document. admin lists the patterns checking the admin
+	// token instead of API credentials.
+	open  map[string]bool
+	admin map[string]bool
+}
+
+func newRouter() *router {
+	return &router{
+		mux:     http.NewServeMux(),
+		accepts: map[string][]string{},
+		open:    map[string]bool{},
+		admin:   map[string]bool{},
+	}
+}
+
+// pattern returns the registered pattern serving r
+func (rt *router) pattern(r *http.Request) string {
+	_, pattern := rt.mux.Handler(r)
+	return pattern
+}
+
+// unauthenticated reports whether r is served by an open route, which skips
+// client certificates, network restrictions and rate limits as well
+func (rt *router) unauthenticated(r *http.Request) bool {
+	return rt.open[rt.pattern(r)]
+}
+
+// public reports whether r is served without API credentials: by an open
+// route, or by an admin route, which checks the admin token
+func (rt *router) public(r *http.Request) bool {
+	pattern := rt.pattern(r)
+	return rt.open[pattern] || rt.admin[pattern]
+}
+
+// accept restricts the request bodies of pattern to the given media types
+func (rt *router) accept(pattern string, mediaTypes ...string) {
+	rt.accepts[pattern] = mediaTypes
+}
+
+// accepted returns the media types accepted by the route of r, nil when
+// any body is accepted
+func (rt *router) accepted(r *http.Request) []string {
+	return rt.accepts[rt.pattern(r)]
+}
+
+// handle serves h at pattern, see http.ServeMux for the pattern syntax
+func (rt *router) handle(pattern string, h http.Handler, middleware ...middleware) {
+	rt.mux.Handle(pattern, chain(h, middleware...))
+	rt.patterns = append(rt.patterns, pattern)
+}
+
+func (rt *router) handleFunc(pattern string, h http.HandlerFunc, middleware ...middleware) {
+	rt.handle(pattern, h, middleware...)
+}
+
+func (rt *router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rt.mux.ServeHTTP(w, r)
+}
+
+// route is a route added by an embedder, see Server.Handle
+type route struct {
+	pattern string
+	handler http.Handler
+}
+
+// Handle serves h at pattern next to the built-in routes, behind the same
+// middleware. It must be called before Init, and the route is kept across
+// configuration reloads.
+func (s *Server) Handle(pattern string, h http.Handler) {
+	s.extraRoutes = append(s.extraRoutes, route{pattern: pattern, handler: h})
+}
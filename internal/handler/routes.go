@@ -0,0 +1,243 @@
+package handler
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/truemilk/trivelastic/internal/chaos"
+	"github.com/truemilk/trivelastic/internal/config"
+	"github.com/truemilk/trivelastic/internal/diff"
+	"github.com/truemilk/trivelastic/internal/metrics"
+)
+
+// routes registers every route of st
+func (s *Server) routes(st *state, diffs *diff.Tracker) {
+	cfg, rt := st.cfg, st.router
+	for _, v := range apiVersions {
+		v.routes(s, v, rt)
+	}
+	// Any Content-Type, as before the API was versioned
+	rt.handleFunc("/", s.deprecatedIngest)
+	s.unversionedTenantRoutes(rt)
+	rt.handleFunc("/api/v1/simulate", s.handleSimulate)
+	rt.accept("/api/v1/simulate", mediaJSON)
+	rt.handleFunc("/readyz", s.handleReady)
+	rt.open["/readyz"] = true
+	rt.handleFunc("/openapi.json", s.handleOpenAPI)
+	rt.open["/openapi.json"] = true
+	if st.fingerprints != nil {
+		rt.handleFunc("/api/v1/fingerprints", s.handleFingerprints)
+	}
+
+	// Named pipelines each get their own path, with batches and uploads
+	// under it
+	for _, pc := range cfg.Pipelines {
+		pl := s.newPipeline(cfg, pc.Index, pc.SanitizeProfile, diffs)
+		rt.handleFunc(pc.Path, func(w http.ResponseWriter, r *http.Request) {
+			s.workerPool.SubmitTo(pl, w, r)
+		})
+		rt.accept(pc.Path, mediaJSON)
+		rt.handleFunc(pc.Path+"/_batch", func(w http.ResponseWriter, r *http.Request) {
+			s.workerPool.SubmitBatchTo(pl, w, r)
+		})
+		rt.accept(pc.Path+"/_batch", mediaNDJSON)
+		rt.handleFunc(pc.Path+"/_upload", func(w http.ResponseWriter, r *http.Request) {
+			s.workerPool.SubmitUploadTo(pl, w, r)
+		})
+		rt.accept(pc.Path+"/_upload", mediaMultipart)
+		s.log.Info().
+			Str("pipeline", pc.Name).
+			Str("path", pc.Path).
+			Msg("Pipeline route registered")
+	}
+
+	if cfg.Metrics.Enabled && cfg.Metrics.Port == "" {
+		rt.handle("/metrics", metrics.Handler())
+		rt.open["/metrics"] = true
+	}
+
+	// Admin endpoints are only exposed when a token is configured
+	if cfg.Admin.Token != "" {
+		rt.handleFunc("/admin/config", s.handleAdminConfig, s.requireAdmin)
+		rt.admin["/admin/config"] = true
+		if s.vex != nil {
+			rt.handleFunc("/admin/vex", s.handleAdminVEX, s.requireAdmin)
+			rt.accept("/admin/vex", mediaJSON)
+			rt.admin["/admin/vex"] = true
+		}
+	}
+
+	for _, extra := range s.extraRoutes {
+		rt.handle(extra.pattern, extra.handler)
+	}
+}
+
+// middleware returns the middleware wrapping every route of st, outermost first
+func (s *Server) middleware(st *state) []middleware {
+	cfg := st.cfg
+	var mw []middleware
+	// Outermost, so that requests rejected by any middleware are logged
+	if cfg.Log.Access {
+		mw = append(mw, func(next http.Handler) http.Handler {
+			return logAccess(cfg.Log.AccessExclude, next)
+		})
+	}
+	if cfg.Metrics.Enabled {
+		mw = append(mw, countRequests)
+	}
+	// Validated by config.Load
+	allowed, _ := config.ParsePrefixes(cfg.Network.AllowedCIDRs)
+	trusted, _ := config.ParsePrefixes(cfg.Network.TrustedProxies)
+	if len(allowed) > 0 {
+		mw = append(mw, func(next http.Handler) http.Handler {
+			return s.allowNetworks(st.router, allowed, trusted, next)
+		})
+	}
+	// Before authentication, since preflight requests have no credentials
+	if len(cfg.CORS.AllowedOrigins) > 0 {
+		mw = append(mw, func(next http.Handler) http.Handler {
+			return allowCORS(cfg.CORS, next)
+		})
+	}
+	// The listener is only configured at startup, see Reload
+	if s.cfg.TLS.ClientAuth == config.ClientAuthRequire {
+		mw = append(mw, func(next http.Handler) http.Handler {
+			return s.requireClientCert(st.router, next)
+		})
+	}
+	if cfg.Chaos.Enabled {
+		mw = append(mw, func(next http.Handler) http.Handler {
+			return chaos.Middleware(cfg.Chaos, next)
+		})
+	}
+	// Tokens and keys are rotated by reloading the configuration
+	if tokens := cfg.Auth.TokenList(); len(tokens) > 0 || len(cfg.Auth.Keys) > 0 {
+		mw = append(mw, func(next http.Handler) http.Handler {
+			return s.authenticate(st.router, tokens, cfg.Auth.Keys, next)
+		})
+	}
+	if cfg.HTTP.MaxBodySize > 0 {
+		mw = append(mw, func(next http.Handler) http.Handler {
+			return limitBody(cfg.HTTP.MaxBodySize, next)
+		})
+	}
+	// Limit after authentication, so that API keys are known, and before
+	// anything reads the body
+	if cfg.RateLimit.Rate > 0 {
+		mw = append(mw, func(next http.Handler) http.Handler {
+			return s.rateLimit(st.router, cfg.RateLimit, trusted, next)
+		})
+	}
+	// Before the signature, which reads the body
+	if cfg.HTTP.StrictContentType {
+		mw = append(mw, func(next http.Handler) http.Handler {
+			return requireContentType(st.router, next)
+		})
+	}
+	if cfg.Auth.SignatureSecret != "" {
+		mw = append(mw, func(next http.Handler) http.Handler {
+			return s.requireSignature(st.router, cfg.Auth.SignatureSecret, next)
+		})
+	}
+	return mw
+}
+
+// apiVersion registers the ingest routes of one version of the API under
+// /<name>/. A new version gets its own routes function, so that clients of
+// earlier versions keep working.
+type apiVersion struct {
+	name   string
+	routes func(s *Server, v apiVersion, rt *router)
+}
+
+// apiVersions are the versions of the ingest API served, oldest first
+var apiVersions = []apiVersion{
+	{name: "v1", routes: (*Server).routesV1},
+}
+
+// path returns the path of route in this version
+func (v apiVersion) path(route string) string {
+	return "/" + v.name + route
+}
+
+func (s *Server) routesV1(v apiVersion, rt *router) {
+	rt.handleFunc(v.path("/reports"), s.handleRequest)
+	rt.accept(v.path("/reports"), mediaJSON)
+	rt.handleFunc(v.path("/reports/_batch"), s.handleBatch)
+	rt.accept(v.path("/reports/_batch"), mediaNDJSON)
+	rt.handleFunc(v.path("/reports/_upload"), s.handleUpload)
+	rt.accept(v.path("/reports/_upload"), mediaMultipart)
+	rt.handleFunc(v.path("/t/{tenant}/reports"), s.handleTenant)
+	rt.accept(v.path("/t/{tenant}/reports"), mediaJSON)
+	rt.handleFunc(v.path("/t/{tenant}/reports/_batch"), s.handleTenantBatch)
+	rt.accept(v.path("/t/{tenant}/reports/_batch"), mediaNDJSON)
+	rt.handleFunc(v.path("/t/{tenant}/reports/_upload"), s.handleTenantUpload)
+	rt.accept(v.path("/t/{tenant}/reports/_upload"), mediaMultipart)
+	rt.handleFunc(v.path("/jobs/{id}"), s.handleJob)
+}
+
+// unversionedTenantRoutes serves the tenant routes under /t/ as well, where
+// they were first requested. They are deprecated like the root route, in
+// favour of the same paths under /v1.
+func (s *Server) unversionedTenantRoutes(rt *router) {
+	for _, route := range []struct {
+		path    string
+		handler http.HandlerFunc
+		media   string
+	}{
+		{path: "/t/{tenant}/reports", handler: s.handleTenant, media: mediaJSON},
+		{path: "/t/{tenant}/reports/_batch", handler: s.handleTenantBatch, media: mediaNDJSON},
+		{path: "/t/{tenant}/reports/_upload", handler: s.handleTenantUpload, media: mediaMultipart},
+	} {
+		handler := route.handler
+		rt.handleFunc(route.path, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Deprecation", "true")
+			w.Header().Set("Link", "</v1"+r.URL.Path+">; rel=\"successor-version\"")
+			handler(w, r)
+		})
+		rt.accept(route.path, route.media)
+	}
+}
+
+// successorPath is the path clients of the deprecated root route should move to
+const successorPath = "/v1/reports"
+
+// reservedPath reports whether path belongs to a route that may not be
+// registered, such as /metrics on a port of its own or the admin endpoints
+// without a token, and must not be taken for an ingest request. Unknown
+// paths under /t/ or an API version are reserved too: indexing them into
+// the default index would leak the reports of a tenant.
+func reservedPath(path string) bool {
+	switch path {
+	case "/readyz", "/metrics", "/openapi.json", "/admin":
+		return true
+	}
+	for _, v := range apiVersions {
+		if strings.HasPrefix(path, v.path("/")) {
+			return true
+		}
+	}
+	return strings.HasPrefix(path, "/admin/") || strings.HasPrefix(path, "/t/")
+}
+
+// deprecatedIngest serves ingest requests sent to any path not matched by
+// another route, as before the API was versioned. Responses announce
+// successorPath with the Deprecation and Link headers, and the first client
+// is logged so that the webhook configuration can be found and updated.
+func (s *Server) deprecatedIngest(w http.ResponseWriter, r *http.Request) {
+	if reservedPath(r.URL.Path) {
+		http.NotFound(w, r)
+		return
+	}
+	s.deprecatedOnce.Do(func() {
+		s.log.Warn().
+			Str("path", r.URL.Path).
+			Str("remote_addr", r.RemoteAddr).
+			Str("user_agent", r.UserAgent()).
+			Str("successor", successorPath).
+			Msg("Reports sent to a deprecated path, use the versioned route")
+	})
+	w.Header().Set("Deprecation", "true")
+	w.Header().Set("Link", "<"+successorPath+">; rel=\"successor-version\"")
+	s.handleRequest(w, r)
+}
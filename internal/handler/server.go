@@ -1,19 +1,91 @@
 package handler
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
 	"net/http"
+	"reflect"
+	"slices"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/rs/zerolog"
+	"github.com/truemilk/trivelastic/internal/chaos"
 	"github.com/truemilk/trivelastic/internal/config"
+	"github.com/truemilk/trivelastic/internal/diff"
 	"github.com/truemilk/trivelastic/internal/elasticsearch"
+	"github.com/truemilk/trivelastic/internal/fingerprint"
+	"github.com/truemilk/trivelastic/internal/indexname"
+	"github.com/truemilk/trivelastic/internal/kev"
 	"github.com/truemilk/trivelastic/internal/logger"
+	"github.com/truemilk/trivelastic/internal/maintenance"
+	"github.com/truemilk/trivelastic/internal/metrics"
+	"github.com/truemilk/trivelastic/internal/pipeline"
+	"github.com/truemilk/trivelastic/internal/queue"
+	"github.com/truemilk/trivelastic/internal/registry"
+	"github.com/truemilk/trivelastic/internal/routing"
+	"github.com/truemilk/trivelastic/internal/schedule"
+	"github.com/truemilk/trivelastic/internal/vex"
 	"github.com/truemilk/trivelastic/internal/worker"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
+// clusterCheckTimeout bounds the startup check of the cluster, retries included
+const clusterCheckTimeout = 30 * time.Second
+
 type Server struct {
+	// cfg is the configuration the server was started with. Options that
+	// can change on reload are read from the current state instead.
 	cfg        *config.Config
 	workerPool *worker.Pool
-	log        zerolog.Logger
+	sink       worker.Sink
+	transforms []pipeline.Transform
+	listener   net.Listener
+	// kev is the Known Exploited Vulnerabilities catalog, nil when disabled
+	kev *kev.Catalog
+	// vex holds the OpenVEX statements, nil when disabled
+	vex *vex.Store
+	// registry reads image metadata from registries, nil when disabled
+	registry *registry.Client
+	// extraRoutes are served next to the built-in routes, see Handle
+	extraRoutes []route
+	// jobs holds the status of reports acknowledged before they were written
+	jobs *worker.Jobs
+	// maintenance and queue hold reports on disk, nil when disabled
+	maintenance *maintenance.Manager
+	queue       *queue.Queue
+	// retries holds failed reports in memory, nil when disabled
+	retries *worker.RetryQueue
+	// httpSrv is the server started by Start, stopped by Shutdown
+	httpSrv atomic.Pointer[http.Server]
+	state   atomic.Pointer[state]
+	// deprecatedOnce logs the first report sent to the deprecated root route
+	deprecatedOnce sync.Once
+	log            zerolog.Logger
+}
+
+// state holds the components rebuilt whenever the configuration is reloaded
+type state struct {
+	cfg *config.Config
+	es  *elasticsearch.Client
+	// sink receives the processed documents, es or a bulk indexer writing
+	// through it unless SetSink replaced them
+	sink     worker.Sink
+	pipeline *pipeline.Pipeline
+	// tenants maps tenant names to the pipelines writing to their index
+	tenants      map[string]*pipeline.Pipeline
+	fingerprints *fingerprint.Tracker
+	router       *router
+	// clusterErr is the result of the startup check, see checkCluster
+	clusterErr error
+	// handler serves router, wrapped by the middleware of every route
+	handler http.Handler
 }
 
 func NewServer(cfg *config.Config, pool *worker.Pool) *Server {
@@ -24,24 +96,674 @@ func NewServer(cfg *config.Config, pool *worker.Pool) *Server {
 	}
 }
 
-func (s *Server) Start() error {
-	// Create Elasticsearch client
+// SetSink replaces Elasticsearch as the destination of processed documents
+func (s *Server) SetSink(sink worker.Sink) {
+	s.sink = sink
+}
+
+// AddTransforms appends transforms to the built-in processing chain
+func (s *Server) AddTransforms(transforms ...pipeline.Transform) {
+	s.transforms = append(s.transforms, transforms...)
+}
+
+// SetListener makes Start serve on l instead of listening on the configured port
+func (s *Server) SetListener(l net.Listener) {
+	s.listener = l
+}
+
+// Init wires the processing components and registers the HTTP routes.
+// Start calls it automatically; embedders that only need Handler call it directly.
+func (s *Server) Init() error {
+	if s.cfg.KEV.Enabled {
+		s.kev = kev.NewCatalog(s.cfg.KEV.URL)
+	}
+	if s.cfg.Registry.Enabled {
+		s.registry = registry.NewClient(s.cfg.Registry)
+	}
+	s.jobs = worker.NewJobs(s.cfg.Async.JobTTL)
+	s.workerPool.SetJobs(s.jobs)
+	if s.cfg.VEX.Dir != "" {
+		s.vex = vex.NewStore(s.cfg.VEX.Dir)
+		if err := s.vex.Load(); err != nil {
+			return err
+		}
+	}
+
+	st, err := s.build(s.cfg, nil)
+	if err != nil {
+		return err
+	}
+	s.checkCluster(st)
+	s.apply(st)
+	s.bootstrap(st)
+
+	// Spool reports to disk during scheduled maintenance windows
+	windows, err := schedule.ParseWindows(s.cfg.Maintenance.Windows)
+	if err != nil {
+		return fmt.Errorf("invalid maintenance windows: %w", err)
+	}
+	if len(windows) > 0 {
+		manager, err := maintenance.NewManager(windows, s.cfg.Maintenance.SpoolDir, s.workerPool.Index)
+		if err != nil {
+			return err
+		}
+		s.workerPool.SetMaintenance(manager)
+		manager.Start()
+		s.maintenance = manager
+	}
+
+	// Keep reports on disk until they are indexed
+	if s.cfg.Queue.Path != "" {
+		q, err := queue.Open(s.cfg.Queue.Path, s.workerPool.Index)
+		if err != nil {
+			return err
+		}
+		s.workerPool.SetQueue(q)
+		q.Start(s.cfg.Queue.RetryInterval)
+		s.queue = q
+		metrics.NewGaugeFunc("trivelastic_persistent_queue_reports", "Reports in the persistent queue, being indexed or waiting to be retried", func() float64 {
+			return float64(q.Len())
+		})
+	}
+
+	// Absorb spikes on disk rather than rejecting them
+	if s.cfg.Queue.SpillDir != "" {
+		spill, err := worker.NewSpill(s.cfg.Queue.SpillDir, s.cfg.Queue.SpillHighWater, s.cfg.Queue.SpillMaxReports)
+		if err != nil {
+			return err
+		}
+		s.workerPool.SetSpill(spill)
+		metrics.NewGaugeFunc("trivelastic_worker_queue_spilled", "Queued requests whose reports are held on disk", func() float64 {
+			return float64(spill.Len())
+		})
+	}
+
+	if s.cfg.RetryQueue.Enabled {
+		rq := s.cfg.RetryQueue
+		retries, err := worker.NewRetryQueue(rq.Size, rq.Interval, rq.MaxInterval, rq.MaxAge, rq.Path)
+		if err != nil {
+			return err
+		}
+		s.retries = retries
+		s.workerPool.SetRetryQueue(s.retries)
+		s.retries.Start()
+		metrics.NewGaugeFunc("trivelastic_retry_queue_reports", "Reports waiting to be retried", func() float64 {
+			return float64(s.retries.Len())
+		})
+	}
+
+	metrics.NewGaugeFunc("trivelastic_worker_queue_depth", "Requests waiting for a worker", func() float64 {
+		return float64(s.workerPool.QueueDepth())
+	})
+	metrics.NewGaugeFunc("trivelastic_worker_queue_bytes", "Payload bytes of the requests queued in memory or being processed", func() float64 {
+		return float64(s.workerPool.QueueBytes())
+	})
+	metrics.NewGaugeFunc("trivelastic_workers", "Running workers", func() float64 {
+		return float64(s.workerPool.Workers())
+	})
+	metrics.NewGaugeFunc("trivelastic_worker_requests_in_flight", "Requests being processed by a worker", func() float64 {
+		return float64(s.workerPool.InFlight())
+	})
+	metrics.NewGaugeFunc("trivelastic_worker_utilization", "Share of the running workers processing a request", func() float64 {
+		workers := s.workerPool.Workers()
+		if workers == 0 {
+			return 0
+		}
+		return float64(s.workerPool.InFlight()) / float64(workers)
+	})
+	s.workerPool.StartScaling(s.cfg.Workers.ScaleInterval, s.cfg.Workers.MaxLatency)
+
+	if s.kev != nil {
+		go s.kev.Run(context.Background(), s.cfg.KEV.RefreshInterval)
+	}
+
+	// Acknowledge redeliveries of the same report without indexing them again
+	if s.cfg.Fingerprint.Window > 0 {
+		s.workerPool.SetRedeliveryWindow(fingerprint.NewDedupWindow(s.cfg.Fingerprint.Window))
+		s.log.Info().
+			Dur("window", s.cfg.Fingerprint.Window).
+			Msg("Skipping redelivered reports")
+	}
+
+	// Replay the answer to payloads submitted again
+	if s.cfg.Idempotency.TTL > 0 {
+		s.workerPool.SetIdempotency(worker.NewIdempotency(s.cfg.Idempotency.TTL, s.cfg.Idempotency.MaxEntries))
+		s.log.Info().
+			Dur("ttl", s.cfg.Idempotency.TTL).
+			Int("max_entries", s.cfg.Idempotency.MaxEntries).
+			Msg("Replaying answers to repeated payloads")
+	}
+
+	// Drop repeat scans of the same artifact
+	if s.cfg.Dedup.Window > 0 {
+		s.workerPool.SetDedupWindow(fingerprint.NewDedupWindow(s.cfg.Dedup.Window))
+		s.log.Info().
+			Dur("window", s.cfg.Dedup.Window).
+			Msg("Deduplicating repeat scans")
+	}
+
+	if s.cfg.ES.Rollover.Enabled {
+		go s.rolloverLoop(s.cfg.ES.Rollover.Interval)
+	}
+
+	// Pick up changes to mounted ConfigMaps and Secrets without a restart
+	if s.cfg.Reload.Watch && len(s.cfg.Reload.Files) > 0 {
+		if err := config.Watch(context.Background(), s.cfg.Reload.Files, s.reloadFromFiles); err != nil {
+			return err
+		}
+		s.log.Info().
+			Strs("files", s.cfg.Reload.Files).
+			Msg("Watching configuration files for changes")
+	}
+
+	return nil
+}
+
+// Reload swaps in cfg for every following request. The ports, pprof, HTTP
+// timeouts, listener TLS options, maintenance windows, fingerprint tracking,
+// deduplication, the job TTL, the queue size, the persistent queue, the KEV
+// catalog, registry enrichment, the VEX directory and watched files only
+// change on restart; the listener certificate is reloaded on its own. The
+// OpenVEX documents are read again.
+func (s *Server) Reload(cfg *config.Config) error {
+	current := s.state.Load().cfg
+	if cfg.Port != current.Port ||
+		cfg.Metrics.Port != current.Metrics.Port ||
+		cfg.Admin.Pprof != current.Admin.Pprof ||
+		cfg.Admin.PprofAddr != current.Admin.PprofAddr ||
+		cfg.HTTP != current.HTTP ||
+		cfg.TLS != current.TLS ||
+		cfg.Maintenance != current.Maintenance ||
+		cfg.Fingerprint.Enabled != current.Fingerprint.Enabled ||
+		cfg.Fingerprint.Window != current.Fingerprint.Window ||
+		cfg.Dedup != current.Dedup ||
+		cfg.Async.JobTTL != current.Async.JobTTL ||
+		cfg.Queue.Size != current.Queue.Size ||
+		cfg.Queue.Path != current.Queue.Path ||
+		cfg.Queue.RetryInterval != current.Queue.RetryInterval ||
+		cfg.Queue.SpillDir != current.Queue.SpillDir ||
+		cfg.Queue.SpillHighWater != current.Queue.SpillHighWater ||
+		cfg.Queue.SpillMaxReports != current.Queue.SpillMaxReports ||
+		cfg.Workers != current.Workers ||
+		cfg.RetryQueue != current.RetryQueue ||
+		cfg.Idempotency != current.Idempotency ||
+		cfg.KEV != current.KEV ||
+		!reflect.DeepEqual(cfg.Registry, current.Registry) ||
+		cfg.VEX.Dir != current.VEX.Dir ||
+		cfg.ES.Rollover.Enabled != current.ES.Rollover.Enabled ||
+		cfg.ES.Rollover.Interval != current.ES.Rollover.Interval ||
+		cfg.Reload.File != current.Reload.File {
+		s.log.Warn().Msg("Port, metrics port, pprof, HTTP timeout, listener TLS, maintenance, fingerprint, dedup, job TTL, queue size, persistent queue, queue spilling, worker scaling, retry queue, idempotency, KEV, registry, VEX directory, rollover scheduling and reload options only take effect after a restart")
+	}
+
+	if s.vex != nil {
+		if err := s.vex.Load(); err != nil {
+			return err
+		}
+	}
+
+	old := s.state.Load()
+	st, err := s.build(cfg, old)
+	if err != nil {
+		return err
+	}
+	s.checkCluster(st)
+	s.apply(st)
+	s.bootstrap(st)
+	if old != nil && st.es != old.es {
+		go s.close(old)
+	}
+	s.log.Info().Msg("Configuration reloaded")
+	return nil
+}
+
+// reloadFromFiles reloads the configuration after a watched file changed.
+// The running configuration is kept when the new one is invalid.
+func (s *Server) reloadFromFiles() {
+	cfg, err := config.Load()
+	if err != nil {
+		s.log.Error().
+			Err(err).
+			Msg("Failed to reload configuration, keeping the running configuration")
+		return
+	}
+	if err := s.Reload(cfg); err != nil {
+		s.log.Error().
+			Err(err).
+			Msg("Failed to apply reloaded configuration, keeping the running configuration")
+	}
+}
+
+// build creates the components and routes for cfg. The Elasticsearch client
+// and sink of current, the running state if any, are kept when the
+// Elasticsearch options did not change.
+func (s *Server) build(cfg *config.Config, current *state) (*state, error) {
+	esClient, sink := s.connect(cfg, current)
+	if esClient == nil {
+		s.log.Info().
+			Strs("es_urls", cfg.ES.URLs).
+			Str("es_index", cfg.ES.Index).
+			Msg("Initializing Elasticsearch client")
+
+		var err error
+		esClient, err = elasticsearch.NewClient(&cfg.ES)
+		if err != nil {
+			return nil, err
+		}
+		if cfg.Chaos.Enabled {
+			esClient.WrapTransport(func(next http.RoundTripper) http.RoundTripper {
+				return chaos.NewTransport(cfg.Chaos, next)
+			})
+		}
+		sink = s.sink
+		if sink == nil {
+			sink = esClient
+			if cfg.ES.Bulk.Enabled {
+				sink = elasticsearch.NewBulkIndexer(esClient, cfg.ES.Bulk)
+			}
+		}
+	}
+
+	// Index only what changed since the previous report of each artifact
+	var diffs *diff.Tracker
+	if cfg.Diff.Enabled {
+		diffs = diff.NewTracker(esClient, cfg.Diff.Index)
+	}
+
+	st := &state{
+		cfg:      cfg,
+		es:       esClient,
+		sink:     sink,
+		pipeline: s.newPipeline(cfg, cfg.ES.Index, config.SanitizeDefault, diffs),
+		tenants:  map[string]*pipeline.Pipeline{},
+	}
+	for _, name := range cfg.Tenants.Names() {
+		st.tenants[name] = s.newPipeline(cfg, cfg.Tenants.Indices[name], config.SanitizeDefault, diffs)
+	}
+
+	// Track duplicate scans across the fleet
+	if s.cfg.Fingerprint.Enabled {
+		st.fingerprints = fingerprint.NewTracker(esClient, cfg.Fingerprint.Index)
+	}
+
+	st.router = newRouter()
+	s.routes(st, diffs)
+	st.handler = chain(st.router, s.middleware(st)...)
+
+	return st, nil
+}
+
+// connect returns the Elasticsearch client and sink of current when cfg
+// reaches the cluster the same way, or nil to create new ones
+func (s *Server) connect(cfg *config.Config, current *state) (*elasticsearch.Client, worker.Sink) {
+	if current == nil ||
+		!reflect.DeepEqual(cfg.ES, current.cfg.ES) ||
+		cfg.Chaos != current.cfg.Chaos {
+		return nil, nil
+	}
+	return current.es, current.sink
+}
+
+// close releases the Elasticsearch client and sink of st, replaced by a
+// reload or shut down, once the documents buffered by the sink are written.
+// Requests still using them complete.
+func (s *Server) close(st *state) {
+	// A sink set with SetSink is shared by every state
+	if s.sink == nil {
+		if closer, ok := st.sink.(interface{ Close() }); ok {
+			closer.Close()
+		}
+	}
+	st.es.Close()
+}
+
+// apply makes st serve every following request
+func (s *Server) apply(st *state) {
+	s.workerPool.SetSink(st.sink)
+	s.workerPool.SetPipeline(st.pipeline)
+	s.workerPool.SetAsync(st.cfg.Async.Enabled)
+	s.workerPool.SetQueueTimeout(st.cfg.Queue.Timeout)
+	s.workerPool.SetMaxBytes(st.cfg.Queue.MaxBytes)
+	if st.cfg.ES.LenientFailures {
+		s.workerPool.SetFailureStatus(0)
+	} else {
+		s.workerPool.SetFailureStatus(st.cfg.ES.FailureStatus)
+	}
+	if st.fingerprints != nil {
+		s.workerPool.SetFingerprintTracker(st.fingerprints)
+	}
+	s.state.Store(st)
+}
+
+// bootstrap prepares the cluster for st. Failures are logged and do not
+// prevent serving, since Elasticsearch may only be temporarily unavailable.
+func (s *Server) bootstrap(st *state) {
+	indices := targetIndices(st.cfg)
+
+	// Install the template first so that indices created below get its mappings
+	if st.cfg.ES.Template.Enabled {
+		var policy string
+		if st.cfg.ES.ILM.Enabled {
+			policy = st.cfg.ES.ILM.Policy
+		}
+
+		// Indices holding one kind of finding get a template of their own
+		findingIndices := routing.FindingIndices(&st.cfg.Routing)
+		isFindingIndex := make(map[string]bool, len(findingIndices))
+		for _, f := range findingIndices {
+			isFindingIndex[f.Index] = true
+		}
+		reportIndices := make([]string, 0, len(indices))
+		for _, index := range indices {
+			if !isFindingIndex[index] {
+				reportIndices = append(reportIndices, index)
+			}
+		}
+		if err := st.es.InstallTemplate(st.cfg.ES.Template, templatePatterns(st.cfg, reportIndices), policy); err != nil {
+			s.log.Error().
+				Err(err).
+				Msg("Failed to install index template")
+		}
+		for _, f := range findingIndices {
+			patterns := templatePatterns(st.cfg, []string{f.Index})
+			if err := st.es.InstallFindingTemplate(st.cfg.ES.Template, f.Part, f.Fields, patterns, policy); err != nil {
+				s.log.Error().
+					Err(err).
+					Str("index", f.Index).
+					Msg("Failed to install finding index template")
+			}
+		}
+		if st.cfg.Routing.Summary {
+			indices := summaryIndices(st.cfg)
+			patterns := make([]string, 0, len(indices))
+			for _, index := range indices {
+				patterns = append(patterns, indexname.Wildcard(index))
+			}
+			if err := st.es.InstallSummaryTemplate(st.cfg.ES.Template, patterns, policy); err != nil {
+				s.log.Error().
+					Err(err).
+					Msg("Failed to install summary index template")
+			}
+		}
+	}
+
+	// Create write aliases before ILM attaches its policy to them
+	if st.cfg.ES.Rollover.Enabled {
+		for _, alias := range rolloverAliases(st.cfg) {
+			if err := st.es.EnsureWriteAlias(alias); err != nil {
+				s.log.Error().
+					Err(err).
+					Str("alias", alias).
+					Msg("Failed to set up write alias for rollover")
+			}
+		}
+	}
+
+	if st.cfg.ES.ILM.Enabled {
+		// Time-based indices get the policy from the template when they are created
+		ilmIndices := indices
+		if st.cfg.ES.Template.Enabled {
+			ilmIndices = make([]string, 0, len(indices))
+			for _, index := range indices {
+				if !indexname.HasPattern(index) {
+					ilmIndices = append(ilmIndices, index)
+				}
+			}
+		}
+		if err := st.es.BootstrapILM(st.cfg.ES.ILM, ilmIndices); err != nil {
+			s.log.Error().
+				Err(err).
+				Msg("Failed to bootstrap ILM policy")
+		}
+	}
+}
+
+// checkCluster connects to the cluster before st serves any request and
+// logs its version and license, so that bad credentials show up at startup
+// rather than on the first report. An authentication failure fails readiness.
+func (s *Server) checkCluster(st *state) {
+	if s.sink != nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), clusterCheckTimeout)
+	defer cancel()
+
+	info, err := st.es.Info(ctx)
+	if err != nil {
+		if errors.Is(err, elasticsearch.ErrUnauthorized) {
+			st.clusterErr = err
+			s.log.Error().
+				Err(err).
+				Msg("Elasticsearch rejected the configured credentials, check TRIVELASTIC_ES_API_KEY")
+			return
+		}
+		s.log.Warn().
+			Err(err).
+			Msg("Elasticsearch is not reachable at startup, documents will fail until it is")
+		return
+	}
+
+	distribution := info.Version.Distribution
+	if distribution == "" {
+		distribution = config.TargetElasticsearch
+	}
 	s.log.Info().
-		Str("es_url", s.cfg.ES.URL).
-		Str("es_index", s.cfg.ES.Index).
-		Msg("Initializing Elasticsearch client")
+		Str("cluster", info.ClusterName).
+		Str("distribution", distribution).
+		Str("version", info.Version.Number).
+		Msg("Connected to cluster")
+	if distribution != st.cfg.ES.Target {
+		s.log.Warn().
+			Str("distribution", distribution).
+			Str("target", st.cfg.ES.Target).
+			Msg("Cluster distribution does not match TRIVELASTIC_ES_TARGET")
+	}
+
+	if st.cfg.ES.Target != config.TargetElasticsearch {
+		return
+	}
+	switch major := info.Major(); {
+	case major == 0:
+	case major < elasticsearch.MinMajorVersion:
+		s.log.Warn().
+			Str("version", info.Version.Number).
+			Int("min_major_version", elasticsearch.MinMajorVersion).
+			Msg("Elasticsearch version not supported, index templates will fail")
+	case major > elasticsearch.MaxMajorVersion && !st.cfg.ES.CompatibilityMode:
+		s.log.Warn().
+			Str("version", info.Version.Number).
+			Msg("Cluster is newer than Elasticsearch 8, set TRIVELASTIC_ES_COMPATIBILITY_MODE=true if requests fail")
+	}
+	license, err := st.es.License(ctx)
+	if err != nil {
+		s.log.Warn().
+			Err(err).
+			Msg("Failed to read the cluster license")
+		return
+	}
+	s.log.Info().
+		Str("license", license.Type).
+		Str("status", license.Status).
+		Msg("Cluster license")
+}
+
+// templatePatterns returns the index patterns of the index template. When
+// indices are rolled over, the numbered indices behind each write alias are
+// matched too. "-0*" rather than "-*" keeps unrelated indices such as
+// "trivy-fingerprints" out of the template.
+func templatePatterns(cfg *config.Config, indices []string) []string {
+	rollover := cfg.ES.Rollover.Enabled || (cfg.ES.ILM.Enabled && cfg.ES.ILM.Rollover())
+	patterns := make([]string, 0, len(indices))
+	for _, index := range indices {
+		patterns = append(patterns, indexname.Wildcard(index))
+		if rollover && !indexname.HasPattern(index) {
+			patterns = append(patterns, index+"-0*")
+		}
+	}
+	return patterns
+}
+
+// targetIndices lists every index documents are written to, without duplicates
+func targetIndices(cfg *config.Config) []string {
+	indices := []string{cfg.ES.Index}
+	seen := map[string]bool{cfg.ES.Index: true}
+	add := func(index string) {
+		if !seen[index] {
+			seen[index] = true
+			indices = append(indices, index)
+		}
+	}
+
+	severities := make([]string, 0, len(cfg.Routing.SeverityIndices))
+	for severity := range cfg.Routing.SeverityIndices {
+		severities = append(severities, severity)
+	}
+	sort.Strings(severities)
+	for _, severity := range severities {
+		add(cfg.Routing.SeverityIndices[severity])
+	}
+	for _, index := range []string{cfg.Routing.KubernetesIndex, cfg.Routing.MisconfigurationIndex, cfg.Routing.LicenseIndex} {
+		if index != "" {
+			add(index)
+		}
+	}
+	for _, p := range cfg.Pipelines {
+		add(p.Index)
+	}
+	for _, name := range cfg.Tenants.Names() {
+		add(cfg.Tenants.Indices[name])
+	}
+	return indices
+}
+
+// summaryIndices lists the summary indices next to every default index
+func summaryIndices(cfg *config.Config) []string {
+	defaults := []string{cfg.ES.Index}
+	if cfg.Routing.KubernetesIndex != "" {
+		defaults = append(defaults, cfg.Routing.KubernetesIndex)
+	}
+	for _, p := range cfg.Pipelines {
+		defaults = append(defaults, p.Index)
+	}
+	for _, name := range cfg.Tenants.Names() {
+		defaults = append(defaults, cfg.Tenants.Indices[name])
+	}
+
+	indices := make([]string, 0, len(defaults))
+	for _, index := range defaults {
+		if !slices.Contains(indices, index+routing.SummarySuffix) {
+			indices = append(indices, index+routing.SummarySuffix)
+		}
+	}
+	return indices
+}
 
-	esClient := elasticsearch.NewClient(&s.cfg.ES)
-	s.workerPool.SetElasticsearchClient(esClient)
+// current returns the state serving requests
+func (s *Server) current() *state {
+	return s.state.Load()
+}
 
-	// Set up the HTTP server with the concurrent handler
-	http.HandleFunc("/", s.handleRequest)
+// newPipeline builds a processing pipeline writing to index by default,
+// reducing reports to their changes when diffs is not nil
+func (s *Server) newPipeline(cfg *config.Config, index, sanitizeProfile string, diffs *diff.Tracker) *pipeline.Pipeline {
+	transforms := []pipeline.Transform{
+		// Redact first so that no other step sees the secrets
+		pipeline.SecretRedactTransform{},
+		pipeline.SanitizeTransform{Profile: sanitizeProfile},
+		pipeline.TruncateTransform{MaxLength: cfg.Transform.MaxFieldLength},
+		pipeline.TimestampTransform{
+			Field:   "CreatedAt",
+			MaxSkew: cfg.Timestamp.MaxSkew,
+			Clamp:   cfg.Timestamp.Clamp,
+		},
+		pipeline.ArtifactTransform{},
+		pipeline.SeverityTransform{},
+		pipeline.CVSSTransform{},
+		pipeline.LicenseTransform{},
+		pipeline.PURLTransform{},
+	}
+	if s.vex != nil {
+		transforms = append(transforms, pipeline.VEXTransform{Store: s.vex, Filter: cfg.VEX.Mode == config.VEXFilter})
+	}
+	if s.kev != nil {
+		transforms = append(transforms, pipeline.KEVTransform{Catalog: s.kev})
+	}
+	if s.registry != nil {
+		transforms = append(transforms, pipeline.RegistryTransform{Client: s.registry})
+	}
+	pl := pipeline.New(
+		routing.NewRouter(index, &cfg.Routing),
+		append(transforms, s.transforms...)...,
+	)
+	if cfg.DocumentID.Enabled {
+		pl.SetDocumentIDFields(cfg.DocumentID.Fields)
+	}
+	pl.SetReportValidation(cfg.Report.Validate)
+	pl.SetRoutingKey(cfg.ES.ShardRouting.Field, cfg.ES.ShardRouting.Value)
+	if diffs != nil {
+		pl.SetDiffTracker(diffs)
+	}
+	return pl
+}
+
+// Handler returns the HTTP handler serving every trivelastic route
+func (s *Server) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.current().handler.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) Start() error {
+	if s.current() == nil {
+		if err := s.Init(); err != nil {
+			return err
+		}
+	}
+
+	if s.cfg.Metrics.Enabled && s.cfg.Metrics.Port != "" {
+		go s.serveMetrics(s.cfg.Metrics.Port)
+	}
+	if s.cfg.Admin.Pprof {
+		go s.servePprof(s.cfg.Admin.PprofAddr)
+	}
+
+	srv := s.httpServer()
+	s.httpSrv.Store(srv)
+	if s.cfg.TLS.Enabled() {
+		tlsConfig, err := s.listenerTLSConfig(s.cfg.TLS, s.cfg.HTTP.HTTP2)
+		if err != nil {
+			return err
+		}
+		srv.TLSConfig = tlsConfig
+	}
+
+	if s.listener != nil {
+		s.log.Info().
+			Str("addr", s.listener.Addr().String()).
+			Bool("tls", s.cfg.TLS.Enabled()).
+			Msg("Starting HTTP server")
+		serve := func() error { return srv.Serve(s.listener) }
+		if s.cfg.TLS.Enabled() {
+			serve = func() error { return srv.ServeTLS(s.listener, "", "") }
+		}
+		if err := serve(); !errors.Is(err, http.ErrServerClosed) {
+			return err
+		}
+		return nil
+	}
 
 	s.log.Info().
 		Str("port", s.cfg.Port).
+		Bool("tls", s.cfg.TLS.Enabled()).
 		Msg("Starting HTTP server")
 
-	if err := http.ListenAndServe(":"+s.cfg.Port, nil); err != nil {
+	serve := srv.ListenAndServe
+	if s.cfg.TLS.Enabled() {
+		// The certificate comes from TLSConfig, see listenerTLSConfig
+		serve = func() error { return srv.ListenAndServeTLS("", "") }
+	}
+	if err := serve(); err != nil && !errors.Is(err, http.ErrServerClosed) {
 		s.log.Error().
 			Err(err).
 			Str("port", s.cfg.Port).
@@ -52,6 +774,76 @@ func (s *Server) Start() error {
 	return nil
 }
 
+// Shutdown stops accepting connections and waits for the requests being
+// served, then for the worker pool to process the reports still queued,
+// until ctx is done. Reports held on disk are kept for the next start.
+func (s *Server) Shutdown(ctx context.Context) error {
+	var errs []error
+	if srv := s.httpSrv.Load(); srv != nil {
+		if err := srv.Shutdown(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("error shutting down HTTP server: %w", err))
+		}
+	}
+	if abandoned, err := s.workerPool.Shutdown(ctx); err != nil {
+		errs = append(errs, fmt.Errorf("%d requests abandoned: %w", abandoned, err))
+	}
+	if s.retries != nil {
+		if abandoned, err := s.retries.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("%d reports waiting to be retried abandoned: %w", abandoned, err))
+		} else if abandoned > 0 {
+			errs = append(errs, fmt.Errorf("%d reports waiting to be retried abandoned", abandoned))
+		}
+	}
+	if st := s.state.Load(); st != nil {
+		s.close(st)
+	}
+	if s.maintenance != nil {
+		s.maintenance.Stop()
+	}
+	if s.queue != nil {
+		if err := s.queue.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// httpServer returns the HTTP server, with the configured timeouts so that
+// stalled clients cannot hold connections open
+func (s *Server) httpServer() *http.Server {
+	srv := &http.Server{
+		Addr:              ":" + s.cfg.Port,
+		Handler:           s.Handler(),
+		ReadHeaderTimeout: s.cfg.HTTP.ReadHeaderTimeout,
+		ReadTimeout:       s.cfg.HTTP.ReadTimeout,
+		WriteTimeout:      s.cfg.HTTP.WriteTimeout,
+		IdleTimeout:       s.cfg.HTTP.IdleTimeout,
+	}
+	switch {
+	case !s.cfg.HTTP.HTTP2:
+		// A non-nil map turns off the HTTP/2 support of net/http
+		srv.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+	case s.cfg.HTTP.H2C:
+		srv.Handler = h2c.NewHandler(srv.Handler, &http2.Server{IdleTimeout: s.cfg.HTTP.IdleTimeout})
+	}
+	return srv
+}
+
+// Ingest processes the report in body synchronously with the default
+// pipeline, without the HTTP routes and their middleware
+func (s *Server) Ingest(ctx context.Context, body []byte) *worker.Response {
+	return s.workerPool.Do(worker.NewRequest(ctx, body, nil, nil))
+}
+
+// handleBatch ingests newline-delimited reports, see worker.Pool.SubmitBatch
+func (s *Server) handleBatch(w http.ResponseWriter, r *http.Request) {
+	s.workerPool.SubmitBatch(w, r)
+}
+
+func (s *Server) handleUpload(w http.ResponseWriter, r *http.Request) {
+	s.workerPool.SubmitUpload(w, r)
+}
+
 func (s *Server) handleRequest(w http.ResponseWriter, r *http.Request) {
 	s.log.Debug().
 		Str("method", r.Method).
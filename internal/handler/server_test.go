@@ -0,0 +1,90 @@
+package handler
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/truemilk/trivelastic/internal/config"
+	"github.com/truemilk/trivelastic/internal/worker"
+)
+
+// recordingSink keeps the documents written to it, by index
+type recordingSink struct {
+	mu   sync.Mutex
+	docs map[string][]map[string]interface{}
+}
+
+func (s *recordingSink) IndexInto(ctx context.Context, index string, doc map[string]interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.docs[index] = append(s.docs[index], doc)
+	return nil
+}
+
+// indexed returns the documents written to index
+func (s *recordingSink) indexed(index string) []map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.docs[index]
+}
+
+// newTestServer returns the handler of a server configured with env on top
+// of a minimal configuration, writing to the returned sink
+func newTestServer(t *testing.T, env map[string]string) (http.Handler, *recordingSink) {
+	t.Helper()
+	// Nothing listens on the cluster, the sink replaces it
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	esURL := "http://" + l.Addr().String()
+	l.Close()
+
+	defaults := map[string]string{
+		"TRIVELASTIC_ES_URL":                esURL,
+		"TRIVELASTIC_ES_API_KEY":            "test",
+		"TRIVELASTIC_ES_INDEX":              "trivy",
+		"TRIVELASTIC_ES_TEMPLATE_ENABLED":   "false",
+		"TRIVELASTIC_ES_RETRY_MAX_ATTEMPTS": "1",
+		"TRIVELASTIC_DOCUMENT_ID_ENABLED":   "false",
+	}
+	for k, v := range env {
+		defaults[k] = v
+	}
+	for k, v := range defaults {
+		t.Setenv(k, v)
+	}
+	cfg, err := config.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sink := &recordingSink{docs: map[string][]map[string]interface{}{}}
+	pool := worker.NewPool(1, 1, 10)
+	t.Cleanup(func() { pool.Shutdown(context.Background()) })
+	s := NewServer(cfg, pool)
+	s.SetSink(sink)
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	return s.Handler(), sink
+}
+
+// post sends body to path with the given headers and returns the response
+func post(h http.Handler, path, body string, headers map[string]string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		r.Header.Set(k, v)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+	return rec
+}
+
+const testReport = `{"SchemaVersion":2,"ArtifactName":"alpine:3.19","ArtifactType":"container_image","CreatedAt":"2026-10-16T10:00:00Z"}`
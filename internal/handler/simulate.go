@@ -0,0 +1,64 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/truemilk/trivelastic/internal/pipeline"
+	"github.com/truemilk/trivelastic/pkg/trivy"
+)
+
+// handleSimulate runs a payload through the processing pipeline and returns
+// the documents that would be written, without indexing anything
+func (s *Server) handleSimulate(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		s.log.Error().
+			Err(err).
+			Msg("Failed to read simulation body")
+		http.Error(w, "Error reading body: "+err.Error(), readErrorStatus(err))
+		return
+	}
+
+	result, err := s.current().pipeline.Process(r.Context(), body, pipeline.RequestFields(r))
+	var invalid *trivy.ValidationError
+	if errors.As(err, &invalid) {
+		s.log.Debug().
+			Err(err).
+			Msg("Simulation payload is not a Trivy report")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":   "error",
+			"message":  "Payload is not a valid Trivy report",
+			"problems": invalid.Problems,
+		})
+		return
+	}
+	if err != nil {
+		s.log.Debug().
+			Err(err).
+			Msg("Simulation payload rejected")
+		http.Error(w, "Invalid payload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.log.Debug().
+		Int("documents", len(result.Routes)).
+		Msg("Simulation completed")
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":    "success",
+		"applied":   result.Applied,
+		"warnings":  result.Warnings,
+		"documents": result.Routes,
+	})
+}
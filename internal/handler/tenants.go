@@ -0,0 +1,37 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/truemilk/trivelastic/internal/pipeline"
+)
+
+// handleTenant ingests a report for the tenant named in the path, writing it
+// to the index of the tenant and stamping the tenant on its documents
+func (s *Server) handleTenant(w http.ResponseWriter, r *http.Request) {
+	s.forTenant(w, r, s.workerPool.SubmitTo)
+}
+
+// handleTenantBatch ingests newline-delimited reports for the tenant named
+// in the path, see handleTenant
+func (s *Server) handleTenantBatch(w http.ResponseWriter, r *http.Request) {
+	s.forTenant(w, r, s.workerPool.SubmitBatchTo)
+}
+
+// handleTenantUpload ingests uploaded report files for the tenant named in
+// the path, see handleTenant
+func (s *Server) handleTenantUpload(w http.ResponseWriter, r *http.Request) {
+	s.forTenant(w, r, s.workerPool.SubmitUploadTo)
+}
+
+// forTenant hands r to submit with the pipeline of the tenant named in the
+// path, or answers 404 for unknown tenants
+func (s *Server) forTenant(w http.ResponseWriter, r *http.Request, submit func(*pipeline.Pipeline, http.ResponseWriter, *http.Request)) {
+	name := r.PathValue("tenant")
+	pl, ok := s.current().tenants[name]
+	if !ok {
+		http.Error(w, "Unknown tenant", http.StatusNotFound)
+		return
+	}
+	submit(pl, w, r.WithContext(pipeline.WithTenant(r.Context(), name)))
+}
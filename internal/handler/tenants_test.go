@@ -0,0 +1,59 @@
+package handler
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestTenantRoutes(t *testing.T) {
+	h, sink := newTestServer(t, map[string]string{
+		"TRIVELASTIC_TENANT_INDICES": "team-a=trivy-team-a",
+	})
+
+	tests := []struct {
+		name       string
+		path       string
+		status     int
+		index      string
+		deprecated bool
+	}{
+		{name: "versioned", path: "/v1/t/team-a/reports", status: http.StatusOK, index: "trivy-team-a"},
+		{name: "unversioned", path: "/t/team-a/reports", status: http.StatusOK, index: "trivy-team-a", deprecated: true},
+		{name: "unknown tenant", path: "/v1/t/team-b/reports", status: http.StatusNotFound},
+		{name: "unknown unversioned tenant", path: "/t/team-b/reports", status: http.StatusNotFound},
+		{name: "unknown path under a tenant", path: "/t/team-a/report", status: http.StatusNotFound},
+		{name: "unknown versioned path", path: "/v1/t/team-a/report", status: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := len(sink.indexed("trivy"))
+			beforeTenant := len(sink.indexed("trivy-team-a"))
+
+			rec := post(h, tt.path, testReport, nil)
+
+			if rec.Code != tt.status {
+				t.Fatalf("expected %d, got %d: %s", tt.status, rec.Code, rec.Body)
+			}
+			if got := len(sink.indexed("trivy")) - before; got != 0 {
+				t.Fatalf("expected nothing written to the default index, got %d documents", got)
+			}
+			if tt.index == "" {
+				if got := len(sink.indexed("trivy-team-a")) - beforeTenant; got != 0 {
+					t.Fatalf("expected nothing written for the tenant, got %d documents", got)
+				}
+				return
+			}
+			docs := sink.indexed(tt.index)
+			if len(docs) == 0 {
+				t.Fatalf("expected the report written to %s", tt.index)
+			}
+			meta, _ := docs[len(docs)-1]["_trivelastic"].(map[string]interface{})
+			if meta["tenant"] != "team-a" {
+				t.Fatalf("expected the tenant recorded, got %v", meta)
+			}
+			if got := rec.Header().Get("Deprecation") == "true"; got != tt.deprecated {
+				t.Fatalf("expected deprecated: %t, got %t", tt.deprecated, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package handler
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/rs/zerolog"
+	"github.com/truemilk/trivelastic/internal/config"
+)
+
+// certificates are the server certificate and the client certificate
+// authorities, reloaded when their files change so that rotated certificates
+// are used without a restart
+type certificates struct {
+	cfg config.ListenerTLSConfig
+	// nextProtos are the protocols offered to clients
+	nextProtos []string
+	mu         sync.RWMutex
+	cert       *tls.Certificate
+	clientCA   *x509.CertPool
+	log        zerolog.Logger
+}
+
+// load reads the certificate files, keeping the previous certificates when they are invalid
+func (c *certificates) load() error {
+	cert, err := tls.LoadX509KeyPair(c.cfg.CertFile, c.cfg.KeyFile)
+	if err != nil {
+		return fmt.Errorf("error loading server certificate: %w", err)
+	}
+	var clientCA *x509.CertPool
+	if c.cfg.ClientCAFile != "" {
+		pem, err := os.ReadFile(c.cfg.ClientCAFile)
+		if err != nil {
+			return fmt.Errorf("error reading client CA bundle: %w", err)
+		}
+		clientCA = x509.NewCertPool()
+		if !clientCA.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in client CA bundle %s", c.cfg.ClientCAFile)
+		}
+	}
+	c.mu.Lock()
+	c.cert = &cert
+	c.clientCA = clientCA
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *certificates) reload() {
+	if err := c.load(); err != nil {
+		c.log.Error().
+			Err(err).
+			Msg("Failed to reload listener certificates, keeping the previous ones")
+		return
+	}
+	c.log.Info().
+		Str("cert_file", c.cfg.CertFile).
+		Str("client_ca_file", c.cfg.ClientCAFile).
+		Msg("Listener certificates reloaded")
+}
+
+// configFor returns the TLS configuration of a new connection
+func (c *certificates) configFor(*tls.ClientHelloInfo) (*tls.Config, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	tlsConfig := &tls.Config{
+		MinVersion:   c.cfg.Version(),
+		Certificates: []tls.Certificate{*c.cert},
+		NextProtos:   c.nextProtos,
+	}
+	// Connections without a certificate are still accepted, so that health
+	// checks work; requireClientCert rejects their other requests
+	if c.clientCA != nil && c.cfg.ClientAuth != config.ClientAuthNone {
+		tlsConfig.ClientCAs = c.clientCA
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return tlsConfig, nil
+}
+
+// listenerTLSConfig returns the TLS configuration of the HTTP listener,
+// watching the certificate files for rotations. HTTP/2 is offered when
+// http2 is set.
+func (s *Server) listenerTLSConfig(cfg config.ListenerTLSConfig, http2 bool) (*tls.Config, error) {
+	certs := &certificates{cfg: cfg, nextProtos: []string{"http/1.1"}, log: s.log}
+	if http2 {
+		certs.nextProtos = []string{"h2", "http/1.1"}
+	}
+	if err := certs.load(); err != nil {
+		return nil, err
+	}
+	files := []string{cfg.CertFile, cfg.KeyFile}
+	if cfg.ClientCAFile != "" {
+		files = append(files, cfg.ClientCAFile)
+	}
+	if err := config.Watch(context.Background(), files, certs.reload); err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		MinVersion:         cfg.Version(),
+		NextProtos:         certs.nextProtos,
+		GetConfigForClient: certs.configFor,
+	}, nil
+}
+
+// requireClientCert rejects requests without a verified client certificate,
+// except for the open routes of rt: health checks, metrics and the OpenAPI
+// document
+func (s *Server) requireClientCert(rt *router, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !rt.unauthenticated(r) && (r.TLS == nil || len(r.TLS.VerifiedChains) == 0) {
+			s.log.Warn().
+				Str("path", r.URL.Path).
+				Str("remote_addr", r.RemoteAddr).
+				Msg("Request without a client certificate rejected")
+			http.Error(w, "A valid client certificate is required", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
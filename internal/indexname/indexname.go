@@ -0,0 +1,113 @@
+// Package indexname resolves time-based index names such as
+// "trivy-%{+yyyy.MM.dd}", so that reports are partitioned by day and old
+// indices can be dropped.
+package indexname
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// jodaTokens maps the date tokens used by Logstash and Beats to Go layout
+// elements, longest first
+var jodaTokens = strings.NewReplacer(
+	"yyyy", "2006",
+	"yy", "06",
+	"MM", "01",
+	"dd", "02",
+	"HH", "15",
+	"mm", "04",
+	"ss", "05",
+)
+
+// HasPattern reports whether name contains a date pattern
+func HasPattern(name string) bool {
+	return strings.Contains(name, "%{+")
+}
+
+// Validate checks that every pattern in name is terminated
+func Validate(name string) error {
+	_, err := expand(name, func(string) string { return "" })
+	return err
+}
+
+// Resolve replaces every %{+format} in name with t formatted in UTC. The
+// format uses Logstash date tokens (yyyy, yy, MM, dd, HH, mm, ss) or, when
+// it contains 2006, a Go time layout. Malformed patterns are left untouched.
+func Resolve(name string, t time.Time) string {
+	if !HasPattern(name) {
+		return name
+	}
+	t = t.UTC()
+	resolved, err := expand(name, func(format string) string {
+		return t.Format(layout(format))
+	})
+	if err != nil {
+		return name
+	}
+	return resolved
+}
+
+// Static returns name without its date patterns and the separators around
+// them, e.g. "trivy" for "trivy-%{+yyyy.MM.dd}"
+func Static(name string) string {
+	static, err := expand(name, func(string) string { return "" })
+	if err != nil {
+		return name
+	}
+	return strings.Trim(static, "-_.")
+}
+
+// Wildcard returns an index pattern matching every index name resolves to,
+// e.g. "trivy-*.*.*" for "trivy-%{+yyyy.MM.dd}". The separators inside the
+// date format are kept so that the pattern does not match unrelated indices
+// sharing the prefix, such as "trivy-fingerprints".
+func Wildcard(name string) string {
+	wildcard, err := expand(name, func(format string) string {
+		var b strings.Builder
+		for _, r := range format {
+			if unicode.IsLetter(r) || unicode.IsDigit(r) {
+				if !strings.HasSuffix(b.String(), "*") {
+					b.WriteByte('*')
+				}
+				continue
+			}
+			b.WriteRune(r)
+		}
+		return b.String()
+	})
+	if err != nil {
+		return name
+	}
+	return wildcard
+}
+
+// expand calls fn for the format of every pattern in name and substitutes the result
+func expand(name string, fn func(format string) string) (string, error) {
+	var b strings.Builder
+	rest := name
+	for {
+		start := strings.Index(rest, "%{+")
+		if start < 0 {
+			b.WriteString(rest)
+			return b.String(), nil
+		}
+		end := strings.Index(rest[start:], "}")
+		if end < 0 {
+			return "", fmt.Errorf("unterminated date pattern in %q", name)
+		}
+		b.WriteString(rest[:start])
+		b.WriteString(fn(rest[start+3 : start+end]))
+		rest = rest[start+end+1:]
+	}
+}
+
+// layout converts a pattern format to a Go time layout
+func layout(format string) string {
+	if strings.Contains(format, "2006") {
+		return format
+	}
+	return jodaTokens.Replace(format)
+}
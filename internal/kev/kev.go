@@ -0,0 +1,130 @@
+// Package kev keeps a copy of the CISA Known Exploited Vulnerabilities
+// catalog, see https://www.cisa.gov/known-exploited-vulnerabilities-catalog
+package kev
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/truemilk/trivelastic/internal/logger"
+)
+
+// fetchTimeout bounds each download of the catalog
+const fetchTimeout = time.Minute
+
+// Entry is a vulnerability of the catalog
+type Entry struct {
+	CVEID                      string `json:"cveID"`
+	VendorProject              string `json:"vendorProject"`
+	Product                    string `json:"product"`
+	DateAdded                  string `json:"dateAdded"`
+	DueDate                    string `json:"dueDate"`
+	RequiredAction             string `json:"requiredAction"`
+	KnownRansomwareCampaignUse string `json:"knownRansomwareCampaignUse"`
+}
+
+// Catalog is the latest successfully fetched copy of the catalog. It is
+// empty until the first fetch succeeds.
+type Catalog struct {
+	url    string
+	client *http.Client
+	mu     sync.RWMutex
+	// entries maps upper-cased CVE IDs to their entry, nil before the first fetch
+	entries map[string]Entry
+	log     zerolog.Logger
+}
+
+func NewCatalog(url string) *Catalog {
+	return &Catalog{
+		url:    url,
+		client: &http.Client{Timeout: fetchTimeout},
+		log:    logger.GetLogger("kev"),
+	}
+}
+
+// Loaded reports whether the catalog was fetched at least once
+func (c *Catalog) Loaded() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.entries != nil
+}
+
+// Lookup returns the catalog entry of a CVE
+func (c *Catalog) Lookup(cveID string) (Entry, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	entry, ok := c.entries[strings.ToUpper(cveID)]
+	return entry, ok
+}
+
+// Run fetches the catalog now and then every interval until ctx is done.
+// A failed fetch keeps the previous copy.
+func (c *Catalog) Run(ctx context.Context, interval time.Duration) {
+	c.log.Info().
+		Str("url", c.url).
+		Dur("interval", interval).
+		Msg("Known Exploited Vulnerabilities catalog refresh enabled")
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := c.Fetch(ctx); err != nil {
+			c.log.Error().
+				Err(err).
+				Msg("Failed to fetch Known Exploited Vulnerabilities catalog, keeping the previous copy")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Fetch downloads the catalog and replaces the current copy
+func (c *Catalog) Fetch(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url, nil)
+	if err != nil {
+		return fmt.Errorf("error creating request: %w", err)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("get %s: %w", c.url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("get %s: unexpected status %s", c.url, resp.Status)
+	}
+
+	var catalog struct {
+		CatalogVersion  string  `json:"catalogVersion"`
+		Vulnerabilities []Entry `json:"vulnerabilities"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&catalog); err != nil {
+		return fmt.Errorf("error decoding catalog: %w", err)
+	}
+	if len(catalog.Vulnerabilities) == 0 {
+		return fmt.Errorf("catalog %s lists no vulnerabilities", c.url)
+	}
+
+	entries := make(map[string]Entry, len(catalog.Vulnerabilities))
+	for _, entry := range catalog.Vulnerabilities {
+		entries[strings.ToUpper(entry.CVEID)] = entry
+	}
+
+	c.mu.Lock()
+	c.entries = entries
+	c.mu.Unlock()
+
+	c.log.Info().
+		Str("version", catalog.CatalogVersion).
+		Int("vulnerabilities", len(entries)).
+		Msg("Known Exploited Vulnerabilities catalog loaded")
+	return nil
+}
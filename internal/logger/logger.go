@@ -15,7 +15,11 @@ type Config struct {
 	JSONFormat bool
 }
 
-// Initialize sets up the global logger with the given configuration
+// custom is set once an embedding service has provided its own logger
+var custom bool
+
+// Initialize sets up the global logger with the given configuration. A logger
+// installed with SetLogger is kept and only the level is applied.
 func Initialize(cfg Config) error {
 	// Set logger time format
 	zerolog.TimeFieldFormat = time.RFC3339
@@ -26,6 +30,9 @@ func Initialize(cfg Config) error {
 		level = zerolog.InfoLevel // Default to info level on error
 	}
 	zerolog.SetGlobalLevel(level)
+	if custom {
+		return nil
+	}
 
 	// Configure output writer
 	var output io.Writer = os.Stdout
@@ -45,6 +52,12 @@ func Initialize(cfg Config) error {
 	return nil
 }
 
+// SetLogger replaces the global logger, e.g. when trivelastic is embedded in another service
+func SetLogger(l zerolog.Logger) {
+	log.Logger = l
+	custom = true
+}
+
 // GetLogger returns a logger instance with the given component name
 func GetLogger(component string) zerolog.Logger {
 	return log.With().Str("component", component).Logger()
@@ -0,0 +1,199 @@
+package maintenance
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/truemilk/trivelastic/internal/logger"
+	"github.com/truemilk/trivelastic/internal/routing"
+	"github.com/truemilk/trivelastic/internal/schedule"
+)
+
+// drainInterval is how often the spool is checked once a window has ended
+const drainInterval = 30 * time.Second
+
+// IndexFunc writes routed documents to Elasticsearch
+type IndexFunc func(routes []routing.Route) error
+
+// Manager holds reports on disk while a maintenance window is active and
+// replays them once the window has ended
+type Manager struct {
+	windows  []schedule.Window
+	spoolDir string
+	index    IndexFunc
+	now      func() time.Time
+	stop     chan struct{}
+	log      zerolog.Logger
+}
+
+func NewManager(windows []schedule.Window, spoolDir string, index IndexFunc) (*Manager, error) {
+	if err := os.MkdirAll(spoolDir, 0o750); err != nil {
+		return nil, fmt.Errorf("error creating spool directory: %w", err)
+	}
+
+	return &Manager{
+		windows:  windows,
+		spoolDir: spoolDir,
+		index:    index,
+		now:      func() time.Time { return time.Now().UTC() },
+		stop:     make(chan struct{}),
+		log:      logger.GetLogger("maintenance"),
+	}, nil
+}
+
+// Active reports whether a maintenance window is currently open
+func (m *Manager) Active() bool {
+	now := m.now()
+	for _, w := range m.windows {
+		if w.Active(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// Store writes routed documents to the spool to be indexed after the window
+func (m *Manager) Store(routes []routing.Route) error {
+	data, err := json.Marshal(routes)
+	if err != nil {
+		return fmt.Errorf("error marshaling routes: %w", err)
+	}
+
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return fmt.Errorf("error generating file name: %w", err)
+	}
+	name := fmt.Sprintf("%020d-%s.json", m.now().UnixNano(), hex.EncodeToString(suffix))
+
+	// Write to a temporary file first so the drainer never sees partial files
+	tmp := filepath.Join(m.spoolDir, name+".tmp")
+	if err := os.WriteFile(tmp, data, 0o640); err != nil {
+		return fmt.Errorf("error writing spool file: %w", err)
+	}
+	if err := os.Rename(tmp, filepath.Join(m.spoolDir, name)); err != nil {
+		return fmt.Errorf("error committing spool file: %w", err)
+	}
+
+	m.log.Debug().
+		Str("file", name).
+		Int("documents", len(routes)).
+		Msg("Report spooled during maintenance window")
+
+	return nil
+}
+
+// rewrite replaces the routes of the spool file at path
+func (m *Manager) rewrite(path string, routes []routing.Route) error {
+	data, err := json.Marshal(routes)
+	if err != nil {
+		return fmt.Errorf("error marshaling routes: %w", err)
+	}
+	if err := os.WriteFile(path+".tmp", data, 0o640); err != nil {
+		return fmt.Errorf("error writing spool file: %w", err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return fmt.Errorf("error committing spool file: %w", err)
+	}
+	return nil
+}
+
+// Start drains the spool in the background whenever no window is active
+func (m *Manager) Start() {
+	m.log.Info().
+		Int("windows", len(m.windows)).
+		Str("spool_dir", m.spoolDir).
+		Msg("Maintenance scheduling enabled")
+
+	go func() {
+		ticker := time.NewTicker(drainInterval)
+		defer ticker.Stop()
+
+		for {
+			if !m.Active() {
+				m.drain()
+			}
+
+			select {
+			case <-m.stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Stop ends background draining
+func (m *Manager) Stop() {
+	close(m.stop)
+}
+
+// drain replays spooled reports in arrival order, stopping at the first failure
+func (m *Manager) drain() {
+	entries, err := os.ReadDir(m.spoolDir)
+	if err != nil {
+		m.log.Error().Err(err).Msg("Failed to read spool directory")
+		return
+	}
+
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".json") {
+			names = append(names, entry.Name())
+		}
+	}
+	if len(names) == 0 {
+		return
+	}
+	sort.Strings(names)
+
+	m.log.Info().
+		Int("reports", len(names)).
+		Msg("Draining reports spooled during maintenance")
+
+	for _, name := range names {
+		if m.Active() {
+			m.log.Info().Msg("Maintenance window opened, pausing drain")
+			return
+		}
+
+		path := filepath.Join(m.spoolDir, name)
+		data, err := os.ReadFile(path)
+		if err != nil {
+			m.log.Error().Err(err).Str("file", name).Msg("Failed to read spool file")
+			return
+		}
+
+		var routes []routing.Route
+		if err := json.Unmarshal(data, &routes); err != nil {
+			m.log.Error().Err(err).Str("file", name).Msg("Discarding corrupt spool file")
+			os.Remove(path)
+			continue
+		}
+
+		if err := m.index(routes); err != nil {
+			// Documents already written are left out of the next attempt
+			if remaining := routing.Remaining(routes, err); len(remaining) < len(routes) {
+				if err := m.rewrite(path, remaining); err != nil {
+					m.log.Error().Err(err).Str("file", name).Msg("Failed to remove written documents from spool file")
+				}
+			}
+			m.log.Error().Err(err).Str("file", name).Msg("Failed to index spooled report, will retry")
+			return
+		}
+
+		if err := os.Remove(path); err != nil {
+			m.log.Error().Err(err).Str("file", name).Msg("Failed to remove drained spool file")
+			return
+		}
+	}
+
+	m.log.Info().Msg("Spool drained")
+}
@@ -0,0 +1,222 @@
+// Package metrics keeps counters, gauges and histograms and serves them in
+// the Prometheus text exposition format, see
+// https://prometheus.io/docs/instrumenting/exposition_formats/
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Metrics written by trivelastic
+var (
+	HTTPRequests = NewCounter("trivelastic_http_requests_total",
+		"HTTP requests handled, by route and status code", "path", "code")
+	PayloadSize = NewHistogram("trivelastic_http_request_size_bytes",
+		"Size of the request bodies received", []float64{1 << 10, 10 << 10, 100 << 10, 1 << 20, 10 << 20, 50 << 20})
+	ESRequestDuration = NewHistogram("trivelastic_elasticsearch_request_duration_seconds",
+		"Time taken by Elasticsearch requests, retries included", []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30})
+	RateLimited = NewCounter("trivelastic_http_rate_limited_total",
+		"Requests rejected because the client was over its rate")
+	QueueRejected = NewCounter("trivelastic_worker_queue_rejected_total",
+		"Requests rejected because the worker queue was full or over its memory budget")
+	ESRetries = NewCounter("trivelastic_elasticsearch_retries_total",
+		"Elasticsearch request attempts retried")
+	ESErrors = NewCounter("trivelastic_elasticsearch_errors_total",
+		"Elasticsearch requests that failed after every attempt")
+	JobDuration = NewHistogram("trivelastic_worker_job_duration_seconds",
+		"Time taken by a worker to process a request, indexing included", []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30})
+	WorkerBusy = NewCounter("trivelastic_worker_busy_seconds_total",
+		"Time spent processing requests, by worker", "worker")
+	RetryQueueAttempts = NewCounter("trivelastic_retry_queue_attempts_total",
+		"Reports retried by the retry queue, by result: indexed, failed, rejected or expired", "result")
+	IdempotencyHits = NewCounter("trivelastic_idempotency_hits_total",
+		"Payloads submitted again and answered from the idempotency cache")
+	BulkFlushes = NewCounter("trivelastic_bulk_flushes_total",
+		"Bulk requests sent, by what triggered them: docs, bytes or interval", "reason")
+	BulkDocuments = NewHistogram("trivelastic_bulk_documents",
+		"Documents written per bulk request", []float64{1, 5, 10, 50, 100, 250, 500, 1000, 5000})
+)
+
+// metric is anything written by Handler
+type metric interface {
+	write(w io.Writer)
+}
+
+var (
+	mu sync.Mutex
+	// registered maps metric names to the metrics written by Handler
+	registered = map[string]metric{}
+)
+
+func register(name string, m metric) {
+	mu.Lock()
+	registered[name] = m
+	mu.Unlock()
+}
+
+// Counter is a value that only goes up, one per combination of label values
+type Counter struct {
+	name   string
+	help   string
+	labels []string
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{name: name, help: help, labels: labels, values: map[string]float64{}}
+	register(name, c)
+	return c
+}
+
+// Inc adds one to the counter with the given label values, in the order of
+// the labels of the counter
+func (c *Counter) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Add adds delta to the counter with the given label values
+func (c *Counter) Add(delta float64, values ...string) {
+	key := labelPairs(c.labels, values)
+	c.mu.Lock()
+	c.values[key] += delta
+	c.mu.Unlock()
+}
+
+func (c *Counter) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	header(w, c.name, c.help, "counter")
+	if len(c.values) == 0 && len(c.labels) == 0 {
+		fmt.Fprintf(w, "%s 0\n", c.name)
+	}
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, key, formatFloat(c.values[key]))
+	}
+}
+
+// GaugeFunc is a value read when the metrics are collected
+type GaugeFunc struct {
+	name  string
+	help  string
+	value func() float64
+}
+
+// NewGaugeFunc registers a gauge reading value, replacing any gauge of the same name
+func NewGaugeFunc(name, help string, value func() float64) *GaugeFunc {
+	g := &GaugeFunc{name: name, help: help, value: value}
+	register(name, g)
+	return g
+}
+
+func (g *GaugeFunc) write(w io.Writer) {
+	header(w, g.name, g.help, "gauge")
+	fmt.Fprintf(w, "%s %s\n", g.name, formatFloat(g.value()))
+}
+
+// Histogram counts observations in cumulative buckets
+type Histogram struct {
+	name    string
+	help    string
+	bounds  []float64
+	mu      sync.Mutex
+	buckets []uint64
+	count   uint64
+	sum     float64
+}
+
+// NewHistogram creates a histogram with the given ascending bucket upper bounds
+func NewHistogram(name, help string, bounds []float64) *Histogram {
+	h := &Histogram{name: name, help: help, bounds: bounds, buckets: make([]uint64, len(bounds))}
+	register(name, h)
+	return h
+}
+
+func (h *Histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, bound := range h.bounds {
+		if v <= bound {
+			h.buckets[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	header(w, h.name, h.help, "histogram")
+	for i, bound := range h.bounds {
+		fmt.Fprintf(w, "%s_bucket{le=%q} %d\n", h.name, formatFloat(bound), h.buckets[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.name, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n", h.name, formatFloat(h.sum))
+	fmt.Fprintf(w, "%s_count %d\n", h.name, h.count)
+}
+
+// Handler serves every registered metric
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		names := make([]string, 0, len(registered))
+		for name := range registered {
+			names = append(names, name)
+		}
+		metrics := make([]metric, 0, len(names))
+		sort.Strings(names)
+		for _, name := range names {
+			metrics = append(metrics, registered[name])
+		}
+		mu.Unlock()
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		for _, m := range metrics {
+			m.write(w)
+		}
+	})
+}
+
+func header(w io.Writer, name, help, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// labelPairs formats label names and values as {name="value",...}
+func labelPairs(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		pairs[i] = name + "=" + strconv.Quote(value)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
@@ -0,0 +1,79 @@
+package pipeline
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+// ciHeaders maps the request headers describing the CI run that produced a
+// report to the fields of its ci object
+var ciHeaders = map[string]string{
+	"X-CI-Pipeline": "pipeline",
+	"X-CI-Job":      "job",
+	"X-CI-Run-URL":  "run_url",
+	"X-Git-Repo":    "git_repo",
+	"X-Git-Commit":  "git_commit",
+	"X-Git-Branch":  "git_branch",
+}
+
+// CIFields returns the fields to set on the reports of a request from its
+// CI headers, such as {"ci": {"pipeline": "build", "git_commit": "4f2a..."}},
+// or nil when the request has none
+func CIFields(h http.Header) map[string]interface{} {
+	ci := map[string]interface{}{}
+	for header, field := range ciHeaders {
+		if value := strings.TrimSpace(h.Get(header)); value != "" {
+			ci[field] = value
+		}
+	}
+	if len(ci) == 0 {
+		return nil
+	}
+	return map[string]interface{}{"ci": ci}
+}
+
+// apiKeyContextKey holds the name of the API key that authenticated a request
+type apiKeyContextKey struct{}
+
+// WithAPIKey records the name of the API key that authenticated a request
+func WithAPIKey(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, apiKeyContextKey{}, name)
+}
+
+// APIKeyName returns the name of the API key that authenticated a request
+func APIKeyName(ctx context.Context) (string, bool) {
+	name, ok := ctx.Value(apiKeyContextKey{}).(string)
+	return name, ok
+}
+
+// tenantContextKey holds the tenant a request was posted for
+type tenantContextKey struct{}
+
+// WithTenant records the tenant a request was posted for
+func WithTenant(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, tenantContextKey{}, name)
+}
+
+// RequestFields returns the fields to set on the reports of a request: its
+// CI fields, see CIFields, and the name of its API key and its tenant under
+// _trivelastic.api_key and _trivelastic.tenant. It returns nil when there
+// are none.
+func RequestFields(r *http.Request) map[string]interface{} {
+	fields := CIFields(r.Header)
+	metadata := map[string]interface{}{}
+	if name, ok := APIKeyName(r.Context()); ok {
+		metadata["api_key"] = name
+	}
+	if name, ok := r.Context().Value(tenantContextKey{}).(string); ok {
+		metadata["tenant"] = name
+	}
+	if len(metadata) > 0 {
+		if fields == nil {
+			fields = map[string]interface{}{}
+		}
+		// Added to the _trivelastic object of the report, which clients cannot set
+		fields[metadataField] = metadata
+	}
+	return fields
+}
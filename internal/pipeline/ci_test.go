@@ -0,0 +1,164 @@
+package pipeline
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/truemilk/trivelastic/internal/config"
+	"github.com/truemilk/trivelastic/internal/routing"
+)
+
+func TestCIFields(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers map[string]string
+		want    map[string]interface{}
+	}{
+		{name: "no headers"},
+		{name: "blank headers", headers: map[string]string{"X-CI-Pipeline": "  ", "X-Git-Branch": ""}},
+		{
+			name: "every header",
+			headers: map[string]string{
+				"X-CI-Pipeline": "build",
+				"X-CI-Job":      "scan",
+				"X-CI-Run-URL":  "https://ci.example.com/runs/1",
+				"X-Git-Repo":    "example/app",
+				"X-Git-Commit":  "4f2a",
+				"X-Git-Branch":  "main",
+			},
+			want: map[string]interface{}{"ci": map[string]interface{}{
+				"pipeline":   "build",
+				"job":        "scan",
+				"run_url":    "https://ci.example.com/runs/1",
+				"git_repo":   "example/app",
+				"git_commit": "4f2a",
+				"git_branch": "main",
+			}},
+		},
+		{
+			name:    "other headers ignored",
+			headers: map[string]string{"X-Git-Branch": " main ", "X-CI-Token": "secret"},
+			want:    map[string]interface{}{"ci": map[string]interface{}{"git_branch": "main"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := http.Header{}
+			for k, v := range tt.headers {
+				h.Set(k, v)
+			}
+			if got := CIFields(h); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestProcessSetsCIFields(t *testing.T) {
+	p := New(routing.NewRouter("trivy", &config.RoutingConfig{}))
+	h := http.Header{}
+	h.Set("X-CI-Pipeline", "build")
+	// The headers take precedence over a ci object in the report
+	body := []byte(`{"ArtifactName":"alpine","ci":{"pipeline":"forged"}}`)
+
+	result, err := p.Process(context.Background(), body, CIFields(h))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ci, _ := result.Reports[0]["ci"].(map[string]interface{})
+	if ci["pipeline"] != "build" {
+		t.Fatalf("expected the pipeline from the headers, got %v", ci)
+	}
+}
+
+func TestRequestFields(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers map[string]string
+		apiKey  string
+		tenant  string
+		want    map[string]interface{}
+	}{
+		{name: "none"},
+		{
+			name:    "CI headers",
+			headers: map[string]string{"X-CI-Pipeline": "build", "X-Git-Commit": " 4f2a ", "X-CI-Job": " "},
+			want:    map[string]interface{}{"ci": map[string]interface{}{"pipeline": "build", "git_commit": "4f2a"}},
+		},
+		{
+			name:   "API key and tenant",
+			apiKey: "ci",
+			tenant: "team-a",
+			want:   map[string]interface{}{metadataField: map[string]interface{}{"api_key": "ci", "tenant": "team-a"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/v1/reports", nil)
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+			ctx := r.Context()
+			if tt.apiKey != "" {
+				ctx = WithAPIKey(ctx, tt.apiKey)
+			}
+			if tt.tenant != "" {
+				ctx = WithTenant(ctx, tt.tenant)
+			}
+			if got := RequestFields(r.WithContext(ctx)); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestProcessDropsClientMetadata(t *testing.T) {
+	p := New(routing.NewRouter("trivy", &config.RoutingConfig{}))
+	body := []byte(`{"ArtifactName":"alpine","_trivelastic":{"api_key":"admin","tenant":"team-b","kubernetes":{"cluster":"prod"}}}`)
+
+	tests := []struct {
+		name   string
+		fields map[string]interface{}
+		want   map[string]interface{}
+	}{
+		{name: "without request metadata"},
+		{
+			name:   "with an API key",
+			fields: map[string]interface{}{metadataField: map[string]interface{}{"api_key": "ci"}},
+			want:   map[string]interface{}{"api_key": "ci"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := p.Process(context.Background(), body, tt.fields)
+			if err != nil {
+				t.Fatal(err)
+			}
+			meta, _ := result.Reports[0][metadataField].(map[string]interface{})
+			for _, field := range []string{"api_key", "tenant", "kubernetes"} {
+				if got, want := meta[field], tt.want[field]; !reflect.DeepEqual(got, want) {
+					t.Errorf("expected %s %v, got %v", field, want, got)
+				}
+			}
+		})
+	}
+}
+
+func TestProcessKeepsKubernetesMetadata(t *testing.T) {
+	p := New(routing.NewRouter("trivy", &config.RoutingConfig{}))
+	body := []byte(`{"ClusterName":"prod","Resources":[{"Namespace":"default","Kind":"Deployment","Name":"web"}]}`)
+	fields := map[string]interface{}{metadataField: map[string]interface{}{"tenant": "team-a"}}
+
+	result, err := p.Process(context.Background(), body, fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, _ := result.Reports[0][metadataField].(map[string]interface{})
+	kubernetes, _ := meta["kubernetes"].(map[string]interface{})
+	if meta["tenant"] != "team-a" || kubernetes["cluster"] != "prod" {
+		t.Fatalf("expected the tenant added to the Kubernetes metadata, got %v", meta)
+	}
+}
@@ -0,0 +1,157 @@
+package pipeline
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// cvssMetric names a base metric of a CVSS vector and its values
+type cvssMetric struct {
+	field  string
+	values map[string]string
+}
+
+var (
+	cvssImpact = map[string]string{"N": "none", "L": "low", "H": "high"}
+
+	// cvss3Metrics are the base metrics of CVSS 3.0 and 3.1 vectors
+	cvss3Metrics = map[string]cvssMetric{
+		"AV": {"attack_vector", map[string]string{"N": "network", "A": "adjacent_network", "L": "local", "P": "physical"}},
+		"AC": {"attack_complexity", map[string]string{"L": "low", "H": "high"}},
+		"PR": {"privileges_required", map[string]string{"N": "none", "L": "low", "H": "high"}},
+		"UI": {"user_interaction", map[string]string{"N": "none", "R": "required"}},
+		"S":  {"scope", map[string]string{"U": "unchanged", "C": "changed"}},
+		"C":  {"confidentiality_impact", cvssImpact},
+		"I":  {"integrity_impact", cvssImpact},
+		"A":  {"availability_impact", cvssImpact},
+	}
+
+	cvss2Impact = map[string]string{"N": "none", "P": "partial", "C": "complete"}
+
+	// cvss2Metrics are the base metrics of CVSS 2.0 vectors
+	cvss2Metrics = map[string]cvssMetric{
+		"AV": {"attack_vector", map[string]string{"L": "local", "A": "adjacent_network", "N": "network"}},
+		"AC": {"attack_complexity", map[string]string{"H": "high", "M": "medium", "L": "low"}},
+		"Au": {"authentication", map[string]string{"M": "multiple", "S": "single", "N": "none"}},
+		"C":  {"confidentiality_impact", cvss2Impact},
+		"I":  {"integrity_impact", cvss2Impact},
+		"A":  {"availability_impact", cvss2Impact},
+	}
+)
+
+// parseCVSSVector decodes the base metrics of a CVSS 2.0, 3.0 or 3.1 vector
+// such as "CVSS:3.1/AV:N/AC:L/PR:N/UI:N/S:U/C:H/I:H/A:H". Temporal and
+// environmental metrics are ignored.
+func parseCVSSVector(vector string) (string, map[string]interface{}, error) {
+	version, metrics := "2.0", cvss2Metrics
+	parts := strings.Split(vector, "/")
+	if prefix, v, ok := strings.Cut(parts[0], ":"); ok && prefix == "CVSS" {
+		if v != "3.0" && v != "3.1" {
+			return "", nil, fmt.Errorf("unsupported CVSS version %q", v)
+		}
+		version, metrics, parts = v, cvss3Metrics, parts[1:]
+	}
+
+	fields := map[string]interface{}{}
+	for _, part := range parts {
+		key, value, ok := strings.Cut(part, ":")
+		if !ok {
+			return "", nil, fmt.Errorf("malformed metric %q", part)
+		}
+		metric, ok := metrics[key]
+		if !ok {
+			continue
+		}
+		name, ok := metric.values[value]
+		if !ok {
+			return "", nil, fmt.Errorf("unknown value %q for metric %s", value, key)
+		}
+		fields[metric.field] = name
+	}
+	var missing []string
+	for key, metric := range metrics {
+		if _, ok := fields[metric.field]; !ok {
+			missing = append(missing, key)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return "", nil, fmt.Errorf("missing base metrics %s", strings.Join(missing, ", "))
+	}
+	return version, fields, nil
+}
+
+// CVSSTransform decomposes the CVSS vectors of every vulnerability into a
+// cvss list with one entry per source and version, holding the base score
+// and each base metric, e.g. attack_vector "network". Trivy's CVSS field is
+// kept as it is.
+type CVSSTransform struct{}
+
+func (CVSSTransform) Name() string {
+	return "cvss"
+}
+
+func (t CVSSTransform) Apply(doc map[string]interface{}) (map[string]interface{}, []Warning, error) {
+	results, _ := doc["Results"].([]interface{})
+
+	var warnings []Warning
+	for i, item := range results {
+		result, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		vulns, _ := result["Vulnerabilities"].([]interface{})
+		for j, item := range vulns {
+			vuln, ok := item.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			sources, ok := vuln["CVSS"].(map[string]interface{})
+			if !ok {
+				continue
+			}
+
+			names := make([]string, 0, len(sources))
+			for source := range sources {
+				names = append(names, source)
+			}
+			sort.Strings(names)
+
+			var entries []interface{}
+			for _, source := range names {
+				scores, ok := sources[source].(map[string]interface{})
+				if !ok {
+					continue
+				}
+				for _, v := range []string{"V2", "V3"} {
+					vector, ok := scores[v+"Vector"].(string)
+					if !ok || vector == "" {
+						continue
+					}
+					version, fields, err := parseCVSSVector(vector)
+					if err != nil {
+						warnings = append(warnings, Warning{
+							Transform: t.Name(),
+							Level:     LevelWarning,
+							Field:     fmt.Sprintf("Results[%d].Vulnerabilities[%d].CVSS.%s.%sVector", i, j, source, v),
+							Message:   err.Error(),
+						})
+						continue
+					}
+					fields["source"] = source
+					fields["version"] = version
+					fields["vector"] = vector
+					if score, ok := scores[v+"Score"].(float64); ok {
+						fields["base_score"] = score
+					}
+					entries = append(entries, fields)
+				}
+			}
+			if len(entries) > 0 {
+				vuln["cvss"] = entries
+			}
+		}
+	}
+	return doc, warnings, nil
+}
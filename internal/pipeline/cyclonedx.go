@@ -0,0 +1,234 @@
+package pipeline
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/truemilk/trivelastic/pkg/trivy"
+)
+
+// trivyProperty prefixes the component properties set by Trivy
+const trivyProperty = "aquasecurity:trivy:"
+
+// cycloneDXSeverities maps the severities of CycloneDX ratings to Trivy's
+var cycloneDXSeverities = map[string]string{
+	"critical": trivy.SeverityCritical,
+	"high":     trivy.SeverityHigh,
+	"medium":   trivy.SeverityMedium,
+	"low":      trivy.SeverityLow,
+	"info":     trivy.SeverityLow,
+	"none":     trivy.SeverityUnknown,
+	"unknown":  trivy.SeverityUnknown,
+}
+
+// cycloneDXFixedVersion finds the fixed version in Trivy's recommendations,
+// such as "Upgrade openssl to version 3.0.8-r0"
+var cycloneDXFixedVersion = regexp.MustCompile(`to versions? (.+)$`)
+
+// cycloneDXReport maps a CycloneDX BOM to a report shaped like a CLI
+// report, so that SBOMs and scans share dashboards. Components are grouped
+// into Results as described by sbomResults: each result lists its
+// components as Packages and the vulnerabilities affecting them as
+// Vulnerabilities, with CLI field names.
+func cycloneDXReport(bom map[string]interface{}) map[string]interface{} {
+	meta, _ := bom["metadata"].(map[string]interface{})
+	root, _ := meta["component"].(map[string]interface{})
+
+	var components []sbomComponent
+	for _, c := range maps(bom["components"]) {
+		components = append(components, cycloneDXComponent(c))
+	}
+	// The first component depending on a component is its parent
+	parents := map[string]string{}
+	for _, dep := range maps(bom["dependencies"]) {
+		children, _ := dep["dependsOn"].([]interface{})
+		for _, child := range children {
+			if ref, ok := child.(string); ok && parents[ref] == "" {
+				parents[ref] = str(dep, "ref")
+			}
+		}
+	}
+
+	artifactName := str(root, "name")
+	report := map[string]interface{}{
+		"SchemaVersion": trivy.SchemaVersion,
+		"ArtifactName":  artifactName,
+		"ArtifactType":  "cyclonedx",
+		metadataField:   sbomMetadata("cyclonedx", str(bom, "specVersion"), str(bom, "serialNumber"), len(components)),
+	}
+	if ts, ok := meta["timestamp"]; ok {
+		report["CreatedAt"] = ts
+	}
+
+	// Trivy records the image identity as properties of the root component
+	image := map[string]interface{}{}
+	for field, property := range map[string]string{
+		"ImageID":     "ImageID",
+		"RepoTags":    "RepoTag",
+		"RepoDigests": "RepoDigest",
+		"DiffIDs":     "DiffID",
+	} {
+		values := properties(root, trivyProperty+property)
+		switch {
+		case len(values) == 0:
+		case field == "ImageID":
+			image[field] = values[0]
+		default:
+			image[field] = stringList(values)
+		}
+	}
+
+	results := newSBOMResults(artifactName, components, parents, image)
+	for _, vuln := range maps(bom["vulnerabilities"]) {
+		for _, affects := range maps(vuln["affects"]) {
+			c, ok := results.byRef[str(affects, "ref")]
+			if !ok {
+				continue
+			}
+			result := results.resultFor(c.ref)
+			list, _ := result["Vulnerabilities"].([]interface{})
+			result["Vulnerabilities"] = append(list, cycloneDXVulnerability(vuln, c))
+		}
+	}
+
+	if len(image) > 0 {
+		report["Metadata"] = image
+	}
+	if results.results != nil {
+		report["Results"] = results.results
+	}
+	return report
+}
+
+// cycloneDXComponent reads a component of a BOM. Maven components are
+// named "<group>:<name>", like Trivy names their packages.
+func cycloneDXComponent(c map[string]interface{}) sbomComponent {
+	component := sbomComponent{
+		ref:     str(c, "bom-ref"),
+		name:    str(c, "name"),
+		version: str(c, "version"),
+		purl:    str(c, "purl"),
+		pkgID:   first(properties(c, trivyProperty+"PkgID")),
+		pkgType: first(properties(c, trivyProperty+"Type")),
+	}
+	if group := str(c, "group"); group != "" {
+		component.name = group + ":" + component.name
+	}
+	if t := str(c, "type"); t == trivy.ComponentOperatingSystem || t == trivy.ComponentApplication {
+		component.kind = t
+	}
+
+	for _, entry := range maps(c["licenses"]) {
+		license, _ := entry["license"].(map[string]interface{})
+		for _, name := range []string{str(entry, "expression"), str(license, "id"), str(license, "name")} {
+			if name != "" {
+				component.licenses = append(component.licenses, name)
+				break
+			}
+		}
+	}
+	return component
+}
+
+// cycloneDXVulnerability maps a vulnerability affecting component c to a
+// vulnerability of a CLI report. Its severity is the one rated by the
+// vulnerability's source, or the highest rating when the source gave none.
+func cycloneDXVulnerability(vuln map[string]interface{}, c sbomComponent) map[string]interface{} {
+	source, _ := vuln["source"].(map[string]interface{})
+	v := rename(map[string]interface{}{
+		"VulnerabilityID":  str(vuln, "id"),
+		"PkgName":          c.name,
+		"InstalledVersion": c.version,
+		"Description":      str(vuln, "description"),
+		"PublishedDate":    str(vuln, "published"),
+		"LastModifiedDate": str(vuln, "updated"),
+	}, nil)
+	if c.purl != "" {
+		v["PkgIdentifier"] = map[string]interface{}{"PURL": c.purl}
+	}
+	if m := cycloneDXFixedVersion.FindStringSubmatch(str(vuln, "recommendation")); m != nil {
+		v["FixedVersion"] = m[1]
+	}
+	if dataSource := rename(map[string]interface{}{"Name": str(source, "name"), "URL": str(source, "url")}, nil); len(dataSource) > 0 {
+		v["DataSource"] = dataSource
+	}
+
+	severity, score := "", -1
+	cvss := map[string]interface{}{}
+	for _, rating := range maps(vuln["ratings"]) {
+		ratingSource, _ := rating["source"].(map[string]interface{})
+		name := str(ratingSource, "name")
+		if s, ok := cycloneDXSeverities[str(rating, "severity")]; ok {
+			rank, _ := trivy.SeverityScore(s)
+			if name != "" && name == str(source, "name") {
+				rank += len(trivy.Severities)
+			}
+			if rank > score {
+				severity, score = s, rank
+			}
+		}
+
+		var version string
+		switch str(rating, "method") {
+		case "CVSSv2":
+			version = "V2"
+		case "CVSSv3", "CVSSv31":
+			version = "V3"
+		default:
+			continue
+		}
+		if name == "" {
+			continue
+		}
+		scores, _ := cvss[name].(map[string]interface{})
+		if scores == nil {
+			scores = map[string]interface{}{}
+			cvss[name] = scores
+		}
+		if vector := str(rating, "vector"); vector != "" {
+			scores[version+"Vector"] = vector
+		}
+		if s, ok := rating["score"].(float64); ok {
+			scores[version+"Score"] = s
+		}
+	}
+	if severity == "" {
+		severity = trivy.SeverityUnknown
+	}
+	v["Severity"] = severity
+	if len(cvss) > 0 {
+		v["CVSS"] = cvss
+	}
+
+	if cwes, ok := vuln["cwes"].([]interface{}); ok {
+		ids := make([]interface{}, 0, len(cwes))
+		for _, cwe := range cwes {
+			if n, ok := cwe.(float64); ok {
+				ids = append(ids, fmt.Sprintf("CWE-%d", int(n)))
+			}
+		}
+		v["CweIDs"] = ids
+	}
+	var references []interface{}
+	for _, advisory := range maps(vuln["advisories"]) {
+		if url := str(advisory, "url"); url != "" {
+			references = append(references, url)
+		}
+	}
+	if references != nil {
+		v["References"] = references
+		v["PrimaryURL"] = references[0]
+	}
+	return v
+}
+
+// properties returns the values of every property of c named name
+func properties(c map[string]interface{}, name string) []string {
+	var values []string
+	for _, p := range maps(c["properties"]) {
+		if str(p, "name") == name {
+			values = append(values, str(p, "value"))
+		}
+	}
+	return values
+}
@@ -0,0 +1,119 @@
+package pipeline
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+)
+
+// scanTimeField is the report field holding the time of the scan
+const scanTimeField = "CreatedAt"
+
+// clusterField holds the cluster name of the reports split from a Trivy
+// Kubernetes cluster report, see kubernetesReports
+const clusterField = metadataField + ".kubernetes.cluster"
+
+// documentID hashes the values found at the given dotted paths of doc, and
+// the cluster name of Kubernetes reports, so that resources of different
+// clusters get different IDs. It returns an empty ID, for Elasticsearch to
+// assign one, unless the scan time, when it is one of the fields, and at
+// least one other field are present: an ID derived from the artifact name
+// alone would make every scan of the artifact replace the previous one.
+func documentID(doc map[string]interface{}, fields []string) string {
+	h := sha256.New()
+	identified := false
+	for _, field := range fields {
+		value, ok := lookup(doc, field)
+		if !ok {
+			if field == scanTimeField {
+				return ""
+			}
+			continue
+		}
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			if field == scanTimeField {
+				return ""
+			}
+			continue
+		}
+		if field != scanTimeField {
+			identified = true
+		}
+		h.Write([]byte(field))
+		h.Write([]byte{'='})
+		h.Write(encoded)
+		h.Write([]byte{0})
+	}
+	if !identified {
+		return ""
+	}
+	if cluster, ok := lookup(doc, clusterField); ok {
+		if name, ok := cluster.(string); ok {
+			h.Write([]byte(clusterField))
+			h.Write([]byte{'='})
+			h.Write([]byte(name))
+			h.Write([]byte{0})
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// contentFingerprint identifies a report by its whole content. encoding/json
+// sorts map keys, so the field order of the payload does not matter.
+func contentFingerprint(report map[string]interface{}) string {
+	encoded, err := json.Marshal(report)
+	if err != nil {
+		return ""
+	}
+	h := sha256.Sum256(encoded)
+	return hex.EncodeToString(h[:])
+}
+
+// partID derives the ID of a document split from a report from the report
+// ID and the part it holds. Without a report ID, every part gets an ID
+// assigned by Elasticsearch.
+func partID(id, part string) string {
+	if id == "" || part == "" {
+		return id
+	}
+	h := sha256.Sum256([]byte(id + "\x00" + part))
+	return hex.EncodeToString(h[:])
+}
+
+// routingKey returns the routing value of doc: the static value, or the
+// value at the routing field. Strings are used as they are, other values as
+// their JSON encoding.
+func (p *Pipeline) routingKey(doc map[string]interface{}) string {
+	if p.routingField == "" {
+		return p.routingValue
+	}
+	value, ok := lookup(doc, p.routingField)
+	if !ok {
+		return ""
+	}
+	if s, ok := value.(string); ok {
+		return s
+	}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return ""
+	}
+	return string(encoded)
+}
+
+// lookup returns the value at a dotted path such as "Metadata.ImageID"
+func lookup(doc map[string]interface{}, path string) (interface{}, bool) {
+	var current interface{} = doc
+	for _, key := range strings.Split(path, ".") {
+		m, ok := current.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if current, ok = m[key]; !ok || current == nil {
+			return nil, false
+		}
+	}
+	return current, true
+}
@@ -0,0 +1,101 @@
+package pipeline
+
+import "testing"
+
+var defaultIDFields = []string{"ArtifactName", "Metadata.ImageID", "Metadata.RepoDigests", "CreatedAt"}
+
+func TestDocumentID(t *testing.T) {
+	tests := []struct {
+		name   string
+		doc    map[string]interface{}
+		fields []string
+		wantID bool
+	}{
+		{
+			name: "image report",
+			doc: map[string]interface{}{
+				"ArtifactName": "alpine:3.19",
+				"CreatedAt":    "2026-10-16T10:00:00Z",
+				"Metadata":     map[string]interface{}{"ImageID": "sha256:abc"},
+			},
+			fields: defaultIDFields,
+			wantID: true,
+		},
+		{
+			name: "filesystem report without digests",
+			doc: map[string]interface{}{
+				"ArtifactName": "/src",
+				"CreatedAt":    "2026-10-16T10:00:00Z",
+			},
+			fields: defaultIDFields,
+			wantID: true,
+		},
+		{
+			name: "without scan time",
+			doc: map[string]interface{}{
+				"ArtifactName": "alpine:3.19",
+				"Metadata":     map[string]interface{}{"ImageID": "sha256:abc"},
+			},
+			fields: defaultIDFields,
+		},
+		{
+			name:   "scan time alone",
+			doc:    map[string]interface{}{"CreatedAt": "2026-10-16T10:00:00Z"},
+			fields: defaultIDFields,
+		},
+		{
+			name:   "none of the fields",
+			doc:    map[string]interface{}{"SchemaVersion": 2},
+			fields: defaultIDFields,
+		},
+		{
+			name:   "scan time not configured",
+			doc:    map[string]interface{}{"ArtifactName": "alpine:3.19"},
+			fields: []string{"ArtifactName"},
+			wantID: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id := documentID(tt.doc, tt.fields)
+			if got := id != ""; got != tt.wantID {
+				t.Fatalf("expected an ID: %t, got %q", tt.wantID, id)
+			}
+		})
+	}
+}
+
+func TestDocumentIDDistinguishesScans(t *testing.T) {
+	report := func(createdAt, cluster string) map[string]interface{} {
+		doc := map[string]interface{}{
+			"ArtifactName": "default/Deployment/web",
+			"CreatedAt":    createdAt,
+		}
+		if cluster != "" {
+			doc[metadataField] = map[string]interface{}{
+				"kubernetes": map[string]interface{}{"cluster": cluster},
+			}
+		}
+		return doc
+	}
+	base := documentID(report("2026-10-16T10:00:00Z", "prod"), defaultIDFields)
+
+	tests := []struct {
+		name string
+		doc  map[string]interface{}
+		same bool
+	}{
+		{name: "same scan resubmitted", doc: report("2026-10-16T10:00:00Z", "prod"), same: true},
+		{name: "later scan", doc: report("2026-10-17T10:00:00Z", "prod")},
+		{name: "other cluster", doc: report("2026-10-16T10:00:00Z", "staging")},
+		{name: "without cluster", doc: report("2026-10-16T10:00:00Z", "")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id := documentID(tt.doc, defaultIDFields)
+			if got := id == base; got != tt.same {
+				t.Fatalf("expected the same ID: %t, got %q and %q", tt.same, base, id)
+			}
+		})
+	}
+}
@@ -0,0 +1,118 @@
+package pipeline
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/truemilk/trivelastic/pkg/trivy"
+)
+
+// ArtifactTransform copies the identity of the scanned artifact into stable
+// fields under _trivelastic.artifact, so that dashboards do not depend on
+// where Trivy puts them in its report
+type ArtifactTransform struct{}
+
+func (ArtifactTransform) Name() string {
+	return "artifact"
+}
+
+func (ArtifactTransform) Apply(doc map[string]interface{}) (map[string]interface{}, []Warning, error) {
+	artifact := map[string]interface{}{}
+	for field, path := range map[string]string{
+		"name":       "ArtifactName",
+		"type":       "ArtifactType",
+		"image_id":   "Metadata.ImageID",
+		"scanned_at": "CreatedAt",
+	} {
+		if value, ok := lookup(doc, path); ok {
+			artifact[field] = value
+		}
+	}
+
+	// RepoDigests are "<repository>@<digest>", the digest is the same for every repository
+	if digests, ok := lookup(doc, "Metadata.RepoDigests"); ok {
+		if list, ok := digests.([]interface{}); ok && len(list) > 0 {
+			if first, ok := list[0].(string); ok {
+				if _, digest, found := strings.Cut(first, "@"); found {
+					artifact["digest"] = digest
+				}
+			}
+		}
+	}
+
+	osInfo := map[string]interface{}{}
+	if family, ok := lookup(doc, "Metadata.OS.Family"); ok {
+		osInfo["family"] = family
+	}
+	if version, ok := lookup(doc, "Metadata.OS.Name"); ok {
+		osInfo["version"] = version
+	}
+	if len(osInfo) > 0 {
+		artifact["os"] = osInfo
+	}
+
+	if len(artifact) > 0 {
+		metadata(doc)["artifact"] = artifact
+	}
+	return doc, nil, nil
+}
+
+// findingFields are the lists of findings in a Trivy result
+var findingFields = []string{"Vulnerabilities", "Misconfigurations", "Secrets", "Licenses"}
+
+// SeverityTransform upper-cases the Severity of every finding and adds its
+// rank as severity_score, from 0 for UNKNOWN to 4 for CRITICAL, so findings
+// can be sorted and compared against a threshold
+type SeverityTransform struct{}
+
+func (SeverityTransform) Name() string {
+	return "severity"
+}
+
+func (t SeverityTransform) Apply(doc map[string]interface{}) (map[string]interface{}, []Warning, error) {
+	results, _ := doc["Results"].([]interface{})
+
+	var warnings []Warning
+	for i, item := range results {
+		result, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		for _, field := range findingFields {
+			findings, _ := result[field].([]interface{})
+			for j, item := range findings {
+				finding, ok := item.(map[string]interface{})
+				if !ok {
+					continue
+				}
+				severity, ok := finding["Severity"].(string)
+				if !ok {
+					continue
+				}
+				score, known := trivy.SeverityScore(severity)
+				if !known {
+					warnings = append(warnings, Warning{
+						Transform: t.Name(),
+						Level:     LevelWarning,
+						Field:     fmt.Sprintf("Results[%d].%s[%d].Severity", i, field, j),
+						Message:   fmt.Sprintf("unknown severity %q", severity),
+					})
+					continue
+				}
+				finding["Severity"] = strings.ToUpper(severity)
+				finding["severity_score"] = score
+			}
+		}
+	}
+	return doc, warnings, nil
+}
+
+// metadata returns the _trivelastic object of doc, creating it if needed
+func metadata(doc map[string]interface{}) map[string]interface{} {
+	meta, ok := doc[metadataField].(map[string]interface{})
+	if !ok {
+		meta = map[string]interface{}{}
+		doc[metadataField] = meta
+	}
+	return meta
+}
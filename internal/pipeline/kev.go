@@ -0,0 +1,51 @@
+package pipeline
+
+import (
+	"github.com/truemilk/trivelastic/internal/kev"
+)
+
+// KEVTransform flags vulnerabilities listed in the CISA Known Exploited
+// Vulnerabilities catalog: known_exploited is true for them, with the
+// catalog dates and required action under kev, and false for the others.
+// Nothing is set until the catalog has been fetched, so that unknown is not
+// mistaken for not exploited.
+type KEVTransform struct {
+	Catalog *kev.Catalog
+}
+
+func (KEVTransform) Name() string {
+	return "kev"
+}
+
+func (t KEVTransform) Apply(doc map[string]interface{}) (map[string]interface{}, []Warning, error) {
+	if !t.Catalog.Loaded() {
+		return doc, nil, nil
+	}
+
+	results, _ := doc["Results"].([]interface{})
+	for _, item := range results {
+		result, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		vulns, _ := result["Vulnerabilities"].([]interface{})
+		for _, item := range vulns {
+			vuln, ok := item.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			id, _ := vuln["VulnerabilityID"].(string)
+			entry, exploited := t.Catalog.Lookup(id)
+			vuln["known_exploited"] = exploited
+			if exploited {
+				vuln["kev"] = rename(map[string]interface{}{
+					"date_added":                    entry.DateAdded,
+					"due_date":                      entry.DueDate,
+					"required_action":               entry.RequiredAction,
+					"known_ransomware_campaign_use": entry.KnownRansomwareCampaignUse,
+				}, nil)
+			}
+		}
+	}
+	return doc, nil, nil
+}
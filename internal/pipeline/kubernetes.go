@@ -0,0 +1,76 @@
+package pipeline
+
+import "strings"
+
+// kubernetesReports turns a Trivy Kubernetes cluster report into one report
+// per resource, shaped like an artifact report. The resource's namespace,
+// kind and name form its ArtifactName and are kept under
+// _trivelastic.kubernetes, together with the cluster name.
+func kubernetesReports(data map[string]interface{}) []map[string]interface{} {
+	cluster, _ := data["ClusterName"].(string)
+	resources, _ := data["Resources"].([]interface{})
+
+	reports := make([]map[string]interface{}, 0, len(resources))
+	for _, item := range resources {
+		resource, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		report := map[string]interface{}{}
+		for _, field := range []string{"SchemaVersion", "CreatedAt"} {
+			if value, ok := data[field]; ok {
+				report[field] = value
+			}
+		}
+		for _, field := range []string{"Metadata", "Results"} {
+			if value, ok := resource[field]; ok {
+				report[field] = value
+			}
+		}
+
+		kubernetes := map[string]interface{}{}
+		var name []string
+		for _, field := range []string{"Namespace", "Kind", "Name"} {
+			if value, ok := resource[field].(string); ok && value != "" {
+				kubernetes[strings.ToLower(field)] = value
+				name = append(name, value)
+			}
+		}
+		if cluster != "" {
+			kubernetes["cluster"] = cluster
+		}
+		if scanErr, ok := resource["Error"].(string); ok && scanErr != "" {
+			kubernetes["error"] = scanErr
+		}
+		report["ArtifactName"] = strings.Join(name, "/")
+		report[metadataField] = map[string]interface{}{"kubernetes": kubernetes}
+
+		reports = append(reports, report)
+	}
+	return reports
+}
+
+// withResources returns a copy of a cluster report with its resources
+// replaced by the processed reports
+func withResources(data map[string]interface{}, reports []map[string]interface{}) map[string]interface{} {
+	doc := make(map[string]interface{}, len(data))
+	for k, v := range data {
+		doc[k] = v
+	}
+	resources := make([]interface{}, len(reports))
+	for i, report := range reports {
+		resources[i] = report
+	}
+	doc["Resources"] = resources
+	return doc
+}
+
+// withItems lists the processed reports of Trivy Operator resources
+func withItems(reports []map[string]interface{}) map[string]interface{} {
+	items := make([]interface{}, len(reports))
+	for i, report := range reports {
+		items[i] = report
+	}
+	return map[string]interface{}{"items": items}
+}
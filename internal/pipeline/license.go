@@ -0,0 +1,154 @@
+package pipeline
+
+import (
+	"regexp"
+	"strings"
+)
+
+// spdxIDs are the SPDX license identifiers recognized in license findings
+var spdxIDs = []string{
+	"0BSD", "AGPL-3.0-only", "AGPL-3.0-or-later", "Apache-1.1", "Apache-2.0",
+	"Artistic-2.0", "BlueOak-1.0.0", "BSD-1-Clause", "BSD-2-Clause", "BSD-3-Clause",
+	"BSD-4-Clause", "BSL-1.0", "CC-BY-4.0", "CC-BY-SA-4.0", "CC0-1.0", "CDDL-1.0",
+	"CDDL-1.1", "EPL-1.0", "EPL-2.0", "GPL-1.0-or-later", "GPL-2.0-only",
+	"GPL-2.0-or-later", "GPL-3.0-only", "GPL-3.0-or-later", "ISC", "LGPL-2.0-only",
+	"LGPL-2.0-or-later", "LGPL-2.1-only", "LGPL-2.1-or-later", "LGPL-3.0-only",
+	"LGPL-3.0-or-later", "MIT", "MIT-0", "MPL-1.1", "MPL-2.0", "OFL-1.1", "OpenSSL",
+	"PostgreSQL", "PSF-2.0", "Python-2.0", "Ruby", "Unicode-DFS-2016", "Unlicense",
+	"WTFPL", "X11", "Zlib",
+}
+
+// licenseAliases maps common non-SPDX license names, lower-cased, to SPDX
+// identifiers. Deprecated SPDX identifiers such as GPL-2.0 are mapped to
+// their current form.
+var licenseAliases = map[string]string{
+	"apache 2":                           "Apache-2.0",
+	"apache 2.0":                         "Apache-2.0",
+	"apache-2":                           "Apache-2.0",
+	"apache2":                            "Apache-2.0",
+	"apache license 2.0":                 "Apache-2.0",
+	"apache license, version 2.0":        "Apache-2.0",
+	"apache software license":            "Apache-2.0",
+	"asl 2.0":                            "Apache-2.0",
+	"mit license":                        "MIT",
+	"the mit license":                    "MIT",
+	"expat":                              "MIT",
+	"isc license":                        "ISC",
+	"bsd-3":                              "BSD-3-Clause",
+	"bsd 3-clause":                       "BSD-3-Clause",
+	"3-clause bsd":                       "BSD-3-Clause",
+	"new bsd":                            "BSD-3-Clause",
+	"modified bsd":                       "BSD-3-Clause",
+	"bsd-2":                              "BSD-2-Clause",
+	"bsd 2-clause":                       "BSD-2-Clause",
+	"2-clause bsd":                       "BSD-2-Clause",
+	"simplified bsd":                     "BSD-2-Clause",
+	"freebsd":                            "BSD-2-Clause",
+	"gpl-2.0":                            "GPL-2.0-only",
+	"gpl-2":                              "GPL-2.0-only",
+	"gpl2":                               "GPL-2.0-only",
+	"gplv2":                              "GPL-2.0-only",
+	"gpl-2.0+":                           "GPL-2.0-or-later",
+	"gpl-2+":                             "GPL-2.0-or-later",
+	"gplv2+":                             "GPL-2.0-or-later",
+	"gpl-3.0":                            "GPL-3.0-only",
+	"gpl-3":                              "GPL-3.0-only",
+	"gpl3":                               "GPL-3.0-only",
+	"gplv3":                              "GPL-3.0-only",
+	"gpl-3.0+":                           "GPL-3.0-or-later",
+	"gpl-3+":                             "GPL-3.0-or-later",
+	"gplv3+":                             "GPL-3.0-or-later",
+	"gpl+":                               "GPL-1.0-or-later",
+	"lgpl-2.0":                           "LGPL-2.0-only",
+	"lgpl-2.0+":                          "LGPL-2.0-or-later",
+	"lgpl-2.1":                           "LGPL-2.1-only",
+	"lgplv2.1":                           "LGPL-2.1-only",
+	"lgpl-2.1+":                          "LGPL-2.1-or-later",
+	"lgplv2+":                            "LGPL-2.0-or-later",
+	"lgpl-3.0":                           "LGPL-3.0-only",
+	"lgplv3":                             "LGPL-3.0-only",
+	"lgpl-3.0+":                          "LGPL-3.0-or-later",
+	"lgplv3+":                            "LGPL-3.0-or-later",
+	"agpl-3.0":                           "AGPL-3.0-only",
+	"agplv3":                             "AGPL-3.0-only",
+	"agpl-3.0+":                          "AGPL-3.0-or-later",
+	"mpl 2.0":                            "MPL-2.0",
+	"mpl-2":                              "MPL-2.0",
+	"mozilla public license 2.0":         "MPL-2.0",
+	"eclipse public license 1.0":         "EPL-1.0",
+	"eclipse public license 2.0":         "EPL-2.0",
+	"boost":                              "BSL-1.0",
+	"boost software license 1.0":         "BSL-1.0",
+	"cc0":                                "CC0-1.0",
+	"zlib license":                       "Zlib",
+	"psf":                                "PSF-2.0",
+	"python software foundation license": "PSF-2.0",
+	"the unlicense":                      "Unlicense",
+}
+
+// licenseOperator splits SPDX license expressions such as "MIT OR Apache-2.0"
+var licenseOperator = regexp.MustCompile(`(?i)\s+(AND|OR)\s+`)
+
+// licenseIndex maps lower-cased identifiers and aliases to SPDX identifiers
+var licenseIndex = func() map[string]string {
+	index := make(map[string]string, len(spdxIDs)+len(licenseAliases))
+	for _, id := range spdxIDs {
+		index[strings.ToLower(id)] = id
+	}
+	for alias, id := range licenseAliases {
+		index[alias] = id
+	}
+	return index
+}()
+
+// spdxID returns the SPDX identifier, or expression, of a license name. It
+// returns false when any part of the name is not recognized.
+func spdxID(name string) (string, bool) {
+	operands := licenseOperator.Split(strings.Trim(name, " ()"), -1)
+	operators := licenseOperator.FindAllStringSubmatch(name, -1)
+
+	var b strings.Builder
+	for i, operand := range operands {
+		id, ok := licenseIndex[strings.ToLower(strings.Join(strings.Fields(strings.Trim(operand, "()")), " "))]
+		if !ok {
+			return "", false
+		}
+		if i > 0 {
+			b.WriteString(" " + strings.ToUpper(operators[i-1][1]) + " ")
+		}
+		b.WriteString(id)
+	}
+	return b.String(), true
+}
+
+// LicenseTransform adds the SPDX identifier of every license finding as
+// spdx_id, so that licenses reported under different names, such as
+// "Apache 2.0" and "Apache-2.0", can be grouped. Trivy's Name is kept as it
+// is, and findings with unrecognized names get no spdx_id.
+type LicenseTransform struct{}
+
+func (LicenseTransform) Name() string {
+	return "license"
+}
+
+func (LicenseTransform) Apply(doc map[string]interface{}) (map[string]interface{}, []Warning, error) {
+	results, _ := doc["Results"].([]interface{})
+	for _, item := range results {
+		result, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		licenses, _ := result["Licenses"].([]interface{})
+		for _, item := range licenses {
+			license, ok := item.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			name, _ := license["Name"].(string)
+			if id, ok := spdxID(name); ok {
+				license["spdx_id"] = id
+			}
+		}
+	}
+	return doc, nil, nil
+}
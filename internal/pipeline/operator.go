@@ -0,0 +1,243 @@
+package pipeline
+
+import (
+	"strings"
+
+	"github.com/truemilk/trivelastic/pkg/trivy"
+)
+
+// Labels set by the Trivy Operator on its reports
+const (
+	labelResourceKind      = "trivy-operator.resource.kind"
+	labelResourceName      = "trivy-operator.resource.name"
+	labelResourceNamespace = "trivy-operator.resource.namespace"
+	labelContainerName     = "trivy-operator.container.name"
+)
+
+// operatorVulnerabilityFields renames the fields of a VulnerabilityReport
+// vulnerability to those of a CLI report
+var operatorVulnerabilityFields = map[string]string{
+	"vulnerabilityID":  "VulnerabilityID",
+	"resource":         "PkgName",
+	"installedVersion": "InstalledVersion",
+	"fixedVersion":     "FixedVersion",
+	"severity":         "Severity",
+	"score":            "Score",
+	"title":            "Title",
+	"description":      "Description",
+	"primaryLink":      "PrimaryURL",
+	"links":            "References",
+	"pkgPath":          "PkgPath",
+	"publishedDate":    "PublishedDate",
+	"lastModifiedDate": "LastModifiedDate",
+}
+
+// operatorCheckFields renames the fields of a ConfigAuditReport check to
+// those of a CLI misconfiguration
+var operatorCheckFields = map[string]string{
+	"checkID":     "ID",
+	"title":       "Title",
+	"description": "Description",
+	"severity":    "Severity",
+	"category":    "Type",
+	"remediation": "Resolution",
+}
+
+// operatorReports turns Trivy Operator VulnerabilityReport and
+// ConfigAuditReport resources, alone or in a list, into reports shaped like
+// CLI reports. Only the report section and the labels identifying the
+// scanned workload are kept; the rest of the Kubernetes metadata, such as
+// managedFields, is dropped.
+func operatorReports(data map[string]interface{}) []map[string]interface{} {
+	resources := []interface{}{data}
+	if items, ok := data["items"].([]interface{}); ok {
+		resources = items
+	}
+
+	reports := make([]map[string]interface{}, 0, len(resources))
+	for _, item := range resources {
+		resource, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		reports = append(reports, operatorReport(resource))
+	}
+	return reports
+}
+
+// operatorReport converts a single Trivy Operator resource
+func operatorReport(resource map[string]interface{}) map[string]interface{} {
+	meta, _ := resource["metadata"].(map[string]interface{})
+	labels, _ := meta["labels"].(map[string]interface{})
+	section, _ := resource["report"].(map[string]interface{})
+
+	kubernetes := map[string]interface{}{}
+	namespace := str(labels, labelResourceNamespace)
+	if namespace == "" {
+		namespace = str(meta, "namespace")
+	}
+	var workload []string
+	for field, value := range map[string]string{
+		"namespace": namespace,
+		"kind":      str(labels, labelResourceKind),
+		"name":      str(labels, labelResourceName),
+		"container": str(labels, labelContainerName),
+	} {
+		if value != "" {
+			kubernetes[field] = value
+		}
+	}
+	for _, field := range []string{"namespace", "kind", "name"} {
+		if value, ok := kubernetes[field].(string); ok {
+			workload = append(workload, value)
+		}
+	}
+	kubernetes["report"] = map[string]interface{}{
+		"kind": str(resource, "kind"),
+		"name": str(meta, "name"),
+	}
+
+	report := map[string]interface{}{
+		"SchemaVersion": trivy.SchemaVersion,
+		metadataField:   map[string]interface{}{"kubernetes": kubernetes},
+	}
+	if ts, ok := section["updateTimestamp"]; ok {
+		report["CreatedAt"] = ts
+	}
+
+	// Vulnerability reports describe a container image
+	artifactName := strings.Join(workload, "/")
+	image := map[string]interface{}{}
+	if artifact, ok := section["artifact"].(map[string]interface{}); ok {
+		repository := str(artifact, "repository")
+		if registry, ok := section["registry"].(map[string]interface{}); ok && str(registry, "server") != "" {
+			repository = str(registry, "server") + "/" + repository
+		}
+		artifactName = repository
+		if tag := str(artifact, "tag"); tag != "" {
+			artifactName += ":" + tag
+			image["RepoTags"] = []interface{}{artifactName}
+		}
+		if digest := str(artifact, "digest"); digest != "" {
+			image["RepoDigests"] = []interface{}{repository + "@" + digest}
+		}
+		report["ArtifactType"] = "container_image"
+	}
+	if osInfo, ok := section["os"].(map[string]interface{}); ok {
+		image["OS"] = rename(osInfo, map[string]string{"family": "Family", "name": "Name", "eosl": "EOSL"})
+	}
+	if len(image) > 0 {
+		report["Metadata"] = image
+	}
+	if artifactName == "" {
+		artifactName = str(meta, "name")
+	}
+	report["ArtifactName"] = artifactName
+
+	var results []interface{}
+	if vulns, ok := section["vulnerabilities"].([]interface{}); ok {
+		results = append(results, vulnerabilityResults(vulns, artifactName)...)
+	}
+	if checks, ok := section["checks"].([]interface{}); ok {
+		results = append(results, checkResult(checks, artifactName))
+	}
+	if results != nil {
+		report["Results"] = results
+	}
+	return report
+}
+
+// vulnerabilityResults groups vulnerabilities into results by target, class
+// and package type, like the CLI does
+func vulnerabilityResults(vulns []interface{}, artifactName string) []interface{} {
+	var results []interface{}
+	byKey := map[string]map[string]interface{}{}
+	for _, item := range vulns {
+		vuln, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		target := str(vuln, "target")
+		if target == "" {
+			target = artifactName
+		}
+		key := target + "\x00" + str(vuln, "class") + "\x00" + str(vuln, "packageType")
+		result, ok := byKey[key]
+		if !ok {
+			result = rename(map[string]interface{}{
+				"Target": target,
+				"Class":  str(vuln, "class"),
+				"Type":   str(vuln, "packageType"),
+			}, nil)
+			byKey[key] = result
+			results = append(results, result)
+		}
+		list, _ := result["Vulnerabilities"].([]interface{})
+		result["Vulnerabilities"] = append(list, rename(vuln, operatorVulnerabilityFields))
+	}
+	return results
+}
+
+// checkResult holds the configuration checks of a ConfigAuditReport as the
+// misconfigurations of a single result
+func checkResult(checks []interface{}, artifactName string) map[string]interface{} {
+	misconfigurations := make([]interface{}, 0, len(checks))
+	successes, failures := 0, 0
+	for _, item := range checks {
+		check, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		misconf := rename(check, operatorCheckFields)
+		if success, _ := check["success"].(bool); success {
+			misconf["Status"] = "PASS"
+			successes++
+		} else {
+			misconf["Status"] = "FAIL"
+			failures++
+		}
+		if messages, ok := check["messages"].([]interface{}); ok {
+			lines := make([]string, 0, len(messages))
+			for _, m := range messages {
+				if s, ok := m.(string); ok {
+					lines = append(lines, s)
+				}
+			}
+			misconf["Message"] = strings.Join(lines, "\n")
+		}
+		misconfigurations = append(misconfigurations, misconf)
+	}
+
+	return map[string]interface{}{
+		"Target":            artifactName,
+		"Class":             "config",
+		"Type":              "kubernetes",
+		"MisconfSummary":    map[string]interface{}{"Successes": successes, "Failures": failures},
+		"Misconfigurations": misconfigurations,
+	}
+}
+
+// rename returns the fields of m listed in names under their new names,
+// leaving out empty strings. A nil names keeps every field under its own name.
+func rename(m map[string]interface{}, names map[string]string) map[string]interface{} {
+	result := make(map[string]interface{}, len(m))
+	for key, value := range m {
+		name := key
+		if names != nil {
+			if name = names[key]; name == "" {
+				continue
+			}
+		}
+		if s, ok := value.(string); ok && s == "" {
+			continue
+		}
+		result[name] = value
+	}
+	return result
+}
+
+// str returns the string value of key in m, or "" when it is missing
+func str(m map[string]interface{}, key string) string {
+	s, _ := m[key].(string)
+	return s
+}
@@ -0,0 +1,302 @@
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/rs/zerolog"
+	"github.com/truemilk/trivelastic/internal/diff"
+	"github.com/truemilk/trivelastic/internal/logger"
+	"github.com/truemilk/trivelastic/internal/routing"
+	"github.com/truemilk/trivelastic/pkg/trivy"
+)
+
+// Result is the outcome of running a payload through the pipeline
+type Result struct {
+	// Document is the sanitized payload before routing
+	Document map[string]interface{}
+	// Reports are the sanitized reports in the payload: the payload itself,
+	// the report mapped from an SBOM, or one per Kubernetes resource
+	Reports []map[string]interface{}
+	// Routes are the documents that would be written and their target indices
+	Routes []routing.Route
+	// Applied lists the processing steps that ran, in order
+	Applied []string
+	// Warnings collects every problem reported by the transforms
+	Warnings []Warning
+	// Fingerprints identify each report by its content as submitted, see
+	// contentFingerprint. They are also stored as _trivelastic.fingerprint.
+	Fingerprints []string
+	// Deltas are the reports reduced to their changes, to commit once the
+	// routes are stored, see SetDiffTracker
+	Deltas []*diff.Delta
+}
+
+// metadataField holds trivelastic's own annotations on indexed documents
+const metadataField = "_trivelastic"
+
+// Pipeline turns a raw payload into the documents written to Elasticsearch
+type Pipeline struct {
+	transforms []Transform
+	router     *routing.Router
+	idFields   []string
+	// validate rejects payloads that are not Trivy reports
+	validate bool
+	// routingField and routingValue select the routing key of every document
+	routingField string
+	routingValue string
+	// diff reduces reports to their changes, nil to index them in full
+	diff *diff.Tracker
+	log  zerolog.Logger
+}
+
+func New(router *routing.Router, transforms ...Transform) *Pipeline {
+	return &Pipeline{
+		transforms: transforms,
+		router:     router,
+		log:        logger.GetLogger("pipeline"),
+	}
+}
+
+// SetDocumentIDFields derives every document ID from the given dotted
+// report paths. No fields lets Elasticsearch assign the IDs.
+func (p *Pipeline) SetDocumentIDFields(fields []string) {
+	p.idFields = fields
+}
+
+// SetReportValidation rejects payloads that do not match the Trivy report
+// schema with a *trivy.ValidationError
+func (p *Pipeline) SetReportValidation(enabled bool) {
+	p.validate = enabled
+}
+
+// SetRoutingKey routes every document to a shard by the value at the given
+// dotted report path, or by a static value. Documents without the field are
+// routed by their ID.
+func (p *Pipeline) SetRoutingKey(field, value string) {
+	p.routingField = field
+	p.routingValue = value
+}
+
+// SetDiffTracker reduces every report to the vulnerabilities that changed
+// since the previous report of the same artifact
+func (p *Pipeline) SetDiffTracker(t *diff.Tracker) {
+	p.diff = t
+}
+
+// Process parses, transforms and routes body without writing anything.
+// fields are set on every report before it is transformed, see CIFields.
+// Processing stops with an error once ctx is done.
+func (p *Pipeline) Process(ctx context.Context, body []byte, fields map[string]interface{}) (*Result, error) {
+	format := detectFormat(body)
+
+	// Reject anything that is not a Trivy report, including JSON that is not an object
+	if p.validate {
+		var err error
+		switch format {
+		case formatCycloneDX:
+			_, err = trivy.ParseCycloneDX(body)
+		case formatSPDX:
+			_, err = trivy.ParseSPDX(body)
+		case formatOperator:
+			_, err = trivy.ParseOperator(body)
+		case formatKubernetes:
+			_, err = trivy.ParseKubernetes(body)
+		default:
+			_, err = trivy.Parse(body)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Parse the JSON into a map
+	var data map[string]interface{}
+	if err := json.Unmarshal(body, &data); err != nil {
+		return nil, fmt.Errorf("error parsing JSON: %w", err)
+	}
+	// null decodes to a nil map, which fields could not be set on
+	if data == nil {
+		return nil, errors.New("payload is not a JSON object")
+	}
+	// Only trivelastic sets its annotations, e.g. the API key and tenant
+	delete(data, metadataField)
+	result := &Result{Applied: []string{"parse"}, Warnings: []Warning{}}
+	if p.validate {
+		result.Applied = append(result.Applied, "validate")
+	}
+
+	// Kubernetes payloads hold one report per resource
+	router := p.router
+	reports := []map[string]interface{}{data}
+	switch format {
+	case formatCycloneDX:
+		reports = []map[string]interface{}{cycloneDXReport(data)}
+		result.Applied = append(result.Applied, "cyclonedx")
+	case formatSPDX:
+		reports = []map[string]interface{}{spdxReport(data)}
+		result.Applied = append(result.Applied, "spdx")
+	case formatOperator:
+		router = p.router.ForKubernetes()
+		reports = operatorReports(data)
+		result.Applied = append(result.Applied, "operator")
+	case formatKubernetes:
+		router = p.router.ForKubernetes()
+		reports = kubernetesReports(data)
+		result.Applied = append(result.Applied, "kubernetes")
+	}
+
+	for _, report := range reports {
+		if err := ctx.Err(); err != nil {
+			return nil, fmt.Errorf("request cancelled: %w", err)
+		}
+		fingerprint := contentFingerprint(report)
+		doc, warnings, routes, delta := p.processReport(ctx, router, report, fingerprint, fields)
+		result.Reports = append(result.Reports, doc)
+		result.Fingerprints = append(result.Fingerprints, fingerprint)
+		if delta != nil {
+			result.Deltas = append(result.Deltas, delta)
+		}
+		result.Warnings = append(result.Warnings, warnings...)
+		result.Routes = append(result.Routes, routes...)
+	}
+	for _, t := range p.transforms {
+		result.Applied = append(result.Applied, t.Name())
+	}
+	if p.diff != nil {
+		result.Applied = append(result.Applied, "diff")
+	}
+	result.Applied = append(result.Applied, "route")
+
+	switch format {
+	case formatOperator:
+		result.Document = withItems(result.Reports)
+	case formatKubernetes:
+		result.Document = withResources(data, result.Reports)
+	default:
+		result.Document = result.Reports[0]
+	}
+	return result, nil
+}
+
+// Payload formats
+const (
+	formatReport     = "report"
+	formatKubernetes = "kubernetes"
+	formatOperator   = "operator"
+	formatCycloneDX  = "cyclonedx"
+	formatSPDX       = "spdx"
+)
+
+// detectFormat tells SBOMs, Trivy Operator resources and Kubernetes
+// cluster reports from artifact reports
+func detectFormat(body []byte) string {
+	switch {
+	case trivy.IsCycloneDX(body):
+		return formatCycloneDX
+	case trivy.IsSPDX(body):
+		return formatSPDX
+	case trivy.IsOperatorResource(body):
+		return formatOperator
+	case trivy.IsKubernetesReport(body):
+		return formatKubernetes
+	default:
+		return formatReport
+	}
+}
+
+// processReport transforms and routes a single report, recording its
+// fingerprint and fields on it. The delta is nil unless the report was
+// reduced to its changes.
+func (p *Pipeline) processReport(ctx context.Context, router *routing.Router, report map[string]interface{}, fingerprint string, fields map[string]interface{}) (map[string]interface{}, []Warning, []routing.Route, *diff.Delta) {
+	// Hash the report as submitted, so transforms such as timestamp clamping
+	// cannot give a resubmitted report a different ID
+	id := documentID(report, p.idFields)
+	routingKey := p.routingKey(report)
+	for field, value := range fields {
+		// Keep the annotations of the report, e.g. its Kubernetes resource
+		if meta, ok := value.(map[string]interface{}); ok && field == metadataField {
+			for k, v := range meta {
+				metadata(report)[k] = v
+			}
+			continue
+		}
+		report[field] = value
+	}
+
+	// Run the transform chain, collecting warnings from every step
+	doc := report
+	all := []Warning{}
+	for _, t := range p.transforms {
+		var transformed map[string]interface{}
+		var warnings []Warning
+		var err error
+		if ct, ok := t.(ContextTransform); ok {
+			transformed, warnings, err = ct.ApplyContext(ctx, doc)
+		} else {
+			transformed, warnings, err = t.Apply(doc)
+		}
+		if err != nil {
+			p.log.Warn().
+				Err(err).
+				Str("transform", t.Name()).
+				Msg("Transform failed")
+			warnings = append(warnings, Warning{
+				Transform: t.Name(),
+				Level:     LevelError,
+				Message:   err.Error(),
+			})
+		} else {
+			doc = transformed
+		}
+		all = append(all, warnings...)
+	}
+	p.log.Debug().
+		Interface("clean_data", doc).
+		Int("warnings", len(all)).
+		Msg("Transforms applied")
+
+	if fingerprint != "" {
+		metadata(doc)["fingerprint"] = fingerprint
+	}
+
+	// Summarize before diffing, so that the counts cover the whole report
+	summary, summarized := router.SummaryRoute(doc)
+
+	// Keep only what changed since the previous report of the artifact. The
+	// full report is indexed when the previous one cannot be read.
+	var delta *diff.Delta
+	if p.diff != nil {
+		var err error
+		if delta, err = p.diff.Diff(ctx, doc); err != nil {
+			p.log.Warn().
+				Err(err).
+				Msg("Report diff failed")
+			all = append(all, Warning{
+				Transform: "diff",
+				Level:     LevelError,
+				Message:   err.Error(),
+			})
+		} else if delta != nil {
+			doc = delta.Report
+		}
+	}
+
+	// Record warnings on the document itself so they are searchable
+	if len(all) > 0 {
+		metadata(doc)["processing_warnings"] = all
+	}
+
+	// Select target indices
+	routes := router.Route(doc)
+	if summarized {
+		routes = append(routes, summary)
+	}
+	for i := range routes {
+		routes[i].ID = partID(id, routes[i].Part)
+		routes[i].RoutingKey = routingKey
+	}
+	return doc, all, routes, delta
+}
@@ -0,0 +1,24 @@
+package pipeline
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/truemilk/trivelastic/internal/config"
+	"github.com/truemilk/trivelastic/internal/routing"
+)
+
+func TestProcessRejectsNonObjects(t *testing.T) {
+	h := http.Header{}
+	h.Set("X-CI-Pipeline", "build")
+	p := New(routing.NewRouter("trivy", &config.RoutingConfig{}))
+
+	for _, body := range []string{"null", "[]", `"report"`, "2"} {
+		t.Run(body, func(t *testing.T) {
+			if _, err := p.Process(context.Background(), []byte(body), CIFields(h)); err == nil {
+				t.Fatal("expected the payload rejected")
+			}
+		})
+	}
+}
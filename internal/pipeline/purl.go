@@ -0,0 +1,119 @@
+package pipeline
+
+import (
+	"net/url"
+	"strings"
+)
+
+// purlTypes maps Trivy package types to package URL types, see
+// https://github.com/package-url/purl-spec/blob/master/PURL-TYPES.rst
+var purlTypes = map[string]string{
+	"npm": "npm", "yarn": "npm", "pnpm": "npm", "node-pkg": "npm", "bun": "npm",
+	"pip": "pypi", "pipenv": "pypi", "poetry": "pypi", "uv": "pypi", "python-pkg": "pypi",
+	"gomod": "golang", "gobinary": "golang",
+	"jar": "maven", "pom": "maven", "gradle": "maven", "sbt": "maven",
+	"cargo": "cargo", "rust-binary": "cargo",
+	"composer": "composer", "composer-vendor": "composer",
+	"bundler": "gem", "gemspec": "gem",
+	"nuget": "nuget", "dotnet-core": "nuget", "packages-props": "nuget",
+	"conan": "conan", "hex": "hex", "pub": "pub", "swift": "swift", "cocoapods": "cocoapods",
+	"conda-pkg": "conda", "conda-environment": "conda",
+}
+
+// osPurlTypes maps the OS families of Trivy to package URL types. The family
+// is the namespace of the package URL.
+var osPurlTypes = map[string]string{
+	"debian": "deb", "ubuntu": "deb",
+	"alpine": "apk", "wolfi": "apk", "chainguard": "apk",
+	"redhat": "rpm", "centos": "rpm", "rocky": "rpm", "alma": "rpm", "amazon": "rpm",
+	"oracle": "rpm", "fedora": "rpm", "photon": "rpm", "cbl-mariner": "rpm", "azurelinux": "rpm",
+	"suse linux enterprise server": "rpm", "opensuse.leap": "rpm", "opensuse.tumbleweed": "rpm",
+}
+
+// PURLTransform sets purl, the package URL of the vulnerable package, on
+// every vulnerability, so that findings can be joined with SBOM and
+// Dependency-Track data. It is the PkgIdentifier.PURL reported by Trivy, or
+// is built from the result type, the package name and the installed version
+// for reports without one. Vulnerabilities of unknown package types get none.
+type PURLTransform struct{}
+
+func (PURLTransform) Name() string {
+	return "purl"
+}
+
+func (PURLTransform) Apply(doc map[string]interface{}) (map[string]interface{}, []Warning, error) {
+	results, _ := doc["Results"].([]interface{})
+	for _, item := range results {
+		result, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		vulns, _ := result["Vulnerabilities"].([]interface{})
+		for _, item := range vulns {
+			vuln, ok := item.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			purl, _ := lookup(vuln, "PkgIdentifier.PURL")
+			if s, _ := purl.(string); s != "" {
+				vuln["purl"] = s
+			} else if s := buildPURL(str(result, "Type"), str(vuln, "PkgName"), str(vuln, "InstalledVersion")); s != "" {
+				vuln["purl"] = s
+			}
+		}
+	}
+	return doc, nil, nil
+}
+
+// buildPURL returns the package URL of a package of the given Trivy type,
+// or "" when the type has no package URL type
+func buildPURL(pkgType, name, version string) string {
+	if name == "" {
+		return ""
+	}
+	var typ, namespace string
+	if t, ok := osPurlTypes[strings.ToLower(pkgType)]; ok {
+		typ, namespace = t, strings.ToLower(pkgType)
+	} else if t, ok := purlTypes[pkgType]; ok {
+		typ = t
+	} else {
+		return ""
+	}
+
+	switch typ {
+	case "maven":
+		// Java packages are named "group:artifact"
+		if group, artifact, ok := strings.Cut(name, ":"); ok {
+			namespace, name = group, artifact
+		}
+	case "pypi":
+		name = strings.ReplaceAll(strings.ToLower(name), "_", "-")
+	case "npm", "golang", "composer", "swift":
+		// Scoped npm packages, module paths and vendors form the namespace
+		if i := strings.LastIndex(name, "/"); i >= 0 {
+			namespace, name = name[:i], name[i+1:]
+		}
+		if typ == "npm" {
+			namespace = strings.ToLower(namespace)
+			name = strings.ToLower(name)
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString("pkg:" + typ + "/")
+	if namespace != "" {
+		for _, segment := range strings.Split(namespace, "/") {
+			b.WriteString(purlEscape(segment) + "/")
+		}
+	}
+	b.WriteString(purlEscape(name))
+	if version != "" {
+		b.WriteString("@" + purlEscape(version))
+	}
+	return b.String()
+}
+
+// purlEscape percent-encodes a component of a package URL
+func purlEscape(s string) string {
+	return strings.ReplaceAll(url.PathEscape(s), "@", "%40")
+}
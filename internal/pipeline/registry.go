@@ -0,0 +1,73 @@
+package pipeline
+
+import (
+	"context"
+	"sort"
+
+	"github.com/truemilk/trivelastic/internal/registry"
+)
+
+// RegistryTransform adds the metadata of scanned container images, read from
+// their registry, under _trivelastic.registry: the repository and its
+// project, the tags pointing at the image, its creation and push times and
+// its labels as "key=value". Images hosted on registries that are not listed
+// are left alone. A failed lookup is a warning, the report is indexed
+// without the metadata.
+type RegistryTransform struct {
+	Client *registry.Client
+}
+
+func (RegistryTransform) Name() string {
+	return "registry"
+}
+
+func (t RegistryTransform) Apply(doc map[string]interface{}) (map[string]interface{}, []Warning, error) {
+	return t.ApplyContext(context.Background(), doc)
+}
+
+// ApplyContext looks the image up until ctx is done
+func (t RegistryTransform) ApplyContext(ctx context.Context, doc map[string]interface{}) (map[string]interface{}, []Warning, error) {
+	if artifactType, _ := doc["ArtifactType"].(string); artifactType != "container_image" {
+		return doc, nil, nil
+	}
+
+	// RepoDigests pin the scanned image, the artifact name may be a moving tag
+	name, _ := doc["ArtifactName"].(string)
+	if digests, ok := lookup(doc, "Metadata.RepoDigests"); ok {
+		if list, ok := digests.([]interface{}); ok && len(list) > 0 {
+			if first, ok := list[0].(string); ok {
+				name = first
+			}
+		}
+	}
+	ref, err := registry.ParseReference(name)
+	if err != nil || !t.Client.Allowed(ref) {
+		return doc, nil, nil
+	}
+
+	image, err := t.Client.Lookup(ctx, ref)
+	if err != nil {
+		return doc, []Warning{{
+			Transform: t.Name(),
+			Level:     LevelWarning,
+			Message:   err.Error(),
+		}}, nil
+	}
+
+	labels := make([]string, 0, len(image.Labels))
+	for key, value := range image.Labels {
+		labels = append(labels, key+"="+value)
+	}
+	sort.Strings(labels)
+	metadata(doc)["registry"] = rename(map[string]interface{}{
+		"host":       ref.Host,
+		"repository": ref.Repository,
+		"project":    ref.Project(),
+		"digest":     image.Digest,
+		"tags":       image.Tags,
+		"created":    image.Created,
+		"pushed_at":  image.PushedAt,
+		"labels":     labels,
+	}, nil)
+	return doc, nil, nil
+}
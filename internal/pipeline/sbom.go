@@ -0,0 +1,157 @@
+package pipeline
+
+import (
+	"fmt"
+
+	"github.com/truemilk/trivelastic/pkg/trivy"
+)
+
+// sbomComponent is a component of an SBOM, in either format
+type sbomComponent struct {
+	ref string
+	// kind is trivy.ComponentOperatingSystem or trivy.ComponentApplication
+	// for the targets of a scan, empty for packages
+	kind    string
+	name    string
+	version string
+	purl    string
+	// pkgID and pkgType are recorded by Trivy
+	pkgID    string
+	pkgType  string
+	licenses []interface{}
+}
+
+// sbomResults groups the components of an SBOM into the Results of a report
+// by the operating system or application they belong to, following the
+// dependency graph
+type sbomResults struct {
+	artifactName string
+	byRef        map[string]sbomComponent
+	// parents maps a component to the first component depending on it
+	parents map[string]string
+	// image receives the operating system of the artifact
+	image    map[string]interface{}
+	results  []interface{}
+	byTarget map[string]map[string]interface{}
+}
+
+func newSBOMResults(artifactName string, components []sbomComponent, parents map[string]string, image map[string]interface{}) *sbomResults {
+	s := &sbomResults{
+		artifactName: artifactName,
+		byRef:        make(map[string]sbomComponent, len(components)),
+		parents:      parents,
+		image:        image,
+		byTarget:     map[string]map[string]interface{}{},
+	}
+	for _, c := range components {
+		if c.ref != "" {
+			s.byRef[c.ref] = c
+		}
+	}
+	for _, c := range components {
+		if c.kind != "" {
+			continue
+		}
+		result := s.resultFor(c.ref)
+		list, _ := result["Packages"].([]interface{})
+		result["Packages"] = append(list, sbomPackage(c))
+	}
+	return s
+}
+
+// resultFor returns the result of the target that component ref belongs to,
+// creating it if needed. Components belonging to no target are grouped
+// under the artifact itself.
+func (s *sbomResults) resultFor(ref string) map[string]interface{} {
+	var target sbomComponent
+	seen := map[string]bool{}
+	for ref != "" && !seen[ref] {
+		seen[ref] = true
+		if c := s.byRef[ref]; c.kind != "" {
+			target = c
+			break
+		}
+		ref = s.parents[ref]
+	}
+
+	if result, ok := s.byTarget[target.ref]; ok {
+		return result
+	}
+	result := map[string]interface{}{"Target": s.artifactName}
+	switch target.kind {
+	case trivy.ComponentOperatingSystem:
+		result = map[string]interface{}{
+			"Target": fmt.Sprintf("%s (%s %s)", s.artifactName, target.name, target.version),
+			"Class":  "os-pkgs",
+			"Type":   target.name,
+		}
+		s.image["OS"] = map[string]interface{}{"Family": target.name, "Name": target.version}
+	case trivy.ComponentApplication:
+		result = rename(map[string]interface{}{
+			"Target": target.name,
+			"Class":  "lang-pkgs",
+			"Type":   target.pkgType,
+		}, nil)
+	}
+	s.byTarget[target.ref] = result
+	s.results = append(s.results, result)
+	return result
+}
+
+// sbomPackage maps a component to a package of a CLI report
+func sbomPackage(c sbomComponent) map[string]interface{} {
+	pkg := rename(map[string]interface{}{
+		"ID":      c.pkgID,
+		"Name":    c.name,
+		"Version": c.version,
+	}, nil)
+	if c.pkgID == "" && c.version != "" {
+		pkg["ID"] = c.name + "@" + c.version
+	}
+	if identifier := rename(map[string]interface{}{"PURL": c.purl, "UID": c.ref}, nil); len(identifier) > 0 {
+		pkg["Identifier"] = identifier
+	}
+	if c.licenses != nil {
+		pkg["Licenses"] = c.licenses
+	}
+	return pkg
+}
+
+// sbomMetadata describes the SBOM a report was mapped from, under _trivelastic.sbom
+func sbomMetadata(format, specVersion, serialNumber string, components int) map[string]interface{} {
+	return map[string]interface{}{"sbom": rename(map[string]interface{}{
+		"format":        format,
+		"spec_version":  specVersion,
+		"serial_number": serialNumber,
+		"components":    components,
+	}, nil)}
+}
+
+// stringList turns values into a JSON array, as found in decoded reports
+func stringList(values []string) []interface{} {
+	list := make([]interface{}, len(values))
+	for i, value := range values {
+		list[i] = value
+	}
+	return list
+}
+
+// maps returns the objects of a JSON array, skipping anything else
+func maps(value interface{}) []map[string]interface{} {
+	list, _ := value.([]interface{})
+	result := make([]map[string]interface{}, 0, len(list))
+	for _, item := range list {
+		if m, ok := item.(map[string]interface{}); ok {
+			result = append(result, m)
+		}
+	}
+	return result
+}
+
+// first returns the first of values, or "" when there is none
+func first(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
@@ -0,0 +1,50 @@
+package pipeline
+
+// redacted replaces secret values in documents
+const redacted = "[REDACTED]"
+
+// SecretRedactTransform masks the values found by Trivy's secret scanner so
+// that leaked credentials are not copied into Elasticsearch. The Match of
+// every secret and the content of its Code lines are replaced, while the
+// rule, category, severity, title and line numbers are kept; the file is the
+// Target of the result.
+type SecretRedactTransform struct{}
+
+func (SecretRedactTransform) Name() string {
+	return "redact"
+}
+
+func (SecretRedactTransform) Apply(doc map[string]interface{}) (map[string]interface{}, []Warning, error) {
+	results, _ := doc["Results"].([]interface{})
+	for _, item := range results {
+		result, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		secrets, _ := result["Secrets"].([]interface{})
+		for _, item := range secrets {
+			secret, ok := item.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			if _, ok := secret["Match"]; ok {
+				secret["Match"] = redacted
+			}
+			code, _ := secret["Code"].(map[string]interface{})
+			lines, _ := code["Lines"].([]interface{})
+			for _, item := range lines {
+				line, ok := item.(map[string]interface{})
+				if !ok {
+					continue
+				}
+				// Lines around the cause can hold the rest of a multi-line secret
+				for _, field := range []string{"Content", "Highlighted"} {
+					if _, ok := line[field]; ok {
+						line[field] = redacted
+					}
+				}
+			}
+		}
+	}
+	return doc, nil, nil
+}
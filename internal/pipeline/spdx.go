@@ -0,0 +1,137 @@
+package pipeline
+
+import (
+	"strings"
+
+	"github.com/truemilk/trivelastic/pkg/trivy"
+)
+
+// spdxNoLicense are the SPDX license values that name no license
+var spdxNoLicense = map[string]bool{"": true, "NOASSERTION": true, "NONE": true}
+
+// spdxReport maps an SPDX document to a report shaped like a CLI report,
+// like cycloneDXReport. SPDX documents hold no vulnerabilities, so the
+// report only lists the Packages of each result.
+func spdxReport(doc map[string]interface{}) map[string]interface{} {
+	packages := maps(doc["packages"])
+
+	// The root package is the one the document describes
+	var rootID string
+	if describes, ok := doc["documentDescribes"].([]interface{}); ok && len(describes) > 0 {
+		rootID, _ = describes[0].(string)
+	}
+	parents := map[string]string{}
+	for _, rel := range maps(doc["relationships"]) {
+		from, to := str(rel, "spdxElementId"), str(rel, "relatedSpdxElement")
+		switch str(rel, "relationshipType") {
+		case "DESCRIBES":
+			if from == trivy.SPDXDocumentID && rootID == "" {
+				rootID = to
+			}
+			continue
+		case "CONTAINED_BY", "DEPENDENCY_OF":
+			from, to = to, from
+		case "CONTAINS", "DEPENDS_ON":
+		default:
+			continue
+		}
+		if parents[to] == "" {
+			parents[to] = from
+		}
+	}
+
+	var root map[string]interface{}
+	components := make([]sbomComponent, 0, len(packages))
+	for _, p := range packages {
+		if str(p, "SPDXID") == rootID {
+			root = p
+			continue
+		}
+		components = append(components, spdxComponent(p))
+	}
+
+	artifactName := str(root, "name")
+	if artifactName == "" {
+		artifactName = str(doc, "name")
+	}
+	report := map[string]interface{}{
+		"SchemaVersion": trivy.SchemaVersion,
+		"ArtifactName":  artifactName,
+		"ArtifactType":  "spdx",
+		metadataField:   sbomMetadata("spdx", str(doc, "spdxVersion"), str(doc, "documentNamespace"), len(components)),
+	}
+	if info, ok := doc["creationInfo"].(map[string]interface{}); ok {
+		if created, ok := info["created"]; ok {
+			report["CreatedAt"] = created
+		}
+	}
+
+	// Trivy records the image identity as annotations of the root package
+	image := map[string]interface{}{}
+	for field, annotation := range map[string]string{
+		"ImageID":     "ImageID",
+		"RepoTags":    "RepoTag",
+		"RepoDigests": "RepoDigest",
+		"DiffIDs":     "DiffID",
+	} {
+		values := annotations(root, annotation)
+		switch {
+		case len(values) == 0:
+		case field == "ImageID":
+			image[field] = values[0]
+		default:
+			image[field] = stringList(values)
+		}
+	}
+
+	results := newSBOMResults(artifactName, components, parents, image)
+	if len(image) > 0 {
+		report["Metadata"] = image
+	}
+	if results.results != nil {
+		report["Results"] = results.results
+	}
+	return report
+}
+
+// spdxComponent reads a package of an SPDX document. The concluded license
+// is preferred over the declared one.
+func spdxComponent(p map[string]interface{}) sbomComponent {
+	component := sbomComponent{
+		ref:     str(p, "SPDXID"),
+		name:    str(p, "name"),
+		version: str(p, "versionInfo"),
+		pkgID:   first(annotations(p, "PkgID")),
+		pkgType: first(append(annotations(p, "Type"), annotations(p, "PkgType")...)),
+	}
+	switch str(p, "primaryPackagePurpose") {
+	case trivy.PurposeOperatingSystem:
+		component.kind = trivy.ComponentOperatingSystem
+	case trivy.PurposeApplication:
+		component.kind = trivy.ComponentApplication
+	}
+	for _, ref := range maps(p["externalRefs"]) {
+		if str(ref, "referenceType") == "purl" {
+			component.purl = str(ref, "referenceLocator")
+			break
+		}
+	}
+	for _, field := range []string{"licenseConcluded", "licenseDeclared"} {
+		if license := str(p, field); !spdxNoLicense[license] {
+			component.licenses = []interface{}{license}
+			break
+		}
+	}
+	return component
+}
+
+// annotations returns the values of the "<name>: <value>" annotations of p
+func annotations(p map[string]interface{}, name string) []string {
+	var values []string
+	for _, a := range maps(p["annotations"]) {
+		if key, value, ok := strings.Cut(str(a, "comment"), ": "); ok && key == name {
+			values = append(values, value)
+		}
+	}
+	return values
+}
@@ -0,0 +1,177 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"time"
+	"unicode/utf8"
+
+	"github.com/truemilk/trivelastic/internal/config"
+	"github.com/truemilk/trivelastic/pkg/sanitizer"
+)
+
+// Warning levels
+const (
+	LevelWarning = "warning"
+	LevelError   = "error"
+)
+
+// Warning describes a problem a transform hit while processing a document.
+// Transforms keep going after a warning so that every problem is reported.
+type Warning struct {
+	Transform string `json:"transform"`
+	Level     string `json:"level"`
+	Field     string `json:"field,omitempty"`
+	Message   string `json:"message"`
+}
+
+// Transform is one step of the processing chain. Apply returns the
+// transformed document and any warnings. When it returns an error the
+// document is left unchanged and the error is reported as a warning.
+type Transform interface {
+	Name() string
+	Apply(doc map[string]interface{}) (map[string]interface{}, []Warning, error)
+}
+
+// ContextTransform is implemented by transforms that call other services,
+// such as RegistryTransform. The pipeline calls ApplyContext instead of
+// Apply, so that the lookups stop with the request.
+type ContextTransform interface {
+	Transform
+	ApplyContext(ctx context.Context, doc map[string]interface{}) (map[string]interface{}, []Warning, error)
+}
+
+// SanitizeTransform cleans documents according to a sanitization profile,
+// see config.SanitizeDefault and pkg/sanitizer. The zero value uses the default profile.
+type SanitizeTransform struct {
+	Profile string
+}
+
+func (SanitizeTransform) Name() string {
+	return "sanitize"
+}
+
+func (t SanitizeTransform) Apply(doc map[string]interface{}) (map[string]interface{}, []Warning, error) {
+	switch t.Profile {
+	case config.SanitizeNone:
+		return doc, nil, nil
+	case config.SanitizeMinimal:
+		return sanitizer.SanitizeKeys(doc), nil, nil
+	case "", config.SanitizeDefault:
+		return sanitizer.SanitizeJSON(doc), nil, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown sanitization profile %q", t.Profile)
+	}
+}
+
+// TruncateTransform shortens string values longer than MaxLength characters,
+// which would otherwise be rejected or silently ignored by keyword mappings
+type TruncateTransform struct {
+	MaxLength int
+}
+
+func (TruncateTransform) Name() string {
+	return "truncate"
+}
+
+func (t TruncateTransform) Apply(doc map[string]interface{}) (map[string]interface{}, []Warning, error) {
+	if t.MaxLength <= 0 {
+		return doc, nil, nil
+	}
+
+	var warnings []Warning
+	var walk func(path string, value interface{}) interface{}
+	walk = func(path string, value interface{}) interface{} {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			for key, child := range v {
+				v[key] = walk(joinPath(path, key), child)
+			}
+		case []interface{}:
+			for i, child := range v {
+				v[i] = walk(fmt.Sprintf("%s[%d]", path, i), child)
+			}
+		case string:
+			if utf8.RuneCountInString(v) > t.MaxLength {
+				warnings = append(warnings, Warning{
+					Transform: t.Name(),
+					Level:     LevelWarning,
+					Field:     path,
+					Message:   fmt.Sprintf("truncated from %d to %d characters", utf8.RuneCountInString(v), t.MaxLength),
+				})
+				return string([]rune(v)[:t.MaxLength])
+			}
+		}
+		return value
+	}
+	walk("", doc)
+
+	return doc, warnings, nil
+}
+
+// TimestampTransform checks that the report timestamp is within MaxSkew of
+// ingest time. Reports from runners with a wrong clock would otherwise fall
+// outside every dashboard's time range. With Clamp the timestamp is replaced
+// by the ingest time; the original value is kept in the warning.
+type TimestampTransform struct {
+	// Field holds the RFC 3339 timestamp, "CreatedAt" in Trivy reports
+	Field string
+	// MaxSkew is the tolerated distance from ingest time. Zero disables the check.
+	MaxSkew time.Duration
+	Clamp   bool
+}
+
+func (TimestampTransform) Name() string {
+	return "timestamp"
+}
+
+func (t TimestampTransform) Apply(doc map[string]interface{}) (map[string]interface{}, []Warning, error) {
+	if t.MaxSkew <= 0 {
+		return doc, nil, nil
+	}
+
+	raw, ok := doc[t.Field].(string)
+	if !ok {
+		return doc, nil, nil
+	}
+
+	ts, err := time.Parse(time.RFC3339Nano, raw)
+	if err != nil {
+		return doc, []Warning{{
+			Transform: t.Name(),
+			Level:     LevelWarning,
+			Field:     t.Field,
+			Message:   fmt.Sprintf("not an RFC 3339 timestamp: %q", raw),
+		}}, nil
+	}
+
+	now := time.Now().UTC()
+	skew := ts.Sub(now)
+	if skew <= t.MaxSkew && skew >= -t.MaxSkew {
+		return doc, nil, nil
+	}
+
+	direction := "ahead of"
+	if skew < 0 {
+		direction, skew = "behind", -skew
+	}
+	message := fmt.Sprintf("timestamp %s is %s %s ingest time", raw, skew.Round(time.Second), direction)
+	if t.Clamp {
+		doc[t.Field] = now.Format(time.RFC3339Nano)
+		message += ", replaced with ingest time"
+	}
+
+	return doc, []Warning{{
+		Transform: t.Name(),
+		Level:     LevelWarning,
+		Field:     t.Field,
+		Message:   message,
+	}}, nil
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
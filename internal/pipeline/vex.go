@@ -0,0 +1,90 @@
+package pipeline
+
+import (
+	"github.com/truemilk/trivelastic/internal/vex"
+)
+
+// VEXTransform applies OpenVEX statements to vulnerabilities. Every
+// vulnerability a statement covers gets a vex object with the statement's
+// status, justification and impact and action statements. With Filter,
+// vulnerabilities declared not_affected or fixed are removed instead, and
+// counted under _trivelastic.vex.suppressed.
+type VEXTransform struct {
+	Store  *vex.Store
+	Filter bool
+}
+
+func (VEXTransform) Name() string {
+	return "vex"
+}
+
+func (t VEXTransform) Apply(doc map[string]interface{}) (map[string]interface{}, []Warning, error) {
+	var artifact []string
+	if name, ok := doc["ArtifactName"].(string); ok {
+		artifact = append(artifact, name)
+	}
+	for _, path := range []string{"Metadata.RepoTags", "Metadata.RepoDigests"} {
+		values, _ := lookup(doc, path)
+		list, _ := values.([]interface{})
+		for _, value := range list {
+			if s, ok := value.(string); ok {
+				artifact = append(artifact, s)
+			}
+		}
+	}
+	if imageID, ok := lookup(doc, "Metadata.ImageID"); ok {
+		if s, ok := imageID.(string); ok {
+			artifact = append(artifact, s)
+		}
+	}
+
+	suppressed := 0
+	results, _ := doc["Results"].([]interface{})
+	for _, item := range results {
+		result, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		vulns, ok := result["Vulnerabilities"].([]interface{})
+		if !ok {
+			continue
+		}
+
+		kept := make([]interface{}, 0, len(vulns))
+		for _, item := range vulns {
+			v, ok := item.(map[string]interface{})
+			if !ok {
+				kept = append(kept, item)
+				continue
+			}
+			id, _ := v["VulnerabilityID"].(string)
+			purl, _ := lookup(v, "PkgIdentifier.PURL")
+			purlString, _ := purl.(string)
+			match, ok := t.Store.Lookup(vex.Finding{VulnerabilityID: id, PURL: purlString, Artifact: artifact})
+			if !ok {
+				kept = append(kept, v)
+				continue
+			}
+
+			status := match.Statement.Status
+			if t.Filter && (status == vex.StatusNotAffected || status == vex.StatusFixed) {
+				suppressed++
+				continue
+			}
+			v["vex"] = rename(map[string]interface{}{
+				"status":           status,
+				"justification":    match.Statement.Justification,
+				"impact_statement": match.Statement.ImpactStatement,
+				"action_statement": match.Statement.ActionStatement,
+				"document":         match.Document,
+			}, nil)
+			kept = append(kept, v)
+		}
+		result["Vulnerabilities"] = kept
+	}
+
+	if suppressed > 0 {
+		metadata(doc)["vex"] = map[string]interface{}{"suppressed": suppressed}
+	}
+	return doc, nil, nil
+}
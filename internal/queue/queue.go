@@ -0,0 +1,338 @@
+// Package queue keeps routed reports on disk until they are indexed, so that
+// accepted reports survive restarts and Elasticsearch outages
+package queue
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/truemilk/trivelastic/internal/elasticsearch"
+	"github.com/truemilk/trivelastic/internal/logger"
+	"github.com/truemilk/trivelastic/internal/routing"
+	bolt "go.etcd.io/bbolt"
+)
+
+// bucket holds the reports, keyed by their big-endian sequence number so that
+// they are replayed in arrival order
+var bucket = []byte("reports")
+
+// IndexFunc writes routed documents to Elasticsearch
+type IndexFunc func(routes []routing.Route) error
+
+// entry is a report stored in the queue
+type entry struct {
+	// Job is the ID of the asynchronous job of the report, if any
+	Job      string          `json:"job,omitempty"`
+	Accepted time.Time       `json:"accepted"`
+	Routes   []routing.Route `json:"routes"`
+}
+
+// decode reads an entry. Entries written before jobs were recorded are
+// plain lists of routes.
+func decode(data []byte) (entry, error) {
+	var e entry
+	if len(data) > 0 && data[0] == '[' {
+		err := json.Unmarshal(data, &e.Routes)
+		return e, err
+	}
+	err := json.Unmarshal(data, &e)
+	return e, err
+}
+
+// Queue is a first-in first-out queue of reports stored in a bbolt database.
+// A report pushed by a worker is claimed by it until it is acknowledged once
+// indexed, or released to be retried in the background.
+type Queue struct {
+	db    *bolt.DB
+	index IndexFunc
+	// jobDone is told the outcome of the reports of asynchronous jobs
+	// indexed or dropped by the drainer
+	jobDone func(job string, err error)
+	mu      sync.Mutex
+	// claimed are the reports being indexed by a worker
+	claimed map[uint64]bool
+	stop    chan struct{}
+	log     zerolog.Logger
+}
+
+// Open opens or creates the database at path. Reports left by a previous
+// process are retried once Start is called.
+func Open(path string, index IndexFunc) (*Queue, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return nil, fmt.Errorf("error creating queue directory: %w", err)
+	}
+	db, err := bolt.Open(path, 0o640, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("error opening queue database: %w", err)
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucket)
+		return err
+	}); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error creating queue bucket: %w", err)
+	}
+
+	return &Queue{
+		db:      db,
+		index:   index,
+		claimed: map[uint64]bool{},
+		stop:    make(chan struct{}),
+		log:     logger.GetLogger("queue"),
+	}, nil
+}
+
+// SetJobDone makes the drainer call done with the outcome of the reports of
+// asynchronous jobs. It must be called before Start.
+func (q *Queue) SetJobDone(done func(job string, err error)) {
+	q.jobDone = done
+}
+
+// Push stores routes, with the ID of their asynchronous job if any, and
+// claims them for the caller, which must Ack or Release the returned ID
+func (q *Queue) Push(routes []routing.Route, job string) (uint64, error) {
+	data, err := json.Marshal(entry{Job: job, Accepted: time.Now(), Routes: routes})
+	if err != nil {
+		return 0, fmt.Errorf("error marshaling routes: %w", err)
+	}
+
+	// Claim before the report is visible to the drainer
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var id uint64
+	err = q.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucket)
+		id, err = b.NextSequence()
+		if err != nil {
+			return err
+		}
+		return b.Put(key(id), data)
+	})
+	if err != nil {
+		return 0, fmt.Errorf("error storing report in queue: %w", err)
+	}
+	q.claimed[id] = true
+	return id, nil
+}
+
+// Ack removes an indexed report
+func (q *Queue) Ack(id uint64) error {
+	q.mu.Lock()
+	delete(q.claimed, id)
+	q.mu.Unlock()
+	if err := q.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).Delete(key(id))
+	}); err != nil {
+		return fmt.Errorf("error removing report from queue: %w", err)
+	}
+	return nil
+}
+
+// Release leaves a report that could not be indexed to the drainer
+func (q *Queue) Release(id uint64) {
+	q.mu.Lock()
+	delete(q.claimed, id)
+	q.mu.Unlock()
+}
+
+// Replace keeps only routes of a claimed report, when some of its documents
+// were written and must not be written again
+func (q *Queue) Replace(id uint64, routes []routing.Route) error {
+	err := q.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucket)
+		e, err := decode(b.Get(key(id)))
+		if err != nil {
+			return err
+		}
+		e.Routes = routes
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		return b.Put(key(id), data)
+	})
+	if err != nil {
+		return fmt.Errorf("error updating report in queue: %w", err)
+	}
+	return nil
+}
+
+// Len is the number of reports in the queue, claimed ones included
+func (q *Queue) Len() int {
+	n := 0
+	q.db.View(func(tx *bolt.Tx) error {
+		n = tx.Bucket(bucket).Stats().KeyN
+		return nil
+	})
+	return n
+}
+
+// Start retries the released reports every interval in the background
+func (q *Queue) Start(interval time.Duration) {
+	q.log.Info().
+		Str("path", q.db.Path()).
+		Int("reports", q.Len()).
+		Dur("retry_interval", interval).
+		Msg("Persistent queue enabled")
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			q.drain()
+
+			select {
+			case <-q.stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Close stops retrying and closes the database
+func (q *Queue) Close() error {
+	close(q.stop)
+	return q.db.Close()
+}
+
+// drain indexes the released reports in arrival order, stopping at the
+// first failure that may go away. Reports rejected by Elasticsearch are
+// dropped.
+func (q *Queue) drain() {
+	ids, err := q.released()
+	if err != nil {
+		q.log.Error().
+			Err(err).
+			Msg("Failed to read queue")
+		return
+	}
+	if len(ids) == 0 {
+		return
+	}
+
+	q.log.Info().
+		Int("reports", len(ids)).
+		Msg("Retrying queued reports")
+
+	for _, id := range ids {
+		var data []byte
+		q.mu.Lock()
+		if q.claimed[id] {
+			q.mu.Unlock()
+			continue
+		}
+		err := q.db.View(func(tx *bolt.Tx) error {
+			data = append([]byte(nil), tx.Bucket(bucket).Get(key(id))...)
+			return nil
+		})
+		if err == nil && data != nil {
+			q.claimed[id] = true
+		}
+		q.mu.Unlock()
+		if err != nil || data == nil {
+			continue
+		}
+
+		e, err := decode(data)
+		if err != nil {
+			q.log.Error().
+				Err(err).
+				Uint64("id", id).
+				Msg("Discarding corrupt queued report")
+			q.Ack(id)
+			continue
+		}
+
+		if err := q.index(e.Routes); err != nil {
+			if !elasticsearch.Retryable(err) {
+				q.log.Error().
+					Err(err).
+					Uint64("id", id).
+					Msg("Queued report rejected by Elasticsearch, discarding it")
+				q.Ack(id)
+				q.finishJob(e.Job, err)
+				continue
+			}
+			if remaining := routing.Remaining(e.Routes, err); len(remaining) < len(e.Routes) {
+				if err := q.Replace(id, remaining); err != nil {
+					q.log.Error().
+						Err(err).
+						Uint64("id", id).
+						Msg("Failed to remove written documents from queued report")
+				}
+			}
+			q.Release(id)
+			q.log.Error().
+				Err(err).
+				Uint64("id", id).
+				Msg("Failed to index queued report, will retry")
+			return
+		}
+		if err := q.Ack(id); err != nil {
+			q.log.Error().
+				Err(err).
+				Uint64("id", id).
+				Msg("Failed to remove indexed report from queue")
+			return
+		}
+		q.finishJob(e.Job, nil)
+	}
+
+	q.log.Info().Msg("Queue drained")
+}
+
+// finishJob reports the outcome of the report of job, if any
+func (q *Queue) finishJob(job string, err error) {
+	if job != "" && q.jobDone != nil {
+		q.jobDone(job, err)
+	}
+}
+
+// Jobs returns the asynchronous jobs of the reports in the queue, with the
+// time they were accepted
+func (q *Queue) Jobs() (map[string]time.Time, error) {
+	jobs := map[string]time.Time{}
+	err := q.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).ForEach(func(_, data []byte) error {
+			e, err := decode(data)
+			if err == nil && e.Job != "" {
+				jobs[e.Job] = e.Accepted
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error reading queue: %w", err)
+	}
+	return jobs, nil
+}
+
+// released lists the reports not claimed by a worker, oldest first
+func (q *Queue) released() ([]uint64, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var ids []uint64
+	err := q.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).ForEach(func(k, _ []byte) error {
+			if id := binary.BigEndian.Uint64(k); !q.claimed[id] {
+				ids = append(ids, id)
+			}
+			return nil
+		})
+	})
+	return ids, err
+}
+
+func key(id uint64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, id)
+	return k
+}
@@ -0,0 +1,432 @@
+// Package registry reads the metadata of images from their container
+// registry through the OCI distribution API, see
+// https://github.com/opencontainers/distribution-spec
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/truemilk/trivelastic/internal/config"
+	"github.com/truemilk/trivelastic/internal/logger"
+)
+
+// DockerHub is the host of images named without a registry
+const DockerHub = "docker.io"
+
+// dockerHubAPI serves the distribution API of Docker Hub
+const dockerHubAPI = "registry-1.docker.io"
+
+// maxTagChecks is the largest number of tags of a repository compared with
+// the digest of an image. Larger repositories only report the scanned tag.
+const maxTagChecks = 20
+
+// maxResponseSize bounds the responses read from a registry
+const maxResponseSize = 4 << 20
+
+// manifestTypes are the manifest media types accepted, image indices included
+var manifestTypes = []string{
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+}
+
+// Reference names an image in a registry
+type Reference struct {
+	Host       string
+	Repository string
+	Tag        string
+	Digest     string
+}
+
+// ParseReference parses an image reference such as "alpine:3.19",
+// "ghcr.io/org/app@sha256:..." or "registry:5000/team/app:1.0". Images named
+// without a registry are on Docker Hub.
+func ParseReference(s string) (Reference, error) {
+	var ref Reference
+	name := s
+	if before, digest, ok := strings.Cut(name, "@"); ok {
+		name, ref.Digest = before, digest
+	}
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		name, ref.Tag = name[:i], name[i+1:]
+	}
+
+	ref.Host = DockerHub
+	if first, rest, ok := strings.Cut(name, "/"); ok && (strings.ContainsAny(first, ".:") || first == "localhost") {
+		ref.Host, name = first, rest
+	}
+	if ref.Host == "index.docker.io" {
+		ref.Host = DockerHub
+	}
+	if ref.Host == DockerHub && !strings.Contains(name, "/") {
+		name = "library/" + name
+	}
+	if name == "" {
+		return Reference{}, fmt.Errorf("invalid image reference %q", s)
+	}
+	ref.Repository = name
+	return ref, nil
+}
+
+// Project is the first path segment of the repository: the project, owner
+// or namespace of the image in most registries
+func (r Reference) Project() string {
+	project, _, _ := strings.Cut(r.Repository, "/")
+	return project
+}
+
+func (r Reference) String() string {
+	s := r.Host + "/" + r.Repository
+	if r.Tag != "" {
+		s += ":" + r.Tag
+	}
+	if r.Digest != "" {
+		s += "@" + r.Digest
+	}
+	return s
+}
+
+// Image is the metadata of an image read from its registry
+type Image struct {
+	Reference Reference
+	// Digest is the digest of the manifest the reference resolves to
+	Digest string
+	// Tags are the tags of the repository pointing at Digest
+	Tags []string
+	// Created is the creation time recorded in the image configuration
+	Created string
+	// PushedAt is the last modification time of the manifest, when the
+	// registry reports it
+	PushedAt string
+	Labels   map[string]string
+}
+
+type cached struct {
+	image   *Image
+	expires time.Time
+}
+
+// Client looks up images in the configured registries, caching the results
+type Client struct {
+	hosts    []string
+	username string
+	password string
+	timeout  time.Duration
+	ttl      time.Duration
+	client   *http.Client
+	mu       sync.Mutex
+	cache    map[string]cached
+	// tokens maps a host and repository to the bearer token granting access
+	tokens map[string]string
+	log    zerolog.Logger
+}
+
+func NewClient(cfg config.RegistryConfig) *Client {
+	return &Client{
+		hosts:    cfg.Hosts,
+		username: cfg.Username,
+		password: cfg.Password,
+		timeout:  cfg.Timeout,
+		ttl:      cfg.CacheTTL,
+		client:   &http.Client{},
+		cache:    map[string]cached{},
+		tokens:   map[string]string{},
+		log:      logger.GetLogger("registry"),
+	}
+}
+
+// Allowed reports whether the registry of ref is one of the configured hosts
+func (c *Client) Allowed(ref Reference) bool {
+	return slices.Contains(c.hosts, ref.Host)
+}
+
+// Lookup reads the manifest, configuration and tags of an image. Results are
+// cached for the configured TTL.
+func (c *Client) Lookup(ctx context.Context, ref Reference) (*Image, error) {
+	if !c.Allowed(ref) {
+		return nil, fmt.Errorf("registry %s is not in the list of registries to query", ref.Host)
+	}
+	key := ref.String()
+	c.mu.Lock()
+	entry, ok := c.cache[key]
+	c.mu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.image, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	image, err := c.fetch(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	c.cache[key] = cached{image: image, expires: time.Now().Add(c.ttl)}
+	c.mu.Unlock()
+
+	c.log.Debug().
+		Str("image", key).
+		Str("digest", image.Digest).
+		Int("tags", len(image.Tags)).
+		Msg("Image metadata read from registry")
+	return image, nil
+}
+
+type manifest struct {
+	MediaType string `json:"mediaType"`
+	Config    struct {
+		Digest string `json:"digest"`
+	} `json:"config"`
+	Manifests []struct {
+		Digest   string `json:"digest"`
+		Platform struct {
+			OS           string `json:"os"`
+			Architecture string `json:"architecture"`
+		} `json:"platform"`
+	} `json:"manifests"`
+}
+
+type imageConfig struct {
+	Created string `json:"created"`
+	Config  struct {
+		Labels map[string]string `json:"Labels"`
+	} `json:"config"`
+}
+
+func (c *Client) fetch(ctx context.Context, ref Reference) (*Image, error) {
+	version := ref.Digest
+	if version == "" {
+		version = ref.Tag
+	}
+	if version == "" {
+		version = "latest"
+	}
+	image := &Image{Reference: ref}
+
+	var m manifest
+	header, err := c.get(ctx, ref, "manifests/"+version, &m)
+	if err != nil {
+		return nil, fmt.Errorf("error reading manifest of %s: %w", ref, err)
+	}
+	image.Digest = header.Get("Docker-Content-Digest")
+	if image.Digest == "" {
+		image.Digest = ref.Digest
+	}
+	if modified, err := http.ParseTime(header.Get("Last-Modified")); err == nil {
+		image.PushedAt = modified.UTC().Format(time.RFC3339)
+	}
+
+	// Multi-platform images read the configuration of linux/amd64, or of
+	// their first platform
+	if len(m.Manifests) > 0 {
+		platform := m.Manifests[0].Digest
+		for _, entry := range m.Manifests {
+			if entry.Platform.OS == "linux" && entry.Platform.Architecture == "amd64" {
+				platform = entry.Digest
+				break
+			}
+		}
+		m = manifest{}
+		if _, err := c.get(ctx, ref, "manifests/"+platform, &m); err != nil {
+			return nil, fmt.Errorf("error reading platform manifest of %s: %w", ref, err)
+		}
+	}
+
+	if m.Config.Digest != "" {
+		var cfg imageConfig
+		if _, err := c.get(ctx, ref, "blobs/"+m.Config.Digest, &cfg); err != nil {
+			return nil, fmt.Errorf("error reading configuration of %s: %w", ref, err)
+		}
+		image.Created = cfg.Created
+		image.Labels = cfg.Config.Labels
+	}
+
+	tags, err := c.tags(ctx, ref, image.Digest)
+	if err != nil {
+		return nil, fmt.Errorf("error listing tags of %s: %w", ref, err)
+	}
+	image.Tags = tags
+	return image, nil
+}
+
+// tags returns the tags of the repository pointing at digest. Only the tag
+// of the reference is checked in repositories with many tags.
+func (c *Client) tags(ctx context.Context, ref Reference, digest string) ([]string, error) {
+	var list struct {
+		Tags []string `json:"tags"`
+	}
+	if _, err := c.get(ctx, ref, "tags/list", &list); err != nil {
+		return nil, err
+	}
+	candidates := list.Tags
+	if len(candidates) > maxTagChecks {
+		candidates = nil
+		if ref.Tag != "" {
+			candidates = []string{ref.Tag}
+		}
+	}
+
+	var tags []string
+	for _, tag := range candidates {
+		resp, err := c.do(ctx, http.MethodHead, ref, "manifests/"+tag)
+		if err != nil {
+			return nil, err
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK && resp.Header.Get("Docker-Content-Digest") == digest {
+			tags = append(tags, tag)
+		}
+	}
+	sort.Strings(tags)
+	return tags, nil
+}
+
+// get decodes the JSON response to a GET of a path of the repository
+func (c *Client) get(ctx context.Context, ref Reference, path string, v interface{}) (http.Header, error) {
+	resp, err := c.do(ctx, http.MethodGet, ref, path)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxResponseSize)).Decode(v); err != nil {
+		return nil, fmt.Errorf("error decoding response: %w", err)
+	}
+	return resp.Header, nil
+}
+
+// do sends a request for a path of the repository, authenticating and
+// retrying once when the registry asks for a bearer token
+func (c *Client) do(ctx context.Context, method string, ref Reference, path string) (*http.Response, error) {
+	send := func() (*http.Response, error) {
+		req, err := http.NewRequestWithContext(ctx, method, baseURL(ref.Host)+"/v2/"+ref.Repository+"/"+path, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", strings.Join(manifestTypes, ", "))
+		c.mu.Lock()
+		token := c.tokens[ref.Host+"/"+ref.Repository]
+		c.mu.Unlock()
+		switch {
+		case token != "":
+			req.Header.Set("Authorization", "Bearer "+token)
+		case c.username != "":
+			req.SetBasicAuth(c.username, c.password)
+		}
+		return c.client.Do(req)
+	}
+
+	resp, err := send()
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	challenge := resp.Header.Get("WWW-Authenticate")
+	resp.Body.Close()
+	scheme, params, _ := strings.Cut(challenge, " ")
+	if !strings.EqualFold(scheme, "Bearer") {
+		return nil, errors.New("registry refused the credentials")
+	}
+	token, err := c.token(ctx, parseChallenge(params), ref.Repository)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	c.tokens[ref.Host+"/"+ref.Repository] = token
+	c.mu.Unlock()
+	return send()
+}
+
+// token requests a pull token from the authorization service named in a
+// bearer challenge
+func (c *Client) token(ctx context.Context, challenge map[string]string, repository string) (string, error) {
+	realm, err := url.Parse(challenge["realm"])
+	if err != nil || realm.Scheme == "" {
+		return "", fmt.Errorf("invalid authentication realm %q", challenge["realm"])
+	}
+	query := realm.Query()
+	if service := challenge["service"]; service != "" {
+		query.Set("service", service)
+	}
+	query.Set("scope", "repository:"+repository+":pull")
+	realm.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	if c.username != "" {
+		req.SetBasicAuth(c.username, c.password)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("error requesting registry token: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("error requesting registry token: unexpected status %s", resp.Status)
+	}
+	var body struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxResponseSize)).Decode(&body); err != nil {
+		return "", fmt.Errorf("error decoding registry token: %w", err)
+	}
+	if body.Token != "" {
+		return body.Token, nil
+	}
+	if body.AccessToken != "" {
+		return body.AccessToken, nil
+	}
+	return "", errors.New("registry token response holds no token")
+}
+
+// parseChallenge reads the parameters of a WWW-Authenticate challenge, such
+// as realm="https://auth.docker.io/token",service="registry.docker.io"
+func parseChallenge(params string) map[string]string {
+	result := map[string]string{}
+	for params != "" {
+		var key, value string
+		key, params, _ = strings.Cut(params, "=")
+		key = strings.TrimSpace(strings.TrimLeft(key, ", "))
+		if strings.HasPrefix(params, `"`) {
+			value, params, _ = strings.Cut(params[1:], `"`)
+		} else {
+			value, params, _ = strings.Cut(params, ",")
+		}
+		result[strings.ToLower(key)] = value
+	}
+	return result
+}
+
+// baseURL is the root of the distribution API of a registry. Registries on
+// the local host are reached over plain HTTP, as Docker does.
+func baseURL(host string) string {
+	if host == DockerHub {
+		host = dockerHubAPI
+	}
+	name := host
+	if h, _, ok := strings.Cut(host, ":"); ok {
+		name = h
+	}
+	if name == "localhost" || name == "127.0.0.1" {
+		return "http://" + host
+	}
+	return "https://" + host
+}
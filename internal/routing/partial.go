@@ -0,0 +1,29 @@
+package routing
+
+import "errors"
+
+// PartialError is returned when only some routes of a report were written.
+// Failed lists the routes still to be written: writing the others again
+// would duplicate their documents when they have no ID.
+type PartialError struct {
+	Err    error
+	Failed []Route
+}
+
+func (e *PartialError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PartialError) Unwrap() error {
+	return e.Err
+}
+
+// Remaining returns the routes still to be written after err: the failed
+// routes of a *PartialError, every route otherwise
+func Remaining(routes []Route, err error) []Route {
+	var partial *PartialError
+	if errors.As(err, &partial) {
+		return partial.Failed
+	}
+	return routes
+}
@@ -0,0 +1,225 @@
+package routing
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/rs/zerolog"
+	"github.com/truemilk/trivelastic/internal/config"
+	"github.com/truemilk/trivelastic/internal/logger"
+)
+
+// Route is a document paired with the index it should be written to
+type Route struct {
+	Index    string                 `json:"index"`
+	Document map[string]interface{} `json:"document"`
+	// Rules describes the routing rules that selected Index
+	Rules []string `json:"rules"`
+	// ID is the document ID, empty to let Elasticsearch assign one
+	ID string `json:"id,omitempty"`
+	// RoutingKey is sent as the routing parameter, so that documents with the
+	// same key are stored on the same shard
+	RoutingKey string `json:"routing_key,omitempty"`
+	// Part identifies the part of the report held by Document when the report
+	// is split, so that each part gets its own document ID
+	Part string `json:"part,omitempty"`
+}
+
+// Router decides which indices a sanitized report is written to
+type Router struct {
+	defaultIndex    string
+	severityIndices map[string]string
+	split           string
+	kubernetesIndex string
+	findingIndices  []FindingIndex
+	// summaryIndex receives a summary of every report, empty when disabled
+	summaryIndex string
+	log          zerolog.Logger
+}
+
+func NewRouter(defaultIndex string, cfg *config.RoutingConfig) *Router {
+	r := &Router{
+		defaultIndex:    defaultIndex,
+		severityIndices: cfg.SeverityIndices,
+		split:           cfg.Split,
+		kubernetesIndex: cfg.KubernetesIndex,
+		findingIndices:  FindingIndices(cfg),
+		log:             logger.GetLogger("router"),
+	}
+	if cfg.Summary {
+		r.summaryIndex = defaultIndex + SummarySuffix
+	}
+	return r
+}
+
+// ForKubernetes returns a router for the resources of Kubernetes cluster
+// reports, which writes to the Kubernetes index by default when one is configured
+func (r *Router) ForKubernetes() *Router {
+	if r.kubernetesIndex == "" {
+		return r
+	}
+	kr := *r
+	kr.defaultIndex = r.kubernetesIndex
+	if r.summaryIndex != "" {
+		kr.summaryIndex = r.kubernetesIndex + SummarySuffix
+	}
+	return &kr
+}
+
+// Route splits a report into documents according to the split mode, and
+// picks the index of each one. Vulnerabilities are grouped by severity
+// according to the routing configuration; everything else stays with the
+// report in the default index.
+func (r *Router) Route(doc map[string]interface{}) []Route {
+	// Findings with an index of their own are taken out first
+	var findingRoutes []Route
+	for _, f := range r.findingIndices {
+		if doc == nil {
+			break
+		}
+		var route *Route
+		if doc, route = r.splitFindings(doc, f); route != nil {
+			findingRoutes = append(findingRoutes, *route)
+		}
+	}
+
+	var routes []Route
+	switch {
+	case doc == nil:
+		// The report only held findings with an index of their own
+	case r.split == config.SplitResult:
+		routes = r.routeResults(doc)
+	case r.split == config.SplitVulnerability:
+		routes = r.routeVulnerabilities(doc)
+	default:
+		routes = r.routeReport(doc)
+	}
+	routes = append(routes, findingRoutes...)
+
+	r.log.Debug().
+		Int("routes", len(routes)).
+		Strs("indices", indicesOf(routes)).
+		Msg("Report routed")
+
+	return routes
+}
+
+// routeReport splits a report into one document per target index
+func (r *Router) routeReport(doc map[string]interface{}) []Route {
+	results, ok := doc["Results"].([]interface{})
+	if len(r.severityIndices) == 0 || !ok {
+		return []Route{r.defaultRoute(doc)}
+	}
+
+	// Partition every result's vulnerabilities by target index
+	resultsByIndex := make(map[string][]interface{})
+	order := []string{r.defaultIndex}
+	for _, item := range results {
+		result, ok := item.(map[string]interface{})
+		if !ok {
+			resultsByIndex[r.defaultIndex] = append(resultsByIndex[r.defaultIndex], item)
+			continue
+		}
+
+		vulns, ok := result["Vulnerabilities"].([]interface{})
+		if !ok {
+			resultsByIndex[r.defaultIndex] = append(resultsByIndex[r.defaultIndex], result)
+			continue
+		}
+
+		vulnsByIndex := make(map[string][]interface{})
+		for _, v := range vulns {
+			index := r.indexFor(v)
+			if !contains(order, index) {
+				order = append(order, index)
+			}
+			vulnsByIndex[index] = append(vulnsByIndex[index], v)
+		}
+
+		for index, group := range vulnsByIndex {
+			resultsByIndex[index] = append(resultsByIndex[index], withField(result, "Vulnerabilities", group))
+		}
+	}
+
+	routes := make([]Route, 0, len(order))
+	for _, index := range order {
+		group, ok := resultsByIndex[index]
+		if !ok {
+			continue
+		}
+		routes = append(routes, Route{
+			Index:    index,
+			Document: withField(doc, "Results", group),
+			Rules:    r.rulesFor(index),
+		})
+	}
+
+	// Reports without any findings still land in the default index
+	if len(routes) == 0 {
+		routes = append(routes, r.defaultRoute(doc))
+	}
+	return routes
+}
+
+func (r *Router) defaultRoute(doc map[string]interface{}) Route {
+	return Route{
+		Index:    r.defaultIndex,
+		Document: doc,
+		Rules:    []string{"default index"},
+	}
+}
+
+// rulesFor describes the severity rules that target index
+func (r *Router) rulesFor(index string) []string {
+	rules := make([]string, 0)
+	for severity, target := range r.severityIndices {
+		if target == index {
+			rules = append(rules, fmt.Sprintf("severity %s -> %s", severity, index))
+		}
+	}
+	sort.Strings(rules)
+	if index == r.defaultIndex {
+		rules = append(rules, "default index")
+	}
+	return rules
+}
+
+func (r *Router) indexFor(vuln interface{}) string {
+	v, ok := vuln.(map[string]interface{})
+	if !ok {
+		return r.defaultIndex
+	}
+	severity, _ := v["Severity"].(string)
+	if index, ok := r.severityIndices[strings.ToUpper(severity)]; ok {
+		return index
+	}
+	return r.defaultIndex
+}
+
+// withField returns a shallow copy of m with key set to value
+func withField(m map[string]interface{}, key string, value interface{}) map[string]interface{} {
+	result := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		result[k] = v
+	}
+	result[key] = value
+	return result
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+func indicesOf(routes []Route) []string {
+	indices := make([]string, 0, len(routes))
+	for _, route := range routes {
+		indices = append(indices, route.Index)
+	}
+	return indices
+}
@@ -0,0 +1,202 @@
+package routing
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/truemilk/trivelastic/internal/config"
+)
+
+// resultFields are the fields of a result copied onto the documents split from it
+var resultFields = []string{"Target", "Class", "Type"}
+
+// routeResults writes one document per result, holding the report metadata
+// and that single result under Results. Vulnerabilities of each result are
+// still grouped by severity like whole reports.
+func (r *Router) routeResults(doc map[string]interface{}) []Route {
+	results, ok := doc["Results"].([]interface{})
+	if !ok || len(results) == 0 {
+		return []Route{r.defaultRoute(doc)}
+	}
+
+	var routes []Route
+	for _, item := range results {
+		result, _ := item.(map[string]interface{})
+		part := strings.Join([]string{str(result, "Target"), str(result, "Class"), str(result, "Type")}, "|")
+		for _, route := range r.routeReport(withField(doc, "Results", []interface{}{item})) {
+			route.Part = part
+			routes = append(routes, route)
+		}
+	}
+	return routes
+}
+
+// routeVulnerabilities writes one document per vulnerability, holding the
+// report metadata, the target and class of its result, and the vulnerability
+// itself. The report without its vulnerabilities is written to the default
+// index, so that every scan and its other findings are kept.
+func (r *Router) routeVulnerabilities(doc map[string]interface{}) []Route {
+	results, ok := doc["Results"].([]interface{})
+	if !ok {
+		return []Route{r.defaultRoute(doc)}
+	}
+	report := withoutField(doc, "Results")
+
+	var vulnRoutes []Route
+	remaining := make([]interface{}, 0, len(results))
+	for _, item := range results {
+		result, ok := item.(map[string]interface{})
+		if !ok {
+			remaining = append(remaining, item)
+			continue
+		}
+
+		vulns, _ := result["Vulnerabilities"].([]interface{})
+		for _, v := range vulns {
+			index := r.indexFor(v)
+			vulnDoc := withField(report, "Result", pick(result, resultFields))
+			vulnDoc["Vulnerability"] = v
+			vulnRoutes = append(vulnRoutes, Route{
+				Index:    index,
+				Document: vulnDoc,
+				Rules:    r.rulesFor(index),
+				Part:     vulnerabilityPart(result, v),
+			})
+		}
+		remaining = append(remaining, withoutField(result, "Vulnerabilities"))
+	}
+
+	return append([]Route{r.defaultRoute(withField(report, "Results", remaining))}, vulnRoutes...)
+}
+
+// vulnerabilityPart identifies a vulnerability within a report. The same CVE
+// can affect several packages, or the same package at several paths.
+func vulnerabilityPart(result map[string]interface{}, vuln interface{}) string {
+	v, _ := vuln.(map[string]interface{})
+	parts := []string{str(result, "Target")}
+	for _, field := range []string{"VulnerabilityID", "PkgID", "PkgName", "PkgPath", "InstalledVersion"} {
+		parts = append(parts, str(v, field))
+	}
+	return strings.Join(parts, "|")
+}
+
+// pick returns the given fields of m that are set
+func pick(m map[string]interface{}, fields []string) map[string]interface{} {
+	result := make(map[string]interface{}, len(fields))
+	for _, field := range fields {
+		if value, ok := m[field]; ok {
+			result[field] = value
+		}
+	}
+	return result
+}
+
+// withoutField returns a shallow copy of m without key
+func withoutField(m map[string]interface{}, key string) map[string]interface{} {
+	result := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		if k != key {
+			result[k] = v
+		}
+	}
+	return result
+}
+
+// str returns the value of key in m formatted as a string, or "" when it is missing
+func str(m map[string]interface{}, key string) string {
+	value, ok := m[key]
+	if !ok || value == nil {
+		return ""
+	}
+	if s, ok := value.(string); ok {
+		return s
+	}
+	return fmt.Sprint(value)
+}
+
+// FindingIndex moves one kind of finding out of reports into an index of its own
+type FindingIndex struct {
+	Index string
+	// Part names the documents written to Index, see Route.Part
+	Part string
+	// Fields are the fields of a result moved to Index
+	Fields []string
+}
+
+// FindingIndices returns the finding indices configured in cfg, in the
+// order reports are split
+func FindingIndices(cfg *config.RoutingConfig) []FindingIndex {
+	var indices []FindingIndex
+	if cfg.MisconfigurationIndex != "" {
+		indices = append(indices, FindingIndex{
+			Index:  cfg.MisconfigurationIndex,
+			Part:   "misconfigurations",
+			Fields: []string{"MisconfSummary", "Misconfigurations"},
+		})
+	}
+	if cfg.LicenseIndex != "" {
+		indices = append(indices, FindingIndex{
+			Index:  cfg.LicenseIndex,
+			Part:   "licenses",
+			Fields: []string{"Licenses"},
+		})
+	}
+	return indices
+}
+
+// splitFindings moves the findings of f out of doc into a document for
+// f.Index, holding the report metadata and, for each result with such
+// findings, its target and findings. It returns the rest of the report, or
+// nil when nothing else is left, and the route of the findings, or nil when
+// the report has none.
+func (r *Router) splitFindings(doc map[string]interface{}, f FindingIndex) (map[string]interface{}, *Route) {
+	results, ok := doc["Results"].([]interface{})
+	if !ok {
+		return doc, nil
+	}
+
+	kept := append(append([]string{}, resultFields...), f.Fields...)
+	var findingResults []interface{}
+	rest := make([]interface{}, 0, len(results))
+	for _, item := range results {
+		result, ok := item.(map[string]interface{})
+		if !ok || !hasAny(result, f.Fields) {
+			rest = append(rest, item)
+			continue
+		}
+
+		findingResults = append(findingResults, pick(result, kept))
+		remainder := result
+		for _, field := range f.Fields {
+			remainder = withoutField(remainder, field)
+		}
+		// Keep results that still hold other findings
+		if len(remainder) > len(pick(remainder, resultFields)) {
+			rest = append(rest, remainder)
+		}
+	}
+	if findingResults == nil {
+		return doc, nil
+	}
+
+	route := &Route{
+		Index:    f.Index,
+		Document: withField(doc, "Results", findingResults),
+		Rules:    []string{f.Part + " -> " + f.Index},
+		Part:     f.Part,
+	}
+	if len(rest) == 0 {
+		return nil, route
+	}
+	return withField(doc, "Results", rest), route
+}
+
+// hasAny reports whether m has any of the given fields
+func hasAny(m map[string]interface{}, fields []string) bool {
+	for _, field := range fields {
+		if _, ok := m[field]; ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,59 @@
+package routing
+
+import (
+	"strings"
+
+	"github.com/truemilk/trivelastic/pkg/trivy"
+)
+
+// SummarySuffix is appended to the default index to name the summary index
+const SummarySuffix = "-summary"
+
+// summaryFields are the report fields copied onto its summary
+var summaryFields = []string{"ArtifactName", "ArtifactType", "CreatedAt", "ci", "_trivelastic"}
+
+// SummaryRoute returns a compact summary of a report for the summary index:
+// the artifact, the scan time and the number of vulnerabilities by severity
+// and with a fix available. It returns false when summaries are disabled.
+func (r *Router) SummaryRoute(doc map[string]interface{}) (Route, bool) {
+	if r.summaryIndex == "" {
+		return Route{}, false
+	}
+	return Route{
+		Index:    r.summaryIndex,
+		Document: summarize(doc),
+		Rules:    []string{"summary index"},
+		Part:     "summary",
+	}, true
+}
+
+// summarize counts the vulnerabilities of a report
+func summarize(doc map[string]interface{}) map[string]interface{} {
+	bySeverity := make(map[string]int, len(trivy.Severities))
+	total, fixable := 0, 0
+	results, _ := doc["Results"].([]interface{})
+	for _, item := range results {
+		result, _ := item.(map[string]interface{})
+		vulns, _ := result["Vulnerabilities"].([]interface{})
+		for _, item := range vulns {
+			vuln, _ := item.(map[string]interface{})
+			severity := strings.ToUpper(str(vuln, "Severity"))
+			if _, ok := trivy.SeverityScore(severity); !ok {
+				severity = trivy.SeverityUnknown
+			}
+			bySeverity[severity]++
+			total++
+			if str(vuln, "FixedVersion") != "" {
+				fixable++
+			}
+		}
+	}
+
+	counts := map[string]interface{}{"total": total, "fixable": fixable}
+	for _, severity := range trivy.Severities {
+		counts[strings.ToLower(severity)] = bySeverity[severity]
+	}
+	summary := pick(doc, summaryFields)
+	summary["vulnerabilities"] = counts
+	return summary
+}
@@ -0,0 +1,53 @@
+package schedule
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Window is a recurring period that starts whenever Start fires and lasts Duration
+type Window struct {
+	Expr     string
+	Start    *Cron
+	Duration time.Duration
+}
+
+// ParseWindows parses a semicolon-separated list of windows, each a cron
+// expression followed by a duration, e.g. "0 2 * * SUN 2h; 30 23 * * * 15m"
+func ParseWindows(value string) ([]Window, error) {
+	windows := make([]Window, 0)
+	for _, entry := range strings.Split(value, ";") {
+		fields := strings.Fields(entry)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 6 {
+			return nil, fmt.Errorf("window %q must be a cron expression followed by a duration", strings.TrimSpace(entry))
+		}
+
+		expr := strings.Join(fields[:5], " ")
+		start, err := ParseCron(expr)
+		if err != nil {
+			return nil, err
+		}
+		duration, err := time.ParseDuration(fields[5])
+		if err != nil || duration <= 0 {
+			return nil, fmt.Errorf("window %q has invalid duration %q", strings.TrimSpace(entry), fields[5])
+		}
+
+		windows = append(windows, Window{Expr: expr, Start: start, Duration: duration})
+	}
+	return windows, nil
+}
+
+// Active reports whether t falls inside an occurrence of the window
+func (w Window) Active(t time.Time) bool {
+	minute := t.Truncate(time.Minute)
+	for start := minute; t.Sub(start) < w.Duration; start = start.Add(-time.Minute) {
+		if w.Start.Matches(start) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,308 @@
+// Package vex loads OpenVEX documents, see https://github.com/openvex/spec,
+// and tells which vulnerabilities they declare as not affecting a product.
+package vex
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/truemilk/trivelastic/internal/logger"
+)
+
+// Statuses of an OpenVEX statement
+const (
+	StatusNotAffected        = "not_affected"
+	StatusAffected           = "affected"
+	StatusFixed              = "fixed"
+	StatusUnderInvestigation = "under_investigation"
+)
+
+var statuses = []string{StatusNotAffected, StatusAffected, StatusFixed, StatusUnderInvestigation}
+
+// Document is an OpenVEX document
+type Document struct {
+	ID         string      `json:"@id"`
+	Author     string      `json:"author"`
+	Timestamp  *time.Time  `json:"timestamp"`
+	Statements []Statement `json:"statements"`
+}
+
+// Statement declares the status of a vulnerability in some products
+type Statement struct {
+	Vulnerability   Vulnerability `json:"vulnerability"`
+	Products        []Product     `json:"products"`
+	Status          string        `json:"status"`
+	Justification   string        `json:"justification"`
+	ImpactStatement string        `json:"impact_statement"`
+	ActionStatement string        `json:"action_statement"`
+	Timestamp       *time.Time    `json:"timestamp"`
+	// Subcomponents is the statement-level list of OpenVEX 0.0.x documents
+	Subcomponents []Product `json:"subcomponents"`
+}
+
+// Vulnerability identifies a vulnerability by name and aliases. OpenVEX
+// 0.0.x documents give the name as a plain string.
+type Vulnerability struct {
+	Name    string   `json:"name"`
+	Aliases []string `json:"aliases"`
+}
+
+func (v *Vulnerability) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &v.Name); err == nil {
+		return nil
+	}
+	type plain Vulnerability
+	return json.Unmarshal(data, (*plain)(v))
+}
+
+// Product identifies a product, such as an image, by an identifier that is
+// usually a package URL, and optionally the subcomponents concerned. OpenVEX
+// 0.0.x documents give products as plain strings.
+type Product struct {
+	ID            string    `json:"@id"`
+	Subcomponents []Product `json:"subcomponents"`
+}
+
+func (p *Product) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &p.ID); err == nil {
+		return nil
+	}
+	type plain Product
+	return json.Unmarshal(data, (*plain)(p))
+}
+
+// Parse decodes an OpenVEX document and checks its statements
+func Parse(data []byte) (*Document, error) {
+	var doc Document
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("error parsing OpenVEX document: %w", err)
+	}
+	if len(doc.Statements) == 0 {
+		return nil, errors.New("OpenVEX document has no statements")
+	}
+	for i, st := range doc.Statements {
+		if st.Vulnerability.Name == "" {
+			return nil, fmt.Errorf("statements[%d]: vulnerability name is required", i)
+		}
+		if !slices.Contains(statuses, st.Status) {
+			return nil, fmt.Errorf("statements[%d]: unknown status %q, expected one of %s", i, st.Status, strings.Join(statuses, ", "))
+		}
+	}
+	return &doc, nil
+}
+
+// Finding is the vulnerability of an indexed report a statement is matched against
+type Finding struct {
+	VulnerabilityID string
+	// PURL is the package URL of the vulnerable package
+	PURL string
+	// Artifact are the identifiers of the scanned artifact: its name, tags and digests
+	Artifact []string
+}
+
+// Match is the statement that applies to a finding
+type Match struct {
+	Document  string
+	Statement Statement
+}
+
+// statement is a statement with the document it comes from
+type statement struct {
+	Statement
+	document string
+	at       time.Time
+}
+
+// Store holds the statements of every OpenVEX document in a directory
+type Store struct {
+	dir string
+	mu  sync.RWMutex
+	// byVulnerability maps vulnerability names and aliases to their
+	// statements, oldest first
+	byVulnerability map[string][]statement
+	documents       []string
+	log             zerolog.Logger
+}
+
+func NewStore(dir string) *Store {
+	return &Store{
+		dir: dir,
+		log: logger.GetLogger("vex"),
+	}
+}
+
+// Load reads every *.json file of the directory, replacing the statements
+// loaded before. Invalid documents are logged and skipped.
+func (s *Store) Load() error {
+	files, err := filepath.Glob(filepath.Join(s.dir, "*.json"))
+	if err != nil {
+		return fmt.Errorf("error listing %s: %w", s.dir, err)
+	}
+	sort.Strings(files)
+
+	byVulnerability := map[string][]statement{}
+	documents := make([]string, 0, len(files))
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("error reading %s: %w", file, err)
+		}
+		doc, err := Parse(data)
+		if err != nil {
+			s.log.Error().
+				Err(err).
+				Str("file", file).
+				Msg("Skipping invalid OpenVEX document")
+			continue
+		}
+		documents = append(documents, filepath.Base(file))
+
+		name := doc.ID
+		if name == "" {
+			name = filepath.Base(file)
+		}
+		for _, st := range doc.Statements {
+			entry := statement{Statement: st, document: name}
+			switch {
+			case st.Timestamp != nil:
+				entry.at = *st.Timestamp
+			case doc.Timestamp != nil:
+				entry.at = *doc.Timestamp
+			}
+			for _, id := range append([]string{st.Vulnerability.Name}, st.Vulnerability.Aliases...) {
+				key := strings.ToUpper(id)
+				byVulnerability[key] = append(byVulnerability[key], entry)
+			}
+		}
+	}
+	for _, list := range byVulnerability {
+		sort.SliceStable(list, func(i, j int) bool { return list[i].at.Before(list[j].at) })
+	}
+
+	s.mu.Lock()
+	s.byVulnerability = byVulnerability
+	s.documents = documents
+	s.mu.Unlock()
+
+	s.log.Info().
+		Str("dir", s.dir).
+		Int("documents", len(documents)).
+		Int("vulnerabilities", len(byVulnerability)).
+		Msg("OpenVEX documents loaded")
+	return nil
+}
+
+// Documents lists the files of the loaded documents
+func (s *Store) Documents() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]string(nil), s.documents...)
+}
+
+// Save validates an OpenVEX document, writes it to the directory and
+// reloads the store. It returns the name of the file, derived from the
+// content so that uploading the same document twice keeps one copy.
+func (s *Store) Save(data []byte) (string, error) {
+	if _, err := Parse(data); err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	name := hex.EncodeToString(sum[:8]) + ".json"
+
+	// Write to a temporary file first so that Load never sees partial files
+	tmp := filepath.Join(s.dir, name+".tmp")
+	if err := os.WriteFile(tmp, data, 0o640); err != nil {
+		return "", fmt.Errorf("error writing OpenVEX document: %w", err)
+	}
+	if err := os.Rename(tmp, filepath.Join(s.dir, name)); err != nil {
+		return "", fmt.Errorf("error committing OpenVEX document: %w", err)
+	}
+	return name, s.Load()
+}
+
+// Lookup returns the most recent statement about the vulnerability of f
+// whose products cover it
+func (s *Store) Lookup(f Finding) (Match, bool) {
+	s.mu.RLock()
+	list := s.byVulnerability[strings.ToUpper(f.VulnerabilityID)]
+	s.mu.RUnlock()
+
+	for i := len(list) - 1; i >= 0; i-- {
+		if list[i].covers(f) {
+			return Match{Document: list[i].document, Statement: list[i].Statement}, true
+		}
+	}
+	return Match{}, false
+}
+
+// covers reports whether the products of st include the package of f. A
+// product matches the artifact or the package itself; subcomponents, when
+// listed, narrow it down to those packages.
+func (st statement) covers(f Finding) bool {
+	if len(st.Products) == 0 {
+		return true
+	}
+	pkg := purlBase(f.PURL)
+	for _, product := range st.Products {
+		if pkg != "" && purlBase(product.ID) == pkg {
+			return true
+		}
+		if !matchesArtifact(product.ID, f.Artifact) {
+			continue
+		}
+		subcomponents := product.Subcomponents
+		if len(subcomponents) == 0 {
+			subcomponents = st.Subcomponents
+		}
+		if len(subcomponents) == 0 {
+			return true
+		}
+		for _, sub := range subcomponents {
+			if pkg != "" && purlBase(sub.ID) == pkg {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchesArtifact reports whether a product identifier names the artifact:
+// its name, one of its tags or digests, or an OCI package URL with its digest
+func matchesArtifact(id string, artifact []string) bool {
+	candidates := []string{id}
+	if rest, ok := strings.CutPrefix(id, "pkg:oci/"); ok {
+		if _, version, ok := strings.Cut(purlBase(rest), "@"); ok {
+			if digest, err := url.PathUnescape(version); err == nil {
+				candidates = append(candidates, digest)
+			}
+		}
+	}
+	for _, a := range artifact {
+		for _, c := range candidates {
+			if a == c || strings.HasSuffix(a, "@"+c) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// purlBase strips the qualifiers and subpath of a package URL
+func purlBase(purl string) string {
+	if i := strings.IndexAny(purl, "?#"); i >= 0 {
+		return purl[:i]
+	}
+	return purl
+}
@@ -0,0 +1,483 @@
+package worker
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/truemilk/trivelastic/internal/elasticsearch"
+	"github.com/truemilk/trivelastic/internal/fingerprint"
+	"github.com/truemilk/trivelastic/internal/metrics"
+	"github.com/truemilk/trivelastic/internal/pipeline"
+	"github.com/truemilk/trivelastic/internal/routing"
+	"github.com/truemilk/trivelastic/pkg/trivy"
+)
+
+// BatchSink is implemented by sinks that write many documents with a single
+// request, such as *elasticsearch.Client
+type BatchSink interface {
+	IndexBatch(ctx context.Context, items []elasticsearch.BatchItem) ([]elasticsearch.Indexed, []error)
+}
+
+// Statuses of the lines of a batch
+const (
+	LineIndexed   = "indexed"
+	LineQueued    = "queued"
+	LineDuplicate = "duplicate"
+	LineError     = "error"
+	// LineAccepted is a line of an asynchronous batch answered before it
+	// is written
+	LineAccepted = "accepted"
+)
+
+// LineResult is the outcome of one line of a batch, or one file of an upload
+type LineResult struct {
+	// Line is the 1-based line number in the request body, or the position
+	// of the file in an upload
+	Line int `json:"line"`
+	// File is the name of an uploaded file
+	File     string             `json:"file,omitempty"`
+	Status   string             `json:"status"`
+	Error    string             `json:"error,omitempty"`
+	Problems []trivy.Problem    `json:"problems,omitempty"`
+	Warnings []pipeline.Warning `json:"warnings,omitempty"`
+	// Documents locates the documents of an indexed line
+	Documents []elasticsearch.Indexed `json:"documents,omitempty"`
+}
+
+// Payload is a report of a batch as received
+type Payload struct {
+	// Line is the 1-based line number in the request body, or the position
+	// of the file in an upload
+	Line int
+	// File is the name of an uploaded file
+	File string
+	Body []byte
+}
+
+// readLines returns the non-blank lines of a newline-delimited JSON body
+// and the size of the body
+func readLines(r *http.Request) ([]Payload, int, error) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, 0, err
+	}
+	var payloads []Payload
+	for i, raw := range bytes.Split(body, []byte("\n")) {
+		if len(bytes.TrimSpace(raw)) == 0 {
+			continue
+		}
+		payloads = append(payloads, Payload{Line: i + 1, Body: raw})
+	}
+	return payloads, len(body), nil
+}
+
+// readUpload returns the files of a multipart/form-data body and their
+// total size. Form fields other than files are ignored.
+func readUpload(r *http.Request) ([]Payload, int, error) {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, 0, err
+	}
+	var payloads []Payload
+	size := 0
+	for {
+		part, err := reader.NextPart()
+		if errors.Is(err, io.EOF) {
+			return payloads, size, nil
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		if part.FileName() == "" {
+			part.Close()
+			continue
+		}
+		body, err := io.ReadAll(part)
+		part.Close()
+		if err != nil {
+			return nil, 0, err
+		}
+		size += len(body)
+		payloads = append(payloads, Payload{Line: len(payloads) + 1, File: part.FileName(), Body: body})
+	}
+}
+
+// batchLine is a line of a batch going through the pipeline
+type batchLine struct {
+	result    *LineResult
+	processed *pipeline.Result
+	dedupKeys []string
+	// queueID identifies the line in the persistent queue when persisted
+	queueID   uint64
+	persisted bool
+}
+
+// SubmitBatch processes a newline-delimited JSON request, one report per
+// line, with the default pipeline
+func (p *Pool) SubmitBatch(w http.ResponseWriter, r *http.Request) {
+	p.mu.RLock()
+	pl := p.pipeline
+	p.mu.RUnlock()
+	p.SubmitBatchTo(pl, w, r)
+}
+
+// SubmitBatchTo processes a newline-delimited JSON request, one report per
+// line, with the given pipeline
+func (p *Pool) SubmitBatchTo(pl *pipeline.Pipeline, w http.ResponseWriter, r *http.Request) {
+	p.submitBatch(pl, w, r, readLines, "Batch has no reports")
+}
+
+// SubmitUpload processes the report files of a multipart/form-data request
+// with the default pipeline, as a batch
+func (p *Pool) SubmitUpload(w http.ResponseWriter, r *http.Request) {
+	p.mu.RLock()
+	pl := p.pipeline
+	p.mu.RUnlock()
+	p.SubmitUploadTo(pl, w, r)
+}
+
+// SubmitUploadTo processes the report files of a multipart/form-data
+// request with the given pipeline, as a batch
+func (p *Pool) SubmitUploadTo(pl *pipeline.Pipeline, w http.ResponseWriter, r *http.Request) {
+	p.submitBatch(pl, w, r, readUpload, "Upload has no report files")
+}
+
+// submitBatch reads the reports of a batch with read and hands them to a
+// worker. Requests without reports are answered with empty.
+func (p *Pool) submitBatch(pl *pipeline.Pipeline, w http.ResponseWriter, r *http.Request, read func(*http.Request) ([]Payload, int, error), empty string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	payloads, size, err := read(r)
+	if err != nil {
+		p.log.Error().
+			Err(err).
+			Msg("Failed to read batch body")
+		http.Error(w, "Error reading body: "+err.Error(), readStatus(err))
+		return
+	}
+	metrics.PayloadSize.Observe(float64(size))
+	if len(payloads) == 0 {
+		http.Error(w, empty, http.StatusBadRequest)
+		return
+	}
+
+	p.mu.RLock()
+	async := p.jobs != nil && asyncRequested(r, p.async)
+	p.mu.RUnlock()
+	req := NewRequest(r.Context(), nil, pipeline.RequestFields(r), pl)
+	req.Batch = payloads
+	req.Async = async
+	p.submit(w, r, req)
+}
+
+// processBatch runs every line of a batch through the pipeline and writes
+// the documents of all valid lines with a single bulk request. The response
+// lists the status of every line. In async mode the client is answered with
+// a job ID once the lines are processed, and the lines are written
+// afterwards.
+func (p *Pool) processBatch(req *Request, log zerolog.Logger) {
+	p.mu.RLock()
+	redeliveries, dedup, fingerprints := p.redeliveries, p.dedup, p.fingerprints
+	maint, retries := p.maintenance, p.retries
+	p.mu.RUnlock()
+
+	var lines []*batchLine
+	for _, payload := range req.Batch {
+		// Nothing was written yet, the whole batch can be given up
+		if err := req.Context.Err(); err != nil {
+			log.Warn().
+				Err(err).
+				Int("line", payload.Line).
+				Msg("Batch cancelled during processing")
+			req.Reply(cancelledResponse(err))
+			return
+		}
+		line := &batchLine{result: &LineResult{Line: payload.Line, File: payload.File}}
+		lines = append(lines, line)
+
+		result, err := req.Pipeline.Process(req.Context, payload.Body, req.Fields)
+		if err != nil {
+			line.result.Status = LineError
+			line.result.Error = err.Error()
+			var invalid *trivy.ValidationError
+			if errors.As(err, &invalid) {
+				line.result.Error = "Payload is not a valid Trivy report"
+				line.result.Problems = invalid.Problems
+			}
+			continue
+		}
+		line.processed = result
+		line.result.Warnings = result.Warnings
+
+		if redeliveries != nil && redeliveries.Seen(result.Fingerprints) {
+			line.result.Status = LineDuplicate
+			continue
+		}
+		if dedup != nil {
+			for _, report := range result.Reports {
+				line.dedupKeys = append(line.dedupKeys, fingerprint.DedupKey(report))
+			}
+			if dedup.Seen(line.dedupKeys) {
+				line.result.Status = LineDuplicate
+				continue
+			}
+		}
+	}
+	// Lines still without a status are written
+	var pending []*batchLine
+	for _, line := range lines {
+		if line.result.Status == "" {
+			pending = append(pending, line)
+		}
+	}
+
+	// Answer asynchronous batches once the lines are on disk, if they can
+	// be, and write them afterwards, once the request is over
+	ctx := req.Context
+	accept := func() {}
+	var job *Job
+	p.mu.RLock()
+	jobs := p.jobs
+	p.mu.RUnlock()
+	if jobs != nil && req.Async && len(pending) > 0 {
+		var err error
+		if job, err = jobs.add(nil); err != nil {
+			log.Error().
+				Err(err).
+				Msg("Failed to create job")
+			req.Reply(ErrorResponse(http.StatusInternalServerError, "Failed to create job"))
+			return
+		}
+		log = log.With().Str("job_id", job.ID).Logger()
+		ctx = context.WithoutCancel(req.Context)
+		accept = func() { req.Reply(acceptedBatch(job.ID, lines)) }
+	}
+
+	// indexErr is the last error of Elasticsearch, if any
+	var indexErr error
+	if maint != nil && maint.Active() {
+		for _, line := range pending {
+			if err := maint.Store(line.processed.Routes); err != nil {
+				line.result.Status, line.result.Error = LineError, "failed to store report during maintenance window"
+				continue
+			}
+			line.result.Status = LineQueued
+			stored(ctx, line.processed, redeliveries, log)
+		}
+		accept()
+	} else {
+		// The lines of a batch share its job, which the persistent queue
+		// cannot track
+		for _, line := range pending {
+			line.queueID, line.persisted = p.persist(line.processed.Routes, "", log)
+		}
+		accept()
+		documents, errs := p.indexBatch(ctx, pending)
+		for i, err := range errs {
+			line := pending[i]
+			if err != nil {
+				// The queue retries the line once the cluster is back
+				if line.persisted && elasticsearch.Retryable(err) {
+					p.requeue(line.queueID, line.processed.Routes, err, log)
+					line.result.Status = LineQueued
+					stored(ctx, line.processed, redeliveries, log)
+					continue
+				}
+				if !line.persisted && retries != nil && ctx.Err() == nil && elasticsearch.Retryable(err) && retries.Add(routing.Remaining(line.processed.Routes, err)) {
+					line.result.Status = LineQueued
+					stored(ctx, line.processed, redeliveries, log)
+					continue
+				}
+				if line.persisted {
+					p.unpersist(line.queueID, log)
+				}
+				line.result.Status, line.result.Error = LineError, err.Error()
+				indexErr = err
+				continue
+			}
+			if line.persisted {
+				p.unpersist(line.queueID, log)
+			}
+			line.result.Status, line.result.Documents = LineIndexed, documents[i]
+			if dedup != nil {
+				dedup.Record(line.dedupKeys)
+			}
+			stored(ctx, line.processed, redeliveries, log)
+			if fingerprints != nil {
+				for _, report := range line.processed.Reports {
+					if err := fingerprints.Record(ctx, report); err != nil {
+						log.Warn().
+							Err(err).
+							Msg("Failed to record report fingerprint")
+					}
+				}
+			}
+		}
+	}
+
+	counts := map[string]int{}
+	results := make([]*LineResult, len(lines))
+	for i, line := range lines {
+		counts[line.result.Status]++
+		results[i] = line.result
+	}
+	status := "success"
+	switch {
+	case counts[LineError] == len(lines):
+		status = "error"
+	case counts[LineError] > 0:
+		status = "partial"
+	}
+
+	// Let clients retry when nothing could be stored because of Elasticsearch
+	resp := &Response{}
+	if stored := counts[LineIndexed] + counts[LineQueued]; stored == 0 && indexErr != nil {
+		resp.Status = p.failureStatusOf(indexErr)
+	}
+
+	log.Info().
+		Int("lines", len(lines)).
+		Int("indexed", counts[LineIndexed]).
+		Int("queued", counts[LineQueued]).
+		Int("duplicates", counts[LineDuplicate]).
+		Int("errors", counts[LineError]).
+		Msg("Batch processed")
+	if job != nil {
+		finishBatch(jobs, job.ID, pending)
+		return
+	}
+	resp.Body = map[string]interface{}{
+		"status":     status,
+		"message":    fmt.Sprintf("%d of %d reports stored", counts[LineIndexed]+counts[LineQueued], len(lines)),
+		"indexed":    counts[LineIndexed],
+		"queued":     counts[LineQueued],
+		"duplicates": counts[LineDuplicate],
+		"errors":     counts[LineError],
+		"items":      results,
+	}
+	req.Reply(resp)
+}
+
+// acceptedBatch answers an asynchronous batch before its lines are written.
+// The results are copied, since the lines are updated while the answer is
+// written.
+func acceptedBatch(id string, lines []*batchLine) *Response {
+	counts := map[string]int{}
+	results := make([]LineResult, len(lines))
+	for i, line := range lines {
+		results[i] = *line.result
+		if results[i].Status == "" {
+			results[i].Status = LineAccepted
+		}
+		counts[results[i].Status]++
+	}
+	accepted := len(lines) - counts[LineError] - counts[LineDuplicate]
+	return &Response{
+		Status: http.StatusAccepted,
+		Header: map[string]string{"Location": "/v1/jobs/" + id},
+		Body: map[string]interface{}{
+			"status":     "accepted",
+			"message":    fmt.Sprintf("%d of %d reports accepted for indexing", accepted, len(lines)),
+			"job_id":     id,
+			"accepted":   accepted,
+			"duplicates": counts[LineDuplicate],
+			"errors":     counts[LineError],
+			"items":      results,
+		},
+	}
+}
+
+// finishBatch records the outcome of the lines of an asynchronous batch
+// written after the answer. The job fails when none of them was stored, and
+// lists the errors of the lines that failed otherwise.
+func finishBatch(jobs *Jobs, id string, lines []*batchLine) {
+	var documents []elasticsearch.Indexed
+	var errs []error
+	indexed := 0
+	for _, line := range lines {
+		switch line.result.Status {
+		case LineIndexed:
+			indexed++
+			documents = append(documents, line.result.Documents...)
+		case LineError:
+			errs = append(errs, fmt.Errorf("line %d: %s", line.result.Line, line.result.Error))
+		}
+	}
+	err := errors.Join(errs...)
+	switch {
+	case len(errs) == len(lines):
+		jobs.finish(id, JobFailed, nil, err)
+	case indexed == 0:
+		jobs.finish(id, JobSpooled, nil, err)
+	default:
+		jobs.finish(id, JobIndexed, documents, err)
+	}
+}
+
+// indexBatch writes the routes of every line, with a single request when the
+// sink supports it, and returns the documents written and the error of each
+// line
+func (p *Pool) indexBatch(ctx context.Context, lines []*batchLine) ([][]elasticsearch.Indexed, []error) {
+	documents := make([][]elasticsearch.Indexed, len(lines))
+	errs := make([]error, len(lines))
+	if len(lines) == 0 {
+		return documents, errs
+	}
+	p.mu.RLock()
+	sink := p.sink
+	p.mu.RUnlock()
+
+	batchSink, ok := sink.(BatchSink)
+	if !ok {
+		// index observes the latency of every line
+		for i, line := range lines {
+			documents[i], errs[i] = p.index(ctx, line.processed.Routes)
+		}
+		return documents, errs
+	}
+
+	defer p.observeLatency(time.Now())
+	ctx = p.indexContext(ctx)
+
+	var items []elasticsearch.BatchItem
+	var owners []int
+	for i, line := range lines {
+		for _, route := range line.processed.Routes {
+			items = append(items, elasticsearch.BatchItem{
+				Index:    route.Index,
+				Options:  elasticsearch.IndexOptions{ID: route.ID, Routing: route.RoutingKey},
+				Document: route.Document,
+			})
+			owners = append(owners, i)
+		}
+	}
+	indexed, itemErrs := batchSink.IndexBatch(ctx, items)
+	// routeErrs are the errors of the routes of each line
+	routeErrs := make([][]error, len(lines))
+	for i, line := range lines {
+		routeErrs[i] = make([]error, 0, len(line.processed.Routes))
+	}
+	for j, err := range itemErrs {
+		if err != nil {
+			err = fmt.Errorf("index %s: %w", items[j].Index, err)
+			errs[owners[j]] = errors.Join(errs[owners[j]], err)
+		} else if indexed[j].ID != "" {
+			documents[owners[j]] = append(documents[owners[j]], indexed[j])
+		}
+		routeErrs[owners[j]] = append(routeErrs[owners[j]], err)
+	}
+	for i, err := range errs {
+		if err != nil {
+			errs[i] = partialError(lines[i].processed.Routes, routeErrs[i], err)
+		}
+	}
+	return documents, errs
+}
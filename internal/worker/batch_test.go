@@ -0,0 +1,101 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/truemilk/trivelastic/internal/config"
+	"github.com/truemilk/trivelastic/internal/pipeline"
+	"github.com/truemilk/trivelastic/internal/routing"
+)
+
+// blockingSink writes documents once released
+type blockingSink struct {
+	release chan struct{}
+	indices chan string
+}
+
+func (s *blockingSink) IndexInto(ctx context.Context, index string, doc map[string]interface{}) error {
+	<-s.release
+	s.indices <- index
+	return nil
+}
+
+func TestSubmitBatchAsync(t *testing.T) {
+	sink := &blockingSink{release: make(chan struct{}), indices: make(chan string, 10)}
+	jobs := NewJobs(time.Hour)
+	p := NewPool(1, 1, 10)
+	p.SetSink(sink)
+	p.SetJobs(jobs)
+	pl := pipeline.New(routing.NewRouter("trivy-tenant", &config.RoutingConfig{}))
+
+	body := `{"ArtifactName":"alpine","SchemaVersion":2}` + "\n" + `{"ArtifactName":` + "\n"
+	r := httptest.NewRequest(http.MethodPost, "/v1/t/tenant/reports/_batch?async=true", strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	p.SubmitBatchTo(pl, rec, r)
+
+	// Answered before the sink writes anything
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d: %s", rec.Code, rec.Body)
+	}
+	var resp struct {
+		JobID    string       `json:"job_id"`
+		Accepted int          `json:"accepted"`
+		Errors   int          `json:"errors"`
+		Items    []LineResult `json:"items"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Accepted != 1 || resp.Errors != 1 || len(resp.Items) != 2 || resp.Items[0].Status != LineAccepted || resp.Items[1].Status != LineError {
+		t.Fatalf("unexpected answer: %+v", resp)
+	}
+	if got := rec.Header().Get("Location"); got != "/v1/jobs/"+resp.JobID {
+		t.Fatalf("unexpected Location %q", got)
+	}
+	if job, _ := jobs.Get(resp.JobID); job.Status != JobPending {
+		t.Fatalf("expected a pending job, got %q", job.Status)
+	}
+
+	close(sink.release)
+	if index := <-sink.indices; index != "trivy-tenant" {
+		t.Fatalf("expected the line written with the given pipeline, got index %q", index)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		job, _ := jobs.Get(resp.JobID)
+		if job.Status == JobIndexed {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job not indexed, got %+v", job)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSubmitBatchSync(t *testing.T) {
+	sink := &blockingSink{release: make(chan struct{}), indices: make(chan string, 10)}
+	close(sink.release)
+	p := NewPool(1, 1, 10)
+	p.SetSink(sink)
+	p.SetJobs(NewJobs(time.Hour))
+	p.SetPipeline(pipeline.New(routing.NewRouter("trivy", &config.RoutingConfig{})))
+
+	body := `{"ArtifactName":"alpine","SchemaVersion":2}`
+	r := httptest.NewRequest(http.MethodPost, "/v1/reports/_batch", strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	p.SubmitBatch(rec, r)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+	if !strings.Contains(rec.Body.String(), `"indexed":1`) {
+		t.Fatalf("expected the line indexed, got %s", rec.Body)
+	}
+}
@@ -0,0 +1,60 @@
+package worker
+
+// payloadSize is the number of payload bytes held by req
+func (req *Request) payloadSize() int64 {
+	size := int64(len(req.Body))
+	for _, payload := range req.Batch {
+		size += int64(len(payload.Body))
+	}
+	return size
+}
+
+// SetMaxBytes bounds the payload bytes of the requests held in memory by the
+// pool, queued or being processed, zero for no bound. Requests over the
+// budget are spilled to disk when possible, otherwise rejected with 429.
+func (p *Pool) SetMaxBytes(maxBytes int64) {
+	p.mu.Lock()
+	p.maxBytes = maxBytes
+	p.mu.Unlock()
+}
+
+// QueueBytes is the payload bytes of the requests held in memory by the
+// pool, queued or being processed
+func (p *Pool) QueueBytes() int64 {
+	return p.bytes.Load()
+}
+
+// reserve counts size more payload bytes in memory, unless the budget would
+// be exceeded. A request is always admitted when the pool holds none, so
+// that reports larger than the budget are still processed, one at a time.
+func (p *Pool) reserve(size int64) bool {
+	p.mu.RLock()
+	maxBytes := p.maxBytes
+	p.mu.RUnlock()
+	for {
+		held := p.bytes.Load()
+		if maxBytes > 0 && held > 0 && held+size > maxBytes {
+			return false
+		}
+		if p.bytes.CompareAndSwap(held, held+size) {
+			return true
+		}
+	}
+}
+
+// acquire reserves size payload bytes, waiting for requests to release
+// theirs while the budget is exceeded
+func (p *Pool) acquire(size int64) {
+	for !p.reserve(size) {
+		<-p.released
+	}
+}
+
+// release returns the payload bytes of a request done with
+func (p *Pool) release(size int64) {
+	p.bytes.Add(-size)
+	select {
+	case p.released <- struct{}{}:
+	default:
+	}
+}
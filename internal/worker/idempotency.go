@@ -0,0 +1,144 @@
+package worker
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/truemilk/trivelastic/internal/metrics"
+)
+
+// idempotent is the answer to a payload, pending until done is closed
+type idempotent struct {
+	done chan struct{}
+	// resp is nil when the answer is not to be replayed
+	resp    *Response
+	expires time.Time
+}
+
+// Idempotency remembers the answers to the payloads stored recently, so that
+// a payload submitted again to the same route, such as a webhook
+// redelivery, gets the same answer without being processed or indexed
+// twice. A payload submitted while the first one is still processed waits
+// for its answer.
+type Idempotency struct {
+	ttl        time.Duration
+	maxEntries int
+	mu         sync.Mutex
+	entries    map[string]*idempotent
+	// swept is when expired entries were last dropped
+	swept time.Time
+	now   func() time.Time
+}
+
+func NewIdempotency(ttl time.Duration, maxEntries int) *Idempotency {
+	return &Idempotency{ttl: ttl, maxEntries: maxEntries, entries: map[string]*idempotent{}, now: time.Now}
+}
+
+// SetIdempotency answers payloads already stored within the TTL of c with
+// the answer they got then
+func (p *Pool) SetIdempotency(c *Idempotency) {
+	p.mu.Lock()
+	p.idempotency = c
+	p.mu.Unlock()
+	p.log.Info().Msg("Idempotency cache configured for worker pool")
+}
+
+// begin returns the answer to replay for key, if any. Otherwise the caller
+// processes the payload and passes its answer to settle, which is nil when
+// the answer cannot be cached.
+func (c *Idempotency) begin(ctx context.Context, key string) (*Response, func(*Response)) {
+	for {
+		c.mu.Lock()
+		now := c.now()
+		if now.Sub(c.swept) >= c.ttl {
+			for k, e := range c.entries {
+				if e.resp != nil && !now.Before(e.expires) {
+					delete(c.entries, k)
+				}
+			}
+			c.swept = now
+		}
+
+		e, ok := c.entries[key]
+		if ok && e.resp != nil && !now.Before(e.expires) {
+			delete(c.entries, key)
+			ok = false
+		}
+		if !ok {
+			if len(c.entries) >= c.maxEntries {
+				c.mu.Unlock()
+				return nil, nil
+			}
+			e = &idempotent{done: make(chan struct{})}
+			c.entries[key] = e
+			c.mu.Unlock()
+			return nil, func(resp *Response) { c.settle(key, e, resp) }
+		}
+		c.mu.Unlock()
+
+		select {
+		case <-e.done:
+		case <-ctx.Done():
+			return nil, nil
+		}
+		if e.resp != nil {
+			return e.resp.replayed(), nil
+		}
+		// The first payload was not stored, try again
+	}
+}
+
+// settle records resp as the answer to key, or forgets key when resp is
+// not worth replaying
+func (c *Idempotency) settle(key string, e *idempotent, resp *Response) {
+	c.mu.Lock()
+	if replayable(resp) {
+		e.resp, e.expires = resp, c.now().Add(c.ttl)
+	} else {
+		delete(c.entries, key)
+	}
+	c.mu.Unlock()
+	close(e.done)
+}
+
+// replayable tells answers of stored payloads, indexed, queued or accepted,
+// from errors that a new attempt could avoid
+func replayable(resp *Response) bool {
+	if resp == nil || resp.Error != "" || resp.Status != 0 && resp.Status != 202 {
+		return false
+	}
+	body, _ := resp.Body.(map[string]interface{})
+	status, _ := body["status"].(string)
+	return status == "success" || status == "accepted"
+}
+
+// replayed is a copy of resp marked as the answer to an earlier submission
+func (resp *Response) replayed() *Response {
+	metrics.IdempotencyHits.Inc()
+	header := map[string]string{"Idempotent-Replayed": "true"}
+	for key, value := range resp.Header {
+		header[key] = value
+	}
+	return &Response{Status: resp.Status, Header: header, Body: resp.Body}
+}
+
+// idempotencyKey identifies the payload of req submitted to path, with the
+// fields set from the request such as the tenant and CI metadata
+func idempotencyKey(path string, req *Request) string {
+	h := sha256.New()
+	fields, _ := json.Marshal(req.Fields)
+	for _, part := range [][]byte{[]byte(path), fields, req.Body} {
+		h.Write([]byte(strconv.Itoa(len(part)) + ":"))
+		h.Write(part)
+	}
+	for _, payload := range req.Batch {
+		h.Write([]byte(strconv.Itoa(payload.Line) + ":" + strconv.Quote(payload.File) + ":" + strconv.Itoa(len(payload.Body)) + ":"))
+		h.Write(payload.Body)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,122 @@
+package worker
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/truemilk/trivelastic/internal/elasticsearch"
+	"github.com/truemilk/trivelastic/internal/pipeline"
+)
+
+// Statuses of asynchronous jobs
+const (
+	// JobPending is a report accepted and not written yet
+	JobPending = "pending"
+	JobIndexed = "indexed"
+	// JobSpooled is a report held on disk until Elasticsearch is available
+	JobSpooled = "spooled"
+	JobFailed  = "failed"
+)
+
+// Job is a report acknowledged before it was written, see SetAsync
+type Job struct {
+	ID       string             `json:"id"`
+	Status   string             `json:"status"`
+	Error    string             `json:"error,omitempty"`
+	Warnings []pipeline.Warning `json:"warnings,omitempty"`
+	// Documents locates the documents of an indexed job
+	Documents []elasticsearch.Indexed `json:"documents,omitempty"`
+	Accepted  time.Time               `json:"accepted"`
+	// Finished is nil while the job is pending
+	Finished *time.Time `json:"finished,omitempty"`
+}
+
+// Jobs remembers the status of asynchronous jobs. Finished jobs are
+// forgotten after the TTL.
+type Jobs struct {
+	ttl  time.Duration
+	mu   sync.Mutex
+	jobs map[string]*Job
+	// swept is when expired jobs were last dropped
+	swept time.Time
+	now   func() time.Time
+}
+
+func NewJobs(ttl time.Duration) *Jobs {
+	return &Jobs{ttl: ttl, jobs: map[string]*Job{}, now: time.Now}
+}
+
+// add records a pending job with a random ID
+func (j *Jobs) add(warnings []pipeline.Warning) (*Job, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, fmt.Errorf("error generating job ID: %w", err)
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	now := j.now()
+	if now.Sub(j.swept) >= j.ttl {
+		for key, job := range j.jobs {
+			if job.Finished != nil && now.Sub(*job.Finished) >= j.ttl {
+				delete(j.jobs, key)
+			}
+		}
+		j.swept = now
+	}
+	job := &Job{ID: hex.EncodeToString(id), Status: JobPending, Warnings: warnings, Accepted: now}
+	j.jobs[job.ID] = job
+	return job, nil
+}
+
+// restore tracks a job accepted by a previous process, whose report is still
+// queued on disk
+func (j *Jobs) restore(id string, accepted time.Time) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if _, ok := j.jobs[id]; !ok {
+		j.jobs[id] = &Job{ID: id, Status: JobPending, Accepted: accepted}
+	}
+}
+
+// finish records the outcome of a job
+func (j *Jobs) finish(id, status string, documents []elasticsearch.Indexed, err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	job, ok := j.jobs[id]
+	if !ok {
+		return
+	}
+	now := j.now()
+	job.Status, job.Finished, job.Documents = status, &now, documents
+	if err != nil {
+		job.Error = err.Error()
+	}
+}
+
+// Get returns a copy of the job with the given ID
+func (j *Jobs) Get(id string) (Job, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	job, ok := j.jobs[id]
+	if !ok || job.Finished != nil && j.now().Sub(*job.Finished) >= j.ttl {
+		return Job{}, false
+	}
+	return *job, true
+}
+
+// asyncRequested tells whether r is to be acknowledged before its report is
+// written: ?async=true or ?async=false override the default
+func asyncRequested(r *http.Request, byDefault bool) bool {
+	if value := r.URL.Query().Get("async"); value != "" {
+		if async, err := strconv.ParseBool(value); err == nil {
+			return async
+		}
+	}
+	return byDefault
+}
@@ -1,145 +1,819 @@
 package worker
 
 import (
-	"encoding/json"
-	"io"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/rs/zerolog"
 	"github.com/truemilk/trivelastic/internal/elasticsearch"
+	"github.com/truemilk/trivelastic/internal/fingerprint"
 	"github.com/truemilk/trivelastic/internal/logger"
-	"github.com/truemilk/trivelastic/pkg/sanitizer"
+	"github.com/truemilk/trivelastic/internal/maintenance"
+	"github.com/truemilk/trivelastic/internal/metrics"
+	"github.com/truemilk/trivelastic/internal/pipeline"
+	"github.com/truemilk/trivelastic/internal/queue"
+	"github.com/truemilk/trivelastic/internal/routing"
+	"github.com/truemilk/trivelastic/pkg/trivy"
 )
 
+// Request is a report read from an HTTP request by Submit, with everything
+// needed to process it. Workers never see the HTTP request or its
+// ResponseWriter: their Processor answers with a Response, written by the
+// goroutine serving the request.
 type Request struct {
-	W    http.ResponseWriter
-	R    *http.Request
-	Done chan bool
+	// Context is the context of the HTTP request, done when it is cancelled
+	Context context.Context
+	// Body is the report as received
+	Body []byte
+	// Fields are set on the reports, see pipeline.RequestFields
+	Fields   map[string]interface{}
+	Pipeline *pipeline.Pipeline
+	// Async acknowledges the report with a job ID before it is written
+	Async bool
+	// Batch holds the reports of a batch or an upload instead of Body, see
+	// SubmitBatch
+	Batch []Payload
+	// responses receives the answer to the client
+	responses chan *Response
+	replied   atomic.Bool
+	// spillFile holds the reports while the request is spilled, see Spill,
+	// and spillErr is the error reading them back
+	spillFile string
+	spillErr  error
+	// size is the payload bytes counted against the budget of the pool, see
+	// SetMaxBytes
+	size int64
+}
+
+// NewRequest returns a request for the report in body, to be answered with
+// Reply. Requests are usually read from HTTP requests by Submit, but
+// processors can be given requests made by NewRequest, e.g. in tests.
+func NewRequest(ctx context.Context, body []byte, fields map[string]interface{}, pl *pipeline.Pipeline) *Request {
+	return &Request{
+		Context:   ctx,
+		Body:      body,
+		Fields:    fields,
+		Pipeline:  pl,
+		responses: make(chan *Response, 1),
+	}
+}
+
+// Reply answers the client of req. Only the first answer is written.
+func (req *Request) Reply(resp *Response) {
+	if req.replied.CompareAndSwap(false, true) {
+		req.responses <- resp
+	}
+}
+
+// Wait returns the answer to req, once replied
+func (req *Request) Wait() *Response {
+	return <-req.responses
+}
+
+// Sink receives the documents produced by the pipeline.
+// *elasticsearch.Client is the default implementation.
+// ctx is done when the request that produced doc is cancelled.
+type Sink interface {
+	IndexInto(ctx context.Context, index string, doc map[string]interface{}) error
+}
+
+// OptionsSink is implemented by sinks that accept per-document options: an
+// ID, so that a resubmitted report replaces its earlier copy instead of
+// duplicating it, and a routing value. They return where the document was
+// written, which is passed on to the client.
+type OptionsSink interface {
+	IndexWithOptions(ctx context.Context, index string, opts elasticsearch.IndexOptions, doc map[string]interface{}) (elasticsearch.Indexed, error)
 }
 
 type Pool struct {
 	requests chan *Request
-	es       *elasticsearch.Client
+	// queued counts the requests waiting for a worker, and processing the
+	// requests being processed
+	queued     atomic.Int64
+	processing atomic.Int64
+	// closeMu guards closing, set by Shutdown. pending counts the requests
+	// queued and not processed yet.
+	closeMu sync.RWMutex
+	closing bool
+	pending sync.WaitGroup
+	// workers is the number of running workers, between minWorkers and
+	// maxWorkers. A worker stops when it receives from retire.
+	workers    atomic.Int64
+	minWorkers int
+	maxWorkers int
+	retire     chan struct{}
+	// freeIDs are the IDs of stopped workers, reused so that the worker
+	// label of the metrics stays below maxWorkers values
+	idsMu      sync.Mutex
+	freeIDs    []int
+	nextWorker int
+	// bytes is the payload size of the requests queued in memory or being
+	// processed, and released is signalled when it goes down
+	bytes    atomic.Int64
+	released chan struct{}
+	// latency is the moving average of the time taken to index a report,
+	// in nanoseconds
+	latency atomic.Int64
+	// mu guards the components below, which may be swapped on reload
+	mu          sync.RWMutex
+	sink        Sink
+	pipeline    *pipeline.Pipeline
+	maintenance *maintenance.Manager
+	// persistent keeps reports on disk until they are indexed, nil when disabled
+	persistent *queue.Queue
+	// spill holds queued requests on disk under pressure, nil when disabled
+	spill *Spill
+	// custom replaces the default processing of requests, nil for the pool
+	custom Processor
+	// idempotency replays the answers to payloads submitted again
+	idempotency *Idempotency
+	// retries schedules failed reports to be indexed again, nil when disabled
+	retries      *RetryQueue
+	fingerprints *fingerprint.Tracker
+	dedup        *fingerprint.DedupWindow
+	// redeliveries remembers the content fingerprints of recent reports
+	redeliveries *fingerprint.DedupWindow
+	// jobs tracks the reports acknowledged before they are written, and
+	// async makes that the default
+	jobs  *Jobs
+	async bool
+	// failureStatus answers reports that could not be indexed, zero to
+	// answer 200 with a warning
+	failureStatus int
+	// queueTimeout is how long a request waits for room in a full queue
+	queueTimeout time.Duration
+	// maxBytes bounds bytes, zero for no bound
+	maxBytes int64
 	log      zerolog.Logger
 }
 
-func NewPool(numWorkers int) *Pool {
+// NewPool starts minWorkers workers, which StartScaling adds to up to
+// maxWorkers while requests queue up. Up to queueSize requests wait for a
+// worker, one per worker when queueSize is zero; further requests are
+// rejected with 429, see SetQueueTimeout.
+func NewPool(minWorkers, maxWorkers, queueSize int) *Pool {
+	maxWorkers = max(minWorkers, maxWorkers)
+	if queueSize <= 0 {
+		queueSize = maxWorkers
+	}
 	pool := &Pool{
-		requests: make(chan *Request, numWorkers),
-		log:      logger.GetLogger("worker_pool"),
+		requests:   make(chan *Request, queueSize),
+		minWorkers: minWorkers,
+		maxWorkers: maxWorkers,
+		retire:     make(chan struct{}),
+		released:   make(chan struct{}, 1),
+		log:        logger.GetLogger("worker_pool"),
 	}
 
 	pool.log.Info().
-		Int("workers", numWorkers).
+		Int("min_workers", minWorkers).
+		Int("max_workers", maxWorkers).
+		Int("queue_size", queueSize).
 		Msg("Initializing worker pool")
 
 	// Start worker pool
-	for i := 0; i < numWorkers; i++ {
-		go pool.worker(i)
-	}
+	pool.addWorkers(minWorkers)
 
 	return pool
 }
 
-func (p *Pool) SetElasticsearchClient(client *elasticsearch.Client) {
-	p.es = client
-	p.log.Info().Msg("Elasticsearch client configured for worker pool")
+// QueueDepth is the number of requests waiting for a worker
+func (p *Pool) QueueDepth() int {
+	return int(p.queued.Load())
+}
+
+// InFlight is the number of requests being processed by a worker
+func (p *Pool) InFlight() int {
+	return int(p.processing.Load())
 }
 
-func (p *Pool) Submit(w http.ResponseWriter, r *http.Request) {
-	p.log.Debug().
-		Str("method", r.Method).
-		Str("path", r.URL.Path).
-		Str("remote_addr", r.RemoteAddr).
-		Msg("Submitting request to worker pool")
+func (p *Pool) SetSink(sink Sink) {
+	p.mu.Lock()
+	p.sink = sink
+	p.mu.Unlock()
+	p.log.Info().
+		Str("sink", fmt.Sprintf("%T", sink)).
+		Msg("Sink configured for worker pool")
+}
+
+func (p *Pool) SetPipeline(pl *pipeline.Pipeline) {
+	p.mu.Lock()
+	p.pipeline = pl
+	p.mu.Unlock()
+	p.log.Info().Msg("Processing pipeline configured for worker pool")
+}
+
+func (p *Pool) SetMaintenance(m *maintenance.Manager) {
+	p.mu.Lock()
+	p.maintenance = m
+	p.mu.Unlock()
+	p.log.Info().Msg("Maintenance windows configured for worker pool")
+}
+
+// SetQueue keeps every report in q until it is indexed. Reports that could
+// not be indexed are answered as queued and retried by q. The asynchronous
+// jobs of the reports left in q by a previous process are tracked again, see
+// SetJobs, which must be called first.
+func (p *Pool) SetQueue(q *queue.Queue) {
+	p.mu.Lock()
+	p.persistent = q
+	jobs := p.jobs
+	p.mu.Unlock()
+	if jobs != nil {
+		recovered, err := q.Jobs()
+		if err != nil {
+			p.log.Error().
+				Err(err).
+				Msg("Failed to read the jobs of the persistent queue")
+		}
+		for id, accepted := range recovered {
+			jobs.restore(id, accepted)
+		}
+		if len(recovered) > 0 {
+			p.log.Info().
+				Int("jobs", len(recovered)).
+				Msg("Recovered asynchronous jobs from persistent queue")
+		}
+		q.SetJobDone(func(id string, err error) {
+			if err != nil {
+				jobs.finish(id, JobFailed, nil, err)
+				return
+			}
+			jobs.finish(id, JobIndexed, nil, nil)
+		})
+	}
+	p.log.Info().Msg("Persistent queue configured for worker pool")
+}
+
+func (p *Pool) SetFingerprintTracker(t *fingerprint.Tracker) {
+	p.mu.Lock()
+	p.fingerprints = t
+	p.mu.Unlock()
+	p.log.Info().Msg("Fingerprint tracking configured for worker pool")
+}
+
+// SetDedupWindow skips payloads whose reports were all indexed within the window
+func (p *Pool) SetDedupWindow(d *fingerprint.DedupWindow) {
+	p.mu.Lock()
+	p.dedup = d
+	p.mu.Unlock()
+	p.log.Info().Msg("Deduplication window configured for worker pool")
+}
+
+// SetRedeliveryWindow acknowledges payloads whose reports were all ingested
+// with the same content within the window, without indexing them again
+func (p *Pool) SetRedeliveryWindow(d *fingerprint.DedupWindow) {
+	p.mu.Lock()
+	p.redeliveries = d
+	p.mu.Unlock()
+	p.log.Info().Msg("Redelivery window configured for worker pool")
+}
+
+// SetJobs tracks the reports of requests with ?async=true, which are
+// acknowledged with 202 Accepted and a job ID before they are written
+func (p *Pool) SetJobs(jobs *Jobs) {
+	p.mu.Lock()
+	p.jobs = jobs
+	p.mu.Unlock()
+}
 
-	done := make(chan bool)
-	req := &Request{
-		W:    w,
-		R:    r,
-		Done: done,
+// SetAsync acknowledges every report before it is written, unless the
+// request has ?async=false. It needs SetJobs.
+func (p *Pool) SetAsync(enabled bool) {
+	p.mu.Lock()
+	p.async = enabled
+	p.mu.Unlock()
+	if enabled {
+		p.log.Info().Msg("Asynchronous ingest enabled for worker pool")
 	}
-	p.requests <- req
-	<-done // Wait for request to be processed
+}
+
+// SetFailureStatus answers reports that could not be indexed with status,
+// or with 503 while the circuit breaker is open. Zero answers 200 with a
+// warning instead.
+func (p *Pool) SetFailureStatus(status int) {
+	p.mu.Lock()
+	p.failureStatus = status
+	p.mu.Unlock()
+}
+
+// SetQueueTimeout makes requests wait up to timeout for room in a full
+// queue before they are rejected, instead of being rejected at once
+func (p *Pool) SetQueueTimeout(timeout time.Duration) {
+	p.mu.Lock()
+	p.queueTimeout = timeout
+	p.mu.Unlock()
+}
+
+// failureStatusOf returns the status code of an indexing error, zero when
+// failures are answered with a warning
+func (p *Pool) failureStatusOf(err error) int {
+	p.mu.RLock()
+	status := p.failureStatus
+	p.mu.RUnlock()
+	if status != 0 && errors.Is(err, elasticsearch.ErrCircuitOpen) {
+		return http.StatusServiceUnavailable
+	}
+	return status
 }
 
 func (p *Pool) worker(id int) {
 	log := p.log.With().Int("worker_id", id).Logger()
 	log.Debug().Msg("Worker started")
+	label := strconv.Itoa(id)
 
-	for req := range p.requests {
+	for {
+		var req *Request
+		select {
+		case req = <-p.requests:
+		case <-p.retire:
+			log.Debug().Msg("Worker stopped")
+			p.releaseID(id)
+			return
+		}
+		p.processing.Add(1)
+		p.queued.Add(-1)
+		start := time.Now()
 		log.Debug().Msg("Processing new request")
-		p.processRequest(req, log)
+		switch {
+		case req.spillErr != nil:
+			req.Reply(ErrorResponse(http.StatusInternalServerError, "Failed to read spilled request"))
+		case req.Context.Err() != nil:
+			// Nobody waits for the answer anymore
+			log.Warn().
+				Err(req.Context.Err()).
+				Msg("Request cancelled before processing")
+			req.Reply(cancelledResponse(req.Context.Err()))
+		default:
+			p.process(req, log)
+			if !req.replied.Load() {
+				log.Error().Msg("Request processed without an answer")
+				req.Reply(ErrorResponse(http.StatusInternalServerError, "Request not answered"))
+			}
+		}
+		elapsed := time.Since(start).Seconds()
+		metrics.JobDuration.Observe(elapsed)
+		metrics.WorkerBusy.Add(elapsed, label)
+		p.release(req.size)
+		p.processing.Add(-1)
+		p.pending.Done()
 	}
 }
 
-func (p *Pool) processRequest(req *Request, log zerolog.Logger) {
-	defer func() {
-		req.Done <- true
-	}()
+// Shutdown stops accepting requests and waits for the queued ones to be
+// processed, asynchronous reports included, until ctx is done. It returns
+// the number of requests abandoned then, still queued or being processed.
+// Requests submitted afterwards are answered with 503.
+func (p *Pool) Shutdown(ctx context.Context) (int, error) {
+	p.closeMu.Lock()
+	p.closing = true
+	p.closeMu.Unlock()
+
+	p.log.Info().
+		Int64("queued", p.queued.Load()).
+		Int64("processing", p.processing.Load()).
+		Msg("Draining worker pool")
 
-	w, r := req.W, req.R
+	drained := make(chan struct{})
+	go func() {
+		p.pending.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		p.log.Info().Msg("Worker pool drained")
+		return 0, nil
+	case <-ctx.Done():
+		abandoned := int(p.queued.Load() + p.processing.Load())
+		p.log.Warn().
+			Int("abandoned", abandoned).
+			Msg("Worker pool not drained before the deadline")
+		return abandoned, ctx.Err()
+	}
+}
 
-	// Set response header to JSON
-	w.Header().Set("Content-Type", "application/json")
+// processRequest runs the report of req through its pipeline, writes it and
+// answers the client. In async mode the client is answered as soon as the
+// report is validated, and the report is written afterwards.
+func (p *Pool) processRequest(req *Request, log zerolog.Logger) {
+	// Log the raw JSON at debug level
+	log.Debug().
+		RawJSON("raw_json", req.Body).
+		Msg("Received JSON payload")
 
-	// Only process POST requests with JSON
-	if r.Method != http.MethodPost {
+	// Parse, sanitize and route the payload
+	result, err := req.Pipeline.Process(req.Context, req.Body, req.Fields)
+	if ctxErr := req.Context.Err(); ctxErr != nil {
 		log.Warn().
-			Str("method", r.Method).
-			Msg("Invalid HTTP method")
-		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+			Err(ctxErr).
+			Msg("Request cancelled during processing")
+		req.Reply(cancelledResponse(ctxErr))
+		return
+	}
+	var invalid *trivy.ValidationError
+	if errors.As(err, &invalid) {
+		log.Warn().
+			Err(err).
+			Msg("Payload is not a Trivy report")
+		req.Reply(&Response{Status: http.StatusUnprocessableEntity, Body: map[string]interface{}{
+			"status":   "error",
+			"message":  "Payload is not a valid Trivy report",
+			"problems": invalid.Problems,
+		}})
 		return
 	}
-
-	// Read the raw JSON body
-	body, err := io.ReadAll(r.Body)
 	if err != nil {
 		log.Error().
 			Err(err).
-			Msg("Failed to read request body")
-		http.Error(w, "Error reading body: "+err.Error(), http.StatusBadRequest)
+			Msg("Failed to process payload")
+		req.Reply(ErrorResponse(http.StatusBadRequest, "Invalid payload: "+err.Error()))
 		return
 	}
+	cleanData := result.Document
 
-	// Log the raw JSON at debug level
-	log.Debug().
-		RawJSON("raw_json", body).
-		Msg("Received JSON payload")
+	// Acknowledge webhook redeliveries of reports that were just ingested
+	p.mu.RLock()
+	redeliveries := p.redeliveries
+	p.mu.RUnlock()
+	if redeliveries != nil && redeliveries.Seen(result.Fingerprints) {
+		log.Info().Msg("Redelivered report skipped")
+		req.Reply(&Response{Body: map[string]interface{}{
+			"status":       "success",
+			"message":      "Report with the same fingerprint already ingested",
+			"duplicate":    true,
+			"fingerprints": result.Fingerprints,
+			"warnings":     result.Warnings,
+			"data":         cleanData,
+		}})
+		return
+	}
 
-	// Parse the JSON into a map
-	var data map[string]interface{}
-	if err := json.Unmarshal(body, &data); err != nil {
-		log.Error().
-			Err(err).
-			Msg("Failed to parse JSON")
-		http.Error(w, "Error parsing JSON: "+err.Error(), http.StatusBadRequest)
+	// Skip repeat scans of artifacts whose vulnerabilities did not change
+	p.mu.RLock()
+	dedup := p.dedup
+	p.mu.RUnlock()
+	var dedupKeys []string
+	if dedup != nil {
+		dedupKeys = make([]string, 0, len(result.Reports))
+		for _, report := range result.Reports {
+			dedupKeys = append(dedupKeys, fingerprint.DedupKey(report))
+		}
+		if dedup.Seen(dedupKeys) {
+			log.Info().Msg("Duplicate report skipped")
+			req.Reply(&Response{Body: map[string]interface{}{
+				"status":    "success",
+				"message":   "Identical report already indexed within the deduplication window",
+				"duplicate": true,
+				"warnings":  result.Warnings,
+				"data":      cleanData,
+			}})
+			return
+		}
+	}
+
+	p.mu.RLock()
+	jobs := p.jobs
+	p.mu.RUnlock()
+	if jobs != nil && req.Async {
+		job, err := jobs.add(result.Warnings)
+		if err != nil {
+			log.Error().
+				Err(err).
+				Msg("Failed to create job")
+			req.Reply(ErrorResponse(http.StatusInternalServerError, "Failed to create job"))
+			return
+		}
+
+		// Answer once the report is in the persistent queue, if any, and
+		// write it afterwards, once the request is over
+		accept := func() {
+			req.Reply(&Response{
+				Status: http.StatusAccepted,
+				Header: map[string]string{"Location": "/v1/jobs/" + job.ID},
+				Body: map[string]interface{}{
+					"status":   "accepted",
+					"message":  "Report accepted for indexing",
+					"job_id":   job.ID,
+					"warnings": result.Warnings,
+				},
+			})
+		}
+
+		log = log.With().Str("job_id", job.ID).Logger()
+		delivered, err := p.deliver(context.WithoutCancel(req.Context), result, dedup, dedupKeys, job.ID, accept, log)
+		switch {
+		case err != nil:
+			jobs.finish(job.ID, JobFailed, nil, err)
+		case delivered.spooled:
+			jobs.finish(job.ID, JobSpooled, nil, nil)
+		default:
+			jobs.finish(job.ID, JobIndexed, delivered.documents, nil)
+		}
 		return
 	}
 
-	// Sanitize the JSON
-	cleanData := sanitizer.SanitizeJSON(data)
-	log.Debug().
-		Interface("clean_data", cleanData).
-		Msg("JSON sanitized")
+	delivered, err := p.deliver(req.Context, result, dedup, dedupKeys, "", nil, log)
+	if errors.Is(err, errMaintenanceSpool) {
+		req.Reply(ErrorResponse(http.StatusServiceUnavailable, "Failed to store report during maintenance window"))
+		return
+	}
+	if err != nil {
+		if status := p.failureStatusOf(err); status != 0 {
+			req.Reply(&Response{Status: status, Body: map[string]interface{}{
+				"status":   "error",
+				"message":  "Failed to store in Elasticsearch",
+				"error":    err.Error(),
+				"warnings": result.Warnings,
+			}})
+			return
+		}
+		req.Reply(&Response{Body: map[string]interface{}{
+			"status":   "warning",
+			"message":  "Request processed but failed to store in Elasticsearch",
+			"warnings": result.Warnings,
+			"data":     cleanData,
+		}})
+		return
+	}
+	body := map[string]interface{}{
+		"status":   "success",
+		"message":  delivered.message,
+		"warnings": result.Warnings,
+		"data":     cleanData,
+	}
+	if delivered.spooled {
+		body["queued"] = true
+	}
+	if len(delivered.documents) > 0 {
+		body["documents"] = delivered.documents
+	}
+	req.Reply(&Response{Body: body})
+}
+
+// errMaintenanceSpool is returned by deliver when a report cannot be
+// spooled during a maintenance window
+var errMaintenanceSpool = errors.New("failed to store report during maintenance window")
+
+// delivery is the outcome of a report written or spooled by deliver
+type delivery struct {
+	// message is for the client
+	message string
+	spooled bool
+	// documents locates the documents written, when the sink reports them
+	documents []elasticsearch.Indexed
+}
+
+// deliver writes the routes of a processed report, or spools them while
+// Elasticsearch is under maintenance or unavailable. job is the ID of the
+// asynchronous job of the report, if any. accept, when set, is called once
+// the report is on disk, or before it is written when it cannot be.
+func (p *Pool) deliver(ctx context.Context, result *pipeline.Result, dedup *fingerprint.DedupWindow, dedupKeys []string, job string, accept func(), log zerolog.Logger) (delivery, error) {
+	p.mu.RLock()
+	redeliveries, maint, retries := p.redeliveries, p.maintenance, p.retries
+	p.mu.RUnlock()
+	if accept == nil {
+		accept = func() {}
+	}
+
+	// Hold the report on disk while Elasticsearch is under maintenance
+	if maint != nil && maint.Active() {
+		err := maint.Store(result.Routes)
+		accept()
+		if err != nil {
+			log.Error().
+				Err(err).
+				Msg("Failed to spool report during maintenance window")
+			return delivery{}, fmt.Errorf("%w: %w", errMaintenanceSpool, err)
+		}
+
+		stored(ctx, result, redeliveries, log)
+		log.Info().Msg("Report spooled during maintenance window")
+		return delivery{message: "Data stored for indexing after the maintenance window", spooled: true}, nil
+	}
+
+	// Keep the report on disk until it is indexed
+	id, persisted := p.persist(result.Routes, job, log)
+	accept()
 
 	// Forward to Elasticsearch
-	if err := p.es.IndexDocument(cleanData); err != nil {
+	documents, err := p.index(ctx, result.Routes)
+	if err != nil {
+		// The queue retries the report once the cluster is back
+		if persisted && elasticsearch.Retryable(err) {
+			p.requeue(id, result.Routes, err, log)
+			stored(ctx, result, redeliveries, log)
+			log.Warn().
+				Err(err).
+				Msg("Report queued while Elasticsearch is unavailable")
+			return delivery{message: "Data stored for indexing once Elasticsearch is available", spooled: true}, nil
+		}
+		if !persisted && retries != nil && ctx.Err() == nil && elasticsearch.Retryable(err) && retries.Add(routing.Remaining(result.Routes, err)) {
+			stored(ctx, result, redeliveries, log)
+			log.Warn().
+				Err(err).
+				Msg("Report scheduled for retry")
+			return delivery{message: "Data stored for indexing once Elasticsearch is available", spooled: true}, nil
+		}
+		if persisted {
+			p.unpersist(id, log)
+		}
+
+		// Hold the report on disk until the cluster is back, rather than losing it
+		if errors.Is(err, elasticsearch.ErrCircuitOpen) && maint != nil {
+			if err := maint.Store(routing.Remaining(result.Routes, err)); err != nil {
+				log.Error().
+					Err(err).
+					Msg("Failed to spool report while Elasticsearch is unavailable")
+			} else {
+				stored(ctx, result, redeliveries, log)
+				log.Warn().Msg("Report spooled while Elasticsearch is unavailable")
+				return delivery{message: "Data stored for indexing once Elasticsearch is available", spooled: true}, nil
+			}
+		}
+
 		log.Error().
 			Err(err).
 			Msg("Failed to index document in Elasticsearch")
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"status":  "warning",
-			"message": "Request processed but failed to store in Elasticsearch",
-			"data":    cleanData,
-		})
-		return
+		return delivery{}, err
+	}
+	if persisted {
+		p.unpersist(id, log)
+	}
+
+	if dedup != nil {
+		dedup.Record(dedupKeys)
+	}
+	stored(ctx, result, redeliveries, log)
+
+	// Track how often the same result is ingested across the fleet
+	p.mu.RLock()
+	fingerprints := p.fingerprints
+	p.mu.RUnlock()
+	if fingerprints != nil {
+		for _, report := range result.Reports {
+			if err := fingerprints.Record(ctx, report); err != nil {
+				log.Warn().
+					Err(err).
+					Msg("Failed to record report fingerprint")
+			}
+		}
 	}
 
 	log.Info().Msg("Request processed successfully")
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"status":  "success",
-		"message": "Data processed successfully",
-		"data":    cleanData,
-	})
+	return delivery{message: "Data processed successfully", documents: documents}, nil
+}
+
+// persist stores routes in the persistent queue, if any, with the ID of
+// their asynchronous job. Documents without an ID get a random one first, so
+// that a report indexed again after a crash overwrites its documents instead
+// of duplicating them. Reports the queue cannot store are still indexed.
+func (p *Pool) persist(routes []routing.Route, job string, log zerolog.Logger) (uint64, bool) {
+	p.mu.RLock()
+	persistent := p.persistent
+	p.mu.RUnlock()
+	if persistent == nil {
+		return 0, false
+	}
+	for i := range routes {
+		if routes[i].ID != "" {
+			continue
+		}
+		id := make([]byte, 16)
+		if _, err := rand.Read(id); err != nil {
+			log.Error().
+				Err(err).
+				Msg("Failed to generate document ID")
+			return 0, false
+		}
+		routes[i].ID = hex.EncodeToString(id)
+	}
+	id, err := persistent.Push(routes, job)
+	if err != nil {
+		log.Error().
+			Err(err).
+			Msg("Failed to store report in persistent queue")
+		return 0, false
+	}
+	return id, true
+}
+
+// unpersist removes a report that was indexed, or that Elasticsearch will
+// never accept, from the persistent queue
+func (p *Pool) unpersist(id uint64, log zerolog.Logger) {
+	p.mu.RLock()
+	persistent := p.persistent
+	p.mu.RUnlock()
+	if err := persistent.Ack(id); err != nil {
+		log.Error().
+			Err(err).
+			Msg("Failed to remove report from persistent queue")
+	}
+}
+
+// stored remembers the fingerprints of reports that were indexed or spooled,
+// and makes them the baseline of the next reports of their artifacts. A
+// failed commit only means the same changes are indexed again.
+func stored(ctx context.Context, result *pipeline.Result, redeliveries *fingerprint.DedupWindow, log zerolog.Logger) {
+	if redeliveries != nil {
+		redeliveries.Record(result.Fingerprints)
+	}
+	for _, delta := range result.Deltas {
+		// The report is stored, so the baseline is committed even if the
+		// request was cancelled meanwhile
+		if err := delta.Commit(context.WithoutCancel(ctx)); err != nil {
+			log.Warn().
+				Err(err).
+				Msg("Failed to record report diff baseline")
+		}
+	}
+}
+
+// Index writes every routed document to its target index
+func (p *Pool) Index(routes []routing.Route) error {
+	_, err := p.index(context.Background(), routes)
+	return err
+}
+
+// partialError returns err, the joined errors of routes, as a
+// *routing.PartialError listing the failed routes when some were written
+func partialError(routes []routing.Route, errs []error, err error) error {
+	var failed []routing.Route
+	for i, routeErr := range errs {
+		if routeErr != nil {
+			failed = append(failed, routes[i])
+		}
+	}
+	if len(failed) == len(routes) {
+		return err
+	}
+	return &routing.PartialError{Err: err, Failed: failed}
+}
+
+// requeue leaves the report id of the persistent queue to its drainer,
+// keeping only the routes that failed with err
+func (p *Pool) requeue(id uint64, routes []routing.Route, err error, log zerolog.Logger) {
+	p.mu.RLock()
+	persistent := p.persistent
+	p.mu.RUnlock()
+	if remaining := routing.Remaining(routes, err); len(remaining) < len(routes) {
+		if err := persistent.Replace(id, remaining); err != nil {
+			log.Error().
+				Err(err).
+				Uint64("id", id).
+				Msg("Failed to remove written documents from queued report")
+		}
+	}
+	persistent.Release(id)
+}
+
+// index writes every routed document to its target index and returns where
+// they were written, when the sink reports it. The routes are written
+// concurrently so that they can share a bulk request.
+func (p *Pool) index(ctx context.Context, routes []routing.Route) ([]elasticsearch.Indexed, error) {
+	defer p.observeLatency(time.Now())
+	ctx = p.indexContext(ctx)
+
+	p.mu.RLock()
+	sink := p.sink
+	p.mu.RUnlock()
+
+	indexed := make([]elasticsearch.Indexed, len(routes))
+	errs := make([]error, len(routes))
+	var wg sync.WaitGroup
+	for i, route := range routes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var err error
+			opts := elasticsearch.IndexOptions{ID: route.ID, Routing: route.RoutingKey}
+			if optsSink, ok := sink.(OptionsSink); ok {
+				indexed[i], err = optsSink.IndexWithOptions(ctx, route.Index, opts, route.Document)
+			} else {
+				err = sink.IndexInto(ctx, route.Index, route.Document)
+			}
+			if err != nil {
+				errs[i] = fmt.Errorf("index %s: %w", route.Index, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if err := errors.Join(errs...); err != nil {
+		return nil, partialError(routes, errs, err)
+	}
+	documents := make([]elasticsearch.Indexed, 0, len(indexed))
+	for _, doc := range indexed {
+		if doc.ID != "" {
+			documents = append(documents, doc)
+		}
+	}
+	return documents, nil
 }
@@ -0,0 +1,63 @@
+package worker
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/truemilk/trivelastic/internal/config"
+	"github.com/truemilk/trivelastic/internal/pipeline"
+	"github.com/truemilk/trivelastic/internal/routing"
+)
+
+func TestSubmitNullWithCIHeaders(t *testing.T) {
+	sink := &blockingSink{release: make(chan struct{}), indices: make(chan string, 10)}
+	close(sink.release)
+	p := NewPool(1, 1, 10)
+	p.SetSink(sink)
+	// Without validation, null reaches the pipeline
+	p.SetPipeline(pipeline.New(routing.NewRouter("trivy", &config.RoutingConfig{})))
+
+	r := httptest.NewRequest(http.MethodPost, "/v1/reports", strings.NewReader("null"))
+	r.Header.Set("X-CI-Pipeline", "build")
+	rec := httptest.NewRecorder()
+	p.Submit(rec, r)
+
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestWorkerRecoversFromPanics(t *testing.T) {
+	p := NewPool(1, 1, 10)
+	p.SetPipeline(pipeline.New(routing.NewRouter("trivy", &config.RoutingConfig{})))
+	panics := true
+	p.SetProcessor(ProcessorFunc(func(req *Request, log zerolog.Logger) {
+		if panics {
+			panics = false
+			panic("broken report")
+		}
+		req.Reply(&Response{Status: http.StatusOK})
+	}))
+
+	for _, want := range []int{http.StatusInternalServerError, http.StatusOK} {
+		r := httptest.NewRequest(http.MethodPost, "/v1/reports", strings.NewReader("{}"))
+		rec := httptest.NewRecorder()
+		done := make(chan struct{})
+		go func() {
+			p.Submit(rec, r)
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("request not answered, the worker is gone")
+		}
+		if rec.Code != want {
+			t.Fatalf("expected %d, got %d: %s", want, rec.Code, rec.Body)
+		}
+	}
+}
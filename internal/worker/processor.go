@@ -0,0 +1,92 @@
+package worker
+
+import (
+	"net/http"
+	"runtime/debug"
+
+	"github.com/rs/zerolog"
+)
+
+// Processor handles the requests taken by the workers of a Pool. It answers
+// every request with Request.Reply, once processed or, for asynchronous
+// requests, as soon as it is accepted. Requests left unanswered when Process
+// returns or panics are answered with 500. log carries the ID of the worker.
+//
+// The Pool itself is the default processor: it runs the pipeline of the
+// request and writes the documents to the sink. Other processors, such as
+// one wrapping the pool to enrich requests or one writing to a fake sink,
+// are set with SetProcessor.
+type Processor interface {
+	Process(req *Request, log zerolog.Logger)
+}
+
+// ProcessorFunc adapts a function to Processor
+type ProcessorFunc func(req *Request, log zerolog.Logger)
+
+func (f ProcessorFunc) Process(req *Request, log zerolog.Logger) {
+	f(req, log)
+}
+
+// SetProcessor makes the workers hand requests to proc. nil restores the
+// default processing.
+func (p *Pool) SetProcessor(proc Processor) {
+	p.mu.Lock()
+	p.custom = proc
+	p.mu.Unlock()
+	if proc != nil {
+		p.log.Info().Msg("Custom processor configured for worker pool")
+	}
+}
+
+// processor is the Processor of the requests
+func (p *Pool) processor() Processor {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.custom != nil {
+		return p.custom
+	}
+	return p
+}
+
+// process hands req to the processor, answering 500 if it panics so that a
+// single payload cannot take the server down
+func (p *Pool) process(req *Request, log zerolog.Logger) {
+	defer func() {
+		if v := recover(); v != nil {
+			log.Error().
+				Interface("panic", v).
+				Bytes("stack", debug.Stack()).
+				Msg("Request processing panicked")
+			req.Reply(ErrorResponse(http.StatusInternalServerError, "Internal error while processing the request"))
+		}
+	}()
+	p.processor().Process(req, log)
+}
+
+// Do hands req to the processor in the calling goroutine, without queueing
+// it, and returns the answer. It is meant for reports submitted in-process,
+// which bypass the HTTP routes.
+func (p *Pool) Do(req *Request) *Response {
+	p.process(req, p.log)
+	if !req.replied.Load() {
+		p.log.Error().Msg("Request processed without an answer")
+		req.Reply(ErrorResponse(http.StatusInternalServerError, "Request not answered"))
+	}
+	return req.Wait()
+}
+
+// Process runs the pipeline of req, the default pipeline when it has none,
+// and writes the documents of its reports to the sink, or spools them, see
+// Processor
+func (p *Pool) Process(req *Request, log zerolog.Logger) {
+	if req.Pipeline == nil {
+		p.mu.RLock()
+		req.Pipeline = p.pipeline
+		p.mu.RUnlock()
+	}
+	if req.Batch != nil {
+		p.processBatch(req, log)
+		return
+	}
+	p.processRequest(req, log)
+}
@@ -0,0 +1,340 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/truemilk/trivelastic/internal/elasticsearch"
+	"github.com/truemilk/trivelastic/internal/logger"
+	"github.com/truemilk/trivelastic/internal/metrics"
+	"github.com/truemilk/trivelastic/internal/routing"
+)
+
+// retryConcurrency bounds the reports of a RetryQueue indexed at once
+const retryConcurrency = 16
+
+// retryItem is a report waiting to be indexed again
+type retryItem struct {
+	routes []routing.Route
+	// failed is when the first attempt failed
+	failed   time.Time
+	attempts int
+	due      time.Time
+}
+
+// savedItem is a retryItem as written to the file of a RetryQueue
+type savedItem struct {
+	Routes   []routing.Route `json:"routes"`
+	Failed   time.Time       `json:"failed"`
+	Attempts int             `json:"attempts"`
+}
+
+// RetryQueue indexes again, later, the reports that failed with an error
+// that may go away, such as an overloaded or unreachable cluster, so that
+// workers do not wait for the cluster to recover. The delay doubles after
+// every failed attempt, from interval up to maxInterval. Reports still
+// failing maxAge after their first failure are dropped. The queue is kept in
+// memory and written to path by Close, to be retried again by the next
+// process. Reports waiting when the process crashes are lost, see
+// queue.Queue for reports that must survive crashes.
+type RetryQueue struct {
+	size        int
+	interval    time.Duration
+	maxInterval time.Duration
+	maxAge      time.Duration
+	// path holds the reports waiting when the queue was closed, empty to
+	// abandon them
+	path string
+	// index is set by Pool.SetRetryQueue
+	index func(routes []routing.Route) error
+
+	mu    sync.Mutex
+	items []*retryItem
+	// closed rejects the reports added once Close was called
+	closed  bool
+	started bool
+	stop    chan struct{}
+	// done is closed once the retries started before Close are over
+	done chan struct{}
+	log  zerolog.Logger
+}
+
+// NewRetryQueue returns a queue retrying the reports left in the file at
+// path by the previous process, if any, as soon as it is started
+func NewRetryQueue(size int, interval, maxInterval, maxAge time.Duration, path string) (*RetryQueue, error) {
+	q := &RetryQueue{
+		size:        size,
+		interval:    interval,
+		maxInterval: maxInterval,
+		maxAge:      maxAge,
+		path:        path,
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+		log:         logger.GetLogger("retry_queue"),
+	}
+	if err := q.load(); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// load reads the reports saved by the previous process and removes the file,
+// so that they are not retried again by the next one
+func (q *RetryQueue) load() error {
+	if q.path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(q.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error reading retry queue: %w", err)
+	}
+
+	var saved []savedItem
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return fmt.Errorf("error parsing retry queue %s: %w", q.path, err)
+	}
+	now := time.Now()
+	for _, item := range saved {
+		q.items = append(q.items, &retryItem{routes: item.Routes, failed: item.Failed, attempts: item.Attempts, due: now})
+	}
+	if err := os.Remove(q.path); err != nil {
+		return fmt.Errorf("error removing retry queue: %w", err)
+	}
+
+	if len(saved) > 0 {
+		q.log.Info().
+			Int("reports", len(saved)).
+			Msg("Recovered reports waiting to be retried")
+	}
+	return nil
+}
+
+// save writes the reports still waiting to path
+func (q *RetryQueue) save() error {
+	q.mu.Lock()
+	saved := make([]savedItem, 0, len(q.items))
+	for _, item := range q.items {
+		saved = append(saved, savedItem{Routes: item.routes, Failed: item.failed, Attempts: item.attempts})
+	}
+	q.mu.Unlock()
+	if len(saved) == 0 {
+		return nil
+	}
+
+	data, err := json.Marshal(saved)
+	if err != nil {
+		return fmt.Errorf("error marshaling retry queue: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(q.path), 0o750); err != nil {
+		return fmt.Errorf("error creating retry queue directory: %w", err)
+	}
+	// Write to a temporary file first so the next process never reads a partial file
+	if err := os.WriteFile(q.path+".tmp", data, 0o640); err != nil {
+		return fmt.Errorf("error writing retry queue: %w", err)
+	}
+	if err := os.Rename(q.path+".tmp", q.path); err != nil {
+		return fmt.Errorf("error committing retry queue: %w", err)
+	}
+
+	q.log.Info().
+		Int("reports", len(saved)).
+		Str("path", q.path).
+		Msg("Reports waiting to be retried saved for the next start")
+	return nil
+}
+
+// SetRetryQueue hands the reports that failed with an error that may go away
+// to q instead of answering with the error. Elasticsearch requests are then
+// attempted once in the request path, q retrying them later.
+func (p *Pool) SetRetryQueue(q *RetryQueue) {
+	q.index = func(routes []routing.Route) error {
+		_, err := p.index(context.Background(), routes)
+		return err
+	}
+	p.mu.Lock()
+	p.retries = q
+	p.mu.Unlock()
+	p.log.Info().Msg("Retry queue configured for worker pool")
+}
+
+// indexContext is the context of the Elasticsearch requests writing reports
+func (p *Pool) indexContext(ctx context.Context) context.Context {
+	p.mu.RLock()
+	retries := p.retries
+	p.mu.RUnlock()
+	if retries != nil {
+		return elasticsearch.WithoutRetries(ctx)
+	}
+	return ctx
+}
+
+// Add schedules routes, which just failed for the first time, to be indexed
+// again. It returns false when the queue is full.
+func (q *RetryQueue) Add(routes []routing.Route) bool {
+	now := time.Now()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return false
+	}
+	if len(q.items) >= q.size {
+		q.log.Warn().
+			Int("size", q.size).
+			Msg("Retry queue full, report not scheduled")
+		return false
+	}
+	q.items = append(q.items, &retryItem{routes: routes, failed: now, attempts: 1, due: now.Add(q.delay(1))})
+	return true
+}
+
+// Len is the number of reports waiting to be retried
+func (q *RetryQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.items)
+}
+
+// Start retries the reports as they become due, in the background
+func (q *RetryQueue) Start() {
+	q.log.Info().
+		Int("size", q.size).
+		Dur("interval", q.interval).
+		Dur("max_interval", q.maxInterval).
+		Dur("max_age", q.maxAge).
+		Msg("Retry queue enabled")
+
+	q.mu.Lock()
+	q.started = true
+	q.mu.Unlock()
+	go func() {
+		defer close(q.done)
+		ticker := time.NewTicker(min(q.interval, time.Second))
+		defer ticker.Stop()
+		for {
+			select {
+			case <-q.stop:
+				return
+			case <-ticker.C:
+				q.retryDue()
+			}
+		}
+	}()
+}
+
+// Close stops retrying, once the retries in progress are over, and writes
+// the reports still waiting to path. Reports added afterwards are rejected.
+// It returns the number of reports abandoned, when they could not be saved.
+func (q *RetryQueue) Close() (int, error) {
+	q.mu.Lock()
+	q.closed = true
+	started := q.started
+	q.mu.Unlock()
+	close(q.stop)
+	if started {
+		<-q.done
+	}
+
+	if q.path == "" {
+		return q.Len(), nil
+	}
+	if err := q.save(); err != nil {
+		return q.Len(), err
+	}
+	return 0, nil
+}
+
+// retryDue indexes the reports whose delay has elapsed
+func (q *RetryQueue) retryDue() {
+	now := time.Now()
+	q.mu.Lock()
+	var due []*retryItem
+	waiting := q.items[:0]
+	for _, item := range q.items {
+		if now.Before(item.due) {
+			waiting = append(waiting, item)
+		} else {
+			due = append(due, item)
+		}
+	}
+	q.items = waiting
+	q.mu.Unlock()
+	if len(due) == 0 {
+		return
+	}
+
+	q.log.Info().
+		Int("reports", len(due)).
+		Msg("Retrying failed reports")
+
+	sem := make(chan struct{}, retryConcurrency)
+	var wg sync.WaitGroup
+	for _, item := range due {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			q.retry(item)
+		}()
+	}
+	wg.Wait()
+}
+
+// retry indexes item, scheduling it again when it fails with an error that
+// may go away before its max age
+func (q *RetryQueue) retry(item *retryItem) {
+	item.attempts++
+	log := q.log.With().Int("attempt", item.attempts).Logger()
+	err := q.index(item.routes)
+	switch {
+	case err == nil:
+		metrics.RetryQueueAttempts.Inc("indexed")
+		log.Info().Msg("Retried report indexed")
+		return
+	case !elasticsearch.Retryable(err):
+		metrics.RetryQueueAttempts.Inc("rejected")
+		log.Error().
+			Err(err).
+			Msg("Retried report rejected by Elasticsearch, dropping it")
+		return
+	case time.Since(item.failed) >= q.maxAge:
+		metrics.RetryQueueAttempts.Inc("expired")
+		log.Error().
+			Err(err).
+			Dur("age", time.Since(item.failed)).
+			Msg("Report still failing after its max age, dropping it")
+		return
+	}
+
+	metrics.RetryQueueAttempts.Inc("failed")
+	// Routes written by this attempt are not written again
+	item.routes = routing.Remaining(item.routes, err)
+	delay := q.delay(item.attempts)
+	item.due = time.Now().Add(delay)
+	q.mu.Lock()
+	q.items = append(q.items, item)
+	q.mu.Unlock()
+	log.Warn().
+		Err(err).
+		Dur("delay", delay).
+		Msg("Retry failed, report rescheduled")
+}
+
+// delay is the wait after the given number of failed attempts
+func (q *RetryQueue) delay(attempts int) time.Duration {
+	d := q.interval
+	for i := 1; i < attempts && d < q.maxInterval; i++ {
+		d *= 2
+	}
+	return min(d, q.maxInterval)
+}
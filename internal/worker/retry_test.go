@@ -0,0 +1,98 @@
+package worker
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/truemilk/trivelastic/internal/routing"
+)
+
+func TestRetryQueueDelay(t *testing.T) {
+	q, err := NewRetryQueue(10, time.Second, 5*time.Second, time.Hour, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{attempts: 1, want: time.Second},
+		{attempts: 2, want: 2 * time.Second},
+		{attempts: 3, want: 4 * time.Second},
+		{attempts: 4, want: 5 * time.Second},
+		{attempts: 50, want: 5 * time.Second},
+	}
+	for _, tt := range tests {
+		if got := q.delay(tt.attempts); got != tt.want {
+			t.Errorf("delay after %d attempts: expected %s, got %s", tt.attempts, tt.want, got)
+		}
+	}
+}
+
+func TestRetryQueueFull(t *testing.T) {
+	q, err := NewRetryQueue(1, time.Second, time.Second, time.Hour, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !q.Add([]routing.Route{{Index: "trivy"}}) {
+		t.Fatal("report not added to an empty queue")
+	}
+	if q.Add([]routing.Route{{Index: "trivy"}}) {
+		t.Fatal("report added to a full queue")
+	}
+}
+
+func TestRetryQueueSavedOnClose(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "retry-queue.json")
+	q, err := NewRetryQueue(10, time.Hour, time.Hour, time.Hour, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.index = func([]routing.Route) error { return errors.New("unreachable") }
+	q.Start()
+	q.Add([]routing.Route{{Index: "trivy", ID: "1", Document: map[string]interface{}{"ArtifactName": "alpine"}}})
+
+	abandoned, err := q.Close()
+	if err != nil || abandoned != 0 {
+		t.Fatalf("expected the report to be saved, got %d abandoned: %v", abandoned, err)
+	}
+	if q.Add([]routing.Route{{Index: "trivy"}}) {
+		t.Fatal("report added to a closed queue")
+	}
+
+	// The next process retries the report straight away
+	next, err := NewRetryQueue(10, time.Hour, time.Hour, time.Hour, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next.Len() != 1 {
+		t.Fatalf("expected 1 recovered report, got %d", next.Len())
+	}
+	var indexed []routing.Route
+	next.index = func(routes []routing.Route) error {
+		indexed = routes
+		return nil
+	}
+	next.retryDue()
+	if len(indexed) != 1 || indexed[0].ID != "1" || indexed[0].Document["ArtifactName"] != "alpine" {
+		t.Fatalf("recovered report not retried as saved: %+v", indexed)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("expected the file to be removed once loaded, got %v", err)
+	}
+}
+
+func TestRetryQueueAbandonedWithoutPath(t *testing.T) {
+	q, err := NewRetryQueue(10, time.Hour, time.Hour, time.Hour, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.Add([]routing.Route{{Index: "trivy"}})
+
+	if abandoned, err := q.Close(); err != nil || abandoned != 1 {
+		t.Fatalf("expected 1 report abandoned, got %d: %v", abandoned, err)
+	}
+}
@@ -0,0 +1,109 @@
+package worker
+
+import (
+	"time"
+)
+
+// StartScaling adjusts the number of workers every interval, between the
+// bounds given to NewPool. A worker is added for every queued request, unless
+// indexing a report takes longer than maxLatency on average: Elasticsearch
+// is then the bottleneck, and more concurrent requests would only slow it
+// down further. Idle workers are stopped one at a time.
+func (p *Pool) StartScaling(interval, maxLatency time.Duration) {
+	if p.minWorkers == p.maxWorkers {
+		return
+	}
+	p.log.Info().
+		Dur("interval", interval).
+		Dur("max_latency", maxLatency).
+		Msg("Worker scaling enabled")
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			p.scale(maxLatency)
+		}
+	}()
+}
+
+// scale adds or stops workers according to the current load
+func (p *Pool) scale(maxLatency time.Duration) {
+	workers := int(p.workers.Load())
+	queued := int(p.queued.Load())
+	latency := time.Duration(p.latency.Load())
+
+	switch {
+	case queued > 0 && workers < p.maxWorkers:
+		if latency > maxLatency {
+			p.log.Debug().
+				Dur("latency", latency).
+				Int("queued", queued).
+				Msg("Indexing slow, not adding workers")
+			return
+		}
+		added := min(queued, p.maxWorkers-workers)
+		p.addWorkers(added)
+		p.log.Info().
+			Int("workers", workers+added).
+			Int("queued", queued).
+			Dur("latency", latency).
+			Msg("Worker pool scaled up")
+	case queued == 0 && int(p.processing.Load()) < workers && workers > p.minWorkers:
+		// Stops whichever worker is idle, if one still is
+		select {
+		case p.retire <- struct{}{}:
+		default:
+			return
+		}
+		p.workers.Add(-1)
+		p.log.Info().
+			Int("workers", workers-1).
+			Msg("Worker pool scaled down")
+	}
+}
+
+// addWorkers starts n workers
+func (p *Pool) addWorkers(n int) {
+	p.idsMu.Lock()
+	defer p.idsMu.Unlock()
+	for i := 0; i < n; i++ {
+		id := p.nextWorker
+		if len(p.freeIDs) > 0 {
+			id = p.freeIDs[len(p.freeIDs)-1]
+			p.freeIDs = p.freeIDs[:len(p.freeIDs)-1]
+		} else {
+			p.nextWorker++
+		}
+		p.workers.Add(1)
+		go p.worker(id)
+	}
+}
+
+// releaseID makes the ID of a stopped worker available to the next one
+func (p *Pool) releaseID(id int) {
+	p.idsMu.Lock()
+	p.freeIDs = append(p.freeIDs, id)
+	p.idsMu.Unlock()
+}
+
+// observeLatency adds the time taken to index a report since start to the
+// moving average of the pool
+func (p *Pool) observeLatency(start time.Time) {
+	sample := int64(time.Since(start))
+	for {
+		old := p.latency.Load()
+		next := sample
+		if old != 0 {
+			next = old + (sample-old)/5
+		}
+		if p.latency.CompareAndSwap(old, next) {
+			return
+		}
+	}
+}
+
+// Workers is the number of running workers
+func (p *Pool) Workers() int {
+	return int(p.workers.Load())
+}
@@ -0,0 +1,64 @@
+package worker
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScaleUp(t *testing.T) {
+	tests := []struct {
+		name    string
+		queued  int64
+		latency time.Duration
+		want    int
+	}{
+		{name: "one worker per queued request", queued: 2, latency: 10 * time.Millisecond, want: 3},
+		{name: "capped at max workers", queued: 10, latency: 10 * time.Millisecond, want: 4},
+		{name: "blocked by slow indexing", queued: 5, latency: 2 * time.Second, want: 1},
+		{name: "idle at min workers", queued: 0, latency: 10 * time.Millisecond, want: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewPool(1, 4, 10)
+			p.queued.Store(tt.queued)
+			p.latency.Store(int64(tt.latency))
+
+			p.scale(time.Second)
+
+			if got := p.Workers(); got != tt.want {
+				t.Fatalf("expected %d workers, got %d", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestScaleDownToMin(t *testing.T) {
+	p := NewPool(1, 4, 10)
+	p.addWorkers(3)
+
+	// Workers stop one at a time, once they wait for requests
+	deadline := time.Now().Add(5 * time.Second)
+	for p.Workers() > 1 && time.Now().Before(deadline) {
+		p.scale(time.Second)
+		time.Sleep(time.Millisecond)
+	}
+	for i := 0; i < 10; i++ {
+		p.scale(time.Second)
+	}
+
+	if got := p.Workers(); got != 1 {
+		t.Fatalf("expected to scale down to 1 worker, got %d", got)
+	}
+}
+
+func TestScaleDownKeepsBusyWorkers(t *testing.T) {
+	p := NewPool(1, 4, 10)
+	p.addWorkers(1)
+	p.processing.Store(2)
+
+	p.scale(time.Second)
+
+	if got := p.Workers(); got != 2 {
+		t.Fatalf("expected busy workers to be kept, got %d workers", got)
+	}
+}
@@ -0,0 +1,185 @@
+package worker
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/rs/zerolog"
+	"github.com/truemilk/trivelastic/internal/logger"
+)
+
+// spilled is the part of a Request written to disk
+type spilled struct {
+	Body  []byte    `json:"body,omitempty"`
+	Batch []Payload `json:"batch,omitempty"`
+}
+
+// Spill holds the reports of queued requests in temporary files while the
+// worker queue is above its high-water mark, so that traffic spikes are
+// absorbed on disk rather than in memory or rejected. Requests are handed
+// back to the workers in arrival order as the queue drains.
+type Spill struct {
+	dir        string
+	highWater  int
+	maxReports int
+
+	mu sync.Mutex
+	// requests are waiting on disk, oldest first
+	requests []*Request
+	wake     chan struct{}
+	log      zerolog.Logger
+}
+
+// NewSpill creates dir if needed and removes the files left in it by a
+// previous process, whose clients never got an answer. highWater is the
+// queue length above which requests are spilled, at most maxReports of
+// them.
+func NewSpill(dir string, highWater, maxReports int) (*Spill, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, fmt.Errorf("error creating spill directory: %w", err)
+	}
+	s := &Spill{
+		dir:        dir,
+		highWater:  highWater,
+		maxReports: maxReports,
+		wake:       make(chan struct{}, 1),
+		log:        logger.GetLogger("spill"),
+	}
+
+	leftovers, err := filepath.Glob(filepath.Join(dir, "request-*.json"))
+	if err != nil {
+		return nil, fmt.Errorf("error reading spill directory: %w", err)
+	}
+	for _, name := range leftovers {
+		if err := os.Remove(name); err != nil {
+			return nil, fmt.Errorf("error removing spill file: %w", err)
+		}
+	}
+	if len(leftovers) > 0 {
+		s.log.Warn().
+			Int("files", len(leftovers)).
+			Msg("Removed requests spilled by a previous process")
+	}
+	return s, nil
+}
+
+// SetSpill spills queued requests to s while the queue is above its
+// high-water mark, zero meaning full
+func (p *Pool) SetSpill(s *Spill) {
+	if s.highWater <= 0 || s.highWater > cap(p.requests) {
+		s.highWater = cap(p.requests)
+	}
+	p.mu.Lock()
+	p.spill = s
+	p.mu.Unlock()
+	go p.feed(s)
+
+	s.log.Info().
+		Str("dir", s.dir).
+		Int("high_water", s.highWater).
+		Int("max_reports", s.maxReports).
+		Msg("Queue spilling enabled")
+}
+
+// Len is the number of requests waiting on disk
+func (s *Spill) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.requests)
+}
+
+// push writes the reports of req to disk when the queue of length queued is
+// above the high-water mark, when the memory budget of the pool is exceeded,
+// or when earlier requests are still spilled. It returns false when req is
+// to be queued in memory.
+func (s *Spill) push(req *Request, queued int, overBudget bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.requests) == 0 && queued < s.highWater && !overBudget || len(s.requests) >= s.maxReports {
+		return false
+	}
+
+	file, err := os.CreateTemp(s.dir, "request-*.json")
+	if err != nil {
+		s.log.Error().
+			Err(err).
+			Msg("Failed to create spill file")
+		return false
+	}
+	err = json.NewEncoder(file).Encode(spilled{Body: req.Body, Batch: req.Batch})
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		s.log.Error().
+			Err(err).
+			Msg("Failed to write spill file")
+		return false
+	}
+
+	// The reports are read back once the request is handed to a worker
+	req.spillFile, req.Body = file.Name(), nil
+	if req.Batch != nil {
+		req.Batch = []Payload{}
+	}
+	s.requests = append(s.requests, req)
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// next returns the oldest spilled request, nil when none is spilled
+func (s *Spill) next() *Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.requests) == 0 {
+		return nil
+	}
+	return s.requests[0]
+}
+
+// pop removes the oldest spilled request, returned by next, and reads its
+// reports back
+func (s *Spill) pop() *Request {
+	s.mu.Lock()
+	req := s.requests[0]
+	s.requests = s.requests[1:]
+	s.mu.Unlock()
+
+	data, err := os.ReadFile(req.spillFile)
+	os.Remove(req.spillFile)
+	var content spilled
+	if err == nil {
+		err = json.Unmarshal(data, &content)
+	}
+	if err != nil {
+		s.log.Error().
+			Err(err).
+			Str("file", req.spillFile).
+			Msg("Failed to read spill file")
+		req.spillErr = err
+		return req
+	}
+	req.Body = content.Body
+	if req.Batch != nil {
+		req.Batch = content.Batch
+	}
+	return req
+}
+
+// feed hands the requests spilled to s back to the workers as room frees up
+// in the queue and in the memory budget
+func (p *Pool) feed(s *Spill) {
+	for range s.wake {
+		for req := s.next(); req != nil; req = s.next() {
+			p.acquire(req.size)
+			p.requests <- s.pop()
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/truemilk/trivelastic/internal/metrics"
+	"github.com/truemilk/trivelastic/internal/pipeline"
+)
+
+// Response is the answer to a Request, written to the client by the
+// goroutine serving the HTTP request
+type Response struct {
+	// Status is the status code, zero for 200
+	Status int
+	Header map[string]string
+	// Body is encoded as JSON
+	Body interface{}
+	// Error is written as plain text instead of Body when set
+	Error string
+}
+
+// ErrorResponse answers with a plain text error
+func ErrorResponse(status int, message string) *Response {
+	return &Response{Status: status, Error: message}
+}
+
+// cancelledResponse answers a request whose context is done. The client
+// is usually gone, but a deadline set by a proxy or an embedding service may
+// have passed while the connection is still open.
+func cancelledResponse(err error) *Response {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return ErrorResponse(http.StatusGatewayTimeout, "Request deadline exceeded")
+	}
+	return ErrorResponse(http.StatusServiceUnavailable, "Request cancelled")
+}
+
+func (resp *Response) write(w http.ResponseWriter) {
+	for key, value := range resp.Header {
+		w.Header().Set(key, value)
+	}
+	if resp.Error != "" {
+		http.Error(w, resp.Error, resp.Status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if resp.Status != 0 {
+		w.WriteHeader(resp.Status)
+	}
+	json.NewEncoder(w).Encode(resp.Body)
+}
+
+// Submit processes the request with the default pipeline
+func (p *Pool) Submit(w http.ResponseWriter, r *http.Request) {
+	p.mu.RLock()
+	pl := p.pipeline
+	p.mu.RUnlock()
+	p.SubmitTo(pl, w, r)
+}
+
+// SubmitTo processes the request with the given pipeline. The body is read
+// here, and the report is handed to a worker with the metadata of the
+// request.
+func (p *Pool) SubmitTo(pl *pipeline.Pipeline, w http.ResponseWriter, r *http.Request) {
+	p.log.Debug().
+		Str("method", r.Method).
+		Str("path", r.URL.Path).
+		Str("remote_addr", r.RemoteAddr).
+		Msg("Submitting request to worker pool")
+
+	// Only process POST requests with JSON
+	if r.Method != http.MethodPost {
+		p.log.Warn().
+			Str("method", r.Method).
+			Msg("Invalid HTTP method")
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Read the raw JSON body
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		p.log.Error().
+			Err(err).
+			Msg("Failed to read request body")
+		http.Error(w, "Error reading body: "+err.Error(), readStatus(err))
+		return
+	}
+	metrics.PayloadSize.Observe(float64(len(body)))
+
+	p.mu.RLock()
+	async := p.jobs != nil && asyncRequested(r, p.async)
+	p.mu.RUnlock()
+	req := NewRequest(r.Context(), body, pipeline.RequestFields(r), pl)
+	req.Async = async
+	p.submit(w, r, req)
+}
+
+// readStatus is the status code answering a body that could not be read
+func readStatus(err error) int {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
+
+// submit queues req and writes the answer of its worker to w. A payload
+// already stored is answered from the idempotency cache instead.
+func (p *Pool) submit(w http.ResponseWriter, r *http.Request, req *Request) {
+	p.mu.RLock()
+	cache := p.idempotency
+	p.mu.RUnlock()
+	settle := func(*Response) {}
+	if cache != nil {
+		replay, begun := cache.begin(r.Context(), idempotencyKey(r.URL.Path, req))
+		if replay != nil {
+			p.log.Debug().
+				Str("path", r.URL.Path).
+				Msg("Payload already stored, answer replayed")
+			replay.write(w)
+			return
+		}
+		if begun != nil {
+			settle = begun
+		}
+	}
+
+	if !p.enqueue(w, r, req) {
+		settle(nil)
+		return
+	}
+	// Wait for the request to be processed
+	resp := req.Wait()
+	settle(resp)
+	resp.write(w)
+}
+
+// enqueue hands req to the workers, waiting up to the queue timeout while
+// the queue is full. Requests still not queued then are answered with 429
+// and a Retry-After header, and requests cancelled meanwhile according to
+// their context. enqueue returns false when req was not queued.
+func (p *Pool) enqueue(w http.ResponseWriter, r *http.Request, req *Request) bool {
+	// Held while queueing, so that Shutdown waits for every queued request
+	p.closeMu.RLock()
+	defer p.closeMu.RUnlock()
+	if p.closing {
+		http.Error(w, "Server shutting down", http.StatusServiceUnavailable)
+		return false
+	}
+
+	p.pending.Add(1)
+	p.queued.Add(1)
+	req.size = req.payloadSize()
+	reserved := p.reserve(req.size)
+	p.mu.RLock()
+	spill, timeout := p.spill, p.queueTimeout
+	p.mu.RUnlock()
+	if spill != nil && spill.push(req, len(p.requests), !reserved) {
+		// The payload is on disk until the request is fed back to the workers
+		if reserved {
+			p.release(req.size)
+		}
+		return true
+	}
+
+	if reserved {
+		select {
+		case p.requests <- req:
+			return true
+		default:
+		}
+		if timeout > 0 {
+			timer := time.NewTimer(timeout)
+			defer timer.Stop()
+			select {
+			case p.requests <- req:
+				return true
+			case <-timer.C:
+			case <-r.Context().Done():
+				// The client gave up, the queue is not to blame
+				p.release(req.size)
+				p.queued.Add(-1)
+				p.pending.Done()
+				p.log.Warn().
+					Err(r.Context().Err()).
+					Str("path", r.URL.Path).
+					Str("remote_addr", r.RemoteAddr).
+					Msg("Request cancelled while waiting for room in the queue")
+				cancelledResponse(r.Context().Err()).write(w)
+				return false
+			}
+		}
+		p.release(req.size)
+	}
+	p.queued.Add(-1)
+	p.pending.Done()
+
+	retryAfter := max(1, int(math.Ceil(timeout.Seconds())))
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	if !reserved {
+		p.log.Warn().
+			Str("path", r.URL.Path).
+			Str("remote_addr", r.RemoteAddr).
+			Int64("size", req.size).
+			Int64("queued_bytes", p.bytes.Load()).
+			Msg("Worker queue memory budget exceeded, request rejected")
+		metrics.QueueRejected.Inc()
+		http.Error(w, "Too much data queued, retry later", http.StatusTooManyRequests)
+		return false
+	}
+	p.log.Warn().
+		Str("path", r.URL.Path).
+		Str("remote_addr", r.RemoteAddr).
+		Msg("Worker queue full, request rejected")
+	metrics.QueueRejected.Inc()
+	http.Error(w, "Too many requests queued, retry later", http.StatusTooManyRequests)
+	return false
+}
@@ -0,0 +1,111 @@
+package worker
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/truemilk/trivelastic/internal/metrics"
+)
+
+// queueRejected returns the value of the queue rejection counter
+func queueRejected(t *testing.T) int {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	scanner := bufio.NewScanner(rec.Body)
+	for scanner.Scan() {
+		if value, ok := strings.CutPrefix(scanner.Text(), "trivelastic_worker_queue_rejected_total "); ok {
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return n
+		}
+	}
+	t.Fatal("queue rejection counter not found")
+	return 0
+}
+
+func TestEnqueue(t *testing.T) {
+	expired, cancelExpired := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancelExpired()
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		name         string
+		ctx          context.Context
+		queueTimeout time.Duration
+		maxBytes     int64
+		body         string
+		status       int
+		retryAfter   string
+		rejected     int
+	}{
+		{name: "full queue", ctx: context.Background(), body: "{}", status: http.StatusTooManyRequests, retryAfter: "1", rejected: 1},
+		{name: "full queue after timeout", ctx: context.Background(), queueTimeout: 1500 * time.Millisecond, body: "{}", status: http.StatusTooManyRequests, retryAfter: "2", rejected: 1},
+		{name: "memory budget exceeded", ctx: context.Background(), maxBytes: 4, body: "{\"a\":1}", status: http.StatusTooManyRequests, retryAfter: "1", rejected: 1},
+		{name: "cancelled while waiting", ctx: cancelled, queueTimeout: time.Minute, body: "{}", status: http.StatusServiceUnavailable},
+		{name: "deadline passed while waiting", ctx: expired, queueTimeout: time.Minute, body: "{}", status: http.StatusGatewayTimeout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// No workers, so that the single slot of the queue stays taken
+			p := NewPool(0, 0, 1)
+			p.SetQueueTimeout(tt.queueTimeout)
+			p.SetMaxBytes(tt.maxBytes)
+			first := httptest.NewRequest(http.MethodPost, "/v1/reports", nil)
+			if !p.enqueue(httptest.NewRecorder(), first, NewRequest(context.Background(), []byte("{}"), nil, nil)) {
+				t.Fatal("first request not queued")
+			}
+			before := queueRejected(t)
+
+			r := httptest.NewRequest(http.MethodPost, "/v1/reports", nil).WithContext(tt.ctx)
+			rec := httptest.NewRecorder()
+			queued := p.enqueue(rec, r, NewRequest(tt.ctx, []byte(tt.body), nil, nil))
+
+			if queued {
+				t.Fatal("request queued in a full queue")
+			}
+			if rec.Code != tt.status {
+				t.Fatalf("expected status %d, got %d: %s", tt.status, rec.Code, rec.Body)
+			}
+			if got := rec.Header().Get("Retry-After"); got != tt.retryAfter {
+				t.Fatalf("expected Retry-After %q, got %q", tt.retryAfter, got)
+			}
+			if got := queueRejected(t) - before; got != tt.rejected {
+				t.Fatalf("expected %d rejections counted, got %d", tt.rejected, got)
+			}
+			if depth := p.QueueDepth(); depth != 1 {
+				t.Fatalf("expected only the first request queued, got %d", depth)
+			}
+			if held := p.QueueBytes(); held != 2 {
+				t.Fatalf("expected only the bytes of the first request held, got %d", held)
+			}
+		})
+	}
+}
+
+func TestEnqueueWaitsForRoom(t *testing.T) {
+	p := NewPool(0, 0, 1)
+	p.SetQueueTimeout(time.Minute)
+	r := httptest.NewRequest(http.MethodPost, "/v1/reports", nil)
+	if !p.enqueue(httptest.NewRecorder(), r, NewRequest(context.Background(), []byte("{}"), nil, nil)) {
+		t.Fatal("first request not queued")
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		<-p.requests
+	}()
+	rec := httptest.NewRecorder()
+	if !p.enqueue(rec, r, NewRequest(context.Background(), []byte("{}"), nil, nil)) {
+		t.Fatalf("request not queued once room was made: %d %s", rec.Code, rec.Body)
+	}
+}
@@ -23,9 +23,9 @@ type ElasticsearchConfig struct {
 
 // Get Elasticsearch config from environment variables
 func getESConfig() (*ElasticsearchConfig, error) {
-	url := os.Getenv("ES_URL")
-	apiKey := os.Getenv("ES_API_KEY")
-	index := os.Getenv("ES_INDEX")
+	url := getenv("ES_URL")
+	apiKey := getenv("ES_API_KEY")
+	index := getenv("ES_INDEX")
 
 	if url == "" || apiKey == "" || index == "" {
 		return nil, fmt.Errorf("missing required environment variables: ES_URL, ES_API_KEY, ES_INDEX")
@@ -278,8 +278,8 @@ func handler(requests chan<- *Request) http.HandlerFunc {
 func main() {
 	// Initialize logger
 	err := logger.Initialize(logger.Config{
-		Level:      os.Getenv("LOG_LEVEL"),
-		JSONFormat: os.Getenv("LOG_FORMAT") == "json",
+		Level:      getenv("LOG_LEVEL"),
+		JSONFormat: getenv("LOG_FORMAT") == "json",
 	})
 	if err != nil {
 		fmt.Printf("Failed to initialize logger: %v\n", err)
@@ -288,7 +288,7 @@ func main() {
 
 	log := logger.GetLogger("main")
 
-	port := os.Getenv("PORT")
+	port := getenv("PORT")
 	if port == "" {
 		port = "8080"
 	}
@@ -303,14 +303,24 @@ func main() {
 	}
 
 	// Set up the HTTP server with the concurrent handler
-	http.HandleFunc("/", handler(requests))
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", handler(requests))
 
 	log.Info().
 		Str("port", port).
 		Int("workers", numWorkers).
 		Msg("Server starting")
 
-	if err := http.ListenAndServe(":"+port, nil); err != nil {
+	if err := http.ListenAndServe(":"+port, mux); err != nil {
 		log.Fatal().Err(err).Msg("Server failed to start")
 	}
 }
+
+// getenv returns the TRIVELASTIC_ prefixed variable name, or the unprefixed
+// alias when the prefixed one is not set
+func getenv(name string) string {
+	if value, ok := os.LookupEnv("TRIVELASTIC_" + name); ok {
+		return value
+	}
+	return os.Getenv(name)
+}
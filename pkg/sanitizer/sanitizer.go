@@ -115,3 +115,45 @@ func sanitizeArray(arr []interface{}) []interface{} {
 
 	return result
 }
+
+// SanitizeKeys only removes the fields Elasticsearch cannot index (dot keys and
+// empty date fields), leaving every other value untouched
+func SanitizeKeys(data map[string]interface{}) map[string]interface{} {
+	log := logger.GetLogger("sanitizer")
+	log.Debug().Msg("Starting key sanitization")
+
+	result := make(map[string]interface{}, len(data))
+	for key, value := range data {
+		// Skip fields that are just dots
+		if key == "." || key == ".." {
+			log.Debug().Str("key", key).Msg("Skipping dot field")
+			continue
+		}
+
+		// Handle empty date fields
+		if key == "lastModifiedDate" && (value == "" || value == nil) {
+			log.Debug().Str("key", key).Msg("Skipping empty date field")
+			continue
+		}
+
+		result[key] = sanitizeKeysValue(value)
+	}
+
+	return result
+}
+
+// sanitizeKeysValue applies SanitizeKeys to objects nested at any depth
+func sanitizeKeysValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return SanitizeKeys(v)
+	case []interface{}:
+		result := make([]interface{}, len(v))
+		for i, item := range v {
+			result[i] = sanitizeKeysValue(item)
+		}
+		return result
+	default:
+		return value
+	}
+}
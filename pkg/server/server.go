@@ -0,0 +1,191 @@
+// Package server embeds trivelastic's ingestion pipeline in another Go
+// service. The returned Server can either listen on its own or expose its
+// routes through Handler so they can be mounted behind the host's router.
+package server
+
+import (
+	"context"
+	"net"
+	"net/http"
+
+	"github.com/rs/zerolog"
+	"github.com/truemilk/trivelastic/internal/config"
+	"github.com/truemilk/trivelastic/internal/handler"
+	"github.com/truemilk/trivelastic/internal/logger"
+	"github.com/truemilk/trivelastic/internal/pipeline"
+	"github.com/truemilk/trivelastic/internal/worker"
+)
+
+type (
+	// Config is the trivelastic configuration, usually obtained from LoadConfig
+	Config = config.Config
+	// ValidationError lists every invalid option found by LoadConfig
+	ValidationError = config.ValidationError
+	// Transform is a processing step applied to every document
+	Transform = pipeline.Transform
+	// ContextTransform is a Transform given the context of the request
+	ContextTransform = pipeline.ContextTransform
+	// Warning is a problem reported by a Transform
+	Warning = pipeline.Warning
+	// Sink receives processed documents instead of Elasticsearch
+	Sink = worker.Sink
+	// Processor handles every request taken by a worker, see WrapProcessor
+	Processor = worker.Processor
+	// ProcessorFunc adapts a function to Processor
+	ProcessorFunc = worker.ProcessorFunc
+	// Request is a report handed to a Processor
+	Request = worker.Request
+	// Response is the answer of a Processor to a Request
+	Response = worker.Response
+)
+
+// Option configures a Server
+type Option func(*options)
+
+type options struct {
+	workers    int
+	listener   net.Listener
+	sink       Sink
+	transforms []Transform
+	wrap       func(Processor) Processor
+	routes     []route
+	logger     *zerolog.Logger
+}
+
+type route struct {
+	pattern string
+	handler http.Handler
+}
+
+// WithWorkers sets a fixed number of pipeline workers. By default the
+// number of workers scales within the configured bounds.
+func WithWorkers(n int) Option {
+	return func(o *options) {
+		o.workers = n
+	}
+}
+
+// WithListener serves on l when ListenAndServe is called, instead of the configured port
+func WithListener(l net.Listener) Option {
+	return func(o *options) {
+		o.listener = l
+	}
+}
+
+// WithSink sends processed documents to sink instead of Elasticsearch
+func WithSink(sink Sink) Option {
+	return func(o *options) {
+		o.sink = sink
+	}
+}
+
+// WithTransforms appends transforms to the built-in processing chain
+func WithTransforms(transforms ...Transform) Option {
+	return func(o *options) {
+		o.transforms = append(o.transforms, transforms...)
+	}
+}
+
+// WrapProcessor replaces the processing of every request by wrap(next),
+// where next is the default processor running the pipeline and writing to
+// the sink. wrap may call next, e.g. to enrich requests or inspect answers,
+// or replace it altogether.
+func WrapProcessor(wrap func(next Processor) Processor) Option {
+	return func(o *options) {
+		o.wrap = wrap
+	}
+}
+
+// NewRequest returns a request for the report in body, to exercise a
+// Processor outside of a server. Its answer is read with Wait.
+func NewRequest(ctx context.Context, body []byte) *Request {
+	return worker.NewRequest(ctx, body, nil, nil)
+}
+
+// WithRoute serves h at pattern next to the built-in routes, behind the same
+// authentication and other middleware. See http.ServeMux for the pattern syntax.
+func WithRoute(pattern string, h http.Handler) Option {
+	return func(o *options) {
+		o.routes = append(o.routes, route{pattern: pattern, handler: h})
+	}
+}
+
+// WithLogger makes trivelastic log through l
+func WithLogger(l zerolog.Logger) Option {
+	return func(o *options) {
+		o.logger = &l
+	}
+}
+
+// Server is an embeddable trivelastic instance
+type Server struct {
+	handler *handler.Server
+}
+
+// LoadConfig reads the configuration from the environment
+func LoadConfig() (*Config, error) {
+	return config.Load()
+}
+
+// New wires the ingestion pipeline. The routes are ready to be served
+// through Handler as soon as New returns.
+func New(cfg *Config, opts ...Option) (*Server, error) {
+	o := &options{}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	// The logger must be replaced before any component creates its own
+	if o.logger != nil {
+		logger.SetLogger(*o.logger)
+	}
+
+	minWorkers, maxWorkers := cfg.Workers.Bounds()
+	if o.workers > 0 {
+		minWorkers, maxWorkers = o.workers, o.workers
+	}
+	pool := worker.NewPool(minWorkers, maxWorkers, cfg.Queue.Size)
+	if o.wrap != nil {
+		pool.SetProcessor(o.wrap(pool))
+	}
+	s := handler.NewServer(cfg, pool)
+	if o.sink != nil {
+		s.SetSink(o.sink)
+	}
+	if o.listener != nil {
+		s.SetListener(o.listener)
+	}
+	s.AddTransforms(o.transforms...)
+	for _, r := range o.routes {
+		s.Handle(r.pattern, r.handler)
+	}
+
+	if err := s.Init(); err != nil {
+		return nil, err
+	}
+
+	return &Server{handler: s}, nil
+}
+
+// Ingest processes the report in body in the calling goroutine and returns
+// the answer once it is written, as POST /v1/reports would with async=false.
+// Authentication and the other middleware of the HTTP routes do not apply.
+func (s *Server) Ingest(ctx context.Context, body []byte) *Response {
+	return s.handler.Ingest(ctx, body)
+}
+
+// Handler returns the HTTP handler serving every trivelastic route
+func (s *Server) Handler() http.Handler {
+	return s.handler.Handler()
+}
+
+// ListenAndServe serves the routes on the configured listener or port
+func (s *Server) ListenAndServe() error {
+	return s.handler.Start()
+}
+
+// Shutdown stops serving and waits for the reports in progress until ctx is
+// done. ListenAndServe returns nil once it is called.
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.handler.Shutdown(ctx)
+}
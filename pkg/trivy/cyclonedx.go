@@ -0,0 +1,163 @@
+package trivy
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// CycloneDXFormat is the bomFormat of CycloneDX JSON documents
+const CycloneDXFormat = "CycloneDX"
+
+// CycloneDX component types used by Trivy for the targets of a scan
+const (
+	ComponentOperatingSystem = "operating-system"
+	ComponentApplication     = "application"
+)
+
+// CycloneDXSeverities are the severities of CycloneDX vulnerability ratings
+var CycloneDXSeverities = []string{"critical", "high", "medium", "low", "info", "none", "unknown"}
+
+// BOM is a CycloneDX JSON document, as written by
+// `trivy image --format cyclonedx` or `trivy sbom`
+type BOM struct {
+	BOMFormat    string `json:"bomFormat"`
+	SpecVersion  string `json:"specVersion"`
+	SerialNumber string `json:"serialNumber"`
+	Version      int    `json:"version"`
+	Metadata     struct {
+		Timestamp *time.Time `json:"timestamp"`
+		Component *Component `json:"component"`
+	} `json:"metadata"`
+	Components      []Component              `json:"components"`
+	Dependencies    []Dependency             `json:"dependencies"`
+	Vulnerabilities []CycloneDXVulnerability `json:"vulnerabilities"`
+}
+
+// Component is a software component of a BOM, such as a package or the
+// operating system it is installed on
+type Component struct {
+	BOMRef     string      `json:"bom-ref"`
+	Type       string      `json:"type"`
+	Name       string      `json:"name"`
+	Group      string      `json:"group"`
+	Version    string      `json:"version"`
+	PURL       string      `json:"purl"`
+	Licenses   []LicenseOf `json:"licenses"`
+	Properties []Property  `json:"properties"`
+}
+
+// LicenseOf is a license entry of a component: a license or an SPDX expression
+type LicenseOf struct {
+	License *struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	} `json:"license"`
+	Expression string `json:"expression"`
+}
+
+// Property is a name-value pair attached to a component. Trivy prefixes its
+// own properties with "aquasecurity:trivy:".
+type Property struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// Dependency lists the components a component depends on
+type Dependency struct {
+	Ref       string   `json:"ref"`
+	DependsOn []string `json:"dependsOn"`
+}
+
+// CycloneDXVulnerability is a vulnerability affecting components of a BOM
+type CycloneDXVulnerability struct {
+	ID     string `json:"id"`
+	Source *struct {
+		Name string `json:"name"`
+		URL  string `json:"url"`
+	} `json:"source"`
+	Ratings []struct {
+		Source *struct {
+			Name string `json:"name"`
+		} `json:"source"`
+		Score    *float64 `json:"score"`
+		Severity string   `json:"severity"`
+		Method   string   `json:"method"`
+		Vector   string   `json:"vector"`
+	} `json:"ratings"`
+	CWEs           []int  `json:"cwes"`
+	Description    string `json:"description"`
+	Recommendation string `json:"recommendation"`
+	Advisories     []struct {
+		URL string `json:"url"`
+	} `json:"advisories"`
+	Published *time.Time `json:"published"`
+	Updated   *time.Time `json:"updated"`
+	Affects   []struct {
+		Ref string `json:"ref"`
+	} `json:"affects"`
+}
+
+// IsCycloneDX reports whether data looks like a CycloneDX JSON document
+func IsCycloneDX(data []byte) bool {
+	var probe struct {
+		BOMFormat string `json:"bomFormat"`
+	}
+	if err := json.Unmarshal(data, &probe); err != nil {
+		return false
+	}
+	return probe.BOMFormat == CycloneDXFormat
+}
+
+// ParseCycloneDX decodes a CycloneDX JSON document and validates it, like Parse
+func ParseCycloneDX(data []byte) (*BOM, error) {
+	var bom BOM
+	if err := decode(data, &bom); err != nil {
+		return nil, err
+	}
+	if err := bom.Validate(); err != nil {
+		return nil, err
+	}
+	return &bom, nil
+}
+
+// Validate checks the fields needed to index the BOM and returns a
+// *ValidationError listing everything that is missing or invalid
+func (b *BOM) Validate() error {
+	problems := &ValidationError{}
+	if b.BOMFormat != CycloneDXFormat {
+		problems.add("bomFormat", "expected %s, got %q", CycloneDXFormat, b.BOMFormat)
+	}
+	if b.SpecVersion == "" {
+		problems.add("specVersion", "is required")
+	}
+	if b.Metadata.Component == nil || b.Metadata.Component.Name == "" {
+		problems.add("metadata.component.name", "is required")
+	}
+	for i, c := range b.Components {
+		if c.Name == "" {
+			problems.add(fmt.Sprintf("components[%d].name", i), "is required")
+		}
+	}
+	for i, v := range b.Vulnerabilities {
+		field := fmt.Sprintf("vulnerabilities[%d]", i)
+		if v.ID == "" {
+			problems.add(field+".id", "is required")
+		}
+		for j, r := range v.Ratings {
+			if r.Severity == "" {
+				continue
+			}
+			if !slices.Contains(CycloneDXSeverities, r.Severity) {
+				problems.add(fmt.Sprintf("%s.ratings[%d].severity", field, j), "unknown severity %q, expected one of %s", r.Severity, strings.Join(CycloneDXSeverities, ", "))
+			}
+		}
+	}
+
+	if len(problems.Problems) == 0 {
+		return nil
+	}
+	return problems
+}
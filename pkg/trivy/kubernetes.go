@@ -0,0 +1,70 @@
+package trivy
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// KubernetesReport is the report written by `trivy k8s --format json`
+type KubernetesReport struct {
+	ClusterName string     `json:"ClusterName"`
+	Resources   []Resource `json:"Resources"`
+}
+
+// Resource holds the findings for one Kubernetes resource
+type Resource struct {
+	Namespace string `json:"Namespace"`
+	Kind      string `json:"Kind"`
+	Name      string `json:"Name"`
+	// Metadata describes the images of the resource's containers
+	Metadata []Metadata `json:"Metadata"`
+	Results  []Result   `json:"Results"`
+	// Error is set when the resource could not be scanned
+	Error string `json:"Error"`
+}
+
+// IsKubernetesReport reports whether data looks like a Kubernetes cluster
+// report rather than an artifact report
+func IsKubernetesReport(data []byte) bool {
+	var probe struct {
+		ArtifactName string          `json:"ArtifactName"`
+		Resources    json.RawMessage `json:"Resources"`
+	}
+	if err := json.Unmarshal(data, &probe); err != nil {
+		return false
+	}
+	return probe.ArtifactName == "" && len(probe.Resources) > 0 && string(probe.Resources) != "null"
+}
+
+// ParseKubernetes decodes a Trivy Kubernetes report and validates it, like Parse
+func ParseKubernetes(data []byte) (*KubernetesReport, error) {
+	var report KubernetesReport
+	if err := decode(data, &report); err != nil {
+		return nil, err
+	}
+	if err := report.Validate(); err != nil {
+		return nil, err
+	}
+	return &report, nil
+}
+
+// Validate checks that every resource is identified and returns a
+// *ValidationError listing everything that is missing or invalid
+func (r *KubernetesReport) Validate() error {
+	problems := &ValidationError{}
+	for i, resource := range r.Resources {
+		path := fmt.Sprintf("Resources[%d]", i)
+		if resource.Kind == "" {
+			problems.add(path+".Kind", "is required")
+		}
+		if resource.Name == "" {
+			problems.add(path+".Name", "is required")
+		}
+		validateResults(problems, path+".", resource.Results)
+	}
+
+	if len(problems.Problems) == 0 {
+		return nil
+	}
+	return problems
+}
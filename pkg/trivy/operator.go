@@ -0,0 +1,173 @@
+package trivy
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// OperatorGroup is the API group of the Trivy Operator custom resources
+const OperatorGroup = "aquasecurity.github.io"
+
+// Trivy Operator report kinds
+const (
+	KindVulnerabilityReport = "VulnerabilityReport"
+	KindConfigAuditReport   = "ConfigAuditReport"
+)
+
+// OperatorResource is a Trivy Operator custom resource, or a list of them as
+// returned by `kubectl get -o json`
+type OperatorResource struct {
+	APIVersion string             `json:"apiVersion"`
+	Kind       string             `json:"kind"`
+	Metadata   ObjectMeta         `json:"metadata"`
+	Report     OperatorReport     `json:"report"`
+	Items      []OperatorResource `json:"items"`
+}
+
+// ObjectMeta is the part of the Kubernetes object metadata used by trivelastic
+type ObjectMeta struct {
+	Name      string            `json:"name"`
+	Namespace string            `json:"namespace"`
+	Labels    map[string]string `json:"labels"`
+}
+
+// OperatorReport is the report section of a VulnerabilityReport or a ConfigAuditReport
+type OperatorReport struct {
+	UpdateTimestamp time.Time `json:"updateTimestamp"`
+	Scanner         struct {
+		Name    string `json:"name"`
+		Vendor  string `json:"vendor"`
+		Version string `json:"version"`
+	} `json:"scanner"`
+	Registry struct {
+		Server string `json:"server"`
+	} `json:"registry"`
+	Artifact struct {
+		Repository string `json:"repository"`
+		Tag        string `json:"tag"`
+		Digest     string `json:"digest"`
+	} `json:"artifact"`
+	OS struct {
+		Family string `json:"family"`
+		Name   string `json:"name"`
+		EOSL   bool   `json:"eosl"`
+	} `json:"os"`
+	Vulnerabilities []OperatorVulnerability `json:"vulnerabilities"`
+	Checks          []OperatorCheck         `json:"checks"`
+}
+
+// OperatorVulnerability is a vulnerability in a VulnerabilityReport
+type OperatorVulnerability struct {
+	VulnerabilityID  string   `json:"vulnerabilityID"`
+	Resource         string   `json:"resource"`
+	InstalledVersion string   `json:"installedVersion"`
+	FixedVersion     string   `json:"fixedVersion"`
+	Severity         string   `json:"severity"`
+	Score            *float64 `json:"score"`
+	Title            string   `json:"title"`
+	Description      string   `json:"description"`
+	PrimaryLink      string   `json:"primaryLink"`
+	Links            []string `json:"links"`
+	Target           string   `json:"target"`
+	Class            string   `json:"class"`
+	PackageType      string   `json:"packageType"`
+	PkgPath          string   `json:"pkgPath"`
+}
+
+// OperatorCheck is a configuration check in a ConfigAuditReport
+type OperatorCheck struct {
+	CheckID     string   `json:"checkID"`
+	Title       string   `json:"title"`
+	Description string   `json:"description"`
+	Severity    string   `json:"severity"`
+	Category    string   `json:"category"`
+	Success     bool     `json:"success"`
+	Messages    []string `json:"messages"`
+	Remediation string   `json:"remediation"`
+}
+
+// IsOperatorResource reports whether data looks like a Trivy Operator custom
+// resource or a list of them
+func IsOperatorResource(data []byte) bool {
+	var probe struct {
+		APIVersion string `json:"apiVersion"`
+		Items      []struct {
+			APIVersion string `json:"apiVersion"`
+		} `json:"items"`
+	}
+	if err := json.Unmarshal(data, &probe); err != nil {
+		return false
+	}
+	if len(probe.Items) > 0 {
+		return isOperatorAPIVersion(probe.Items[0].APIVersion)
+	}
+	return isOperatorAPIVersion(probe.APIVersion)
+}
+
+func isOperatorAPIVersion(apiVersion string) bool {
+	return strings.HasPrefix(apiVersion, OperatorGroup+"/")
+}
+
+// ParseOperator decodes a Trivy Operator custom resource and validates it, like Parse
+func ParseOperator(data []byte) (*OperatorResource, error) {
+	var resource OperatorResource
+	if err := decode(data, &resource); err != nil {
+		return nil, err
+	}
+	if err := resource.Validate(); err != nil {
+		return nil, err
+	}
+	return &resource, nil
+}
+
+// Validate checks that every resource is a supported report and returns a
+// *ValidationError listing everything that is missing or invalid
+func (r *OperatorResource) Validate() error {
+	problems := &ValidationError{}
+	if len(r.Items) > 0 {
+		for i, item := range r.Items {
+			item.validate(problems, fmt.Sprintf("items[%d].", i))
+		}
+	} else {
+		r.validate(problems, "")
+	}
+
+	if len(problems.Problems) == 0 {
+		return nil
+	}
+	return problems
+}
+
+func (r *OperatorResource) validate(problems *ValidationError, prefix string) {
+	if r.Kind != KindVulnerabilityReport && r.Kind != KindConfigAuditReport {
+		problems.add(prefix+"kind", "unsupported kind %q, expected %s or %s", r.Kind, KindVulnerabilityReport, KindConfigAuditReport)
+	}
+	if r.Metadata.Name == "" {
+		problems.add(prefix+"metadata.name", "is required")
+	}
+
+	severity := func(field, value string) {
+		if _, ok := SeverityScore(value); !ok {
+			problems.add(field, "unknown severity %q, expected one of %s", value, strings.Join(Severities, ", "))
+		}
+	}
+	for i, v := range r.Report.Vulnerabilities {
+		field := fmt.Sprintf("%sreport.vulnerabilities[%d]", prefix, i)
+		if v.VulnerabilityID == "" {
+			problems.add(field+".vulnerabilityID", "is required")
+		}
+		if v.Resource == "" {
+			problems.add(field+".resource", "is required")
+		}
+		severity(field+".severity", v.Severity)
+	}
+	for i, c := range r.Report.Checks {
+		field := fmt.Sprintf("%sreport.checks[%d]", prefix, i)
+		if c.CheckID == "" {
+			problems.add(field+".checkID", "is required")
+		}
+		severity(field+".severity", c.Severity)
+	}
+}
@@ -0,0 +1,180 @@
+// Package trivy describes the JSON report written by `trivy --format json`
+// (schema version 2) and validates payloads against it.
+package trivy
+
+import (
+	"encoding/json"
+	"slices"
+	"strings"
+	"time"
+)
+
+// SchemaVersion is the report schema version this package understands
+const SchemaVersion = 2
+
+// Severities reported by Trivy, from least to most severe
+const (
+	SeverityUnknown  = "UNKNOWN"
+	SeverityLow      = "LOW"
+	SeverityMedium   = "MEDIUM"
+	SeverityHigh     = "HIGH"
+	SeverityCritical = "CRITICAL"
+)
+
+// Severities lists every severity, from least to most severe
+var Severities = []string{SeverityUnknown, SeverityLow, SeverityMedium, SeverityHigh, SeverityCritical}
+
+// SeverityScore ranks severity from 0 (UNKNOWN) to 4 (CRITICAL), ignoring
+// case. It returns false for a value that is not a Trivy severity.
+func SeverityScore(severity string) (int, bool) {
+	score := slices.Index(Severities, strings.ToUpper(severity))
+	return score, score >= 0
+}
+
+// Report is a Trivy scan report
+type Report struct {
+	SchemaVersion int       `json:"SchemaVersion"`
+	CreatedAt     time.Time `json:"CreatedAt"`
+	ArtifactName  string    `json:"ArtifactName"`
+	ArtifactType  string    `json:"ArtifactType"`
+	Metadata      Metadata  `json:"Metadata"`
+	Results       []Result  `json:"Results"`
+}
+
+// Metadata describes the scanned artifact
+type Metadata struct {
+	Size        int64    `json:"Size"`
+	OS          *OS      `json:"OS"`
+	ImageID     string   `json:"ImageID"`
+	DiffIDs     []string `json:"DiffIDs"`
+	RepoTags    []string `json:"RepoTags"`
+	RepoDigests []string `json:"RepoDigests"`
+	// ImageConfig is the OCI image configuration, kept as it is
+	ImageConfig json.RawMessage `json:"ImageConfig"`
+}
+
+// OS is the operating system detected in the artifact
+type OS struct {
+	Family string `json:"Family"`
+	Name   string `json:"Name"`
+	EOSL   bool   `json:"EOSL"`
+}
+
+// Result holds the findings for one target, such as an OS package database
+// or a lock file
+type Result struct {
+	Target            string                     `json:"Target"`
+	Class             string                     `json:"Class"`
+	Type              string                     `json:"Type"`
+	Vulnerabilities   []DetectedVulnerability    `json:"Vulnerabilities"`
+	MisconfSummary    *MisconfSummary            `json:"MisconfSummary"`
+	Misconfigurations []DetectedMisconfiguration `json:"Misconfigurations"`
+	Secrets           []DetectedSecret           `json:"Secrets"`
+	Licenses          []DetectedLicense          `json:"Licenses"`
+}
+
+// Layer identifies the image layer a finding comes from
+type Layer struct {
+	Digest string `json:"Digest"`
+	DiffID string `json:"DiffID"`
+}
+
+// PkgIdentifier identifies a package across ecosystems
+type PkgIdentifier struct {
+	PURL string `json:"PURL"`
+	UID  string `json:"UID"`
+}
+
+// DataSource is the advisory database a vulnerability comes from
+type DataSource struct {
+	ID   string `json:"ID"`
+	Name string `json:"Name"`
+	URL  string `json:"URL"`
+}
+
+// CVSS holds the vectors and scores given by one source
+type CVSS struct {
+	V2Vector  string  `json:"V2Vector"`
+	V3Vector  string  `json:"V3Vector"`
+	V40Vector string  `json:"V40Vector"`
+	V2Score   float64 `json:"V2Score"`
+	V3Score   float64 `json:"V3Score"`
+	V40Score  float64 `json:"V40Score"`
+}
+
+// DetectedVulnerability is a vulnerability found in a package
+type DetectedVulnerability struct {
+	VulnerabilityID  string          `json:"VulnerabilityID"`
+	VendorIDs        []string        `json:"VendorIDs"`
+	PkgID            string          `json:"PkgID"`
+	PkgName          string          `json:"PkgName"`
+	PkgPath          string          `json:"PkgPath"`
+	PkgIdentifier    *PkgIdentifier  `json:"PkgIdentifier"`
+	InstalledVersion string          `json:"InstalledVersion"`
+	FixedVersion     string          `json:"FixedVersion"`
+	Status           string          `json:"Status"`
+	Layer            *Layer          `json:"Layer"`
+	SeveritySource   string          `json:"SeveritySource"`
+	PrimaryURL       string          `json:"PrimaryURL"`
+	DataSource       *DataSource     `json:"DataSource"`
+	Title            string          `json:"Title"`
+	Description      string          `json:"Description"`
+	Severity         string          `json:"Severity"`
+	CweIDs           []string        `json:"CweIDs"`
+	VendorSeverity   map[string]int  `json:"VendorSeverity"`
+	CVSS             map[string]CVSS `json:"CVSS"`
+	References       []string        `json:"References"`
+	PublishedDate    *time.Time      `json:"PublishedDate"`
+	LastModifiedDate *time.Time      `json:"LastModifiedDate"`
+}
+
+// MisconfSummary counts the passed and failed configuration checks
+type MisconfSummary struct {
+	Successes int `json:"Successes"`
+	Failures  int `json:"Failures"`
+}
+
+// DetectedMisconfiguration is a failed (or passed) configuration check
+type DetectedMisconfiguration struct {
+	Type        string   `json:"Type"`
+	ID          string   `json:"ID"`
+	AVDID       string   `json:"AVDID"`
+	Title       string   `json:"Title"`
+	Description string   `json:"Description"`
+	Message     string   `json:"Message"`
+	Namespace   string   `json:"Namespace"`
+	Query       string   `json:"Query"`
+	Resolution  string   `json:"Resolution"`
+	Severity    string   `json:"Severity"`
+	PrimaryURL  string   `json:"PrimaryURL"`
+	References  []string `json:"References"`
+	Status      string   `json:"Status"`
+	Layer       *Layer   `json:"Layer"`
+	// CauseMetadata locates the offending lines, kept as it is
+	CauseMetadata json.RawMessage `json:"CauseMetadata"`
+}
+
+// DetectedSecret is a secret found in a file
+type DetectedSecret struct {
+	RuleID    string `json:"RuleID"`
+	Category  string `json:"Category"`
+	Severity  string `json:"Severity"`
+	Title     string `json:"Title"`
+	StartLine int    `json:"StartLine"`
+	EndLine   int    `json:"EndLine"`
+	Match     string `json:"Match"`
+	Layer     *Layer `json:"Layer"`
+	// Code holds the lines around the secret, kept as it is
+	Code json.RawMessage `json:"Code"`
+}
+
+// DetectedLicense is a license found in a package or file
+type DetectedLicense struct {
+	Severity   string  `json:"Severity"`
+	Category   string  `json:"Category"`
+	PkgName    string  `json:"PkgName"`
+	FilePath   string  `json:"FilePath"`
+	Name       string  `json:"Name"`
+	Confidence float64 `json:"Confidence"`
+	Link       string  `json:"Link"`
+}
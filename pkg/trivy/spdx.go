@@ -0,0 +1,110 @@
+package trivy
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// SPDXDocumentID is the SPDX identifier of the document itself
+const SPDXDocumentID = "SPDXRef-DOCUMENT"
+
+// SPDX primary package purposes used by Trivy
+const (
+	PurposeContainer       = "CONTAINER"
+	PurposeOperatingSystem = "OPERATING-SYSTEM"
+	PurposeApplication     = "APPLICATION"
+	PurposeLibrary         = "LIBRARY"
+)
+
+// SPDXDocument is an SPDX 2.x JSON document, as written by
+// `trivy image --format spdx-json`
+type SPDXDocument struct {
+	SPDXVersion       string `json:"spdxVersion"`
+	SPDXID            string `json:"SPDXID"`
+	Name              string `json:"name"`
+	DocumentNamespace string `json:"documentNamespace"`
+	CreationInfo      struct {
+		Created  *time.Time `json:"created"`
+		Creators []string   `json:"creators"`
+	} `json:"creationInfo"`
+	DocumentDescribes []string           `json:"documentDescribes"`
+	Packages          []SPDXPackage      `json:"packages"`
+	Relationships     []SPDXRelationship `json:"relationships"`
+}
+
+// SPDXPackage is a package of an SPDX document
+type SPDXPackage struct {
+	SPDXID                string `json:"SPDXID"`
+	Name                  string `json:"name"`
+	VersionInfo           string `json:"versionInfo"`
+	LicenseConcluded      string `json:"licenseConcluded"`
+	LicenseDeclared       string `json:"licenseDeclared"`
+	PrimaryPackagePurpose string `json:"primaryPackagePurpose"`
+	ExternalRefs          []struct {
+		ReferenceCategory string `json:"referenceCategory"`
+		ReferenceType     string `json:"referenceType"`
+		ReferenceLocator  string `json:"referenceLocator"`
+	} `json:"externalRefs"`
+	// Annotations hold Trivy's own fields as "<name>: <value>" comments
+	Annotations []struct {
+		Comment string `json:"comment"`
+	} `json:"annotations"`
+}
+
+// SPDXRelationship relates two elements of an SPDX document
+type SPDXRelationship struct {
+	SPDXElementID      string `json:"spdxElementId"`
+	RelationshipType   string `json:"relationshipType"`
+	RelatedSPDXElement string `json:"relatedSpdxElement"`
+}
+
+// IsSPDX reports whether data looks like an SPDX JSON document
+func IsSPDX(data []byte) bool {
+	var probe struct {
+		SPDXVersion string `json:"spdxVersion"`
+	}
+	if err := json.Unmarshal(data, &probe); err != nil {
+		return false
+	}
+	return strings.HasPrefix(probe.SPDXVersion, "SPDX-")
+}
+
+// ParseSPDX decodes an SPDX JSON document and validates it, like Parse
+func ParseSPDX(data []byte) (*SPDXDocument, error) {
+	var doc SPDXDocument
+	if err := decode(data, &doc); err != nil {
+		return nil, err
+	}
+	if err := doc.Validate(); err != nil {
+		return nil, err
+	}
+	return &doc, nil
+}
+
+// Validate checks the fields needed to index the document and returns a
+// *ValidationError listing everything that is missing or invalid
+func (d *SPDXDocument) Validate() error {
+	problems := &ValidationError{}
+	if !strings.HasPrefix(d.SPDXVersion, "SPDX-2.") {
+		problems.add("spdxVersion", "unsupported version %q, expected SPDX-2.x", d.SPDXVersion)
+	}
+	if d.Name == "" {
+		problems.add("name", "is required")
+	}
+	for i, p := range d.Packages {
+		field := fmt.Sprintf("packages[%d]", i)
+		if p.SPDXID == "" {
+			problems.add(field+".SPDXID", "is required")
+		}
+		if p.Name == "" {
+			problems.add(field+".name", "is required")
+		}
+	}
+
+	if len(problems.Problems) == 0 {
+		return nil
+	}
+	return problems
+}
@@ -0,0 +1,145 @@
+package trivy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Problem is a single field of a payload that does not match the report schema
+type Problem struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationError lists every problem found in a payload, so that a
+// misconfigured scanner can be fixed in one go
+type ValidationError struct {
+	Problems []Problem `json:"problems"`
+}
+
+func (e *ValidationError) Error() string {
+	lines := make([]string, 0, len(e.Problems))
+	for _, p := range e.Problems {
+		lines = append(lines, p.Field+": "+p.Message)
+	}
+	return fmt.Sprintf("not a Trivy report (%d problems): %s", len(e.Problems), strings.Join(lines, "; "))
+}
+
+func (e *ValidationError) add(field, format string, args ...interface{}) {
+	e.Problems = append(e.Problems, Problem{
+		Field:   field,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// Parse decodes a Trivy JSON report and validates it. A payload that is valid
+// JSON but does not match the schema returns a *ValidationError.
+func Parse(data []byte) (*Report, error) {
+	var report Report
+	if err := decode(data, &report); err != nil {
+		return nil, err
+	}
+	if err := report.Validate(); err != nil {
+		return nil, err
+	}
+	return &report, nil
+}
+
+// decode unmarshals data into v. Valid JSON with a value of the wrong type,
+// such as a malformed date, returns a *ValidationError.
+func decode(data []byte, v interface{}) error {
+	err := json.Unmarshal(data, v)
+	if err == nil {
+		return nil
+	}
+	var syntaxErr *json.SyntaxError
+	if errors.As(err, &syntaxErr) {
+		return fmt.Errorf("error parsing JSON: %w", err)
+	}
+
+	problems := &ValidationError{}
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		if typeErr.Field == "" {
+			problems.add("(root)", "expected a JSON object, got %s", typeErr.Value)
+		} else {
+			problems.add(typeErr.Field, "expected %s, got %s", typeErr.Type, typeErr.Value)
+		}
+	} else {
+		problems.add("(root)", "%v", err)
+	}
+	return problems
+}
+
+// Validate checks the fields every Trivy report has and returns a
+// *ValidationError listing everything that is missing or invalid
+func (r *Report) Validate() error {
+	problems := &ValidationError{}
+
+	switch r.SchemaVersion {
+	case SchemaVersion:
+	case 0:
+		problems.add("SchemaVersion", "is required")
+	default:
+		problems.add("SchemaVersion", "unsupported version %d, expected %d", r.SchemaVersion, SchemaVersion)
+	}
+	if r.ArtifactName == "" {
+		problems.add("ArtifactName", "is required")
+	}
+
+	validateResults(problems, "", r.Results)
+
+	if len(problems.Problems) == 0 {
+		return nil
+	}
+	return problems
+}
+
+// validateResults checks the findings of every result. prefix is the path of
+// the object holding the results, ending with a dot, or empty for a report.
+func validateResults(problems *ValidationError, prefix string, results []Result) {
+	severity := func(field, value string) {
+		if _, ok := SeverityScore(value); !ok {
+			problems.add(field, "unknown severity %q, expected one of %s", value, strings.Join(Severities, ", "))
+		}
+	}
+	for i, result := range results {
+		path := fmt.Sprintf("%sResults[%d]", prefix, i)
+		if result.Target == "" {
+			problems.add(path+".Target", "is required")
+		}
+		for j, v := range result.Vulnerabilities {
+			field := fmt.Sprintf("%s.Vulnerabilities[%d]", path, j)
+			if v.VulnerabilityID == "" {
+				problems.add(field+".VulnerabilityID", "is required")
+			}
+			if v.PkgName == "" {
+				problems.add(field+".PkgName", "is required")
+			}
+			severity(field+".Severity", v.Severity)
+		}
+		for j, m := range result.Misconfigurations {
+			field := fmt.Sprintf("%s.Misconfigurations[%d]", path, j)
+			if m.ID == "" && m.AVDID == "" {
+				problems.add(field+".ID", "is required")
+			}
+			severity(field+".Severity", m.Severity)
+		}
+		for j, s := range result.Secrets {
+			field := fmt.Sprintf("%s.Secrets[%d]", path, j)
+			if s.RuleID == "" {
+				problems.add(field+".RuleID", "is required")
+			}
+			severity(field+".Severity", s.Severity)
+		}
+		for j, l := range result.Licenses {
+			field := fmt.Sprintf("%s.Licenses[%d]", path, j)
+			if l.Name == "" {
+				problems.add(field+".Name", "is required")
+			}
+			severity(field+".Severity", l.Severity)
+		}
+	}
+}